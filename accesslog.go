@@ -0,0 +1,97 @@
+package gost
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// accessLog is the access log record of a client connection, which is logged when the connection closes.
+type accessLog struct {
+	proto  string
+	start  time.Time
+	client net.Addr
+	target string
+	path   []Node
+	in     int64 // the bytes from the client
+	out    int64 // the bytes to the client
+}
+
+// newAccessLog starts the access log record of the connection from the client, nil if the access log is disabled.
+func (opts *HandlerOptions) newAccessLog(proto string, client net.Addr) *accessLog {
+	if !opts.AccessLog {
+		return nil
+	}
+	return &accessLog{
+		proto:  proto,
+		start:  time.Now(),
+		client: client,
+	}
+}
+
+// setTarget sets the target and the chain nodes the upstream connection cc traversed.
+func (a *accessLog) setTarget(target string, cc net.Conn) {
+	if a == nil {
+		return
+	}
+	a.target = target
+	if c, ok := cc.(*bufferdConn); ok {
+		cc = c.Conn
+	}
+	if c, ok := cc.(*chainConn); ok {
+		a.path = c.Path()
+	}
+}
+
+// countConn counts the bytes transferred over the client connection conn.
+func (a *accessLog) countConn(conn net.Conn) net.Conn {
+	if a == nil {
+		return conn
+	}
+	return &accessLogConn{Conn: conn, log: a}
+}
+
+// Log writes the access log line with the structured fields.
+func (a *accessLog) Log() {
+	if a == nil {
+		return
+	}
+	upstream := "direct"
+	if len(a.path) > 0 {
+		upstream = a.path[0].Addr
+	}
+	in, out := atomic.LoadInt64(&a.in), atomic.LoadInt64(&a.out)
+	duration := time.Since(a.start).Round(time.Millisecond)
+	LogfWith(Fields{
+		"proto":    a.proto,
+		"start":    a.start.Format(time.RFC3339Nano),
+		"client":   a.client.String(),
+		"target":   a.target,
+		"upstream": upstream,
+		"via":      pathString(a.path),
+		"bytesIn":  in,
+		"bytesOut": out,
+		"duration": duration.String(),
+	}, "[access] %s %s -> %s via %s in %d out %d %s", a.proto, a.client, a.target, upstream, in, out, duration)
+}
+
+type accessLogConn struct {
+	net.Conn
+	log *accessLog
+}
+
+func (c *accessLogConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	atomic.AddInt64(&c.log.in, int64(n))
+	return
+}
+
+func (c *accessLogConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	atomic.AddInt64(&c.log.out, int64(n))
+	return
+}
+
+func (c *accessLogConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
@@ -0,0 +1,107 @@
+package gost
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	golog "github.com/go-log/log"
+)
+
+// chanWriter sends each written log line to the channel.
+type chanWriter chan []byte
+
+func (w chanWriter) Write(b []byte) (int, error) {
+	w <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func TestTCPDirectForwardAccessLog(t *testing.T) {
+	lines := make(chanWriter, 64)
+	old := golog.DefaultLogger
+	golog.DefaultLogger = &JSONLogger{Writer: lines}
+	defer func() { golog.DefaultLogger = old }()
+
+	// the echo target.
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	proxyLn, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := &Server{Listener: proxyLn}
+	go proxy.Serve(HTTPHandler())
+	defer proxy.Close()
+
+	chain := NewChain(Node{
+		Addr: proxyLn.Addr().String(),
+		Client: &Client{
+			Connector:   HTTPConnector(nil),
+			Transporter: TCPTransporter(),
+		},
+	})
+
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := TCPDirectForwardHandler(target.Addr().String())
+	h.Init(ChainHandlerOption(chain), AccessLogHandlerOption(true))
+	server := &Server{Listener: ln, Handler: h}
+	go server.Run()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 5)
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case line := <-lines:
+			var entry map[string]interface{}
+			if err := json.Unmarshal(line, &entry); err != nil {
+				t.Fatal(err)
+			}
+			if msg, _ := entry["msg"].(string); !strings.HasPrefix(msg, "[access]") {
+				continue
+			}
+			if entry["proto"] != "tcp" || entry["client"] != conn.LocalAddr().String() ||
+				entry["target"] != target.Addr().String() || entry["upstream"] != proxyLn.Addr().String() ||
+				entry["bytesIn"] != float64(5) || entry["bytesOut"] != float64(5) {
+				t.Errorf("unexpected access log %v", entry)
+			}
+			if _, err := time.ParseDuration(entry["duration"].(string)); err != nil {
+				t.Errorf("invalid duration: %v", err)
+			}
+			return
+		case <-timeout:
+			t.Fatal("no access log")
+		}
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 // Authenticator is an interface for user authentication.
@@ -14,6 +16,7 @@ type Authenticator interface {
 }
 
 // LocalAuthenticator is an Authenticator that authenticates client by local key-value pairs.
+// A password with the prefix "$2" is a bcrypt hash, the others are plaintext.
 type LocalAuthenticator struct {
 	kvs     map[string]string
 	period  time.Duration
@@ -36,14 +39,24 @@ func (au *LocalAuthenticator) Authenticate(user, password string) bool {
 	}
 
 	au.mux.RLock()
-	defer au.mux.RUnlock()
-
 	if len(au.kvs) == 0 {
+		au.mux.RUnlock()
 		return true
 	}
-
 	v, ok := au.kvs[user]
-	return ok && (v == "" || password == v)
+	au.mux.RUnlock()
+
+	if !ok {
+		return false
+	}
+	if v == "" {
+		return true
+	}
+	// EMOD: bcrypt hashed password, it is compared outside the lock for it is slow.
+	if strings.HasPrefix(v, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(v), []byte(password)) == nil
+	}
+	return password == v
 }
 
 // Add adds a key-value pair to the Authenticator.
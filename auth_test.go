@@ -7,6 +7,8 @@ import (
 	"net/url"
 	"testing"
 	"time"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 var localAuthenticatorTests = []struct {
@@ -189,3 +191,29 @@ func TestLocalAuthenticatorReload(t *testing.T) {
 		})
 	}
 }
+
+func TestLocalAuthenticatorBcrypt(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("123456"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	au := NewLocalAuthenticator(nil)
+	au.Reload(bytes.NewBufferString("admin " + string(hash) + "\ntest 123\n"))
+
+	for _, tc := range []struct {
+		user, password string
+		valid          bool
+	}{
+		{"admin", "123456", true},
+		{"admin", "12345", false},
+		{"admin", string(hash), false},
+		{"test", "123", true},
+		{"test", "1234", false},
+		{"guest", "123456", false},
+	} {
+		if au.Authenticate(tc.user, tc.password) != tc.valid {
+			t.Errorf("%s:%s should be %v", tc.user, tc.password, tc.valid)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package gost
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Connection priorities of the shared bandwidth limiter.
+const (
+	PriorityNormal = "normal"
+	PriorityHigh   = "high"
+)
+
+// highPriorityWeight is the number of grants to the high priority connections per grant
+// to the normal ones while both are waiting, so the bulk transfers are not starved.
+var highPriorityWeight = 4
+
+// BandwidthLimiter is a token bucket shared by the connections to cap their total bandwidth.
+// When the cap is reached, the waiting high priority connections are scheduled before the normal ones.
+type BandwidthLimiter struct {
+	rate   float64 // bytes per second
+	burst  int
+	tokens float64
+	last   time.Time
+	// the waiters of the high (0) and normal (1) priority.
+	queues      [2][]*bandwidthWaiter
+	highGrants  int
+	dispatching bool
+	mux         sync.Mutex
+}
+
+type bandwidthWaiter struct {
+	n     int
+	ready chan struct{}
+}
+
+// NewBandwidthLimiter creates a BandwidthLimiter with the rate in bytes per second,
+// it returns nil (no limit) if rate is not positive.
+func NewBandwidthLimiter(rate int) *BandwidthLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	burst := rate / 10
+	if burst < 1 {
+		burst = 1
+	}
+	return &BandwidthLimiter{
+		rate:   float64(rate),
+		burst:  burst,
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Wait blocks until n bytes can be transferred with the priority.
+func (l *BandwidthLimiter) Wait(n int, priority string) {
+	if l == nil {
+		return
+	}
+	for n > 0 {
+		k := n
+		if k > l.burst {
+			k = l.burst
+		}
+		l.wait(k, priority == PriorityHigh)
+		n -= k
+	}
+}
+
+func (l *BandwidthLimiter) wait(n int, high bool) {
+	l.mux.Lock()
+	l.refill()
+	if len(l.queues[0]) == 0 && len(l.queues[1]) == 0 && l.tokens >= float64(n) {
+		l.tokens -= float64(n)
+		l.mux.Unlock()
+		return
+	}
+
+	w := &bandwidthWaiter{n: n, ready: make(chan struct{})}
+	q := 1
+	if high {
+		q = 0
+	}
+	l.queues[q] = append(l.queues[q], w)
+	if !l.dispatching {
+		l.dispatching = true
+		go l.dispatch()
+	}
+	l.mux.Unlock()
+
+	<-w.ready
+}
+
+func (l *BandwidthLimiter) refill() {
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > float64(l.burst) {
+		l.tokens = float64(l.burst)
+	}
+	l.last = now
+}
+
+// dispatch grants the tokens to the waiters until no one is waiting,
+// the next waiter is chosen again after each sleep, so a new high priority waiter preempts the normal ones.
+func (l *BandwidthLimiter) dispatch() {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	for {
+		q := l.nextQueue()
+		if q < 0 {
+			l.dispatching = false
+			return
+		}
+		w := l.queues[q][0]
+
+		l.refill()
+		if need := float64(w.n) - l.tokens; need > 0 {
+			l.mux.Unlock()
+			time.Sleep(time.Duration(need / l.rate * float64(time.Second)))
+			l.mux.Lock()
+			continue
+		}
+
+		l.tokens -= float64(w.n)
+		l.queues[q] = l.queues[q][1:]
+		if q == 0 && len(l.queues[1]) > 0 {
+			l.highGrants++
+		} else {
+			l.highGrants = 0
+		}
+		close(w.ready)
+	}
+}
+
+// nextQueue returns the queue of the next waiter to grant, -1 if no one is waiting.
+func (l *BandwidthLimiter) nextQueue() int {
+	high, normal := len(l.queues[0]) > 0, len(l.queues[1]) > 0
+	switch {
+	case high && (!normal || l.highGrants < highPriorityWeight):
+		return 0
+	case normal:
+		return 1
+	default:
+		return -1
+	}
+}
+
+// bandwidthConn is a connection whose transfer in both directions is limited by the shared limiter.
+type bandwidthConn struct {
+	net.Conn
+	limiter  *BandwidthLimiter
+	priority string
+	packet   bool
+}
+
+func newBandwidthConn(conn net.Conn, limiter *BandwidthLimiter, priority string) net.Conn {
+	if limiter == nil {
+		return conn
+	}
+	return &bandwidthConn{
+		Conn:     conn,
+		limiter:  limiter,
+		priority: priority,
+		packet:   isPacketConn(conn),
+	}
+}
+
+func (c *bandwidthConn) Read(b []byte) (n int, err error) {
+	return limitRead(c.Conn, b, c.limiter, c.priority, c.packet)
+}
+
+func (c *bandwidthConn) Write(b []byte) (n int, err error) {
+	return limitWrite(c.Conn, b, c.limiter, c.priority, c.packet)
+}
+
+// limitRead reads from conn at most a burst of the limiter at a time, a datagram is read as a whole.
+func limitRead(conn net.Conn, b []byte, l *BandwidthLimiter, priority string, packet bool) (n int, err error) {
+	if !packet && len(b) > l.burst {
+		b = b[:l.burst]
+	}
+	n, err = conn.Read(b)
+	l.Wait(n, priority)
+	return
+}
+
+// limitWrite writes b to conn in the bursts of the limiter, a datagram is written as a whole once its tokens are granted.
+func limitWrite(conn net.Conn, b []byte, l *BandwidthLimiter, priority string, packet bool) (n int, err error) {
+	if packet {
+		l.Wait(len(b), priority)
+		return conn.Write(b)
+	}
+	for len(b) > 0 {
+		k := len(b)
+		if k > l.burst {
+			k = l.burst
+		}
+		l.Wait(k, priority)
+
+		var nw int
+		nw, err = conn.Write(b[:k])
+		n += nw
+		if err != nil {
+			return
+		}
+		b = b[k:]
+	}
+	return
+}
+
+func (c *bandwidthConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// ParseBitRate parses the rate with the suffix kbit, mbit or gbit (e.g. 10mbit) in bytes per second,
+// the rate without suffix is in bytes per second.
+func ParseBitRate(rate string) (int, error) {
+	s := strings.ToLower(strings.TrimSpace(rate))
+	unit := 1.0
+	for suffix, bits := range map[string]float64{"kbit": 1e3, "mbit": 1e6, "gbit": 1e9} {
+		if strings.HasSuffix(s, suffix) {
+			s = strings.TrimSuffix(s, suffix)
+			unit = bits / 8
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid rate %q, e.g. 500kbit, 10mbit or 1gbit", rate)
+	}
+	return int(v * unit), nil
+}
+
+// rateLimitConn is a connection whose reads and writes are limited separately.
+type rateLimitConn struct {
+	net.Conn
+	read   *BandwidthLimiter
+	write  *BandwidthLimiter
+	packet bool
+}
+
+func newRateLimitConn(conn net.Conn, read, write *BandwidthLimiter) net.Conn {
+	if read == nil && write == nil {
+		return conn
+	}
+	return &rateLimitConn{Conn: conn, read: read, write: write, packet: isPacketConn(conn)}
+}
+
+func (c *rateLimitConn) Read(b []byte) (n int, err error) {
+	if c.read == nil {
+		return c.Conn.Read(b)
+	}
+	return limitRead(c.Conn, b, c.read, PriorityNormal, c.packet)
+}
+
+func (c *rateLimitConn) Write(b []byte) (n int, err error) {
+	if c.write == nil {
+		return c.Conn.Write(b)
+	}
+	return limitWrite(c.Conn, b, c.write, PriorityNormal, c.packet)
+}
+
+func (c *rateLimitConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
@@ -0,0 +1,139 @@
+package gost
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBandwidthLimiterPriority(t *testing.T) {
+	const rate = 200 * 1024
+	l := NewBandwidthLimiter(rate)
+	// drain the burst, which is not scheduled by priority.
+	l.Wait(l.burst, PriorityNormal)
+
+	var high, normal int64
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	transfer := func(priority string, n *int64) {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			l.Wait(1024, priority)
+			atomic.AddInt64(n, 1024)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		wg.Add(2)
+		go transfer(PriorityHigh, &high)
+		go transfer(PriorityNormal, &normal)
+	}
+
+	d := 500 * time.Millisecond
+	time.Sleep(d)
+	close(done)
+	wg.Wait()
+
+	total := high + normal
+	if max := int64(rate*d.Seconds()) + int64(l.burst) + 4*1024; total > max {
+		t.Errorf("transferred %d bytes, should be capped at %d", total, max)
+	}
+	if high < 2*normal {
+		t.Errorf("high priority should get more of the budget, high %d, normal %d", high, normal)
+	}
+	if normal == 0 {
+		t.Error("normal priority should not be starved")
+	}
+}
+
+func TestBandwidthLimiterNoLimit(t *testing.T) {
+	if l := NewBandwidthLimiter(0); l != nil {
+		t.Fatal("zero rate should mean no limit")
+	}
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	if c := newBandwidthConn(conn, nil, PriorityHigh); c != conn {
+		t.Error("conn should not be wrapped without limiter")
+	}
+}
+
+func TestBandwidthConn(t *testing.T) {
+	const rate = 100 * 1024
+	l := NewBandwidthLimiter(rate)
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	conn := newBandwidthConn(c1, l, PriorityNormal)
+
+	go io.Copy(io.Discard, c2)
+
+	start := time.Now()
+	if _, err := conn.Write(make([]byte, 50*1024)); err != nil {
+		t.Fatal(err)
+	}
+	// the first burst is free.
+	if d := time.Since(start); d < 350*time.Millisecond {
+		t.Errorf("write should be limited, took %v", d)
+	}
+}
+
+func TestParseBitRate(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		rate int
+		ok   bool
+	}{
+		{"1000", 1000, true},
+		{"8kbit", 1000, true},
+		{"10mbit", 1250000, true},
+		{"1.5Gbit", 187500000, true},
+		{"mbit", 0, false},
+		{"-1mbit", 0, false},
+		{"10mb", 0, false},
+	} {
+		rate, err := ParseBitRate(tc.s)
+		if (err == nil) != tc.ok || rate != tc.rate {
+			t.Errorf("%q: got %d, %v", tc.s, rate, err)
+		}
+	}
+}
+
+func TestRateLimitConn(t *testing.T) {
+	const rate = 100 * 1024
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	// only the writes are limited.
+	conn := newRateLimitConn(c1, nil, NewBandwidthLimiter(rate))
+
+	go io.Copy(io.Discard, c2)
+
+	start := time.Now()
+	if _, err := conn.Write(make([]byte, 50*1024)); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 350*time.Millisecond {
+		t.Errorf("write should be limited, took %v", d)
+	}
+
+	go c2.Write(make([]byte, 50*1024))
+	start = time.Now()
+	if _, err := io.ReadFull(conn, make([]byte, 50*1024)); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 200*time.Millisecond {
+		t.Errorf("read should not be limited, took %v", d)
+	}
+
+	if conn := newRateLimitConn(c1, nil, nil); conn != c1 {
+		t.Error("connection without limit should not be wrapped")
+	}
+}
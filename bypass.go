@@ -124,6 +124,7 @@ type Bypass struct {
 	matchers []Matcher
 	period   time.Duration // the period for live reloading
 	reversed bool
+	geoip    *GeoIP // the database of the geoip:CC patterns
 	stopped  chan struct{}
 	mux      sync.RWMutex
 }
@@ -152,6 +153,36 @@ func NewBypassPatterns(reversed bool, patterns ...string) *Bypass {
 	return bp
 }
 
+// SetGeoIP sets the GeoIP database used by the geoip:CC patterns of ParseMatcher and Reload.
+func (bp *Bypass) SetGeoIP(db *GeoIP) {
+	bp.mux.Lock()
+	defer bp.mux.Unlock()
+
+	bp.geoip = db
+}
+
+// ParseMatcher creates a Matcher for the pattern as NewMatcher does,
+// except that the pattern geoip:CC, such as geoip:CN, creates a GeoIP Matcher
+// for the IP addresses of the country using the GeoIP database of the bypass.
+func (bp *Bypass) ParseMatcher(pattern string) (Matcher, error) {
+	country, ok := strings.CutPrefix(pattern, "geoip:")
+	if !ok {
+		return NewMatcher(pattern), nil
+	}
+
+	bp.mux.RLock()
+	db := bp.geoip
+	bp.mux.RUnlock()
+
+	if db == nil {
+		return nil, fmt.Errorf("%s: no geoip database", pattern)
+	}
+	if country == "" {
+		return nil, fmt.Errorf("%s: missing country code", pattern)
+	}
+	return GeoIPMatcher(db, country), nil
+}
+
 // Contains reports whether the bypass includes addr.
 func (bp *Bypass) Contains(addr string) bool {
 	if bp == nil || addr == "" {
@@ -237,7 +268,11 @@ func (bp *Bypass) Reload(r io.Reader) error {
 				reversed, _ = strconv.ParseBool(ss[1])
 			}
 		default:
-			matchers = append(matchers, NewMatcher(ss[0]))
+			m, err := bp.ParseMatcher(ss[0])
+			if err != nil {
+				return err
+			}
+			matchers = append(matchers, m)
 		}
 	}
 
@@ -4,7 +4,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math/rand"
 	"net"
+	"os"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 	// EMOD:
@@ -19,6 +23,8 @@ import (
 var (
 	// ErrEmptyChain is an error that implies the chain is empty.
 	ErrEmptyChain = errors.New("empty chain")
+	// ErrPrivateAddress is an error that implies the destination is a blocked private address.
+	ErrPrivateAddress = errors.New("private address is blocked")
 )
 
 // Chain is a proxy chain that holds a list of proxy node groups.
@@ -29,6 +35,9 @@ type Chain struct {
 	Interface  string
 	nodeGroups []*NodeGroup
 	route      []Node // nodes in the selected route
+	candidates []Node // candidates of the first node raced by the parallel dialing
+	// EMOD: 主链无法建立连接时使用的备用链。
+	Fallback *Chain
 }
 
 // NewChain creates a proxy chain with a list of proxy nodes.
@@ -137,10 +146,18 @@ func (c *Chain) DialContext(ctx context.Context, network, address string, opts .
 
 	for i := 0; i < retries; i++ {
 		conn, err = c.dialWithOptions(ctx, network, address, options)
-		if err == nil {
+		// EMOD: no more retries if all nodes of a group are down, the fallback chain is tried at once.
+		if err == nil || errors.Is(err, ErrNoneAvailable) {
 			break
 		}
 	}
+
+	// EMOD: the fallback chain is used only if the primary chain can not connect at all,
+	// the fallback chains are tried in order, as each one may have its own fallback.
+	if err != nil && c != nil && c.Fallback != nil && ctx.Err() == nil {
+		log.Logf("[chain] dial %s: %s, try the fallback chain", address, err)
+		conn, err = c.Fallback.DialContext(ctx, network, address, opts...)
+	}
 	return
 }
 
@@ -149,6 +166,16 @@ type NsDialer struct {
 	net.Dialer
 	Netns string
 }
+
+// CheckNetns checks that the named network namespace (/var/run/netns/<name>) can be opened.
+func CheckNetns(name string) error {
+	ns, err := netns.GetFromName(name)
+	if err != nil {
+		return fmt.Errorf("netns '%s': %w", name, err)
+	}
+	return ns.Close()
+}
+
 func (nsd *NsDialer) NsDialContext(ctx context.Context, network, address string) (net.Conn, error) {
 	ns, err := netns.GetFromName(nsd.Netns)
 	if err != nil {
@@ -172,17 +199,21 @@ func (c *Chain) dialWithOptions(ctx context.Context, network, address string, op
 	if c == nil {
 		c = &Chain{}
 	}
-	route, err := c.selectRouteFor(address)
+	route, err := c.selectRouteForClient(address, options.ClientAddr)
 	if err != nil {
 		return nil, err
 	}
 
+	span := SpanFromContext(ctx)
+
 	ipAddr := address
 	if address != "" {
-		ipAddr = c.resolve(address, options.Resolver, options.Hosts)
-		if ipAddr == "" {
-			return nil, fmt.Errorf("resolver: domain %s does not exists", address)
+		ipAddr, err = c.resolve(address, options.Resolver, options.Hosts)
+		if err != nil {
+			span.AddEvent("resolve", "address", address, "error", err.Error())
+			return nil, err
 		}
+		span.AddEvent("resolve", "address", address, "ip", ipAddr)
 	}
 
 	timeout := options.Timeout
@@ -216,6 +247,46 @@ func (c *Chain) dialWithOptions(ctx context.Context, network, address string, op
 		}
 	}
 
+	// EMOD: 设置IP_TRANSPARENT，允许绑定非本地的源地址。
+	if options.Transparent {
+		control := controlFunction
+		controlFunction = func(network, address string, cc syscall.RawConn) error {
+			var err error
+			if e := cc.Control(func(fd uintptr) {
+				err = setSocketTransparent(int(fd), strings.HasSuffix(network, "6"))
+			}); e != nil {
+				return e
+			}
+			if err != nil {
+				return fmt.Errorf("set transparent: %w", err)
+			}
+			if control != nil {
+				return control(network, address, cc)
+			}
+			return nil
+		}
+	}
+
+	// EMOD: 检查实际连接的地址，防止DNS rebinding绕过blockPrivate。
+	if options.BlockPrivate {
+		if address != "" {
+			if ipAddr, err = checkPrivateAddr(ctx, ipAddr, !route.IsEmpty()); err != nil {
+				return nil, err
+			}
+		}
+
+		control := controlFunction
+		controlFunction = func(network, address string, cc syscall.RawConn) error {
+			if _, err := checkPrivateAddr(ctx, address, false); err != nil {
+				return err
+			}
+			if control != nil {
+				return control(network, address, cc)
+			}
+			return nil
+		}
+	}
+
 	if route.IsEmpty() {
 		switch network {
 		case "udp", "udp4", "udp6":
@@ -225,50 +296,99 @@ func (c *Chain) dialWithOptions(ctx context.Context, network, address string, op
 		default:
 		}
 
+		var conn net.Conn
 		// EMOD: 我们的场景一定不会配置route，回此这里构建laddr。
-		if options.SrcAddr.String() != "" {
+		if options.SrcAddr != nil && options.Netns != "" {
 			// 基于ns进行proxy连接。
 			nsd := &NsDialer{
 				Dialer: net.Dialer{
-					Timeout: timeout,
-					Control: controlFunction,
+					Timeout:   timeout,
+					Control:   controlFunction,
 					LocalAddr: options.SrcAddr,
 				},
 				Netns: options.Netns,
 			}
-			return nsd.NsDialContext(ctx, network, ipAddr)
+			conn, err = nsd.NsDialContext(ctx, network, ipAddr)
 		} else {
 			d := &net.Dialer{
-				Timeout: timeout,
-				Control: controlFunction,
-				// LocalAddr: laddr, // TODO: optional local address
+				Timeout:   timeout,
+				Control:   controlFunction,
+				LocalAddr: options.SrcAddr,
+			}
+			if options.RandomizeSourcePort && options.SrcAddr == nil {
+				conn, err = dialRandomSourcePort(ctx, d, network, ipAddr)
+			} else {
+				conn, err = d.DialContext(ctx, network, ipAddr)
 			}
-			return d.DialContext(ctx, network, ipAddr)
 		}
+		span.AddEvent("dial", spanErrAttrs(err, "network", network, "address", ipAddr)...)
+		return conn, err
 	}
 
 	conn, err := route.getConn(ctx)
+	span.AddEvent("dial", spanErrAttrs(err, "address", route.LastNode().Addr)...)
 	if err != nil {
 		return nil, err
 	}
 
 	cOpts := append([]ConnectOption{AddrConnectOption(address)}, route.LastNode().ConnectOptions...)
 	cc, err := route.LastNode().Client.ConnectContext(ctx, conn, network, ipAddr, cOpts...)
+	span.AddEvent("handshake", spanErrAttrs(err, "protocol", route.LastNode().Protocol, "address", ipAddr)...)
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
-	return cc, nil
+
+	// EMOD: 记录连接实际经过的节点，用于审计。
+	path := route.route
+	if len(path) == 0 {
+		path = route.Nodes()
+	}
+	if Debug {
+		log.Logf("[route] %s via %s", address, pathString(path))
+	}
+	if _, ok := cc.(net.PacketConn); ok {
+		return cc, nil // keep the packet connection as is
+	}
+	return &chainConn{Conn: cc, path: path}, nil
+}
+
+// chainConn is a connection established through a chain route.
+type chainConn struct {
+	net.Conn
+	path []Node
+}
+
+// Path returns the nodes the connection actually traversed, in order,
+// after the node selection within each group.
+func (c *chainConn) Path() []Node {
+	return c.path
+}
+
+func (c *chainConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func pathString(path []Node) string {
+	var b strings.Builder
+	for i, node := range path {
+		if i > 0 {
+			b.WriteString(" -> ")
+		}
+		b.WriteString(node.Addr)
+	}
+	return b.String()
 }
 
-func (*Chain) resolve(addr string, resolver Resolver, hosts *Hosts) string {
+// resolve resolves the host of addr by the hosts and the resolver.
+func (*Chain) resolve(addr string, resolver Resolver, hosts *Hosts) (string, error) {
 	host, port, err := net.SplitHostPort(addr)
 	if err != nil {
-		return addr
+		return addr, nil
 	}
 
 	if ip := hosts.Lookup(host); ip != nil {
-		return net.JoinHostPort(ip.String(), port)
+		return net.JoinHostPort(ip.String(), port), nil
 	}
 	if resolver != nil {
 		ips, err := resolver.Resolve(host)
@@ -276,12 +396,108 @@ func (*Chain) resolve(addr string, resolver Resolver, hosts *Hosts) string {
 			log.Logf("[resolver] %s: %v", host, err)
 		}
 		if len(ips) == 0 {
+			if err != nil {
+				// EMOD: the name servers failed, the domain may exist.
+				return "", fmt.Errorf("resolver: %s: %w", host, err)
+			}
 			log.Logf("[resolver] %s: domain does not exists", host)
-			return ""
+			return "", fmt.Errorf("resolver: domain %s does not exists", host)
+		}
+		return net.JoinHostPort(ips[0].String(), port), nil
+	}
+	return addr, nil
+}
+
+// checkPrivateAddr returns an error wrapping ErrPrivateAddress if addr is a private address.
+// If resolve is true, a domain name is resolved and replaced by the checked IP,
+// so that the next hop can not dial a different address.
+func checkPrivateAddr(ctx context.Context, addr string, resolve bool) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if isPrivateIP(ip) {
+			return "", fmt.Errorf("%s: %w", addr, ErrPrivateAddress)
 		}
-		return net.JoinHostPort(ips[0].String(), port)
+		return addr, nil
+	}
+	if !resolve {
+		return addr, nil
+	}
+
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	if len(ips) == 0 {
+		return "", fmt.Errorf("resolver: domain %s does not exists", host)
 	}
-	return addr
+	for _, ip := range ips {
+		if isPrivateIP(ip.IP) {
+			return "", fmt.Errorf("%s (%s): %w", addr, ip.IP, ErrPrivateAddress)
+		}
+	}
+	return net.JoinHostPort(ips[0].IP.String(), port), nil
+}
+
+// sourcePortRange returns the ephemeral port range of the system.
+var sourcePortRange = func() (min, max int) {
+	min, max = 32768, 60999
+	b, err := os.ReadFile("/proc/sys/net/ipv4/ip_local_port_range")
+	if err != nil {
+		return
+	}
+	if ss := strings.Fields(string(b)); len(ss) == 2 {
+		lo, err1 := strconv.Atoi(ss[0])
+		hi, err2 := strconv.Atoi(ss[1])
+		if err1 == nil && err2 == nil && lo > 0 && lo <= hi {
+			min, max = lo, hi
+		}
+	}
+	return
+}
+
+// randSourcePort draws a port from [min, max] randomly.
+var randSourcePort = func(min, max int) int {
+	return min + rand.Intn(max-min+1)
+}
+
+// maxSourcePortRetries is the number of attempts to find a free random source port.
+const maxSourcePortRetries = 8
+
+// dialRandomSourcePort dials with a source port drawn randomly from the ephemeral port range,
+// instead of the sequential one allocated by the system. The port is redrawn if it is in use.
+func dialRandomSourcePort(ctx context.Context, d *net.Dialer, network, address string) (conn net.Conn, err error) {
+	min, max := sourcePortRange()
+	for i := 0; i < maxSourcePortRetries; i++ {
+		dd := *d
+		port := randSourcePort(min, max)
+		if strings.HasPrefix(network, "udp") {
+			dd.LocalAddr = &net.UDPAddr{Port: port}
+		} else {
+			dd.LocalAddr = &net.TCPAddr{Port: port}
+		}
+		conn, err = dd.DialContext(ctx, network, address)
+		if !errors.Is(err, syscall.EADDRINUSE) && !errors.Is(err, syscall.EADDRNOTAVAIL) {
+			return
+		}
+		if Debug {
+			log.Logf("[chain] source port %d: %v, retrying", port, err)
+		}
+	}
+	return
+}
+
+// isPrivateIP reports whether ip is an unspecified, loopback, link-local
+// or private (RFC 1918, RFC 4193) address.
+func isPrivateIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return ip.IsUnspecified() || ip.IsLoopback() || ip.IsPrivate() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast()
 }
 
 // Conn obtains a handshaked connection to the last node of the chain.
@@ -324,24 +540,30 @@ func (c *Chain) getConn(ctx context.Context) (conn net.Conn, err error) {
 	nodes := c.Nodes()
 	node := nodes[0]
 
-	cc, err := node.Client.Dial(node.Addr, node.DialOptions...)
-	if err != nil {
-		node.MarkDead()
-		return
-	}
-
-	cn, err := node.Client.Handshake(cc, node.HandshakeOptions...)
-	if err != nil {
-		cc.Close()
-		node.MarkDead()
+	var cn net.Conn
+	if len(c.candidates) > 1 {
+		// EMOD: race the candidates of the first node, e.g. the IPs of the node.
+		if node, cn, err = c.dialParallel(ctx); err != nil {
+			return
+		}
+		for i := range c.route {
+			if c.route[i].ID == c.candidates[0].ID && c.route[i].Addr == c.candidates[0].Addr {
+				c.route[i] = node
+			}
+		}
+	} else if cn, err = c.dialNode(node); err != nil {
 		return
 	}
-	node.ResetDead()
 
 	preNode := node
 	for _, node := range nodes[1:] {
+		var addr string
+		if addr, err = c.nodeAddr(node); err != nil {
+			cn.Close()
+			return
+		}
 		var cc net.Conn
-		cc, err = preNode.Client.ConnectContext(ctx, cn, "tcp", node.Addr, preNode.ConnectOptions...)
+		cc, err = preNode.Client.ConnectContext(ctx, cn, "tcp", addr, preNode.ConnectOptions...)
 		if err != nil {
 			cn.Close()
 			node.MarkDead()
@@ -363,12 +585,156 @@ func (c *Chain) getConn(ctx context.Context) (conn net.Conn, err error) {
 	return
 }
 
+// dialNode dials and handshakes with the node, the node is marked dead on failure.
+func (c *Chain) dialNode(node Node) (net.Conn, error) {
+	addr, err := c.nodeAddr(node)
+	if err != nil {
+		return nil, err
+	}
+	options := node.DialOptions
+	// EMOD: the socket to the first node is marked by the mark of the chain as the direct dials.
+	if c.Mark > 0 {
+		options = append(options[:len(options):len(options)], MarkDialOption(c.Mark))
+	}
+	cc, err := node.Client.Dial(addr, options...)
+	if err != nil {
+		node.MarkDead()
+		return nil, err
+	}
+	if node.KeepAlive != 0 {
+		setConnKeepAlive(cc, node.KeepAlive)
+	}
+
+	cn, err := node.Client.Handshake(cc, node.HandshakeOptions...)
+	if err != nil {
+		cc.Close()
+		node.MarkDead()
+		return nil, err
+	}
+	node.ResetDead()
+	return cn, nil
+}
+
+// dialParallel races the candidates in the happy eyeballs style (RFC 8305): the next candidate is started
+// when the previous one fails or DialParallelDelay passes, the first established connection is used
+// and the later ones are closed.
+func (c *Chain) dialParallel(ctx context.Context) (Node, net.Conn, error) {
+	type result struct {
+		node Node
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(c.candidates))
+	started, pending := 0, 0
+	var next <-chan time.Time
+	start := func() {
+		node := c.candidates[started]
+		started++
+		pending++
+		go func() {
+			conn, err := c.dialNode(node)
+			results <- result{node: node, conn: conn, err: err}
+		}()
+		next = nil
+		if started < len(c.candidates) {
+			next = time.After(DialParallelDelay)
+		}
+	}
+	// closeLater closes the connections of the attempts still in flight.
+	closeLater := func() {
+		go func(n int) {
+			for ; n > 0; n-- {
+				if r := <-results; r.conn != nil {
+					r.conn.Close()
+				}
+			}
+		}(pending)
+	}
+
+	var firstErr error
+	start()
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				closeLater()
+				return r.node, r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if started < len(c.candidates) {
+				start()
+			}
+		case <-next:
+			start()
+		case <-ctx.Done():
+			closeLater()
+			return Node{}, nil, ctx.Err()
+		}
+	}
+	return Node{}, nil, firstErr
+}
+
+// parallelCandidates returns the nodes to race for the selected node, the selected one first,
+// then the others alternating the address families, starting with the other family.
+func parallelCandidates(selected Node, nodes []Node) []Node {
+	isIPv6 := func(node Node) bool {
+		host, _, _ := net.SplitHostPort(node.Addr)
+		ip := net.ParseIP(host)
+		return ip != nil && ip.To4() == nil
+	}
+
+	var same, other []Node
+	for _, node := range nodes {
+		if node.ID == selected.ID && node.Addr == selected.Addr {
+			continue
+		}
+		if isIPv6(node) == isIPv6(selected) {
+			same = append(same, node)
+		} else {
+			other = append(other, node)
+		}
+	}
+
+	candidates := []Node{selected}
+	for len(same) > 0 || len(other) > 0 {
+		if len(other) > 0 {
+			candidates = append(candidates, other[0])
+			other = other[1:]
+		}
+		if len(same) > 0 {
+			candidates = append(candidates, same[0])
+			same = same[1:]
+		}
+	}
+	return candidates
+}
+
+// nodeAddr returns the address of the node, resolved by the resolver of the node if it is set.
+func (c *Chain) nodeAddr(node Node) (string, error) {
+	if node.Resolver == nil {
+		return node.Addr, nil
+	}
+	addr, err := c.resolve(node.Addr, node.Resolver, nil)
+	if err != nil {
+		return "", fmt.Errorf("node %s: %w", node.Addr, err)
+	}
+	return addr, nil
+}
+
 func (c *Chain) selectRoute() (route *Chain, err error) {
 	return c.selectRouteFor("")
 }
 
 // selectRouteFor selects route with bypass testing.
 func (c *Chain) selectRouteFor(addr string) (route *Chain, err error) {
+	return c.selectRouteForClient(addr, nil)
+}
+
+// selectRouteForClient selects route for the client with bypass testing.
+func (c *Chain) selectRouteForClient(addr string, client net.Addr) (route *Chain, err error) {
 	if c.IsEmpty() {
 		return c.newRoute(), nil
 	}
@@ -381,7 +747,7 @@ func (c *Chain) selectRouteFor(addr string) (route *Chain, err error) {
 
 	for _, group := range c.nodeGroups {
 		var node Node
-		node, err = group.Next()
+		node, err = group.NextFor(client)
 		if err != nil {
 			return
 		}
@@ -397,6 +763,9 @@ func (c *Chain) selectRouteFor(addr string) (route *Chain, err error) {
 			route = c.newRoute() // cutoff the chain for multiplex node.
 		}
 
+		if route.IsEmpty() && node.DialParallel {
+			route.candidates = parallelCandidates(node, group.Available())
+		}
 		route.AddNode(node)
 		nl = append(nl, node)
 	}
@@ -414,8 +783,13 @@ type ChainOptions struct {
 	Resolver Resolver
 	Mark     int
 	// EMOD:
-	SrcAddr net.Addr
-	Netns string
+	SrcAddr             net.Addr
+	Netns               string
+	BlockPrivate        bool
+	Transparent         bool
+	RandomizeSourcePort bool
+	// the client address, used by the sourcehash strategy.
+	ClientAddr net.Addr
 }
 
 // ChainOption allows a common way to set chain options.
@@ -460,3 +834,34 @@ func NetnsChainOption(netns string) ChainOption {
 		opts.Netns = netns
 	}
 }
+
+// ClientAddrChainOption sets the address of the client the connection is dialed for,
+// so that the nodes can be selected by the client, e.g. by the sourcehash strategy.
+func ClientAddrChainOption(addr net.Addr) ChainOption {
+	return func(opts *ChainOptions) {
+		opts.ClientAddr = addr
+	}
+}
+
+// TransparentChainOption sets IP_TRANSPARENT on the dial socket,
+// so that it can bind to a non-local source address (Linux only).
+func TransparentChainOption(b bool) ChainOption {
+	return func(opts *ChainOptions) {
+		opts.Transparent = b
+	}
+}
+
+// RandomizeSourcePortChainOption draws the source port of the direct dials randomly
+// from the ephemeral port range.
+func RandomizeSourcePortChainOption(b bool) ChainOption {
+	return func(opts *ChainOptions) {
+		opts.RandomizeSourcePort = b
+	}
+}
+
+// BlockPrivateChainOption rejects the destinations resolved to private addresses.
+func BlockPrivateChainOption(b bool) ChainOption {
+	return func(opts *ChainOptions) {
+		opts.BlockPrivate = b
+	}
+}
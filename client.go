@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"net"
+	"net/http"
 	"net/url"
 	"time"
 
@@ -84,6 +85,12 @@ type DialOptions struct {
 	Timeout time.Duration
 	Chain   *Chain
 	Host    string
+	// EMOD: the source address of the connection to the node, which is dialed directly.
+	LocalAddr net.Addr
+	// EMOD: DSCP of the IP packets sent by the dialed socket, 0 for the system default.
+	DSCP int
+	// EMOD: the mark (SO_MARK) of the dialed socket, 0 for none.
+	Mark int
 }
 
 // DialOption allows a common way to set DialOptions.
@@ -110,18 +117,45 @@ func HostDialOption(host string) DialOption {
 	}
 }
 
+// LocalAddrDialOption specifies the source address used by Transporter.Dial when it dials the node directly.
+func LocalAddrDialOption(addr net.Addr) DialOption {
+	return func(opts *DialOptions) {
+		opts.LocalAddr = addr
+	}
+}
+
+// DSCPDialOption specifies the DSCP set on the socket dialed by Transporter.Dial when it dials the node directly.
+func DSCPDialOption(dscp int) DialOption {
+	return func(opts *DialOptions) {
+		opts.DSCP = dscp
+	}
+}
+
+// MarkDialOption specifies the mark set on the socket dialed by Transporter.Dial when it dials the node directly.
+func MarkDialOption(mark int) DialOption {
+	return func(opts *DialOptions) {
+		opts.Mark = mark
+	}
+}
+
+// dialTCP dials the TCP address addr directly with the timeout and the source address of the options.
+func (opts *DialOptions) dialTCP(addr string, timeout time.Duration) (net.Conn, error) {
+	d := net.Dialer{Timeout: timeout, LocalAddr: opts.LocalAddr, Control: joinControl(markControl(opts.Mark), dscpControl(opts.DSCP))}
+	return d.Dial("tcp", addr)
+}
+
 // HandshakeOptions describes the options for handshake.
 type HandshakeOptions struct {
-	Addr       string
-	Host       string
-	User       *url.Userinfo
-	Timeout    time.Duration
-	Interval   time.Duration
-	Retry      int
-	TLSConfig  *tls.Config
-	WSOptions  *WSOptions
-	KCPConfig  *KCPConfig
-	SSHConfig  *SSHConfig
+	Addr      string
+	Host      string
+	User      *url.Userinfo
+	Timeout   time.Duration
+	Interval  time.Duration
+	Retry     int
+	TLSConfig *tls.Config
+	WSOptions *WSOptions
+	KCPConfig *KCPConfig
+	SSHConfig *SSHConfig
 }
 
 // HandshakeOption allows a common way to set HandshakeOptions.
@@ -206,6 +240,12 @@ type ConnectOptions struct {
 	UserAgent string
 	NoTLS     bool
 	NoDelay   bool
+	// EMOD: the upstream relay understands the extension frame in front of the relay request.
+	RelayExt bool
+	// EMOD: send a nonce and timestamp with the relay request, it requires RelayExt.
+	RelayAntiReplay bool
+	// EMOD: the extra headers of the HTTP CONNECT request, e.g. the token of the proxy gateway.
+	Header http.Header
 }
 
 // ConnectOption allows a common way to set ConnectOptions.
@@ -246,6 +286,31 @@ func UserAgentConnectOption(ua string) ConnectOption {
 	}
 }
 
+// HeaderConnectOption adds the extra headers to the HTTP CONNECT request,
+// they replace the headers of the same names set by the connector, such as Proxy-Authorization.
+func HeaderConnectOption(header http.Header) ConnectOption {
+	return func(opts *ConnectOptions) {
+		if opts.Header == nil {
+			opts.Header = make(http.Header)
+		}
+		for k, vs := range header {
+			for _, v := range vs {
+				opts.Header.Add(k, v)
+			}
+		}
+	}
+}
+
+// setHeader sets the extra headers on the request header h.
+func (opts *ConnectOptions) setHeader(h http.Header) {
+	for k, vs := range opts.Header {
+		h.Del(k)
+		for _, v := range vs {
+			h.Add(k, v)
+		}
+	}
+}
+
 // NoTLSConnectOption specifies the SOCKS5 method without TLS.
 func NoTLSConnectOption(b bool) ConnectOption {
 	return func(opts *ConnectOptions) {
@@ -259,3 +324,19 @@ func NoDelayConnectOption(b bool) ConnectOption {
 		opts.NoDelay = b
 	}
 }
+
+// RelayExtConnectOption declares that the upstream relay understands the extension frame,
+// which carries the anti-replay nonce, the trace context and the tenant ID.
+// A stock relay server takes the frame for a bad version, so nothing is sent without it.
+func RelayExtConnectOption(b bool) ConnectOption {
+	return func(opts *ConnectOptions) {
+		opts.RelayExt = b
+	}
+}
+
+// RelayAntiReplayConnectOption enables the anti-replay nonce for relay.Connect, it requires RelayExtConnectOption.
+func RelayAntiReplayConnectOption(b bool) ConnectOption {
+	return func(opts *ConnectOptions) {
+		opts.RelayAntiReplay = b
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/ginuerzh/gost"
+	"github.com/go-log/log"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	// defaultACMECacheDir is the directory caching the ACME certificates and account key.
+	defaultACMECacheDir = "acme"
+	// defaultACMEHTTPAddr is the address of the HTTP-01 challenge server.
+	defaultACMEHTTPAddr = ":80"
+)
+
+// acmeState is the ACME certificate manager shared by all the nodes,
+// so that one HTTP-01 challenge server answers the challenges of all the hostnames.
+var acmeState struct {
+	manager  *autocert.Manager
+	cacheDir string
+	hosts    map[string]bool
+	// the address of the HTTP-01 challenge server, empty if it is not running.
+	httpAddr string
+	mux      sync.Mutex
+}
+
+// acmeCache returns the cache of the certificates in the directory, it is replaced by the tests.
+var acmeCache = func(dir string) autocert.Cache {
+	return autocert.DirCache(dir)
+}
+
+// acmeTLSConfig returns the TLS config obtaining and renewing the certificates of the hostnames
+// (comma-separated) by ACME (Let's Encrypt), the certificates are cached in the cacheDir.
+// The challenge is HTTP-01 on :80 (or httpAddr) unless challenge is tls-alpn,
+// the challenge server is shared by all the nodes, so their httpAddr must be the same.
+func acmeTLSConfig(hostnames, cacheDir, email, challenge, httpAddr string) (*tls.Config, error) {
+	var hosts []string
+	for _, s := range strings.Split(hostnames, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			hosts = append(hosts, s)
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, errors.New("acme: no hostname")
+	}
+	switch challenge {
+	case "", "http-01", "tls-alpn", "tls-alpn-01":
+	default:
+		return nil, fmt.Errorf("acme: unknown challenge %q, should be http-01 or tls-alpn", challenge)
+	}
+	if cacheDir == "" {
+		cacheDir = defaultACMECacheDir
+	}
+	if httpAddr == "" {
+		httpAddr = defaultACMEHTTPAddr
+	}
+
+	acmeState.mux.Lock()
+	defer acmeState.mux.Unlock()
+
+	m := acmeState.manager
+	if m == nil {
+		acmeState.hosts = make(map[string]bool)
+		acmeState.cacheDir = cacheDir
+		m = &autocert.Manager{
+			Prompt: autocert.AcceptTOS,
+			Cache:  acmeCache(cacheDir),
+			Email:  email,
+			HostPolicy: func(_ context.Context, host string) error {
+				acmeState.mux.Lock()
+				defer acmeState.mux.Unlock()
+				if !acmeState.hosts[host] {
+					return fmt.Errorf("acme: host %q not configured", host)
+				}
+				return nil
+			},
+		}
+		acmeState.manager = m
+	}
+	if cacheDir != acmeState.cacheDir {
+		return nil, fmt.Errorf("acme: conflicting cache directory %s, %s is in use", cacheDir, acmeState.cacheDir)
+	}
+	alpn := strings.HasPrefix(challenge, "tls-alpn")
+	if !alpn && acmeState.httpAddr == "" {
+		// the challenge server is bound here, so the node fails if the address is in use.
+		ln, err := gost.TCPListener(httpAddr)
+		if err != nil {
+			return nil, fmt.Errorf("acme: HTTP-01 challenge server: %w", err)
+		}
+		acmeState.httpAddr = httpAddr
+		auxListeners = append(auxListeners, ln)
+		log.Logf("[acme] HTTP-01 challenge server on %s", ln.Addr())
+		go func() {
+			log.Logf("[acme] %s", http.Serve(ln, m.HTTPHandler(nil)))
+		}()
+	} else if !alpn && httpAddr != acmeState.httpAddr {
+		return nil, fmt.Errorf("acme: conflicting HTTP-01 address %s, %s is in use", httpAddr, acmeState.httpAddr)
+	}
+	for _, host := range hosts {
+		acmeState.hosts[host] = true
+	}
+
+	if alpn {
+		return m.TLSConfig(), nil
+	}
+	return &tls.Config{GetCertificate: m.GetCertificate}, nil
+}
+
+// acmeNodeTLSConfig returns the ACME TLS config of the node with the acme value.
+func acmeNodeTLSConfig(node gost.Node) (*tls.Config, error) {
+	return acmeTLSConfig(node.Get("acme"), node.Get("acmeCache"), node.Get("acmeEmail"),
+		node.Get("acmeChallenge"), node.Get("acmeHTTP"))
+}
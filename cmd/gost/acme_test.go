@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// memACMECache is the in-memory autocert.Cache of the tests.
+type memACMECache struct {
+	data map[string][]byte
+	mux  sync.Mutex
+}
+
+func (c *memACMECache) Get(_ context.Context, key string) ([]byte, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if b, ok := c.data[key]; ok {
+		return b, nil
+	}
+	return nil, autocert.ErrCacheMiss
+}
+
+func (c *memACMECache) Put(_ context.Context, key string, data []byte) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.data[key] = data
+	return nil
+}
+
+func (c *memACMECache) Delete(_ context.Context, key string) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	delete(c.data, key)
+	return nil
+}
+
+// resetACME clears the shared ACME state, and makes the managers use the cache.
+func resetACME(t *testing.T, cache autocert.Cache) {
+	prevCache, nAux := acmeCache, len(auxListeners)
+	acmeCache = func(string) autocert.Cache { return cache }
+	acmeState.manager, acmeState.cacheDir, acmeState.hosts, acmeState.httpAddr = nil, "", nil, ""
+	t.Cleanup(func() {
+		acmeCache = prevCache
+		for _, ln := range auxListeners[nAux:] {
+			ln.Close()
+		}
+		auxListeners = auxListeners[:nAux]
+		acmeState.manager, acmeState.cacheDir, acmeState.hosts, acmeState.httpAddr = nil, "", nil, ""
+	})
+}
+
+// cachedACMECert returns the cache entry of the self-signed ECDSA certificate of the host.
+func cachedACMECert(host string) ([]byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		// not renewed during the test, which is 30 days before the expiry.
+		NotAfter: time.Now().Add(90 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	kb, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	b := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb})
+	return append(b, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...), nil
+}
+
+func TestACMETLSConfig(t *testing.T) {
+	cache := &memACMECache{data: make(map[string][]byte)}
+	resetACME(t, cache)
+
+	data, err := cachedACMECert("a.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Put(context.Background(), "a.example.com", data)
+
+	cfg, err := acmeTLSConfig("a.example.com, b.example.com", "", "", "", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the host policy allows the configured hostnames only.
+	m := acmeState.manager
+	for host, ok := range map[string]bool{"a.example.com": true, "b.example.com": true, "c.example.com": false} {
+		if err := m.HostPolicy(context.Background(), host); (err == nil) != ok {
+			t.Errorf("host policy of %s: ok should be %v, got %v", host, ok, err)
+		}
+	}
+
+	// the certificate is served from the cache, the unconfigured host is refused before ordering.
+	hello := func(name string) *tls.ClientHelloInfo {
+		return &tls.ClientHelloInfo{
+			ServerName:       name,
+			CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			SupportedCurves:  []tls.CurveID{tls.CurveP256},
+			SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		}
+	}
+	cert, err := cfg.GetCertificate(hello("a.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf == nil || cert.Leaf.DNSNames[0] != "a.example.com" {
+		t.Errorf("should serve the cached certificate, got %v", cert.Leaf)
+	}
+	if _, err := cfg.GetCertificate(hello("c.example.com")); err == nil || !strings.Contains(err.Error(), "not configured") {
+		t.Errorf("unconfigured host should be refused, got %v", err)
+	}
+
+	// the HTTP-01 challenge server is listening when the config is returned.
+	ln := auxListeners[len(auxListeners)-1]
+	client := &http.Client{
+		Timeout: 3 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://"+ln.Addr().String()+"/", nil)
+	req.Host = "a.example.com"
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("non-challenge request should be redirected to https, got %s", resp.Status)
+	}
+
+	// the nodes share the challenge server, a different address conflicts.
+	if _, err := acmeTLSConfig("d.example.com", "", "", "http-01", "127.0.0.1:0"); err != nil {
+		t.Errorf("same HTTP-01 address: %v", err)
+	}
+	if _, err := acmeTLSConfig("e.example.com", "", "", "", "127.0.0.1:1"); err == nil {
+		t.Error("conflicting HTTP-01 address should fail")
+	}
+	if _, err := acmeTLSConfig("f.example.com", "", "", "tls-alpn", "127.0.0.1:1"); err != nil {
+		t.Errorf("tls-alpn does not use the HTTP-01 address: %v", err)
+	}
+	if _, err := acmeTLSConfig("g.example.com", "other", "", "", ""); err == nil {
+		t.Error("conflicting cache directory should fail")
+	}
+}
+
+func TestACMETLSConfigBindError(t *testing.T) {
+	resetACME(t, &memACMECache{data: make(map[string][]byte)})
+
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	if _, err := acmeTLSConfig("a.example.com", "", "", "", busy.Addr().String()); err == nil {
+		t.Fatal("HTTP-01 address in use should fail")
+	}
+	if acmeState.hosts["a.example.com"] || acmeState.httpAddr != "" {
+		t.Errorf("the failed node should not be registered, hosts %v, HTTP-01 address %q",
+			acmeState.hosts, acmeState.httpAddr)
+	}
+}
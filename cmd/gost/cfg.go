@@ -6,22 +6,50 @@ import (
 	"crypto/x509"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/ginuerzh/gost"
+	"github.com/go-log/log"
+	"gopkg.in/yaml.v3"
 )
 
 var (
-	routers []router
+	// the running routers.
+	running = &routerSet{}
+	// the bandwidth limiter shared by all the routers, nil if Bandwidth is not set.
+	bandwidthLimiter *gost.BandwidthLimiter
+	// the counters of the routers, nil if the metrics are not enabled.
+	metrics *gost.Metrics
 )
 
 type baseConfig struct {
-	route
-	Routes []route
-	Debug  bool
+	route  `yaml:",inline"`
+	Routes []route    `yaml:"routes"`
+	Debug  bool       `yaml:"debug"`
+	Mgmt   mgmtConfig `yaml:"mgmt"`
+	// the total bandwidth cap of all the routers in bytes per second.
+	Bandwidth int `yaml:"bandwidth"`
+	// log one line per forwarded connection when it closes, as the accessLog node option of all the routers.
+	AccessLog bool `yaml:"accessLog"`
+}
+
+// mgmtConfig is the config of the management (admin/metrics) server.
+type mgmtConfig struct {
+	Addr     string `yaml:"addr"`
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	CAFile   string `yaml:"caFile"`
 }
 
 func parseBaseConfig(s string) (*baseConfig, error) {
@@ -31,38 +59,114 @@ func parseBaseConfig(s string) (*baseConfig, error) {
 	}
 	defer file.Close()
 
-	if err := json.NewDecoder(file).Decode(baseCfg); err != nil {
+	if err := decodeBaseConfig(file, s, baseCfg); err != nil {
 		return nil, err
 	}
-
 	return baseCfg, nil
 }
 
+// decodeBaseConfig decodes the config file name read from r into cfg and validates it.
+func decodeBaseConfig(r io.Reader, name string, cfg *baseConfig) error {
+	// EMOD: the config file is in YAML if the extension is .yaml or .yml, otherwise in JSON.
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		if err := yaml.NewDecoder(r).Decode(cfg); err != nil && err != io.EOF {
+			return err
+		}
+	default:
+		if err := json.NewDecoder(r).Decode(cfg); err != nil {
+			return err
+		}
+	}
+	return cfg.validate()
+}
+
+// validate checks that each route has at least one serve node,
+// the base route may be empty if the routes are in Routes.
+func (cfg *baseConfig) validate() error {
+	r := cfg.route
+	if len(r.ServeNodes) == 0 && (len(r.ChainNodes) > 0 || len(r.FallbackChain) > 0) {
+		return errors.New("route has no serve node")
+	}
+	for i, r := range cfg.Routes {
+		if len(r.ServeNodes) == 0 {
+			return fmt.Errorf("routes[%d] has no serve node", i)
+		}
+	}
+	return nil
+}
+
 var (
 	defaultCertFile = "cert.pem"
 	defaultKeyFile  = "key.pem"
+	// certReloadPeriod is the period to check the changes of the certificate files.
+	certReloadPeriod = 5 * time.Second
+	// listReloadPeriod is the period to check the changes of the @file lists without a reload option.
+	listReloadPeriod = 5 * time.Second
 )
 
 // Load the certificate from cert & key files and optional client CA file,
 // will use the default certificate if the provided info are invalid.
+// The certificate is reloaded when the files change.
 func tlsConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
 	if certFile == "" || keyFile == "" {
 		certFile, keyFile = defaultCertFile, defaultKeyFile
 	}
 
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	certs, err := certReloader(certFile, keyFile)
 	if err != nil {
 		return nil, err
 	}
 
-	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	cfg := &tls.Config{GetCertificate: certs.GetCertificate}
+
+	if err := setClientCA(cfg, caFile); err != nil {
+		return nil, fmt.Errorf("invalid CA file %s: %w", caFile, err)
+	}
+
+	return cfg, nil
+}
 
-	if pool, _ := loadCA(caFile); pool != nil {
+// setClientCA requires the clients to present the certificates signed by the CA in caFile,
+// the config is unchanged if caFile is empty.
+func setClientCA(cfg *tls.Config, caFile string) error {
+	pool, err := loadCA(caFile)
+	if err != nil {
+		return err
+	}
+	if pool != nil {
 		cfg.ClientCAs = pool
 		cfg.ClientAuth = tls.RequireAndVerifyClientCert
 	}
+	return nil
+}
 
-	return cfg, nil
+var (
+	// the certificate reloaders by the cert and key files, shared by all the nodes and reloads.
+	certReloaders   = map[[2]string]*gost.CertReloader{}
+	certReloadersMu sync.Mutex
+)
+
+// certReloader returns the watched reloader of the cert and key files,
+// so the nodes using the same files, and the same nodes across reloads, share one watcher.
+func certReloader(certFile, keyFile string) (*gost.CertReloader, error) {
+	certReloadersMu.Lock()
+	defer certReloadersMu.Unlock()
+
+	key := [2]string{certFile, keyFile}
+	if certs := certReloaders[key]; certs != nil {
+		return certs, nil
+	}
+	certs, err := gost.NewCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	// the config is only parsed by -dump-config.
+	if !dumpConfig {
+		go certs.Watch(certReloadPeriod)
+	}
+	certReloaders[key] = certs
+	return certs, nil
 }
 
 func loadCA(caFile string) (cp *x509.CertPool, err error) {
@@ -90,11 +194,7 @@ func parseKCPConfig(configFile string) (*gost.KCPConfig, error) {
 	}
 	defer file.Close()
 
-	config := &gost.KCPConfig{}
-	if err = json.NewDecoder(file).Decode(config); err != nil {
-		return nil, err
-	}
-	return config, nil
+	return gost.ParseKCPConfig(file)
 }
 
 func parseUsers(authFile string) (users []*url.Userinfo, err error) {
@@ -125,7 +225,7 @@ func parseUsers(authFile string) (users []*url.Userinfo, err error) {
 	return
 }
 
-func parseAuthenticator(s string) (gost.Authenticator, error) {
+func parseAuthenticator(s string, rs *reloaders) (gost.Authenticator, error) {
 	if s == "" {
 		return nil, nil
 	}
@@ -138,11 +238,58 @@ func parseAuthenticator(s string) (gost.Authenticator, error) {
 	au := gost.NewLocalAuthenticator(nil)
 	au.Reload(f)
 
-	go gost.PeriodReload(au, s)
+	rs.start(au, s)
 
 	return au, nil
 }
 
+// parseKeepAlive parses the keepalive period of the node, 0 if it is not set,
+// and negative if it is 0, which disables the keepalive.
+func parseKeepAlive(node gost.Node) time.Duration {
+	if node.Get("keepalive") == "" {
+		return 0
+	}
+	if d := node.GetDuration("keepalive"); d > 0 {
+		return d
+	}
+	return -1
+}
+
+// parsePortRange expands the serve node ns listening on a port range, such as :8000-8010,
+// to one serve node per port. ns is returned as is if it listens on a single port.
+func parsePortRange(ns string) ([]string, error) {
+	scheme, s := "", ns
+	if i := strings.Index(s, "://"); i >= 0 {
+		scheme, s = s[:i+3], s[i+3:]
+	}
+	end := strings.IndexAny(s, "/?")
+	if end < 0 {
+		end = len(s)
+	}
+	host, rest := s[:end], s[end:]
+	user := ""
+	if i := strings.LastIndex(host, "@"); i >= 0 {
+		user, host = host[:i+1], host[i+1:]
+	}
+	i := strings.LastIndex(host, ":")
+	if i < 0 || !strings.Contains(host[i+1:], "-") {
+		return []string{ns}, nil
+	}
+
+	min, max, _ := strings.Cut(host[i+1:], "-")
+	lo, err1 := strconv.Atoi(min)
+	hi, err2 := strconv.Atoi(max)
+	if err1 != nil || err2 != nil || lo <= 0 || hi > 65535 || lo > hi {
+		return nil, fmt.Errorf("%s: invalid port range %s", ns, host[i+1:])
+	}
+
+	var nodes []string
+	for port := lo; port <= hi; port++ {
+		nodes = append(nodes, scheme+user+host[:i+1]+strconv.Itoa(port)+rest)
+	}
+	return nodes, nil
+}
+
 func parseIP(s string, port string) (ips []string) {
 	if s == "" {
 		return
@@ -187,17 +334,263 @@ func parseIP(s string, port string) (ips []string) {
 	return
 }
 
-func parseBypass(s string) *gost.Bypass {
+// interfaceAddrs returns the addresses of the interface (name or %index) in the family: inet (default), inet6 or both,
+// the link-local IPv6 addresses carry the interface name as the zone.
+func interfaceAddrs(ifName, family string) ([]net.IPAddr, error) {
+	switch family {
+	case "", "inet", "inet6", "both":
+	default:
+		return nil, fmt.Errorf("invalid sourceInterfaceFamily %s, should be inet, inet6 or both", family)
+	}
+
+	ief, err := lookupInterface(ifName)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := ief.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("your interface %v is does not have address", ifName)
+	}
+
+	var ips []net.IPAddr
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ip := ipNet.IP.To4(); ip != nil {
+			if family != "inet6" {
+				ips = append(ips, net.IPAddr{IP: ip})
+			}
+			continue
+		}
+		if family == "inet6" || family == "both" {
+			ip := net.IPAddr{IP: ipNet.IP}
+			if ip.IP.IsLinkLocalUnicast() {
+				ip.Zone = ief.Name
+			}
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		if family == "" {
+			family = "inet"
+		}
+		return nil, fmt.Errorf("your interface %s don't have an %s address", ifName, family)
+	}
+	return ips, nil
+}
+
+// lookupInterface finds the interface by the name, or by the index in the form of %index,
+// e.g. %3, which is stable in the containers where the interface names differ from the host.
+func lookupInterface(s string) (*net.Interface, error) {
+	if !strings.HasPrefix(s, "%") {
+		ief, err := net.InterfaceByName(s)
+		if err != nil {
+			return nil, fmt.Errorf("your interface %v is error, lookup by name: %v", s, err)
+		}
+		return ief, nil
+	}
+
+	index, err := strconv.Atoi(s[1:])
+	if err != nil || index <= 0 {
+		return nil, fmt.Errorf("your interface %v is error, invalid index", s)
+	}
+	ief, err := net.InterfaceByIndex(index)
+	if err != nil {
+		return nil, fmt.Errorf("your interface %v is error, lookup by index %d: %v", s, index, err)
+	}
+	return ief, nil
+}
+
+// waitInterfaceAddrs is like interfaceAddrs, but polls the interface every second up to wait
+// for it to come up with an address, the last error is returned if it does not in time.
+func waitInterfaceAddrs(ifName, family string, wait time.Duration) ([]net.IPAddr, error) {
+	deadline := time.Now().Add(wait)
+	for {
+		addrs, err := interfaceAddrs(ifName, family)
+		if err == nil || !time.Now().Before(deadline) {
+			return addrs, err
+		}
+		log.Logf("[route] %v, waiting for the interface", err)
+		time.Sleep(time.Second)
+	}
+}
+
+// parseIPAddr parses the IP address with the optional zone, e.g. fe80::1%wg0.
+func parseIPAddr(s string) net.IPAddr {
+	var addr net.IPAddr
+	if n := strings.IndexByte(s, '%'); n >= 0 {
+		s, addr.Zone = s[:n], s[n+1:]
+	}
+	addr.IP = net.ParseIP(s)
+	return addr
+}
+
+// parseBindIP parses the source IP s, which must be assigned to the host.
+func parseBindIP(s string) (net.IPAddr, error) {
+	ip := parseIPAddr(s)
+	if ip.IP == nil {
+		return ip, fmt.Errorf("invalid IP %s", s)
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ip, err
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip.IP) {
+			return ip, nil
+		}
+	}
+	return ip, fmt.Errorf("%s is not assigned to the host", s)
+}
+
+// parseDSCP parses the dscp option of the node, 0 if it is not set.
+func parseDSCP(node gost.Node) (int, error) {
+	s := node.Get("dscp")
 	if s == "" {
-		return nil
+		return 0, nil
+	}
+	dscp, err := strconv.Atoi(s)
+	if err != nil || dscp < 0 || dscp > 63 {
+		return 0, fmt.Errorf("invalid DSCP %s, should be 0-63", s)
+	}
+	return dscp, nil
+}
+
+// routeTableRe matches the routeTable of the tun/tap nodes, a table number or a name in the rt_tables of iproute2.
+var routeTableRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// parseConnRate parses the connRate node option in the form of rate[,burst],
+// the rate is the new connections per second.
+func parseConnRate(s string) (rate float64, burst int, err error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	rs, bs, ok := strings.Cut(s, ",")
+	if rate, err = strconv.ParseFloat(strings.TrimSpace(rs), 64); err != nil || rate < 0 {
+		return 0, 0, fmt.Errorf("invalid connRate %s, should be rate[,burst]", s)
+	}
+	if ok {
+		if burst, err = strconv.Atoi(strings.TrimSpace(bs)); err != nil || burst < 0 {
+			return 0, 0, fmt.Errorf("invalid connRate %s, should be rate[,burst]", s)
+		}
+	}
+	return rate, burst, nil
+}
+
+// parseShedAtLoad parses the shedAtLoad node option, the load average per CPU.
+func parseShedAtLoad(s string) (float64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	load, err := strconv.ParseFloat(s, 64)
+	if err != nil || load < 0 {
+		return 0, fmt.Errorf("invalid shedAtLoad %s, should be a non-negative number", s)
+	}
+	return load, nil
+}
+
+// parseHeader parses the headers in the form of Name:Value, the values of the same name accumulate.
+func parseHeader(values []string) (http.Header, error) {
+	header := make(http.Header)
+	for _, s := range values {
+		name, value, ok := strings.Cut(s, ":")
+		if name = strings.TrimSpace(name); !ok || name == "" {
+			return nil, fmt.Errorf("invalid header %q, should be Name:Value", s)
+		}
+		header.Add(name, strings.TrimSpace(value))
+	}
+	return header, nil
+}
+
+// watchReloader reloads the @file list when the file changes,
+// the file is checked at listReloadPeriod unless it sets the reload option.
+type watchReloader struct {
+	gost.Reloader
+}
+
+func (r watchReloader) Period() time.Duration {
+	if period := r.Reloader.Period(); period != 0 {
+		return period
+	}
+	return listReloadPeriod
+}
+
+func (r watchReloader) Stop() {
+	if s, ok := r.Reloader.(gost.Stoppable); ok {
+		s.Stop()
+	}
+}
+
+func (r watchReloader) Stopped() bool {
+	s, ok := r.Reloader.(gost.Stoppable)
+	return ok && s.Stopped()
+}
+
+// parsePermissions parses the whitelist or blacklist value s,
+// the Permissions of the @file form is returned by the reloader, which reloads it when the file changes.
+func parsePermissions(s string, rs *reloaders) (*gost.Permissions, *gost.PermissionsReloader, error) {
+	path, ok := strings.CutPrefix(s, "@")
+	if !ok {
+		ps, err := gost.ParsePermissions(s)
+		return ps, nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	pr := gost.NewPermissionsReloader(nil)
+	if err := pr.Reload(f); err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	rs.start(watchReloader{pr}, path)
+
+	return nil, pr, nil
+}
+
+// parseGeoIP loads the GeoIP country database of the path s, nil if s is empty.
+func parseGeoIP(s string) (*gost.GeoIP, error) {
+	if s == "" {
+		return nil, nil
+	}
+	return gost.OpenGeoIP(s)
+}
+
+// parseBypass parses the bypass value s, the geoip:CC patterns use the GeoIP database geoip.
+func parseBypass(s string, geoip *gost.GeoIP, rs *reloaders) (*gost.Bypass, error) {
+	if s == "" {
+		return nil, nil
 	}
-	var matchers []gost.Matcher
 	var reversed bool
 	if strings.HasPrefix(s, "~") {
 		reversed = true
 		s = strings.TrimLeft(s, "~")
 	}
 
+	if path, ok := strings.CutPrefix(s, "@"); ok {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Logf("[bypass] %s", err)
+			return nil, nil
+		}
+		defer f.Close()
+
+		bp := gost.NewBypass(reversed)
+		bp.SetGeoIP(geoip)
+		if err := bp.Reload(f); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		rs.start(watchReloader{bp}, path)
+		return bp, nil
+	}
+
+	bp := gost.NewBypass(reversed)
+	bp.SetGeoIP(geoip)
+
 	f, err := os.Open(s)
 	if err != nil {
 		for _, s := range strings.Split(s, ",") {
@@ -205,20 +598,25 @@ func parseBypass(s string) *gost.Bypass {
 			if s == "" {
 				continue
 			}
-			matchers = append(matchers, gost.NewMatcher(s))
+			m, err := bp.ParseMatcher(s)
+			if err != nil {
+				return nil, err
+			}
+			bp.AddMatchers(m)
 		}
-		return gost.NewBypass(reversed, matchers...)
+		return bp, nil
 	}
 	defer f.Close()
 
-	bp := gost.NewBypass(reversed)
-	bp.Reload(f)
-	go gost.PeriodReload(bp, s)
+	if err := bp.Reload(f); err != nil {
+		return nil, fmt.Errorf("%s: %w", s, err)
+	}
+	rs.start(bp, s)
 
-	return bp
+	return bp, nil
 }
 
-func parseResolver(cfg string) gost.Resolver {
+func parseResolver(cfg string, rs *reloaders) gost.Resolver {
 	if cfg == "" {
 		return nil
 	}
@@ -270,14 +668,18 @@ func parseResolver(cfg string) gost.Resolver {
 	resolver := gost.NewResolver(0)
 	resolver.Reload(f)
 
-	go gost.PeriodReload(resolver, cfg)
+	rs.start(resolver, cfg)
 
 	return resolver
 }
 
-func parseHosts(s string) *gost.Hosts {
-	f, err := os.Open(s)
+func parseHosts(s string, rs *reloaders) *gost.Hosts {
+	path, watch := strings.CutPrefix(s, "@")
+	f, err := os.Open(path)
 	if err != nil {
+		if watch {
+			log.Logf("[hosts] %s", err)
+		}
 		return nil
 	}
 	defer f.Close()
@@ -285,11 +687,71 @@ func parseHosts(s string) *gost.Hosts {
 	hosts := gost.NewHosts()
 	hosts.Reload(f)
 
-	go gost.PeriodReload(hosts, s)
+	if watch {
+		rs.start(watchReloader{hosts}, path)
+	} else {
+		rs.start(hosts, path)
+	}
 
 	return hosts
 }
 
+// relayOptions are the per-connection options applied by the relay loops of the handlers.
+var relayOptions = []string{"maxBytes", "idleTimeout", "rateLimit", "priority", "closeOnEOF"}
+
+// checkRelayOptions rejects the per-connection options on the handlers relaying no connections
+// (the tun/tap devices and the dns server), instead of accepting and ignoring them.
+func checkRelayOptions(node gost.Node) error {
+	switch node.Protocol {
+	case "tun", "tap", "dns":
+	default:
+		return nil
+	}
+	for _, key := range relayOptions {
+		if node.Get(key) != "" {
+			return fmt.Errorf("%s: %s is not supported by the %s handler", node.String(), key, node.Protocol)
+		}
+	}
+	return nil
+}
+
+// parseRateLimit parses the rate limit in the form of rate or up,down, e.g. 10mbit or 5mbit,10mbit,
+// and returns the limiters of the upload and download, nil means no limit.
+func parseRateLimit(s string) (up, down *gost.BandwidthLimiter, err error) {
+	if s == "" {
+		return nil, nil, nil
+	}
+	us, ds, ok := strings.Cut(s, ",")
+	if !ok {
+		ds = us
+	}
+	upRate, err := gost.ParseBitRate(us)
+	if err != nil {
+		return nil, nil, err
+	}
+	downRate, err := gost.ParseBitRate(ds)
+	if err != nil {
+		return nil, nil, err
+	}
+	return gost.NewBandwidthLimiter(upRate), gost.NewBandwidthLimiter(downRate), nil
+}
+
+// parseTicketKeys loads the session ticket keys of the file s into cfg,
+// the returned keys are the reloader of the file, which is left to the caller to start.
+func parseTicketKeys(s string, cfg *tls.Config) (*gost.TLSTicketKeys, error) {
+	f, err := os.Open(s)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := gost.NewTLSTicketKeys(cfg)
+	if err := keys.Reload(f); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
 func parseIPRoutes(s string) (routes []gost.IPRoute) {
 	if s == "" {
 		return
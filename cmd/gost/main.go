@@ -2,12 +2,18 @@ package main
 
 import (
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
+	"sync"
+	"syscall"
+	"time"
 
 	_ "net/http/pprof"
 
@@ -20,33 +26,73 @@ var (
 	baseCfg       = &baseConfig{}
 	pprofAddr     string
 	pprofEnabled  = os.Getenv("PROFILING") != ""
+	mgmtServer    *gost.MgmtServer
+	otlpEndpoint  string
+	dumpConfig    bool
+	upgradeDrain  time.Duration
+	shutdownGrace time.Duration
+	metricsAddr   string
+	healthAddr    string
+	pidFile       string
+
+	printVersion   bool
+	tproxySelfTest bool
+	logFormat      string
 )
 
 func init() {
 	gost.SetLogger(&gost.LogLogger{})
 
-	var (
-		printVersion bool
-	)
-
 	flag.Var(&baseCfg.route.ChainNodes, "F", "forward address, can make a forward chain")
+	flag.Var(&baseCfg.route.FallbackChain, "FB", "fallback forward address, the fallback chain is used only when the forward chain fails, the same as -F with fallback=1")
 	flag.Var(&baseCfg.route.ServeNodes, "L", "listen address, can listen on multiple ports (required)")
 	flag.IntVar(&baseCfg.route.Mark, "M", 0, "Specify out connection mark")
 	flag.StringVar(&configureFile, "C", "", "configure file")
 	flag.StringVar(&baseCfg.route.Interface, "I", "", "Interface to bind")
 	flag.BoolVar(&baseCfg.Debug, "D", false, "enable debug log")
 	flag.BoolVar(&printVersion, "V", false, "print version")
+	flag.StringVar(&logFormat, "log-format", "text", "log format, text or json")
+	flag.BoolVar(&tproxySelfTest, "tproxy-selftest", false, "check the kernel prerequisites of tproxy (red/redu) and exit")
+	flag.IntVar(&baseCfg.Bandwidth, "bandwidth", 0, "total bandwidth cap of all the connections in bytes per second, the connections with priority=high are scheduled first")
+	flag.BoolVar(&baseCfg.AccessLog, "access-log", false, "log one line per forwarded connection when it closes, with the client, target, upstream node, bytes and duration")
+	flag.StringVar(&baseCfg.Mgmt.Addr, "mgmt", "", "management (admin/metrics) HTTP server address")
+	flag.StringVar(&baseCfg.Mgmt.CertFile, "mgmt-cert", "", "TLS certificate file of the management server")
+	flag.StringVar(&baseCfg.Mgmt.KeyFile, "mgmt-key", "", "TLS key file of the management server")
+	flag.StringVar(&baseCfg.Mgmt.CAFile, "mgmt-ca", "", "CA file to verify the client certificates of the management server")
+	flag.StringVar(&metricsAddr, "metrics", "", "Prometheus metrics HTTP server address, e.g. :9200, the metrics are also served on /metrics of the management server")
+	flag.StringVar(&healthAddr, "health", "", "health check HTTP server address, e.g. :8080, it serves the status of the chain nodes in JSON, and 503 if any hop has no available node")
+	flag.BoolVar(&dumpConfig, "dump-config", false, "print the effective config in JSON (secrets redacted) and exit")
+	flag.DurationVar(&upgradeDrain, "upgrade", 0, "on SIGUSR2, hand the listeners over to a new process and drain the connections for at most the duration")
+	flag.DurationVar(&shutdownGrace, "grace", 0, "on SIGTERM, stop accepting and wait at most the duration for the active connections before exit")
+	flag.StringVar(&pidFile, "pid", "", "write the process ID to the file, e.g. /run/echo-tproxy.pid, it is removed on SIGTERM or SIGINT")
+	flag.StringVar(&otlpEndpoint, "otlp", "", "OTLP/HTTP endpoint to export the connection traces, e.g. http://127.0.0.1:4318")
 	if pprofEnabled {
 		flag.StringVar(&pprofAddr, "P", ":6060", "profiling HTTP server address")
 	}
+}
+
+func main() {
 	flag.Parse()
 
+	switch logFormat {
+	case "json":
+		gost.SetLogger(&gost.JSONLogger{})
+	case "text", "":
+	default:
+		fmt.Fprintf(os.Stderr, "invalid log format %s, should be text or json\n", logFormat)
+		os.Exit(1)
+	}
+
 	if printVersion {
 		fmt.Fprintf(os.Stdout, "gost %s (%s %s/%s)\n",
 			gost.Version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
 		os.Exit(0)
 	}
 
+	if tproxySelfTest {
+		os.Exit(runTProxySelfTest())
+	}
+
 	if configureFile != "" {
 		_, err := parseBaseConfig(configureFile)
 		if err != nil {
@@ -58,9 +104,7 @@ func init() {
 		flag.PrintDefaults()
 		os.Exit(0)
 	}
-}
 
-func main() {
 	if pprofEnabled {
 		go func() {
 			log.Log("profiling server on", pprofAddr)
@@ -86,8 +130,21 @@ func main() {
 
 	gost.DefaultTLSConfig = tlsConfig
 
+	if otlpEndpoint != "" {
+		exporter := gost.NewOTLPExporter(otlpEndpoint)
+		gost.DefaultTracer = gost.NewTracer(exporter)
+		log.Log("export traces to", exporter.URL)
+	}
+
+	if dumpConfig {
+		os.Exit(runDumpConfig())
+	}
+
 	if err := start(); err != nil {
 		log.Log(err)
+		if pidFile != "" {
+			removePIDFile(pidFile)
+		}
 		os.Exit(1)
 	}
 
@@ -97,27 +154,258 @@ func main() {
 func start() error {
 	gost.Debug = baseCfg.Debug
 
-	var routers []router
-	rts, err := baseCfg.route.GenRouters()
+	n, err := gost.InheritFromParent()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Logf("inherited %d listeners from the old process", n)
+	}
+	// the new process of the upgrade takes the pid file over from the old one.
+	if pidFile != "" {
+		if err := writePIDFile(pidFile, n > 0); err != nil {
+			return err
+		}
+	}
+
+	routers, err := genRouters()
 	if err != nil {
 		return err
 	}
+	running.set(routers)
+	for i := range routers {
+		go routers[i].Serve()
+	}
+	if shutdownGrace > 0 || pidFile != "" {
+		go handleShutdown(shutdownGrace)
+	}
+	if configureFile != "" {
+		go running.handleReload(configureFile)
+	}
+	if metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+		serveAux("metrics", metricsAddr, mux)
+	}
+	if healthAddr != "" {
+		serveAux("health", healthAddr, gost.HealthHandler(running.nodeGroups))
+	}
+	if err := startMgmt(routers); err != nil {
+		return err
+	}
+
+	if upgradeDrain > 0 {
+		go gost.HandleUpgrade(upgradeDrain, running.servers, auxListeners...)
+	}
+	// the old process of the upgrade stops serving after the servers of this process are running.
+	if err := gost.UpgradeReady(); err != nil {
+		log.Logf("[upgrade] %s", err)
+	}
+	return nil
+}
+
+// auxListeners are the listeners of the metrics, health and management servers,
+// which are handed over with the ones of the routers on upgrade.
+var auxListeners []gost.Listener
+
+// serveAux serves h on addr in the background, the listen error is only logged.
+func serveAux(name, addr string, h http.Handler) {
+	ln, err := gost.TCPListener(addr)
+	if err != nil {
+		log.Logf("%s server: %s", name, err)
+		return
+	}
+	auxListeners = append(auxListeners, ln)
+	log.Log(name+" server on", addr)
+	go func() {
+		log.Log(http.Serve(ln, h))
+	}()
+}
+
+// handleShutdown closes the routers gracefully on SIGTERM, and exits after all of them are closed.
+// The pid file is removed before exit, SIGINT also exits if the pid file is written.
+func handleShutdown(grace time.Duration) {
+	sigs := []os.Signal{syscall.SIGTERM}
+	if pidFile != "" {
+		sigs = append(sigs, os.Interrupt)
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+	sig := <-ch
+
+	if grace > 0 {
+		log.Logf("signal %s received, closing the routers in %s", sig, grace)
+
+		routers := running.list()
+		var wg sync.WaitGroup
+		for i := range routers {
+			wg.Add(1)
+			go func(r *router) {
+				defer wg.Done()
+				if err := r.CloseGraceful(grace); err != nil {
+					log.Logf("%s : %s", r.node.String(), err)
+				}
+			}(&routers[i])
+		}
+		wg.Wait()
+	}
+	if pidFile != "" {
+		removePIDFile(pidFile)
+	}
+	os.Exit(0)
+}
+
+// genRouters generates the routers of all the routes in the base config.
+func genRouters() ([]router, error) {
+	bandwidthLimiter = gost.NewBandwidthLimiter(baseCfg.Bandwidth)
+	if metricsAddr != "" || baseCfg.Mgmt.Addr != "" {
+		metrics = gost.NewMetrics()
+	}
+
+	var routers []router
+	rts, err := baseCfg.route.GenRouters(baseCfg)
+	if err != nil {
+		return nil, err
+	}
 	routers = append(routers, rts...)
 
 	for _, route := range baseCfg.Routes {
-		rts, err := route.GenRouters()
+		rts, err := route.GenRouters(baseCfg)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		routers = append(routers, rts...)
 	}
 
 	if len(routers) == 0 {
-		return errors.New("invalid config")
+		return nil, errors.New("invalid config")
+	}
+	return routers, nil
+}
+
+// runDumpConfig prints the effective config of the routers parsed from the base config,
+// and returns the exit code, which is non-zero if the config is invalid.
+// No listener is created, so it does not conflict with the running process.
+func runDumpConfig() int {
+	var cfgs []routerConfig
+	for _, r := range append([]route{baseCfg.route}, baseCfg.Routes...) {
+		rcfgs, err := r.configs()
+		if err != nil {
+			log.Log(err)
+			return 1
+		}
+		cfgs = append(cfgs, rcfgs...)
+	}
+	if len(cfgs) == 0 {
+		log.Log("invalid config")
+		return 1
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(cfgs); err != nil {
+		log.Log(err)
+		return 1
+	}
+	return 0
+}
+
+func startMgmt(routers []router) error {
+	cfg := baseCfg.Mgmt
+	if cfg.Addr == "" {
+		return nil
+	}
+
+	var tlsCfg *tls.Config
+	if cfg.CertFile != "" || cfg.KeyFile != "" || cfg.CAFile != "" {
+		var err error
+		// client certificates are required if the CA file is specified.
+		if tlsCfg, err = tlsConfig(cfg.CertFile, cfg.KeyFile, cfg.CAFile); err != nil {
+			return err
+		}
+		if cfg.CAFile != "" && tlsCfg.ClientCAs == nil {
+			return errors.New("mgmt: invalid CA file " + cfg.CAFile)
+		}
+	}
+
+	mgmtServer = gost.NewMgmtServer(cfg.Addr, tlsCfg)
+	if metrics != nil {
+		mgmtServer.Handle("/metrics", metrics)
 	}
 	for i := range routers {
-		go routers[i].Serve()
+		registerMgmt(mgmtServer, &routers[i])
+	}
+	// the listener is handed over on upgrade, it is adopted from the old process by TCPListener.
+	tln, err := gost.TCPListener(cfg.Addr)
+	if err != nil {
+		return err
 	}
+	auxListeners = append(auxListeners, tln)
+	var ln net.Listener = tln
+	if tlsCfg != nil {
+		ln = tls.NewListener(ln, tlsCfg)
+	}
+	log.Logf("management server on %s (tls: %v)", ln.Addr(), tlsCfg != nil)
+	go func() {
+		log.Log(mgmtServer.Serve(ln))
+	}()
 
 	return nil
 }
+
+// registerMgmt adds the listener, the resolver and the node groups of the router to the management server.
+func registerMgmt(s *gost.MgmtServer, r *router) {
+	s.AddListener(r.node, r.server)
+	if r.resolver != nil {
+		s.AddResolver(r.resolver)
+	}
+	for chain := r.chain; chain != nil; chain = chain.Fallback {
+		s.AddNodeGroup(chain.NodeGroups()...)
+	}
+}
+
+// unregisterMgmt removes the listeners, the resolvers and the node groups of the removed routers
+// from the management server, the ones shared with the running routers are kept.
+func unregisterMgmt(s *gost.MgmtServer, removed, running []router) {
+	resolvers := make(map[gost.Resolver]bool)
+	groups := make(map[*gost.NodeGroup]bool)
+	for i := range running {
+		if running[i].resolver != nil {
+			resolvers[running[i].resolver] = true
+		}
+		for chain := running[i].chain; chain != nil; chain = chain.Fallback {
+			for _, group := range chain.NodeGroups() {
+				groups[group] = true
+			}
+		}
+	}
+
+	for i := range removed {
+		s.RemoveListener(removed[i].server)
+		if r := removed[i].resolver; r != nil && !resolvers[r] {
+			s.RemoveResolver(r)
+		}
+		for chain := removed[i].chain; chain != nil; chain = chain.Fallback {
+			for _, group := range chain.NodeGroups() {
+				if !groups[group] {
+					s.RemoveNodeGroup(group)
+				}
+			}
+		}
+	}
+}
+
+// runTProxySelfTest prints the results of the tproxy self-test,
+// and returns the exit code, which is non-zero if any check fails.
+func runTProxySelfTest() int {
+	code := 0
+	for _, check := range gost.TProxySelfTest() {
+		status := "OK"
+		if !check.OK {
+			status = "FAIL"
+			code = 1
+		}
+		fmt.Fprintf(os.Stdout, "[%s] %s: %s\n", status, check.Name, check.Detail)
+	}
+	return code
+}
@@ -4,23 +4,29 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"io"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ginuerzh/gost"
 )
 
 type peerConfig struct {
-	Strategy    string `json:"strategy"`
-	MaxFails    int    `json:"max_fails"`
-	FailTimeout time.Duration
-	period      time.Duration // the period for live reloading
-	Nodes       []string      `json:"nodes"`
-	group       *gost.NodeGroup
-	baseNodes   []gost.Node
-	stopped     chan struct{}
+	Strategy     string `json:"strategy"`
+	MaxFails     int    `json:"max_fails"`
+	FailTimeout  time.Duration
+	RecoverProbe string        `json:"recover_probe"`
+	period       time.Duration // the period for live reloading
+	Nodes        []string      `json:"nodes"`
+	group        *gost.NodeGroup
+	baseNodes    []gost.Node
+	// reloaders are those of the peer nodes, replaced on each reload.
+	reloaders *reloaders
+	mux       sync.Mutex
+	stopped   chan struct{}
 }
 
 func newPeerConfig() *peerConfig {
@@ -41,25 +47,19 @@ func (cfg *peerConfig) Reload(r io.Reader) error {
 		return err
 	}
 	cfg.Validate()
+	// the recovery probe dials the nodes directly, so only the first hop of the chain can be probed.
+	if cfg.RecoverProbe != "" && cfg.group.ID > 1 {
+		return errors.New("recover_probe is only supported on the first node of the chain")
+	}
 
-	group := cfg.group
-	group.SetSelector(
-		nil,
-		gost.WithFilter(
-			&gost.FailFilter{
-				MaxFails:    cfg.MaxFails,
-				FailTimeout: cfg.FailTimeout,
-			},
-			&gost.InvalidFilter{},
-		),
-		gost.WithStrategy(gost.NewStrategy(cfg.Strategy)),
-	)
-
+	// parse all the nodes first, the group is not changed if any of them is invalid.
+	rs := newReloaders()
 	gNodes := cfg.baseNodes
 	nid := len(gNodes) + 1
 	for _, s := range cfg.Nodes {
-		nodes, err := parseChainNode(s)
+		nodes, err := parseChainNode(s, rs)
 		if err != nil {
+			rs.release()
 			return err
 		}
 
@@ -71,6 +71,20 @@ func (cfg *peerConfig) Reload(r io.Reader) error {
 		gNodes = append(gNodes, nodes...)
 	}
 
+	group := cfg.group
+	group.SetSelector(
+		nil,
+		gost.WithFilter(
+			&gost.FailFilter{
+				MaxFails:     cfg.MaxFails,
+				FailTimeout:  cfg.FailTimeout,
+				RecoverProbe: cfg.RecoverProbe,
+			},
+			&gost.InvalidFilter{},
+		),
+		gost.WithStrategy(gost.NewStrategy(cfg.Strategy)),
+	)
+
 	nodes := group.SetNodes(gNodes...)
 	for _, node := range nodes[len(cfg.baseNodes):] {
 		if node.Bypass != nil {
@@ -78,6 +92,16 @@ func (cfg *peerConfig) Reload(r io.Reader) error {
 		}
 	}
 
+	cfg.mux.Lock()
+	old := cfg.reloaders
+	if cfg.Stopped() {
+		old = rs
+	} else {
+		cfg.reloaders = rs
+	}
+	cfg.mux.Unlock()
+	old.release()
+
 	return nil
 }
 
@@ -127,6 +151,8 @@ func (cfg *peerConfig) parse(r io.Reader) error {
 			cfg.MaxFails, _ = strconv.Atoi(ss[1])
 		case "fail_timeout":
 			cfg.FailTimeout, _ = time.ParseDuration(ss[1])
+		case "recover_probe":
+			cfg.RecoverProbe = ss[1]
 		case "reload":
 			cfg.period, _ = time.ParseDuration(ss[1])
 		case "peer":
@@ -151,6 +177,12 @@ func (cfg *peerConfig) Stop() {
 	default:
 		close(cfg.stopped)
 	}
+
+	cfg.mux.Lock()
+	rs := cfg.reloaders
+	cfg.reloaders = nil
+	cfg.mux.Unlock()
+	rs.release()
 }
 
 // Stopped checks whether the reloader is stopped.
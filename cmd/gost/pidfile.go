@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"syscall"
+)
+
+// writePIDFile writes the PID of the current process to the file of the path.
+// It fails if the file names another live process, unless takeover is true and
+// the process is the parent, which hands the listeners over by the upgrade.
+func writePIDFile(path string, takeover bool) error {
+	if b, err := os.ReadFile(path); err == nil {
+		pid, _ := strconv.Atoi(string(bytes.TrimSpace(b)))
+		if pid > 0 && pid != os.Getpid() && !(takeover && pid == os.Getppid()) && processAlive(pid) {
+			return fmt.Errorf("pid file %s: process %d is running", path, pid)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("pid file %s: %w", path, err)
+	}
+
+	if err := os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		return fmt.Errorf("pid file %s: %w", path, err)
+	}
+	return nil
+}
+
+// removePIDFile removes the file of the path if it still names the current process,
+// so that the file written by the new process of the upgrade is kept.
+func removePIDFile(path string) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	if pid, _ := strconv.Atoi(string(bytes.TrimSpace(b))); pid == os.Getpid() {
+		os.Remove(path)
+	}
+}
+
+// processAlive reports whether the process of the pid exists.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	// FindProcess opens the process on windows, and always succeeds on unix.
+	if runtime.GOOS == "windows" {
+		p.Release()
+		return true
+	}
+	// the signal 0 checks the existence, EPERM means the process is owned by another user.
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
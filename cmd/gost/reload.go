@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/ginuerzh/gost"
+	"github.com/go-log/log"
+)
+
+// routerSet is the running routers. It reloads the routes from the config file on SIGHUP,
+// only the routers whose definition changed are re-opened, the unaffected ones keep serving.
+type routerSet struct {
+	configFile string
+	routers    []router
+	mux        sync.Mutex
+}
+
+func (s *routerSet) set(routers []router) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.routers = routers
+}
+
+// nodeGroups returns the node groups of the chains of the running routers, with their fallback chains.
+func (s *routerSet) nodeGroups() []*gost.NodeGroup {
+	var groups []*gost.NodeGroup
+	seen := make(map[*gost.NodeGroup]bool)
+	for _, r := range s.list() {
+		for chain := r.chain; chain != nil; chain = chain.Fallback {
+			for _, group := range chain.NodeGroups() {
+				if !seen[group] {
+					seen[group] = true
+					groups = append(groups, group)
+				}
+			}
+		}
+	}
+	return groups
+}
+
+func (s *routerSet) list() []router {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return append([]router(nil), s.routers...)
+}
+
+func (s *routerSet) servers() []*gost.Server {
+	routers := s.list()
+	servers := make([]*gost.Server, 0, len(routers))
+	for i := range routers {
+		servers = append(servers, routers[i].server)
+	}
+	return servers
+}
+
+// handleReload reloads the config file on SIGHUP.
+func (s *routerSet) handleReload(configFile string) {
+	s.configFile = configFile
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		f, err := gost.OpenConfig(configFile)
+		if err != nil {
+			log.Logf("[reload] %s: %s", configFile, err)
+			continue
+		}
+		log.Log("[reload]", configFile)
+		if err := s.Reload(f); err != nil {
+			log.Logf("[reload] %s: %s", configFile, err)
+		}
+		f.Close()
+	}
+}
+
+// Reload implements gost.Reloader, it diffs the routes in the config against the running routers
+// by the route definition and the serve node: the removed routers are closed gracefully,
+// and the added ones start serving. If any added route is invalid, the running routers are kept as they are. The routes given by the flags are kept unless the config overrides them.
+func (s *routerSet) Reload(r io.Reader) error {
+	cfg := *baseCfg
+	cfg.Routes = nil
+	if err := decodeBaseConfig(r, s.configFile, &cfg); err != nil {
+		return err
+	}
+
+	type serveNode struct {
+		route route
+		ns    string
+	}
+	wanted := make(map[string]serveNode)
+	for _, rt := range append([]route{cfg.route}, cfg.Routes...) {
+		for _, ns := range rt.ServeNodes {
+			wanted[rt.key(ns)] = serveNode{route: rt, ns: ns}
+		}
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	// a serve node may have several routers with the same key, such as the ports of a port range.
+	var kept, removed []router
+	keptKeys := make(map[string]bool)
+	for _, rt := range s.routers {
+		if _, ok := wanted[rt.key]; ok {
+			kept = append(kept, rt)
+			keptKeys[rt.key] = true
+		} else {
+			removed = append(removed, rt)
+		}
+	}
+	for key := range keptKeys {
+		delete(wanted, key)
+	}
+
+	// the added routers are generated while the removed ones are still serving,
+	// they adopt the duplicates of the sockets of the removed ones bound to the same addresses.
+	lns := make([]gost.Listener, 0, len(removed))
+	for i := range removed {
+		lns = append(lns, removed[i].server.Listener)
+	}
+	release := gost.ShareListeners(lns...)
+	defer release()
+
+	var added []router
+	for _, sn := range wanted {
+		rt := sn.route
+		rt.ServeNodes = stringList{sn.ns}
+		rts, err := rt.GenRouters(&cfg)
+		if err != nil {
+			// nothing is changed if any route is invalid.
+			for i := range added {
+				added[i].Close()
+			}
+			return fmt.Errorf("%s: %w", sn.ns, err)
+		}
+		added = append(added, rts...)
+	}
+
+	for i := range removed {
+		rt := removed[i]
+		rt.Close()
+		go func() {
+			if err := rt.CloseGraceful(shutdownGrace); err != nil {
+				log.Logf("[reload] %s : %s", rt.node.String(), err)
+			}
+		}()
+		log.Logf("[reload] %s removed", rt.node.String())
+	}
+	for i := range added {
+		go added[i].Serve()
+	}
+
+	s.routers = append(kept, added...)
+	if mgmtServer != nil {
+		unregisterMgmt(mgmtServer, removed, s.routers)
+		for i := range added {
+			registerMgmt(mgmtServer, &added[i])
+		}
+	}
+	log.Logf("[reload] %d routers kept, %d removed, %d added", len(kept), len(removed), len(added))
+	return nil
+}
+
+// Period implements gost.Reloader, the routes are reloaded on SIGHUP only.
+func (s *routerSet) Period() time.Duration {
+	return 0
+}
+
+// reloaders are the period reloaders started for the routers, they are stopped along with
+// the last router using them, so that the routers removed on reload do not leave them running.
+type reloaders struct {
+	stoppables []gost.Stoppable
+	refs       int32
+}
+
+// newReloaders returns the reloaders holding the reference of the caller.
+func newReloaders() *reloaders {
+	return &reloaders{refs: 1}
+}
+
+// start reloads r from the config file periodically. Nothing is started by the nil reloaders,
+// e.g. when the config is parsed to be dumped only, nor in the dump mode.
+func (rs *reloaders) start(r gost.Reloader, file string) {
+	if rs == nil || dumpConfig {
+		return
+	}
+	if s, ok := r.(gost.Stoppable); ok {
+		rs.stoppables = append(rs.stoppables, s)
+	}
+	go gost.PeriodReload(r, file)
+}
+
+// acquire adds a reference of a router sharing the reloaders.
+func (rs *reloaders) acquire() *reloaders {
+	if rs != nil {
+		atomic.AddInt32(&rs.refs, 1)
+	}
+	return rs
+}
+
+// release drops a reference, the reloaders are stopped with the last one.
+func (rs *reloaders) release() {
+	if rs == nil || atomic.AddInt32(&rs.refs, -1) > 0 {
+		return
+	}
+	for _, s := range rs.stoppables {
+		s.Stop()
+	}
+}
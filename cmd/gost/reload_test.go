@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ginuerzh/gost"
+)
+
+func TestRouterSetNodeGroups(t *testing.T) {
+	primary := gost.NewNodeGroup(gost.Node{Addr: "1.1.1.1:8080"})
+	fallback := gost.NewNodeGroup(gost.Node{Addr: "2.2.2.2:8080"})
+	chain := gost.NewChain()
+	chain.AddNodeGroup(primary)
+	chain.Fallback = gost.NewChain()
+	chain.Fallback.AddNodeGroup(fallback)
+
+	s := &routerSet{}
+	s.set([]router{{chain: chain}, {chain: chain}, {}})
+	groups := s.nodeGroups()
+	if len(groups) != 2 || groups[0] != primary || groups[1] != fallback {
+		t.Errorf("expected the primary and fallback groups once each, got %v", groups)
+	}
+}
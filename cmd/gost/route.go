@@ -2,16 +2,16 @@ package main
 
 import (
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/base64"
 	"fmt"
 	"net"
 	"net/url"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
-	// EMOD:
-	"errors"
 
 	"github.com/ginuerzh/gost"
 	"github.com/go-log/log"
@@ -28,27 +28,74 @@ func (l *stringList) Set(value string) error {
 }
 
 type route struct {
-	ServeNodes stringList
-	ChainNodes stringList
-	Retries    int
-	Mark       int
-	Interface  string
+	// the name to refer the chain of the route, e.g. by the SNI routes.
+	Name          string     `yaml:"name"`
+	ServeNodes    stringList `yaml:"serveNodes"`
+	ChainNodes    stringList `yaml:"chainNodes"`
+	FallbackChain stringList `yaml:"fallbackChain"`
+	Retries       int        `yaml:"retries"`
+	Mark          int        `yaml:"mark"`
+	Interface     string     `yaml:"interface"`
 }
 
-func (r *route) parseChain() (*gost.Chain, error) {
+// parseChain parses the chain of the route with its fallback chains.
+// The chain nodes with fallback=N belong to the Nth fallback chain, the fallbackChain nodes to the first one,
+// the chains are tried in order of N when the previous one can not connect.
+// The reloaders of the chain, e.g. of the peer configs, are started in rs.
+func (r *route) parseChain(rs *reloaders) (*gost.Chain, error) {
+	levels := map[int][]string{}
+	for _, ns := range r.ChainNodes {
+		node, err := gost.ParseNode(ns)
+		if err != nil {
+			return nil, err
+		}
+		level := node.GetInt("fallback")
+		if level < 0 {
+			return nil, fmt.Errorf("%s: invalid fallback %s", node.String(), node.Get("fallback"))
+		}
+		levels[level] = append(levels[level], ns)
+	}
+	levels[1] = append(levels[1], r.FallbackChain...)
+
+	var orders []int
+	for level := range levels {
+		if level > 0 && len(levels[level]) > 0 {
+			orders = append(orders, level)
+		}
+	}
+	sort.Ints(orders)
+
+	chain, err := r.newChain(levels[0], rs)
+	if err != nil {
+		return nil, err
+	}
+	last := chain
+	for _, level := range orders {
+		fallback, err := r.newChain(levels[level], rs)
+		if err != nil {
+			return nil, fmt.Errorf("fallback chain %d: %w", level, err)
+		}
+		last.Fallback = fallback
+		last = fallback
+	}
+	return chain, nil
+}
+
+// newChain creates the chain of the nodes, one node group per node.
+func (r *route) newChain(chainNodes []string, rs *reloaders) (*gost.Chain, error) {
 	chain := gost.NewChain()
 	chain.Retries = r.Retries
 	chain.Mark = r.Mark
 	chain.Interface = r.Interface
 	gid := 1 // group ID
 
-	for _, ns := range r.ChainNodes {
+	for _, ns := range chainNodes {
 		ngroup := gost.NewNodeGroup()
 		ngroup.ID = gid
 		gid++
 
 		// parse the base nodes
-		nodes, err := parseChainNode(ns)
+		nodes, err := parseChainNode(ns, rs)
 		if err != nil {
 			return nil, err
 		}
@@ -60,19 +107,37 @@ func (r *route) parseChain() (*gost.Chain, error) {
 		}
 		ngroup.AddNode(nodes...)
 
-		ngroup.SetSelector(nil,
+		// the recovery probe dials the node directly, so only the first hop of the chain can be probed.
+		if nodes[0].Get("recoverProbe") != "" && ngroup.ID > 1 {
+			return nil, fmt.Errorf("%s: recoverProbe is only supported on the first node of the chain", nodes[0].String())
+		}
+		selectOpts := []gost.SelectOption{
 			gost.WithFilter(
 				&gost.FailFilter{
-					MaxFails:    nodes[0].GetInt("max_fails"),
-					FailTimeout: nodes[0].GetDuration("fail_timeout"),
+					MaxFails:      nodes[0].GetInt("max_fails"),
+					FailTimeout:   nodes[0].GetDuration("fail_timeout"),
+					RecoverProbe:  nodes[0].Get("recoverProbe"),
+					ProbeInterval: nodes[0].GetDuration("recoverProbeInterval"),
 				},
 				&gost.InvalidFilter{},
 			),
 			gost.WithStrategy(gost.NewStrategy(nodes[0].Get("strategy"))),
-		)
+		}
+		// EMOD: verify the node reachability on its first selection instead of in advance.
+		// The probe dials the node directly, so only the first hop of the chain can be probed.
+		if nodes[0].GetBool("lazyProbe") {
+			if ngroup.ID > 1 {
+				return nil, fmt.Errorf("%s: lazyProbe is only supported on the first node of the chain", nodes[0].String())
+			}
+			selectOpts = append(selectOpts, gost.WithLazyProbe(&gost.LazyProbe{
+				TTL: nodes[0].GetDuration("probeCacheTTL"),
+			}))
+		}
+		ngroup.SetSelector(nil, selectOpts...)
+		ngroup.SetHistory(nodes[0].GetInt("selectorHistory"))
 
 		if cfg := nodes[0].Get("peer"); cfg != "" {
-			f, err := os.Open(cfg)
+			f, err := gost.OpenConfig(cfg)
 			if err != nil {
 				return nil, err
 			}
@@ -80,10 +145,13 @@ func (r *route) parseChain() (*gost.Chain, error) {
 			peerCfg := newPeerConfig()
 			peerCfg.group = ngroup
 			peerCfg.baseNodes = nodes
-			peerCfg.Reload(f)
+			err = peerCfg.Reload(f)
 			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("%s: peer %s: %w", nodes[0].String(), cfg, err)
+			}
 
-			go gost.PeriodReload(peerCfg, cfg)
+			rs.start(peerCfg, cfg)
 		}
 
 		chain.AddNodeGroup(ngroup)
@@ -92,11 +160,14 @@ func (r *route) parseChain() (*gost.Chain, error) {
 	return chain, nil
 }
 
-func parseChainNode(ns string) (nodes []gost.Node, err error) {
+func parseChainNode(ns string, rs *reloaders) (nodes []gost.Node, err error) {
 	node, err := gost.ParseNode(ns)
 	if err != nil {
 		return
 	}
+	node.Weight = node.GetInt("weight")
+	node.DialParallel = node.GetBool("dialParallel")
+	node.KeepAlive = parseKeepAlive(node)
 
 	if auth := node.Get("auth"); auth != "" && node.User == nil {
 		c, err := base64.StdEncoding.DecodeString(auth)
@@ -125,43 +196,75 @@ func parseChainNode(ns string) (nodes []gost.Node, err error) {
 	if serverName == "" {
 		serverName = "localhost" // default server name
 	}
+	// EMOD: serverName sets the SNI and the name verifying the certificate, e.g. when the node is dialed by IP.
+	// It is only for TLS and takes precedence over the node address, while host is the HTTP Host of the transports.
+	if s := node.Get("serverName"); s != "" {
+		serverName = s
+	}
 
 	rootCAs, err := loadCA(node.Get("ca"))
 	if err != nil {
 		return
 	}
 	tlsCfg := &tls.Config{
-		ServerName:         serverName,
-		InsecureSkipVerify: !node.GetBool("secure"),
-		RootCAs:            rootCAs,
-	}
-
-	// If the argument `ca` is given, but not open `secure`, we verify the
-	// certificate manually.
-	if rootCAs != nil && !node.GetBool("secure") {
-		tlsCfg.VerifyConnection = func(state tls.ConnectionState) error {
-			opts := x509.VerifyOptions{
-				Roots:         rootCAs,
-				CurrentTime:   time.Now(),
-				DNSName:       "",
-				Intermediates: x509.NewCertPool(),
-			}
-
-			certs := state.PeerCertificates
-			for i, cert := range certs {
-				if i == 0 {
-					continue
-				}
-				opts.Intermediates.AddCert(cert)
-			}
+		ServerName: serverName,
+		RootCAs:    rootCAs,
+	}
+
+	// EMOD: the verification mode can be chosen explicitly by `verifyMode`.
+	// By default, if `secure` is open, we use the standard verification;
+	// if the argument `ca` is given, but not open `secure`, we verify the
+	// certificate manually; otherwise the verification is skipped.
+	verifyMode := node.Get("verifyMode")
+	if verifyMode == "" {
+		switch {
+		case node.GetBool("secure"):
+			verifyMode = gost.TLSVerifyStandard
+		case rootCAs != nil:
+			verifyMode = gost.TLSVerifyManual
+		default:
+			verifyMode = gost.TLSVerifySkip
+		}
+	}
+	if err = gost.SetTLSVerifyMode(tlsCfg, verifyMode); err != nil {
+		return
+	}
+
+	// EMOD: reject the node whose certificate expires within certMinValidity.
+	if d := node.GetDuration("certMinValidity"); d > 0 {
+		tlsCfg.VerifyConnection = gost.CertMinValidityVerifier(d, tlsCfg.VerifyConnection)
+	}
 
-			_, err = certs[0].Verify(opts)
-			return err
+	// EMOD: pin=sha256/<base64>,... accepts only the peer whose public key or certificate matches a pin,
+	// in addition to the verification of the verify mode, which is skipped by default, e.g. for a self-signed node.
+	if s := node.Get("pin"); s != "" {
+		pins, err := gost.ParseCertPins(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: pin: %w", node.String(), err)
+		}
+		tlsCfg.VerifyConnection = gost.CertPinVerifier(pins, tlsCfg.VerifyConnection)
+	}
+
+	// EMOD: the client certificate is reloaded when the files change.
+	if certFile, keyFile := node.Get("cert"), node.Get("key"); certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("%s: cert and key should be set together", node.String())
+		}
+		certs, err := certReloader(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: cert: %w", node.String(), err)
 		}
+		tlsCfg.GetClientCertificate = certs.GetClientCertificate
 	}
 
-	if cert, err := tls.LoadX509KeyPair(node.Get("cert"), node.Get("key")); err == nil {
-		tlsCfg.Certificates = []tls.Certificate{cert}
+	// EMOD: the minimum TLS version, set before the renegotiation which checks it.
+	if err = gost.SetTLSMinVersion(tlsCfg, node.Get("tlsMinVersion")); err != nil {
+		return
+	}
+
+	// EMOD: renegotiation and post-handshake auth for the upstreams requesting the client certificate after the handshake.
+	if err = gost.SetTLSRenegotiation(tlsCfg, node.Get("tlsRenegotiation"), node.GetBool("tlsPostHandshakeAuth")); err != nil {
+		return
 	}
 
 	wsOpts := &gost.WSOptions{}
@@ -172,6 +275,15 @@ func parseChainNode(ns string) (nodes []gost.Node, err error) {
 	wsOpts.Path = node.Get("path")
 
 	timeout := node.GetDuration("timeout")
+	// EMOD: dialTimeout is the timeout of the TCP connect to the node, handshakeTimeout is the timeout of
+	// the transport handshake (TLS, SSH, ...), each of them takes precedence over timeout, which is used if unset.
+	dialTimeout, handshakeTimeout := timeout, timeout
+	if d := node.GetDuration("dialTimeout"); d > 0 {
+		dialTimeout = d
+	}
+	if d := node.GetDuration("handshakeTimeout"); d > 0 {
+		handshakeTimeout = d
+	}
 
 	var tr gost.Transporter
 	switch node.Transport {
@@ -199,6 +311,12 @@ func parseChainNode(ns string) (nodes []gost.Node, err error) {
 			}
 			config = &conf
 		}
+		// EMOD: establishment timeouts for lossy links, independent of the data timeout.
+		config.DialTimeout = node.GetDuration("kcpDialTimeout")
+		config.DialTimeoutMax = node.GetDuration("kcpDialTimeoutMax")
+		if err := config.Validate(); err != nil {
+			return nil, err
+		}
 		tr = gost.KCPTransporter(config)
 	case "ssh":
 		if node.Protocol == "direct" || node.Protocol == "remote" {
@@ -207,11 +325,11 @@ func parseChainNode(ns string) (nodes []gost.Node, err error) {
 			tr = gost.SSHTunnelTransporter()
 		}
 	case "http2":
-		tr = gost.HTTP2Transporter(tlsCfg)
+		tr = gost.HTTP2Transporter(tlsCfg, gost.MaxStreamsHTTP2Option(node.GetInt("h2MaxStreams")))
 	case "h2":
-		tr = gost.H2Transporter(tlsCfg, node.Get("path"))
+		tr = gost.H2Transporter(tlsCfg, node.Get("path"), gost.MaxStreamsHTTP2Option(node.GetInt("h2MaxStreams")))
 	case "h2c":
-		tr = gost.H2CTransporter(node.Get("path"))
+		tr = gost.H2CTransporter(node.Get("path"), gost.MaxStreamsHTTP2Option(node.GetInt("h2MaxStreams")))
 	case "obfs4":
 		tr = gost.Obfs4Transporter()
 	case "ohttp":
@@ -220,10 +338,22 @@ func parseChainNode(ns string) (nodes []gost.Node, err error) {
 		tr = gost.ObfsTLSTransporter()
 	case "ftcp":
 		tr = gost.FakeTCPTransporter()
+	case "quic":
+		// EMOD: the QUIC session is dialed over UDP, the handshake is bounded by the handshakeTimeout (or timeout)
+		// and verified by the TLS config of the node (ca, secure, cert and key).
+		tr = gost.QUICTransporter(&gost.QUICConfig{
+			TLSConfig:       tlsCfg,
+			Timeout:         handshakeTimeout,
+			KeepAlivePeriod: node.KeepAlive,
+		})
 	case "udp":
 		tr = gost.UDPTransporter()
 	case "vsock":
-		tr = gost.VSOCKTransporter()
+		tr = gost.VSOCKTransporter(&gost.VSOCKConfig{
+			BufferSize: node.GetInt("vsockBuf"),
+		})
+	case "unix":
+		tr = gost.UnixTransporter()
 	default:
 		tr = gost.TCPTransporter()
 	}
@@ -233,7 +363,13 @@ func parseChainNode(ns string) (nodes []gost.Node, err error) {
 	case "http2":
 		connector = gost.HTTP2Connector(node.User)
 	case "socks", "socks5":
-		connector = gost.SOCKS5Connector(node.User)
+		// EMOD: udpAssociate relays the UDP by the standard UDP associate, for the third-party SOCKS5 servers.
+		// The relay socket of the proxy is reached directly, not through the preceding nodes of the chain.
+		if node.GetBool("udpAssociate") {
+			connector = gost.SOCKS5AssociateConnector(node.User)
+		} else {
+			connector = gost.SOCKS5Connector(node.User)
+		}
 	case "socks4":
 		connector = gost.SOCKS4Connector()
 	case "socks4a":
@@ -264,14 +400,43 @@ func parseChainNode(ns string) (nodes []gost.Node, err error) {
 	}
 
 	node.DialOptions = append(node.DialOptions,
-		gost.TimeoutDialOption(timeout),
+		gost.TimeoutDialOption(dialTimeout),
 		gost.HostDialOption(host),
 	)
+	// EMOD: bindIP dials the node from the source IP, e.g. a secondary address the upstream ACL keys on.
+	if s := node.Get("bindIP"); s != "" {
+		ip, err := parseBindIP(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: bindIP: %w", node.String(), err)
+		}
+		node.DialOptions = append(node.DialOptions, gost.LocalAddrDialOption(&net.TCPAddr{IP: ip.IP, Zone: ip.Zone}))
+	}
+	// EMOD: dscp marks the packets to the node (IP_TOS/IPV6_TCLASS), e.g. dscp=46 for EF.
+	if dscp, err := parseDSCP(node); err != nil {
+		return nil, fmt.Errorf("%s: dscp: %w", node.String(), err)
+	} else if dscp > 0 {
+		node.DialOptions = append(node.DialOptions, gost.DSCPDialOption(dscp))
+	}
 
+	// EMOD: relayExt=true declares the upstream relay understands the extension frame (this fork),
+	// which carries the anti-replay nonce, the trace context and the tenant ID.
+	if node.GetBool("relayAntiReplay") && !node.GetBool("relayExt") {
+		return nil, fmt.Errorf("%s: relayAntiReplay requires relayExt=true", node.String())
+	}
 	node.ConnectOptions = []gost.ConnectOption{
 		gost.UserAgentConnectOption(node.Get("agent")),
 		gost.NoTLSConnectOption(node.GetBool("notls")),
 		gost.NoDelayConnectOption(node.GetBool("nodelay")),
+		gost.RelayExtConnectOption(node.GetBool("relayExt")),
+		gost.RelayAntiReplayConnectOption(node.GetBool("relayAntiReplay")),
+	}
+	// EMOD: header=Name:Value, repeatable, adds the headers to the CONNECT request of the http and http2 nodes.
+	if values := node.Values["header"]; len(values) > 0 {
+		header, err := parseHeader(values)
+		if err != nil {
+			return nil, fmt.Errorf("%s: header: %w", node.String(), err)
+		}
+		node.ConnectOptions = append(node.ConnectOptions, gost.HeaderConnectOption(header))
 	}
 
 	sshConfig := &gost.SSHConfig{}
@@ -288,7 +453,7 @@ func parseChainNode(ns string) (nodes []gost.Node, err error) {
 		gost.UserHandshakeOption(node.User),
 		gost.TLSConfigHandshakeOption(tlsCfg),
 		gost.IntervalHandshakeOption(node.GetDuration("ping")),
-		gost.TimeoutHandshakeOption(timeout),
+		gost.TimeoutHandshakeOption(handshakeTimeout),
 		gost.RetryHandshakeOption(node.GetInt("retry")),
 		gost.SSHConfigHandshakeOption(sshConfig),
 	}
@@ -298,7 +463,23 @@ func parseChainNode(ns string) (nodes []gost.Node, err error) {
 		Transporter: tr,
 	}
 
-	node.Bypass = parseBypass(node.Get("bypass"))
+	// EMOD: the geoip:CC bypass patterns select the direct dialing by the country of the destination IP.
+	geoip, err := parseGeoIP(node.Get("geoip"))
+	if err != nil {
+		return nil, err
+	}
+	if node.Bypass, err = parseBypass(node.Get("bypass"), geoip, rs); err != nil {
+		return nil, fmt.Errorf("%s: bypass: %w", node.String(), err)
+	}
+
+	// EMOD: resolve the node address with its own DNS servers, independent of the serve node resolver.
+	if resolver := parseResolver(node.Get("nodeDns"), rs); resolver != nil {
+		resolver.Init(
+			gost.TimeoutResolverOption(timeout),
+			gost.ParallelResolverOption(node.GetBool("dnsParallel")),
+		)
+		node.Resolver = resolver
+	}
 
 	ips := parseIP(node.Get("ip"), sport)
 	for _, ip := range ips {
@@ -325,19 +506,167 @@ func parseChainNode(ns string) (nodes []gost.Node, err error) {
 	return
 }
 
-func (r *route) GenRouters() ([]router, error) {
-	chain, err := r.parseChain()
+// sourceInterface returns the sourceInterface of the node, the sourceInterfaceIndex
+// is returned in the form of %index, as a literal % needs escaping in the node URL.
+func sourceInterface(node gost.Node) string {
+	if index := node.Get("sourceInterfaceIndex"); index != "" {
+		return "%" + index
+	}
+	return node.Get("sourceInterface")
+}
+
+// serveNodes returns the serve nodes of the route with the configured serve node each one comes from,
+// a node listening on a port range (:8000-8010) is expanded to one node per port,
+// and a tcp node listening on both the IPv4 and IPv6 addresses of the sourceInterface
+// (sourceInterfaceFamily=both) is expanded to one node per address.
+func (r *route) serveNodes() (nodes, origins []string, err error) {
+	for _, origin := range r.ServeNodes {
+		portNodes, err := parsePortRange(origin)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, ns := range portNodes {
+			ifNodes, err := interfaceNodes(ns)
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, ns := range ifNodes {
+				nodes = append(nodes, ns)
+				origins = append(origins, origin)
+			}
+		}
+	}
+	return
+}
+
+// interfaceNodes expands the serve node ns listening on both the IPv4 and IPv6 addresses
+// of the sourceInterface to one node per address.
+func interfaceNodes(ns string) (nodes []string, err error) {
+	node, err := gost.ParseNode(ns)
+	if err != nil {
+		return nil, err
+	}
+	ifName := sourceInterface(node)
+	if ifName == "" || node.Get("sourceInterfaceFamily") != "both" || node.Transport != "tcp" {
+		return []string{ns}, nil
+	}
+
+	addrs, err := waitInterfaceAddrs(ifName, "both", node.GetDuration("sourceInterfaceWait"))
+	if err != nil {
+		return nil, err
+	}
+	s := ns
+	if !strings.Contains(s, "://") {
+		s = "auto://" + s
+	}
+	u, err := url.Parse(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	// the configured address is kept, the chosen address is substituted by the listener.
+	query := u.Query()
+	query.Del("sourceInterfaceFamily")
+	for _, addr := range addrs {
+		query.Set("sourceInterfaceIP", addr.String())
+		u.RawQuery = query.Encode()
+		nodes = append(nodes, u.String())
+	}
+	return
+}
+
+// key identifies the router of the serve node ns in the route, the routers
+// with the same key have the same definition, which are kept on reload.
+func (r *route) key(ns string) string {
+	return fmt.Sprintf("%q %q %d %d %q %s",
+		r.ChainNodes, r.FallbackChain, r.Retries, r.Mark, r.Interface, ns)
+}
+
+// namedRoute returns the route with the name in the config.
+func (cfg *baseConfig) namedRoute(name string) *route {
+	if cfg.route.Name == name {
+		return &cfg.route
+	}
+	for i := range cfg.Routes {
+		if cfg.Routes[i].Name == name {
+			return &cfg.Routes[i]
+		}
+	}
+	return nil
+}
+
+// parseSNIRoutes parses the SNI routes in the form of host=chainName, the host can be a wildcard
+// such as *.example.com, or * to match all. The chainName is the name of a route in the config cfg.
+// It also returns the key of the referred routes, so the router is re-opened if they change.
+func parseSNIRoutes(cfg *baseConfig, specs []string, rs *reloaders) ([]gost.SNIRoute, string, error) {
+	var routes []gost.SNIRoute
+	var keys []string
+	chains := make(map[string]*gost.Chain)
+	for _, spec := range specs {
+		host, name, ok := strings.Cut(spec, "=")
+		host, name = strings.TrimSpace(host), strings.TrimSpace(name)
+		if !ok || host == "" || name == "" {
+			return nil, "", fmt.Errorf("invalid sni route %q, should be host=chainName", spec)
+		}
+		chain, ok := chains[name]
+		if !ok {
+			rt := cfg.namedRoute(name)
+			if rt == nil {
+				return nil, "", fmt.Errorf("sni route %q: unknown chain %s", spec, name)
+			}
+			var err error
+			if chain, err = rt.parseChain(rs); err != nil {
+				return nil, "", err
+			}
+			chains[name] = chain
+			keys = append(keys, rt.key(""))
+		}
+		routes = append(routes, gost.SNIRoute{Matcher: gost.DomainMatcher(host), Chain: chain})
+	}
+	return routes, strings.Join(keys, " "), nil
+}
+
+// GenRouters creates the routers of the serve nodes of the route in the config cfg,
+// which is the config being loaded on reload.
+func (r *route) GenRouters(cfg *baseConfig) (_ []router, err error) {
+	// the reloaders of the chain are shared by the routers, they are stopped with the last one,
+	// or at return if there is no router.
+	chainReloaders := newReloaders()
+	defer chainReloaders.release()
+
+	chain, err := r.parseChain(chainReloaders)
 	if err != nil {
 		return nil, err
 	}
 
 	var rts []router
+	// pending is the listener of the router being generated, it is closed if the node turns out invalid,
+	// and so are the reloaders started for the node.
+	var pending gost.Listener
+	var pendingReloaders *reloaders
+	// the routers of the route fail as a whole, e.g. when any port of a port range fails to bind.
+	defer func() {
+		if err != nil {
+			if pending != nil {
+				pending.Close()
+			}
+			pendingReloaders.release()
+			for i := range rts {
+				rts[i].Close()
+			}
+		}
+	}()
 
-	for _, ns := range r.ServeNodes {
+	serveNodes, origins, err := r.serveNodes()
+	if err != nil {
+		return nil, err
+	}
+	for i, ns := range serveNodes {
 		node, err := gost.ParseNode(ns)
 		if err != nil {
 			return nil, err
 		}
+		rs := newReloaders()
+		pendingReloaders = rs
 
 		if auth := node.Get("auth"); auth != "" && node.User == nil {
 			c, err := base64.StdEncoding.DecodeString(auth)
@@ -352,7 +681,7 @@ func (r *route) GenRouters() ([]router, error) {
 				node.User = url.UserPassword(cs[:s], cs[s+1:])
 			}
 		}
-		authenticator, err := parseAuthenticator(node.Get("secrets"))
+		authenticator, err := parseAuthenticator(node.Get("secrets"), rs)
 		if err != nil {
 			return nil, err
 		}
@@ -367,10 +696,54 @@ func (r *route) GenRouters() ([]router, error) {
 			}
 		}
 		certFile, keyFile := node.Get("cert"), node.Get("key")
-		tlsCfg, err := tlsConfig(certFile, keyFile, node.Get("ca"))
-		if err != nil && certFile != "" && keyFile != "" {
+		var tlsCfg *tls.Config
+		// EMOD: acme=host[,host...] obtains the certificates by ACME instead of cert/key.
+		if node.Get("acme") != "" {
+			if tlsCfg, err = acmeNodeTLSConfig(node); err != nil {
+				return nil, err
+			}
+		} else if tlsCfg, err = tlsConfig(certFile, keyFile, ""); err != nil && certFile != "" && keyFile != "" {
 			return nil, err
 		}
+		// EMOD: mutual TLS, the clients must present the certificates signed by the clientCA,
+		// ca is the same option by its upstream name, they can not be set to different files.
+		caFile := node.Get("clientCA")
+		if ca := node.Get("ca"); caFile == "" {
+			caFile = ca
+		} else if ca != "" && ca != caFile {
+			return nil, fmt.Errorf("%s: ca %s and clientCA %s conflict", node.String(), ca, caFile)
+		}
+		if caFile != "" {
+			if tlsCfg == nil {
+				tlsCfg = gost.DefaultTLSConfig.Clone()
+			}
+			if err := setClientCA(tlsCfg, caFile); err != nil {
+				return nil, fmt.Errorf("%s: invalid clientCA %s: %w", node.String(), caFile, err)
+			}
+		}
+		// EMOD: session ticket control, e.g. to share the keys in a cluster.
+		if node.GetBool("ticketsDisabled") || node.Get("ticketKeys") != "" {
+			if tlsCfg == nil {
+				tlsCfg = gost.DefaultTLSConfig.Clone()
+			}
+			tlsCfg.SessionTicketsDisabled = node.GetBool("ticketsDisabled")
+			if s := node.Get("ticketKeys"); s != "" && !tlsCfg.SessionTicketsDisabled {
+				keys, err := parseTicketKeys(s, tlsCfg)
+				if err != nil {
+					return nil, err
+				}
+				rs.start(keys, s)
+			}
+		}
+		// EMOD: the minimum TLS version, e.g. tlsMinVersion=1.2.
+		if v := node.Get("tlsMinVersion"); v != "" {
+			if tlsCfg == nil {
+				tlsCfg = gost.DefaultTLSConfig.Clone()
+			}
+			if err := gost.SetTLSMinVersion(tlsCfg, v); err != nil {
+				return nil, err
+			}
+		}
 
 		wsOpts := &gost.WSOptions{}
 		wsOpts.EnableCompression = node.GetBool("compression")
@@ -380,6 +753,31 @@ func (r *route) GenRouters() ([]router, error) {
 
 		ttl := node.GetDuration("ttl")
 		timeout := node.GetDuration("timeout")
+		// EMOD: udpSessionTTL is the idle timeout of the UDP sessions, defaults to ttl,
+		// udpMaxSessions limits the number of the UDP sessions.
+		udpSessionTTL := node.GetDuration("udpSessionTTL")
+		if udpSessionTTL == 0 {
+			udpSessionTTL = ttl
+		}
+		udpMaxSessions := node.GetInt("udpMaxSessions")
+		// EMOD: dscp marks the packets sent by the listening sockets and the accepted connections.
+		dscp, err := parseDSCP(node)
+		if err != nil {
+			return nil, fmt.Errorf("%s: dscp: %w", node.String(), err)
+		}
+		connRate, connBurst, err := parseConnRate(node.Get("connRate"))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", node.String(), err)
+		}
+		shedAtLoad, err := parseShedAtLoad(node.Get("shedAtLoad"))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", node.String(), err)
+		}
+		if s := node.Get("routeTable"); s != "" && !routeTableRe.MatchString(s) {
+			return nil, fmt.Errorf("%s: invalid routeTable %s, should be a number or a name of letters, digits, _ and -", node.String(), s)
+		}
+
+		rm := metrics.Router(node.String(), node.Protocol, node.Addr)
 
 		tunRoutes := parseIPRoutes(node.Get("route"))
 		gw := net.ParseIP(node.Get("gw")) // default gateway
@@ -389,263 +787,351 @@ func (r *route) GenRouters() ([]router, error) {
 			}
 		}
 
-		var ln gost.Listener
-		switch node.Transport {
-		case "tls":
-			ln, err = gost.TLSListener(node.Addr, tlsCfg)
-		case "mtls":
-			ln, err = gost.MTLSListener(node.Addr, tlsCfg)
-		case "ws":
-			ln, err = gost.WSListener(node.Addr, wsOpts)
-		case "mws":
-			ln, err = gost.MWSListener(node.Addr, wsOpts)
-		case "wss":
-			ln, err = gost.WSSListener(node.Addr, tlsCfg, wsOpts)
-		case "mwss":
-			ln, err = gost.MWSSListener(node.Addr, tlsCfg, wsOpts)
-		case "kcp":
-			config, er := parseKCPConfig(node.Get("c"))
-			if er != nil {
-				return nil, er
-			}
-			if config == nil {
-				conf := gost.DefaultKCPConfig
-				if node.GetBool("tcp") {
-					conf.TCP = true
+		// EMOD: the listener is created by a closure so that the bind can be retried.
+		listen := func() (ln gost.Listener, err error) {
+			switch node.Transport {
+			case "tls":
+				ln, err = gost.TLSListener(node.Addr, tlsCfg)
+			case "mtls":
+				ln, err = gost.MTLSListener(node.Addr, tlsCfg)
+			case "ws":
+				ln, err = gost.WSListener(node.Addr, wsOpts)
+			case "mws":
+				ln, err = gost.MWSListener(node.Addr, wsOpts)
+			case "wss":
+				ln, err = gost.WSSListener(node.Addr, tlsCfg, wsOpts)
+			case "mwss":
+				ln, err = gost.MWSSListener(node.Addr, tlsCfg, wsOpts)
+			case "kcp":
+				config, er := parseKCPConfig(node.Get("c"))
+				if er != nil {
+					return nil, er
 				}
-				config = &conf
-			}
-			ln, err = gost.KCPListener(node.Addr, config)
-		case "ssh":
-			config := &gost.SSHConfig{
-				Authenticator: authenticator,
-				TLSConfig:     tlsCfg,
-			}
-			if s := node.Get("ssh_key"); s != "" {
-				key, err := gost.ParseSSHKeyFile(s)
-				if err != nil {
-					return nil, err
+				if config == nil {
+					conf := gost.DefaultKCPConfig
+					if node.GetBool("tcp") {
+						conf.TCP = true
+					}
+					config = &conf
 				}
-				config.Key = key
-			}
-			if s := node.Get("ssh_authorized_keys"); s != "" {
-				keys, err := gost.ParseSSHAuthorizedKeysFile(s)
-				if err != nil {
-					return nil, err
+				ln, err = gost.KCPListener(node.Addr, config)
+			case "ssh":
+				config := &gost.SSHConfig{
+					Authenticator: authenticator,
+					TLSConfig:     tlsCfg,
 				}
-				config.AuthorizedKeys = keys
-			}
-			if node.Protocol == "forward" {
-				ln, err = gost.TCPListener(node.Addr)
-			} else {
-				ln, err = gost.SSHTunnelListener(node.Addr, config)
-			}
-		case "http2":
-			ln, err = gost.HTTP2Listener(node.Addr, tlsCfg)
-		case "h2":
-			ln, err = gost.H2Listener(node.Addr, tlsCfg, node.Get("path"))
-		case "h2c":
-			ln, err = gost.H2CListener(node.Addr, node.Get("path"))
-		case "tcp":
-			// Directly use SSH port forwarding if the last chain node is forward+ssh
-			if chain.LastNode().Protocol == "forward" && chain.LastNode().Transport == "ssh" {
-				chain.Nodes()[len(chain.Nodes())-1].Client.Connector = gost.SSHDirectForwardConnector()
-				chain.Nodes()[len(chain.Nodes())-1].Client.Transporter = gost.SSHForwardTransporter()
-			}
-			// XMOD: 替换为接口地址，如果接口找不到地址，则直接退出。
-			// 这样我们可以靠systemd直接再拉起来，适用于tailscaled重启或没有认证的情况。
-			addr := node.Addr
-			ifName := node.Get("sourceInterface")
-			if ifName != "" {
-				var (
-					ief      *net.Interface
-					addrs    []net.Addr
-					ipv4Addr net.IP
-				)
-				if ief, err = net.InterfaceByName(ifName); err != nil { // get interface
-					return nil, errors.New(fmt.Sprintf("your interface %v is error", ifName))
-				}
-				if addrs, err = ief.Addrs(); err != nil { // get addresses
-					return nil, errors.New(fmt.Sprintf("your interface %v is does not have address", ifName))
+				if s := node.Get("ssh_key"); s != "" {
+					key, err := gost.ParseSSHKeyFile(s)
+					if err != nil {
+						return nil, err
+					}
+					config.Key = key
 				}
-				for _, addr := range addrs { // get ipv4 address
-					if ipv4Addr = addr.(*net.IPNet).IP.To4(); ipv4Addr != nil {
-						break
+				if s := node.Get("ssh_authorized_keys"); s != "" {
+					keys, err := gost.ParseSSHAuthorizedKeysFile(s)
+					if err != nil {
+						return nil, err
 					}
+					config.AuthorizedKeys = keys
 				}
-				if ipv4Addr == nil {
-					return nil, errors.New(fmt.Sprintf("your interface %s don't have an ipv4 address\n", ifName))
+				if node.Protocol == "forward" {
+					ln, err = gost.TCPListener(node.Addr)
+				} else {
+					ln, err = gost.SSHTunnelListener(node.Addr, config)
 				}
+			case "http2":
+				ln, err = gost.HTTP2Listener(node.Addr, tlsCfg, gost.MaxStreamsHTTP2Option(node.GetInt("h2MaxStreams")))
+			case "h2":
+				ln, err = gost.H2Listener(node.Addr, tlsCfg, node.Get("path"), gost.MaxStreamsHTTP2Option(node.GetInt("h2MaxStreams")))
+			case "h2c":
+				ln, err = gost.H2CListener(node.Addr, node.Get("path"), gost.MaxStreamsHTTP2Option(node.GetInt("h2MaxStreams")))
+			case "tcp":
+				// Directly use SSH port forwarding if the last chain node is forward+ssh
+				if chain.LastNode().Protocol == "forward" && chain.LastNode().Transport == "ssh" {
+					chain.Nodes()[len(chain.Nodes())-1].Client.Connector = gost.SSHDirectForwardConnector()
+					chain.Nodes()[len(chain.Nodes())-1].Client.Transporter = gost.SSHForwardTransporter()
+				}
+				// XMOD: 替换为接口地址，如果接口在sourceInterfaceWait内找不到地址，则直接退出。
+				// 这样我们可以靠systemd直接再拉起来，适用于tailscaled重启或没有认证的情况。
+				addr := node.Addr
+				ifName := sourceInterface(node)
+				if ifName != "" {
+					// EMOD: sourceInterfaceFamily选择inet(默认)或inet6地址，
+					// sourceInterfaceWait时间内等待接口获得地址。
+					var ifAddrs []net.IPAddr
+					if ip := node.Get("sourceInterfaceIP"); ip != "" {
+						// the address chosen by serveNodes for sourceInterfaceFamily=both.
+						ifAddrs = []net.IPAddr{parseIPAddr(ip)}
+					} else if ifAddrs, err = waitInterfaceAddrs(ifName, node.Get("sourceInterfaceFamily"), node.GetDuration("sourceInterfaceWait")); err != nil {
+						return nil, err
+					}
 
-				// 替换地址字段
-				laddr, err := net.ResolveTCPAddr("tcp", addr)
-				if err != nil {
+					// 替换地址字段
+					laddr, err := net.ResolveTCPAddr("tcp", addr)
+					if err != nil {
+						return nil, err
+					}
+					tAddr := net.TCPAddr{
+						IP:   ifAddrs[0].IP,
+						Port: laddr.Port,
+						Zone: ifAddrs[0].Zone,
+					}
+					addr = tAddr.String()
+					log.Logf("%s: substituted address is %v, orig addrs is %v", node.String(), &tAddr, laddr)
+				}
+				// EMOD: mark设置监听socket的SO_MARK，用于策略路由。
+				ln, err = gost.TCPListenerWithConfig(addr, &gost.TCPListenConfig{
+					Mark: node.GetInt("mark"),
+					DSCP: dscp,
+				})
+			case "vsock":
+				ln, err = gost.VSOCKListener(node.Addr, &gost.VSOCKConfig{
+					BufferSize: node.GetInt("vsockBuf"),
+				})
+			case "unix":
+				var mode uint64
+				if s := node.Get("unmode"); s != "" {
+					if mode, err = strconv.ParseUint(s, 8, 32); err != nil {
+						return nil, fmt.Errorf("%s: invalid unmode %s: %w", node.String(), s, err)
+					}
+				}
+				ln, err = gost.UnixListener(node.Addr, os.FileMode(mode))
+			case "udp":
+				ln, err = gost.UDPListener(node.Addr, &gost.UDPListenConfig{
+					TTL:         udpSessionTTL,
+					Backlog:     node.GetInt("backlog"),
+					QueueSize:   node.GetInt("queue"),
+					Mark:        node.GetInt("mark"),
+					DSCP:        dscp,
+					MaxSessions: udpMaxSessions,
+					Metrics:     rm,
+				})
+			case "rtcp":
+				// Directly use SSH port forwarding if the last chain node is forward+ssh
+				if chain.LastNode().Protocol == "forward" && chain.LastNode().Transport == "ssh" {
+					chain.Nodes()[len(chain.Nodes())-1].Client.Connector = gost.SSHRemoteForwardConnector()
+					chain.Nodes()[len(chain.Nodes())-1].Client.Transporter = gost.SSHForwardTransporter()
+				}
+				ln, err = gost.TCPRemoteForwardListener(node.Addr, chain)
+			case "rudp":
+				ln, err = gost.UDPRemoteForwardListener(node.Addr,
+					chain,
+					&gost.UDPListenConfig{
+						TTL:         udpSessionTTL,
+						Backlog:     node.GetInt("backlog"),
+						QueueSize:   node.GetInt("queue"),
+						MaxSessions: udpMaxSessions,
+						Metrics:     rm,
+					})
+			case "obfs4":
+				if err = gost.Obfs4Init(node, true); err != nil {
 					return nil, err
 				}
-				tAddr := net.TCPAddr{
-					IP: ipv4Addr,
-					Port: laddr.Port,
-					Zone: laddr.Zone,
+				ln, err = gost.Obfs4Listener(node.Addr)
+			case "ohttp":
+				ln, err = gost.ObfsHTTPListener(node.Addr)
+			case "otls":
+				ln, err = gost.ObfsTLSListener(node.Addr)
+			case "tun":
+				cfg := gost.TunConfig{
+					Name:    node.Get("name"),
+					Addr:    node.Get("net"),
+					Peer:    node.Get("peer"),
+					MTU:     node.GetInt("mtu"),
+					Routes:  tunRoutes,
+					Gateway: node.Get("gw"),
+					// EMOD: the routes are installed into routeTable instead of the main table.
+					RouteTable: node.Get("routeTable"),
 				}
-				addr = tAddr.String()
-				fmt.Printf("substituded address is %v, orig addrs is %v\n", tAddr, laddr)
-			}
-			ln, err = gost.TCPListener(addr)
-		case "vsock":
-			ln, err = gost.VSOCKListener(node.Addr)
-		case "udp":
-			ln, err = gost.UDPListener(node.Addr, &gost.UDPListenConfig{
-				TTL:       ttl,
-				Backlog:   node.GetInt("backlog"),
-				QueueSize: node.GetInt("queue"),
-			})
-		case "rtcp":
-			// Directly use SSH port forwarding if the last chain node is forward+ssh
-			if chain.LastNode().Protocol == "forward" && chain.LastNode().Transport == "ssh" {
-				chain.Nodes()[len(chain.Nodes())-1].Client.Connector = gost.SSHRemoteForwardConnector()
-				chain.Nodes()[len(chain.Nodes())-1].Client.Transporter = gost.SSHForwardTransporter()
-			}
-			ln, err = gost.TCPRemoteForwardListener(node.Addr, chain)
-		case "rudp":
-			ln, err = gost.UDPRemoteForwardListener(node.Addr,
-				chain,
-				&gost.UDPListenConfig{
-					TTL:       ttl,
-					Backlog:   node.GetInt("backlog"),
-					QueueSize: node.GetInt("queue"),
+				ln, err = gost.TunListener(cfg)
+			case "tap":
+				cfg := gost.TapConfig{
+					Name:    node.Get("name"),
+					Addr:    node.Get("net"),
+					MTU:     node.GetInt("mtu"),
+					Routes:  strings.Split(node.Get("route"), ","),
+					Gateway: node.Get("gw"),
+					// EMOD: the routes are installed into routeTable instead of the main table.
+					RouteTable: node.Get("routeTable"),
+				}
+				ln, err = gost.TapListener(cfg)
+			case "quic":
+				// EMOD: QUIC listens on the UDP port of the node, which must be allowed by the firewall.
+				ln, err = gost.QUICListener(node.Addr, &gost.QUICConfig{
+					TLSConfig:       tlsCfg,
+					Timeout:         timeout,
+					KeepAlivePeriod: parseKeepAlive(node),
+				})
+			case "ftcp":
+				ln, err = gost.FakeTCPListener(
+					node.Addr,
+					&gost.FakeTCPListenConfig{
+						TTL:       ttl,
+						Backlog:   node.GetInt("backlog"),
+						QueueSize: node.GetInt("queue"),
+					},
+				)
+			case "dns":
+				ln, err = gost.DNSListener(
+					node.Addr,
+					&gost.DNSOptions{
+						Mode:      node.Get("mode"),
+						TLSConfig: tlsCfg,
+					},
+				)
+			case "redu", "redirectu":
+				ln, err = gost.UDPRedirectListener(node.Addr, &gost.UDPListenConfig{
+					TTL:         udpSessionTTL,
+					Backlog:     node.GetInt("backlog"),
+					QueueSize:   node.GetInt("queue"),
+					Mark:        node.GetInt("mark"),
+					DSCP:        dscp,
+					MaxSessions: udpMaxSessions,
+					Metrics:     rm,
+				})
+			default:
+				ln, err = gost.TCPListenerWithConfig(node.Addr, &gost.TCPListenConfig{
+					Mark: node.GetInt("mark"),
+					DSCP: dscp,
 				})
-		case "obfs4":
-			if err = gost.Obfs4Init(node, true); err != nil {
-				return nil, err
 			}
-			ln, err = gost.Obfs4Listener(node.Addr)
-		case "ohttp":
-			ln, err = gost.ObfsHTTPListener(node.Addr)
-		case "otls":
-			ln, err = gost.ObfsTLSListener(node.Addr)
-		case "tun":
-			cfg := gost.TunConfig{
-				Name:    node.Get("name"),
-				Addr:    node.Get("net"),
-				Peer:    node.Get("peer"),
-				MTU:     node.GetInt("mtu"),
-				Routes:  tunRoutes,
-				Gateway: node.Get("gw"),
-			}
-			ln, err = gost.TunListener(cfg)
-		case "tap":
-			cfg := gost.TapConfig{
-				Name:    node.Get("name"),
-				Addr:    node.Get("net"),
-				MTU:     node.GetInt("mtu"),
-				Routes:  strings.Split(node.Get("route"), ","),
-				Gateway: node.Get("gw"),
-			}
-			ln, err = gost.TapListener(cfg)
-		case "ftcp":
-			ln, err = gost.FakeTCPListener(
-				node.Addr,
-				&gost.FakeTCPListenConfig{
-					TTL:       ttl,
-					Backlog:   node.GetInt("backlog"),
-					QueueSize: node.GetInt("queue"),
-				},
-			)
-		case "dns":
-			ln, err = gost.DNSListener(
-				node.Addr,
-				&gost.DNSOptions{
-					Mode:      node.Get("mode"),
-					TLSConfig: tlsCfg,
-				},
-			)
-		case "redu", "redirectu":
-			ln, err = gost.UDPRedirectListener(node.Addr, &gost.UDPListenConfig{
-				TTL:       ttl,
-				Backlog:   node.GetInt("backlog"),
-				QueueSize: node.GetInt("queue"),
-			})
-		default:
-			ln, err = gost.TCPListener(node.Addr)
+			return
 		}
+		ln, err := gost.ListenWithRetry(listen, node.GetDuration("bindRetry"))
 		if err != nil {
+			if ns != origins[i] {
+				_, port, _ := net.SplitHostPort(node.Addr)
+				return nil, fmt.Errorf("%s: port %s: %w", origins[i], port, err)
+			}
 			return nil, err
 		}
-
-		var handler gost.Handler
-		switch node.Protocol {
-		case "http2":
-			handler = gost.HTTP2Handler()
-		case "socks", "socks5":
-			handler = gost.SOCKS5Handler()
-		case "socks4", "socks4a":
-			handler = gost.SOCKS4Handler()
-		case "ss":
-			handler = gost.ShadowHandler()
-		case "http":
-			handler = gost.HTTPHandler()
-		case "tcp":
-			handler = gost.TCPDirectForwardHandler(node.Remote)
-		case "rtcp":
-			handler = gost.TCPRemoteForwardHandler(node.Remote)
-		case "udp":
-			handler = gost.UDPDirectForwardHandler(node.Remote)
-		case "rudp":
-			handler = gost.UDPRemoteForwardHandler(node.Remote)
-		case "forward":
-			handler = gost.SSHForwardHandler()
-		case "red", "redirect":
-			handler = gost.TCPRedirectHandler()
-		case "redu", "redirectu":
-			handler = gost.UDPRedirectHandler()
-		case "ssu":
-			handler = gost.ShadowUDPHandler()
-		case "sni":
-			handler = gost.SNIHandler()
-		case "tun":
-			handler = gost.TunHandler()
-		case "tap":
-			handler = gost.TapHandler()
-		case "dns":
-			handler = gost.DNSHandler(node.Remote)
-		case "relay":
-			handler = gost.RelayHandler(node.Remote)
-		default:
-			// start from 2.5, if remote is not empty, then we assume that it is a forward tunnel.
-			if node.Remote != "" {
-				handler = gost.TCPDirectForwardHandler(node.Remote)
-			} else {
-				handler = gost.AutoHandler()
+		pending = ln
+		// EMOD: the listening socket is replaced under the wrappers when the address of sourceInterface changes.
+		var rebind *gost.RebindListener
+		if ifName, _ := interfaceWatch(node); ifName != "" {
+			rebind = gost.NewRebindListener(ln)
+			ln = rebind
+		}
+		// EMOD: keepalive=period sets the TCP keepalive of the accepted connections, keepalive=0 disables it.
+		if keepAlive := parseKeepAlive(node); keepAlive != 0 {
+			ln = gost.KeepAliveListener(ln, keepAlive)
+		}
+		// EMOD: acceptProxyProtocol strips the PROXY protocol header added by the L4 load balancer in front,
+		// and uses the source in it as the client address, which the peerAllow, whitelist and the logs see.
+		// proxyProtocolFrom lists the IPs/CIDRs of the load balancers, the header is only accepted
+		// from these TCP peers, so that the clients connecting directly can not spoof their address.
+		if node.GetBool("acceptProxyProtocol") {
+			switch {
+			case node.Transport != "tcp":
+				return nil, fmt.Errorf("%s: acceptProxyProtocol is only supported on the tcp transport", node.String())
+			case node.Protocol == "red" || node.Protocol == "redirect":
+				return nil, fmt.Errorf("%s: acceptProxyProtocol is not supported by the redirect", node.String())
+			}
+			var trusted *gost.PeerAllow
+			if s := node.Get("proxyProtocolFrom"); s != "" {
+				if trusted, err = gost.ParsePeerAllow(s); err != nil {
+					return nil, fmt.Errorf("%s: proxyProtocolFrom: %w", node.String(), err)
+				}
+				if trusted.HasNames() {
+					return nil, fmt.Errorf("%s: proxyProtocolFrom should be IPs or CIDRs", node.String())
+				}
+			} else if node.Get("peerAllow") != "" {
+				return nil, fmt.Errorf("%s: peerAllow with acceptProxyProtocol requires proxyProtocolFrom, "+
+					"as peerAllow checks the source in the PROXY header", node.String())
 			}
+			ln = gost.ProxyProtocolTrustedListener(ln, trusted)
+		}
+
+		handler, err := nodeHandler(node)
+		if err != nil {
+			return nil, err
 		}
 
 		var whitelist, blacklist *gost.Permissions
+		var whitelistReloader, blacklistReloader *gost.PermissionsReloader
 		if node.Values.Get("whitelist") != "" {
-			if whitelist, err = gost.ParsePermissions(node.Get("whitelist")); err != nil {
+			if whitelist, whitelistReloader, err = parsePermissions(node.Get("whitelist"), rs); err != nil {
 				return nil, err
 			}
 		}
 		if node.Values.Get("blacklist") != "" {
-			if blacklist, err = gost.ParsePermissions(node.Get("blacklist")); err != nil {
+			if blacklist, blacklistReloader, err = parsePermissions(node.Get("blacklist"), rs); err != nil {
 				return nil, err
 			}
 		}
+		var peerAllow *gost.PeerAllow
+		if s := node.Get("peerAllow"); s != "" {
+			if peerAllow, err = gost.ParsePeerAllow(s); err != nil {
+				return nil, err
+			}
+		}
+
+		switch mode := node.Get("udpOversize"); mode {
+		case "", gost.UDPOversizeDrop, gost.UDPOversizeTruncate, gost.UDPOversizeFrag:
+		default:
+			return nil, fmt.Errorf("%s: invalid udpOversize %q, must be drop, truncate or frag", node.String(), mode)
+		}
+		if tenant := node.Get("tenant"); tenant != "" && tenant != gost.TenantUser &&
+			(!strings.HasPrefix(tenant, gost.TenantStaticPrefix) || tenant == gost.TenantStaticPrefix) {
+			return nil, fmt.Errorf("%s: invalid tenant %q, must be user or static:<id>", node.String(), tenant)
+		}
+		switch priority := node.Get("priority"); priority {
+		case "", gost.PriorityNormal, gost.PriorityHigh:
+		default:
+			return nil, fmt.Errorf("%s: invalid priority %q, must be normal or high", node.String(), priority)
+		}
+		// the recovery probe dials the targets directly, but the direct forwarders reach them through the chain,
+		// only the remote forwarders dial the targets from the local host.
+		if node.Get("recoverProbe") != "" && (!chain.IsEmpty() || chain != nil && chain.Fallback != nil) &&
+			node.Protocol != "rtcp" && node.Protocol != "rudp" {
+			return nil, fmt.Errorf("%s: recoverProbe is not supported with the chain, the targets are dialed through it", node.String())
+		}
+		if err := checkRelayOptions(node); err != nil {
+			return nil, err
+		}
+
+		rateUp, rateDown, err := parseRateLimit(node.Get("rateLimit"))
+		if err != nil {
+			return nil, fmt.Errorf("%s: rateLimit: %w", node.String(), err)
+		}
+		if rateUp != nil || rateDown != nil {
+			log.Logf("[rate] %s: rateLimit %s, the zero-copy (splice) forwarding is disabled for the limited connections",
+				node.String(), node.Get("rateLimit"))
+		}
 
-		node.Bypass = parseBypass(node.Get("bypass"))
-		hosts := parseHosts(node.Get("hosts"))
+		proxyProtocol := node.GetInt("proxyProtocol")
+		if proxyProtocol < 0 || proxyProtocol > 2 {
+			return nil, fmt.Errorf("%s: invalid proxyProtocol %s, must be 1 or 2", node.String(), node.Get("proxyProtocol"))
+		}
+
+		geoip, err := parseGeoIP(node.Get("geoip"))
+		if err != nil {
+			return nil, err
+		}
+		if node.Bypass, err = parseBypass(node.Get("bypass"), geoip, rs); err != nil {
+			return nil, fmt.Errorf("%s: bypass: %w", node.String(), err)
+		}
+		hosts := parseHosts(node.Get("hosts"), rs)
 		ips := parseIP(node.Get("ip"), "")
 
-		resolver := parseResolver(node.Get("dns"))
+		resolver := parseResolver(node.Get("dns"), rs)
 		if resolver != nil {
 			resolver.Init(
 				gost.ChainResolverOption(chain),
 				gost.TimeoutResolverOption(timeout),
+				gost.DNSTimeoutResolverOption(node.GetDuration("dnsTimeout")),
 				gost.TTLResolverOption(ttl),
 				gost.PreferResolverOption(node.Get("prefer")),
 				gost.SrcIPResolverOption(net.ParseIP(node.Get("ip"))),
+				gost.SingleflightResolverOption(node.GetBool("dnsSingleflight")),
+				// EMOD: the answers with the zero TTL are not cached, unless dnsMinTTL raises them.
+				gost.TTLBoundsResolverOption(node.GetDuration("dnsMinTTL"), node.GetDuration("dnsMaxTTL")),
+				gost.NegativeTTLResolverOption(node.GetDuration("dnsNegTTL")),
+				gost.ParallelResolverOption(node.GetBool("dnsParallel")),
 			)
 		}
 
+		rm.SetMaxConns(node.GetInt("maxConns"))
 		handler.Init(
 			gost.AddrHandlerOption(ln.Addr().String()),
 			gost.ChainHandlerOption(chain),
@@ -654,9 +1140,13 @@ func (r *route) GenRouters() ([]router, error) {
 			gost.TLSConfigHandlerOption(tlsCfg),
 			gost.WhitelistHandlerOption(whitelist),
 			gost.BlacklistHandlerOption(blacklist),
+			gost.PermissionsReloaderHandlerOption(whitelistReloader, blacklistReloader),
 			gost.StrategyHandlerOption(gost.NewStrategy(node.Get("strategy"))),
 			gost.MaxFailsHandlerOption(node.GetInt("max_fails")),
 			gost.FailTimeoutHandlerOption(node.GetDuration("fail_timeout")),
+			gost.RecoverProbeHandlerOption(node.Get("recoverProbe")),
+			gost.BlockPrivateHandlerOption(node.GetBool("blockPrivate")),
+			gost.RandomizeSourcePortHandlerOption(node.GetBool("randomizeSourcePort")),
 			gost.BypassHandlerOption(node.Bypass),
 			gost.ResolverHandlerOption(resolver),
 			gost.HostsHandlerOption(hosts),
@@ -667,52 +1157,349 @@ func (r *route) GenRouters() ([]router, error) {
 			gost.NodeHandlerOption(node),
 			gost.IPsHandlerOption(ips),
 			gost.TCPModeHandlerOption(node.GetBool("tcp")),
+			gost.TunBatchHandlerOption(node.GetInt("tunBatch")),
 			gost.IPRoutesHandlerOption(tunRoutes...),
 			gost.ProxyAgentHandlerOption(node.Get("proxyAgent")),
 			gost.HTTPTunnelHandlerOption(node.GetBool("httpTunnel")),
+			gost.RelayAntiReplayHandlerOption(node.GetBool("relayAntiReplay")),
+			gost.SlowLogHandlerOption(node.GetDuration("slowLog")),
+			gost.MaxBytesHandlerOption(int64(node.GetInt("maxBytes"))),
+			gost.UDPMaxSizeHandlerOption(node.GetInt("udpMaxSize"), node.Get("udpOversize")),
+			gost.AppKeepaliveHandlerOption(node.GetDuration("appKeepalive")),
+			gost.CloseOnEOFHandlerOption(node.GetBool("closeOnEOF"), node.GetDuration("closeOnEOFGrace")),
+			gost.BandwidthHandlerOption(bandwidthLimiter, node.Get("priority")),
+			gost.SNIRewriteHandlerOption(node.Get("sniRewrite"), node.GetBool("sniRewriteInsert")),
+			gost.TenantHandlerOption(node.Get("tenant")),
+			gost.RetryOnImmediateCloseHandlerOption(node.GetDuration("retryOnImmediateClose")),
+			gost.FirstByteTimeoutHandlerOption(node.GetDuration("firstByteTimeout")),
+			gost.TransparentEgressHandlerOption(parseTransparentEgress(node.Get("transparentEgress"))),
+			gost.MetricsHandlerOption(rm),
+			gost.IdleTimeoutHandlerOption(node.GetDuration("idleTimeout")),
+			gost.RateLimitHandlerOption(rateUp, rateDown),
+			gost.ProxyProtocolHandlerOption(proxyProtocol),
+			gost.AccessLogHandlerOption(cfg.AccessLog || node.GetBool("accessLog")),
+			gost.SpliceHandlerOption(node.GetBool("splice")),
 		)
 
 		// EMOD: 如果是基于redirect的tproxy，则给handler构建必要的参数。
-		if node.Protocol == "red" || node.Protocol == "redirect" {
-			log.Logf("red node %v preserve src %v, proxy netns %v",
+		switch node.Protocol {
+		case "red", "redirect", "redu", "redirectu":
+			gost.LogfWith(gost.Fields{"node": node.String(), "protocol": node.Protocol, "addr": node.Addr},
+				"red node %v preserve src %v, proxy netns %v",
 				node.String(), node.GetBool("preserveSrc"), node.Get("proxyNetns"))
+			if proxyProtocol > 0 && node.GetBool("preserveSrc") {
+				log.Logf("[red] %s: proxyProtocol takes precedence, the TCP connections do not preserve the source", node.String())
+			}
+			// fail fast, otherwise the connections fail one by one when the netns is missing.
+			if netns := node.Get("proxyNetns"); netns != "" {
+				if err := gost.CheckNetns(netns); err != nil {
+					return nil, fmt.Errorf("%s: invalid proxyNetns: %w", node.String(), err)
+				}
+			}
 			handler.Init(
 				gost.PreserveSrcHandlerOption(node.GetBool("preserveSrc")),
 				gost.ProxyNetnsHandlerOption(node.Get("proxyNetns")),
 			)
 		}
 
+		// EMOD: sni=host=chainName routes the SNI proxy connections to the chains of the named routes.
+		key := r.key(origins[i])
+		if specs := node.Values["sni"]; node.Protocol == "sni" && len(specs) > 0 {
+			routes, refs, err := parseSNIRoutes(cfg, specs, rs)
+			if err != nil {
+				return nil, err
+			}
+			handler.Init(gost.SNIRoutesHandlerOption(routes))
+			key += " " + refs
+		}
+
 		rt := router{
-			node:     node,
-			server:   &gost.Server{Listener: ln},
-			handler:  handler,
-			chain:    chain,
-			resolver: resolver,
-			hosts:    hosts,
+			key:       key,
+			node:      node,
+			server:    &gost.Server{Listener: ln},
+			handler:   handler,
+			chain:     chain,
+			resolver:  resolver,
+			hosts:     hosts,
+			peerAllow: peerAllow,
+			metrics:   rm,
+			rebind:    rebind,
+			dscp:      dscp,
+
+			connRate:   connRate,
+			connBurst:  connBurst,
+			shedAtLoad: shedAtLoad,
 		}
+		chainRs := chainReloaders.acquire()
+		rt.stopReloaders = sync.OnceFunc(func() {
+			rs.release()
+			chainRs.release()
+		})
 		rts = append(rts, rt)
+		pending, pendingReloaders = nil, nil
 	}
 
 	return rts, nil
 }
 
+// nodeHandler creates the handler of the serve node by its protocol.
+func nodeHandler(node gost.Node) (handler gost.Handler, err error) {
+	switch node.Protocol {
+	case "http2":
+		handler = gost.HTTP2Handler()
+	case "socks", "socks5":
+		handler = gost.SOCKS5Handler()
+	case "socks4", "socks4a":
+		handler = gost.SOCKS4Handler()
+	case "ss":
+		handler = gost.ShadowHandler()
+	case "http":
+		handler = gost.HTTPHandler()
+	case "tcp":
+		handler = gost.TCPDirectForwardHandler(node.Remote)
+	case "rtcp":
+		handler = gost.TCPRemoteForwardHandler(node.Remote)
+	case "udp":
+		handler = gost.UDPDirectForwardHandler(node.Remote)
+	case "rudp":
+		handler = gost.UDPRemoteForwardHandler(node.Remote)
+	case "forward":
+		handler = gost.SSHForwardHandler()
+	case "red", "redirect":
+		handler = gost.TCPRedirectHandler()
+	case "redu", "redirectu":
+		handler = gost.UDPRedirectHandler()
+	case "ssu":
+		handler = gost.ShadowUDPHandler()
+	case "sni":
+		handler = gost.SNIHandler()
+	case "tun":
+		handler = gost.TunHandler()
+	case "tap":
+		handler = gost.TapHandler()
+	case "dns":
+		handler = gost.DNSHandler(node.Remote)
+	case "relay":
+		handler = gost.RelayHandler(node.Remote)
+	default:
+		// start from 2.5, if remote is not empty, then we assume that it is a forward tunnel.
+		// EMOD: autoForward=false keeps the auto handler when remote is set for another purpose.
+		autoForward := true
+		if s := node.Get("autoForward"); s != "" {
+			if autoForward, err = strconv.ParseBool(s); err != nil {
+				return nil, fmt.Errorf("%s: invalid autoForward %s: %w", node.String(), s, err)
+			}
+		}
+		if node.Remote != "" && autoForward {
+			log.Logf("%s: no protocol with remote %s, the forward handler is used (autoForward=false for the auto handler)",
+				node.String(), node.Remote)
+			handler = gost.TCPDirectForwardHandler(node.Remote)
+		} else {
+			handler = gost.AutoHandler()
+		}
+	}
+	return handler, nil
+}
+
 type router struct {
-	node     gost.Node
-	server   *gost.Server
-	handler  gost.Handler
-	chain    *gost.Chain
-	resolver gost.Resolver
-	hosts    *gost.Hosts
+	key       string
+	node      gost.Node
+	server    *gost.Server
+	handler   gost.Handler
+	chain     *gost.Chain
+	resolver  gost.Resolver
+	hosts     *gost.Hosts
+	peerAllow *gost.PeerAllow
+	metrics   *gost.RouterMetrics
+	// rebind is the listener rebound by the sourceInterface watcher, nil if not watched.
+	rebind *gost.RebindListener
+	// dscp is the DSCP of the listening sockets, the rebound ones included.
+	dscp int
+
+	// the admission control of the new connections, see the connRate and shedAtLoad node options.
+	connRate   float64
+	connBurst  int
+	shedAtLoad float64
+
+	// stopReloaders stops the reloaders of the node, and the chain ones if no other router shares them.
+	stopReloaders func()
+}
+
+// routerConfig is the effective config of a router, with the secrets redacted.
+type routerConfig struct {
+	Node     gost.NodeConfig   `json:"node"`
+	Handler  string            `json:"handler"`
+	Chain    *gost.ChainConfig `json:"chain,omitempty"`
+	Resolver []string          `json:"resolver,omitempty"`
+}
+
+// configs returns the effective configs of the routers of the route, parsed from the nodes
+// without creating the listeners, so the config can be dumped while the routers are running.
+func (r *route) configs() ([]routerConfig, error) {
+	chain, err := r.parseChain(nil)
+	if err != nil {
+		return nil, err
+	}
+	var chainCfg *gost.ChainConfig
+	if !chain.IsEmpty() || chain != nil && chain.Fallback != nil {
+		chainCfg = chain.Config()
+	}
+
+	serveNodes, _, err := r.serveNodes()
+	if err != nil {
+		return nil, err
+	}
+	var cfgs []routerConfig
+	for _, ns := range serveNodes {
+		node, err := gost.ParseNode(ns)
+		if err != nil {
+			return nil, err
+		}
+		handler, err := nodeHandler(node)
+		if err != nil {
+			return nil, err
+		}
+		geoip, err := parseGeoIP(node.Get("geoip"))
+		if err != nil {
+			return nil, err
+		}
+		if node.Bypass, err = parseBypass(node.Get("bypass"), geoip, nil); err != nil {
+			return nil, fmt.Errorf("%s: bypass: %w", node.String(), err)
+		}
+
+		cfg := routerConfig{
+			Node:    node.Config(),
+			Handler: fmt.Sprintf("%T", handler),
+			Chain:   chainCfg,
+		}
+		if resolver, ok := parseResolver(node.Get("dns"), nil).(fmt.Stringer); ok {
+			for _, line := range strings.Split(resolver.String(), "\n") {
+				if line != "" {
+					cfg.Resolver = append(cfg.Resolver, line)
+				}
+			}
+		}
+		cfgs = append(cfgs, cfg)
+	}
+	return cfgs, nil
 }
 
 func (r *router) Serve() error {
-	log.Logf("%s on %s", r.node.String(), r.server.Addr())
-	return r.server.Serve(r.handler)
+	gost.LogfWith(gost.Fields{"node": r.node.String(), "protocol": r.node.Protocol, "addr": r.server.Addr().String()},
+		"%s on %s", r.node.String(), r.server.Addr())
+	opts := []gost.ServerOption{
+		gost.ConnRateServerOption(r.connRate),
+		gost.ConnBurstServerOption(r.connBurst),
+		gost.MaxConnsServerOption(r.node.GetInt("maxConns")),
+		gost.ShedAtConnsServerOption(r.node.GetInt("shedAtConns")),
+		gost.ShedAtLoadServerOption(r.shedAtLoad),
+		gost.PeerAllowServerOption(r.peerAllow),
+	}
+
+	handler := gost.MetricsHandler(r.handler, r.metrics)
+
+	// EMOD: 监视sourceInterface，地址变化时重新绑定监听。
+	if r.rebind != nil {
+		ifName, interval := interfaceWatch(r.node)
+		done := make(chan struct{})
+		defer close(done)
+		go r.watchInterface(ifName, interval, done)
+	}
+	return r.server.Serve(handler, opts...)
+}
+
+// interfaceWatch returns the interface and the polling interval of the sourceInterfaceWatch of the node,
+// the interface is empty if the listener is not watched.
+func interfaceWatch(node gost.Node) (string, time.Duration) {
+	ifName := sourceInterface(node)
+	interval := node.GetDuration("sourceInterfaceWatch")
+	if ifName == "" || interval <= 0 || node.Transport != "tcp" || node.Get("sourceInterfaceIP") != "" {
+		return "", 0
+	}
+	return ifName, interval
+}
+
+// watchInterface polls the interface every interval, when the bound address is gone from the interface,
+// the listening socket is rebound on the new address. The accepted connections are kept.
+func (r *router) watchInterface(ifName string, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+
+		bound, ok := r.rebind.Addr().(*net.TCPAddr)
+		if !ok {
+			return
+		}
+		addrs, err := interfaceAddrs(ifName, r.node.Get("sourceInterfaceFamily"))
+		if err != nil {
+			log.Logf("%s : %s, keep listening on %s", r.node.String(), err, bound)
+			continue
+		}
+		gone := true
+		for _, addr := range addrs {
+			if addr.IP.Equal(bound.IP) {
+				gone = false
+				break
+			}
+		}
+		if !gone {
+			continue
+		}
+
+		laddr := net.TCPAddr{IP: addrs[0].IP, Port: bound.Port, Zone: addrs[0].Zone}
+		ln, err := gost.TCPListenerWithConfig(laddr.String(), &gost.TCPListenConfig{
+			Mark: r.node.GetInt("mark"),
+			DSCP: r.dscp,
+		})
+		if err != nil {
+			log.Logf("%s : rebind on %s: %s", r.node.String(), laddr.String(), err)
+			continue
+		}
+		// the router is closed meanwhile.
+		if err := r.rebind.Rebind(ln); err != nil {
+			ln.Close()
+			return
+		}
+		log.Logf("%s rebound on %s", r.node.String(), ln.Addr())
+	}
 }
 
 func (r *router) Close() error {
 	if r == nil || r.server == nil {
 		return nil
 	}
+	if r.stopReloaders != nil {
+		r.stopReloaders()
+	}
 	return r.server.Close()
 }
+
+// CloseGraceful stops accepting new connections and waits at most timeout for the active ones to finish,
+// then falls back to closing them.
+func (r *router) CloseGraceful(timeout time.Duration) error {
+	if r == nil || r.server == nil {
+		return nil
+	}
+	if r.stopReloaders != nil {
+		r.stopReloaders()
+	}
+	return r.server.CloseGraceful(timeout)
+}
+
+// parseTransparentEgress parses the transparentEgress option,
+// which is a boolean or the source IP of the outbound connections.
+func parseTransparentEgress(s string) net.IP {
+	if ip := net.ParseIP(s); ip != nil {
+		return ip
+	}
+	if b, _ := strconv.ParseBool(s); b {
+		return net.IPv4zero
+	}
+	return nil
+}
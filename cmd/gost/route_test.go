@@ -0,0 +1,523 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ginuerzh/gost"
+)
+
+func TestAutoForward(t *testing.T) {
+	for _, tc := range []struct {
+		ns      string
+		handler string
+	}{
+		{"127.0.0.1:0/10.0.0.1:80", "*gost.tcpDirectForwardHandler"},
+		{"127.0.0.1:0/10.0.0.1:80?autoForward=true", "*gost.tcpDirectForwardHandler"},
+		{"127.0.0.1:0/10.0.0.1:80?autoForward=false", "*gost.autoHandler"},
+		{"127.0.0.1:0", "*gost.autoHandler"},
+	} {
+		r := route{ServeNodes: stringList{tc.ns}}
+		rts, err := r.GenRouters(&baseConfig{})
+		if err != nil {
+			t.Errorf("%s: %v", tc.ns, err)
+			continue
+		}
+		if handler := fmt.Sprintf("%T", rts[0].handler); handler != tc.handler {
+			t.Errorf("%s: handler should be %s, got %s", tc.ns, tc.handler, handler)
+		}
+		rts[0].Close()
+	}
+
+	r := route{ServeNodes: stringList{"127.0.0.1:0/10.0.0.1:80?autoForward=maybe"}}
+	if _, err := r.GenRouters(&baseConfig{}); err == nil || !strings.Contains(err.Error(), "invalid autoForward") {
+		t.Errorf("invalid autoForward should be rejected, got %v", err)
+	}
+}
+
+// writeCert writes the certificate and its key in PEM to the files named name.pem and name.key in dir.
+func writeCert(dir, name string, cert tls.Certificate) (certFile, keyFile string, err error) {
+	der, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		return
+	}
+	certFile, keyFile = filepath.Join(dir, name+".pem"), filepath.Join(dir, name+".key")
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600); err != nil {
+		return
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	return
+}
+
+func TestQUICNode(t *testing.T) {
+	dir := t.TempDir()
+	srvCert, caPEM, err := genServerCert("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cliCert, clientCAPEM, err := genServerCert("client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvCertFile, srvKeyFile, err := writeCert(dir, "server", srvCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cliCertFile, cliKeyFile, err := writeCert(dir, "client", cliCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile, clientCAFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "clientca.pem")
+	if err := os.WriteFile(caFile, caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(clientCAFile, clientCAPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	// the clients must present the certificates signed by the clientCA.
+	r := route{ServeNodes: stringList{fmt.Sprintf("quic://127.0.0.1:0/%s?cert=%s&key=%s&ca=%s&timeout=5s&keepalive=10s",
+		echo.Addr(), srvCertFile, srvKeyFile, clientCAFile)}}
+	rts, err := r.GenRouters(&baseConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go rts[0].Serve()
+	defer rts[0].Close()
+	addr := rts[0].server.Addr().String()
+
+	clientCert := fmt.Sprintf("&cert=%s&key=%s", cliCertFile, cliKeyFile)
+	for _, tc := range []struct {
+		params string
+		ok     bool
+	}{
+		{"secure=true&ca=" + caFile + "&serverName=example.com" + clientCert, true},
+		// ca without secure verifies the certificate chain only.
+		{"ca=" + caFile + clientCert, true},
+		{"keepalive=10s&timeout=5s" + clientCert, true},
+		{"secure=true&serverName=example.com" + clientCert, false},
+		{"secure=true&ca=" + caFile + "&serverName=other.com" + clientCert, false},
+		{"ca=" + clientCAFile + clientCert, false},
+		{"secure=true&ca=" + caFile + "&serverName=example.com", false},
+	} {
+		nodes, err := parseChainNode(fmt.Sprintf("quic://%s?%s", addr, tc.params), nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.params, err)
+		}
+		if err := quicNodeEcho(nodes[0]); (err == nil) != tc.ok {
+			t.Errorf("%s: ok should be %v, got %v", tc.params, tc.ok, err)
+		}
+	}
+}
+
+func TestQUICNodeTimeout(t *testing.T) {
+	// the server never answers the handshake.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	for _, params := range []string{"timeout=300ms", "timeout=1m&handshakeTimeout=300ms"} {
+		nodes, err := parseChainNode(fmt.Sprintf("quic://%s?%s", pc.LocalAddr(), params), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		if err := quicNodeEcho(nodes[0]); err == nil {
+			t.Fatalf("%s: handshake should time out", params)
+		}
+		if d := time.Since(start); d > 2*time.Second {
+			t.Errorf("%s: handshake should time out in 300ms, took %s", params, d)
+		}
+	}
+}
+
+// quicNodeEcho checks the echo of a stream to the QUIC chain node.
+func quicNodeEcho(node gost.Node) error {
+	conn, err := node.Client.Dial(node.Addr, node.DialOptions...)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	cc, err := node.Client.Handshake(conn, node.HandshakeOptions...)
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+
+	cc.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err := cc.Write([]byte("ping")); err != nil {
+		return err
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(cc, b); err != nil {
+		return err
+	}
+	if string(b) != "ping" {
+		return fmt.Errorf("unexpected echo %q", b)
+	}
+	return nil
+}
+
+func TestRelayOptionsRejected(t *testing.T) {
+	r := route{ServeNodes: stringList{"dns://127.0.0.1:0?idleTimeout=10s"}}
+	if _, err := r.GenRouters(&baseConfig{}); err == nil || !strings.Contains(err.Error(), "idleTimeout") {
+		t.Errorf("idleTimeout on the dns node should be rejected, got %v", err)
+	}
+
+	// the anti-replay nonce is sent in the extension frame, which a stock relay server rejects.
+	if _, err := parseChainNode("relay://127.0.0.1:8421?relayAntiReplay=true", nil); err == nil || !strings.Contains(err.Error(), "relayExt") {
+		t.Errorf("relayAntiReplay without relayExt should be rejected, got %v", err)
+	}
+	if _, err := parseChainNode("relay://127.0.0.1:8421?relayAntiReplay=true&relayExt=true", nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestProbeFirstHop(t *testing.T) {
+	tests := []struct {
+		chainNodes []string
+		fallback   []string
+		option     string
+	}{
+		{[]string{"relay://127.0.0.1:8421?lazyProbe=true", "relay://127.0.0.1:8422"}, nil, ""},
+		{[]string{"relay://127.0.0.1:8421", "relay://127.0.0.1:8422?lazyProbe=true"}, nil, "lazyProbe"},
+		// the first node of the fallback chain is a first hop too.
+		{[]string{"relay://127.0.0.1:8421"}, []string{"relay://127.0.0.1:8422?lazyProbe=true"}, ""},
+		{[]string{"relay://127.0.0.1:8421?recoverProbe=node", "relay://127.0.0.1:8422"}, nil, ""},
+		{[]string{"relay://127.0.0.1:8421", "relay://127.0.0.1:8422?recoverProbe=node"}, nil, "recoverProbe"},
+	}
+	for i, tc := range tests {
+		r := route{ChainNodes: tc.chainNodes, FallbackChain: tc.fallback}
+		_, err := r.parseChain(nil)
+		if tc.option == "" {
+			if err != nil {
+				t.Errorf("#%d: %v", i, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.option) {
+			t.Errorf("#%d: %s on the second hop should be rejected, got %v", i, tc.option, err)
+		}
+	}
+
+	// the direct forwarder dials the targets through the chain, which the recovery probe bypasses.
+	r := route{
+		ServeNodes: stringList{"tcp://127.0.0.1:0/127.0.0.1:80,127.0.0.1:81?recoverProbe=node"},
+		ChainNodes: stringList{"relay://127.0.0.1:8421"},
+	}
+	if _, err := r.GenRouters(&baseConfig{}); err == nil || !strings.Contains(err.Error(), "recoverProbe") {
+		t.Errorf("recoverProbe on the forwarder with the chain should be rejected, got %v", err)
+	}
+	r.ChainNodes = nil
+	rts, err := r.GenRouters(&baseConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range rts {
+		rts[i].Close()
+	}
+
+	// the peer nodes are in the group of the peer node.
+	peerFile := filepath.Join(t.TempDir(), "peer")
+	if err := os.WriteFile(peerFile, []byte("recover_probe node\npeer relay://127.0.0.1:8423\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	r = route{ChainNodes: stringList{"relay://127.0.0.1:8421", "relay://127.0.0.1:8422?peer=" + peerFile}}
+	if _, err := r.parseChain(newReloaders()); err == nil || !strings.Contains(err.Error(), "recover_probe") {
+		t.Errorf("recover_probe of the peer on the second hop should be rejected, got %v", err)
+	}
+}
+
+func TestProxyProtocolFrom(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		err   string
+	}{
+		{"acceptProxyProtocol=true", ""},
+		{"acceptProxyProtocol=true&proxyProtocolFrom=10.0.0.0/8&peerAllow=192.168.0.0/16", ""},
+		// peerAllow checks the source in the header, which any client could send.
+		{"acceptProxyProtocol=true&peerAllow=192.168.0.0/16", "proxyProtocolFrom"},
+		{"acceptProxyProtocol=true&proxyProtocolFrom=cert:lb.example.com", "proxyProtocolFrom"},
+		{"acceptProxyProtocol=true&proxyProtocolFrom=lb", "proxyProtocolFrom"},
+	} {
+		r := route{ServeNodes: stringList{"tcp://127.0.0.1:0/127.0.0.1:80?" + tc.query}}
+		rts, err := r.GenRouters(&baseConfig{})
+		for i := range rts {
+			rts[i].Close()
+		}
+		if tc.err == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tc.query, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: should be rejected with %s, got %v", tc.query, tc.err, err)
+		}
+	}
+}
+
+func TestRouterDSCP(t *testing.T) {
+	// the listener rebound by the sourceInterface watcher takes the DSCP parsed at setup.
+	r := route{ServeNodes: stringList{"tcp://127.0.0.1:0/127.0.0.1:80?dscp=46"}}
+	rts, err := r.GenRouters(&baseConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rts[0].Close()
+	if rts[0].dscp != 46 {
+		t.Errorf("dscp should be 46, got %d", rts[0].dscp)
+	}
+}
+
+func TestChainNodeClientCert(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	for _, ns := range []string{
+		fmt.Sprintf("tls://127.0.0.1:8443?cert=%s&key=%s", certFile, keyFile),
+		fmt.Sprintf("tls://127.0.0.1:8443?cert=%s", certFile),
+	} {
+		if _, err := parseChainNode(ns, nil); err == nil || !strings.Contains(err.Error(), "cert") {
+			t.Errorf("%s: invalid client certificate should be rejected, got %v", ns, err)
+		}
+	}
+	if _, err := parseChainNode("tls://127.0.0.1:8443", nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRouterReloaders(t *testing.T) {
+	dir := t.TempDir()
+	hostsFile := filepath.Join(dir, "hosts")
+	dnsFile := filepath.Join(dir, "dns")
+	for _, name := range []string{hostsFile, dnsFile} {
+		if err := os.WriteFile(name, []byte("reload 10s\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := route{ServeNodes: stringList{fmt.Sprintf("127.0.0.1:0?hosts=%s&dns=%s", hostsFile, dnsFile)}}
+	rts, err := r.GenRouters(&baseConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := rts[0].resolver.(gost.Stoppable)
+	if rts[0].hosts.Stopped() || resolver.Stopped() {
+		t.Fatal("the reloaders should be running")
+	}
+	rts[0].Close()
+	if !rts[0].hosts.Stopped() || !resolver.Stopped() {
+		t.Error("the reloaders should be stopped with the router")
+	}
+
+	// the shared reloaders are stopped with the last router.
+	hosts := gost.NewHosts()
+	rs := newReloaders()
+	rs.stoppables = append(rs.stoppables, hosts)
+	rs.acquire()
+	rs.release()
+	if hosts.Stopped() {
+		t.Error("the reloaders should be running until the last release")
+	}
+	rs.release()
+	if !hosts.Stopped() {
+		t.Error("the reloaders should be stopped by the last release")
+	}
+}
+
+func TestChainNodeTimeouts(t *testing.T) {
+	for _, tc := range []struct {
+		params    string
+		dial      time.Duration
+		handshake time.Duration
+	}{
+		{"", 0, 0},
+		{"timeout=5s", 5 * time.Second, 5 * time.Second},
+		{"timeout=5s&dialTimeout=2s", 2 * time.Second, 5 * time.Second},
+		{"timeout=5s&handshakeTimeout=10s", 5 * time.Second, 10 * time.Second},
+		{"timeout=5s&dialTimeout=2s&handshakeTimeout=10s", 2 * time.Second, 10 * time.Second},
+		{"dialTimeout=2s&handshakeTimeout=10s", 2 * time.Second, 10 * time.Second},
+	} {
+		nodes, err := parseChainNode("socks5+tls://127.0.0.1:1080?"+tc.params, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.params, err)
+		}
+		dopts := &gost.DialOptions{}
+		for _, opt := range nodes[0].DialOptions {
+			opt(dopts)
+		}
+		hopts := &gost.HandshakeOptions{}
+		for _, opt := range nodes[0].HandshakeOptions {
+			opt(hopts)
+		}
+		if dopts.Timeout != tc.dial || hopts.Timeout != tc.handshake {
+			t.Errorf("%q: timeouts should be dial %v, handshake %v, got %v, %v",
+				tc.params, tc.dial, tc.handshake, dopts.Timeout, hopts.Timeout)
+		}
+	}
+}
+
+// genServerCert returns the certificate of the dnsName signed by a new CA, and the CA in PEM.
+// The certificate is usable by both the server and the client.
+func genServerCert(dnsName string) (tls.Certificate, []byte, error) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gost test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: dnsName},
+		DNSNames:     []string{dnsName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caTmpl, &key.PublicKey, caKey)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), nil
+}
+
+func TestChainNodeServerName(t *testing.T) {
+	cert, caPEM, err := genServerCert("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	sni := make(chan string, 1)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			sni <- hello.ServerName
+			return &cert, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+
+	for _, tc := range []struct {
+		params string
+		sni    string
+		ok     bool
+	}{
+		// serverName takes precedence over the address and host, for both the SNI and the verification.
+		{"serverName=example.com&host=other.com", "example.com", true},
+		{"serverName=example.com", "example.com", true},
+		// host is the HTTP Host only, the address is verified without serverName.
+		{"host=example.com", "", false},
+		{"serverName=other.com", "other.com", false},
+	} {
+		nodes, err := parseChainNode(fmt.Sprintf("tls://%s?secure=true&ca=%s&%s", ln.Addr(), caFile, tc.params), nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.params, err)
+		}
+		node := nodes[0]
+		conn, err := node.Client.Dial(node.Addr, node.DialOptions...)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.params, err)
+		}
+		cc, err := node.Client.Handshake(conn, node.HandshakeOptions...)
+		if cc != nil {
+			cc.Close()
+		}
+		conn.Close()
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: ok should be %v, got %v", tc.params, tc.ok, err)
+		}
+		select {
+		case name := <-sni:
+			if name != tc.sni {
+				t.Errorf("%s: SNI should be %q, got %q", tc.params, tc.sni, name)
+			}
+		case <-time.After(3 * time.Second):
+			t.Errorf("%s: no handshake", tc.params)
+		}
+	}
+
+	// the node listening on all the interfaces defaults to localhost, unless serverName is set.
+	for params, name := range map[string]string{"": "localhost", "?serverName=example.com": "example.com"} {
+		nodes, err := parseChainNode("tls://:8443"+params, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hopts := &gost.HandshakeOptions{}
+		for _, opt := range nodes[0].HandshakeOptions {
+			opt(hopts)
+		}
+		if hopts.TLSConfig.ServerName != name {
+			t.Errorf("%q: server name should be %s, got %s", params, name, hopts.TLSConfig.ServerName)
+		}
+	}
+}
@@ -257,3 +257,37 @@ func (s *udpTestServer) Close() error {
 
 	return err
 }
+
+// closedWithin reports whether conn is closed by the peer within d, the data read is discarded.
+func closedWithin(conn net.Conn, d time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+// udpEcho sends the datagram data over conn, and checks it is echoed back.
+func udpEcho(conn net.Conn, data []byte) error {
+	conn.SetDeadline(time.Now().Add(1 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := conn.Write(data); err != nil {
+		return err
+	}
+	recv := make([]byte, len(data)+1)
+	n, err := conn.Read(recv)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(data, recv[:n]) {
+		return fmt.Errorf("data not equal")
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package gost
+
+import (
+	"fmt"
+	"strings"
+)
+
+// redactedValue replaces the secrets in the dumped config.
+const redactedValue = "xxxxx"
+
+// redactedParams are the node parameters holding secrets, matched case-insensitively.
+var redactedParams = map[string]bool{
+	"auth": true,
+	// the header values may carry the credentials, e.g. Proxy-Authorization.
+	"header":   true,
+	"password": true,
+	"passwd":   true,
+	"psk":      true,
+	"token":    true,
+}
+
+// NodeConfig is the effective config of a node, with the secrets redacted.
+type NodeConfig struct {
+	ID          int                 `json:"id"`
+	Addr        string              `json:"addr"`
+	Host        string              `json:"host,omitempty"`
+	Protocol    string              `json:"protocol"`
+	Transport   string              `json:"transport"`
+	Remote      string              `json:"remote,omitempty"`
+	User        string              `json:"user,omitempty"`
+	Params      map[string][]string `json:"params,omitempty"`
+	Connector   string              `json:"connector,omitempty"`
+	Transporter string              `json:"transporter,omitempty"`
+	PreserveSrc bool                `json:"preserveSrc,omitempty"`
+	ProxyNetns  string              `json:"proxyNetns,omitempty"`
+	Resolver    []string            `json:"resolver,omitempty"`
+	Bypass      []string            `json:"bypass,omitempty"`
+}
+
+// Config returns the effective config of the node.
+func (node *Node) Config() NodeConfig {
+	cfg := NodeConfig{
+		ID:          node.ID,
+		Addr:        node.Addr,
+		Host:        node.Host,
+		Protocol:    node.Protocol,
+		Transport:   node.Transport,
+		Remote:      node.Remote,
+		PreserveSrc: node.PreserveSrc,
+		ProxyNetns:  node.ProxyNetns,
+	}
+	if node.User != nil {
+		cfg.User = node.User.Username()
+		if _, ok := node.User.Password(); ok {
+			cfg.User += ":" + redactedValue
+		}
+	}
+	if len(node.Values) > 0 {
+		cfg.Params = make(map[string][]string, len(node.Values))
+		for k, v := range node.Values {
+			if redactedParams[strings.ToLower(k)] {
+				v = []string{redactedValue}
+			}
+			cfg.Params[k] = append([]string(nil), v...)
+		}
+	}
+	if node.Client != nil {
+		if node.Client.Connector != nil {
+			cfg.Connector = fmt.Sprintf("%T", node.Client.Connector)
+		}
+		if node.Client.Transporter != nil {
+			cfg.Transporter = fmt.Sprintf("%T", node.Client.Transporter)
+		}
+	}
+	if r, ok := node.Resolver.(fmt.Stringer); ok && node.Resolver != nil {
+		cfg.Resolver = configLines(r.String())
+	}
+	if node.Bypass != nil {
+		cfg.Bypass = configLines(node.Bypass.String())
+	}
+	return cfg
+}
+
+// NodeGroupConfig is the effective config of a node group.
+type NodeGroupConfig struct {
+	ID       int          `json:"id"`
+	Strategy string       `json:"strategy,omitempty"`
+	Filters  []string     `json:"filters,omitempty"`
+	History  int          `json:"history,omitempty"`
+	Nodes    []NodeConfig `json:"nodes"`
+}
+
+// Config returns the effective config of the group.
+func (group *NodeGroup) Config() NodeGroupConfig {
+	group.mux.RLock()
+	defer group.mux.RUnlock()
+
+	cfg := NodeGroupConfig{
+		ID:    group.ID,
+		Nodes: []NodeConfig{},
+	}
+
+	sopts := SelectOptions{}
+	for _, opt := range group.selectorOptions {
+		opt(&sopts)
+	}
+	if sopts.Strategy != nil {
+		cfg.Strategy = sopts.Strategy.String()
+	}
+	for _, f := range sopts.Filters {
+		if ff, ok := f.(*FailFilter); ok {
+			cfg.Filters = append(cfg.Filters, ff.config())
+			continue
+		}
+		cfg.Filters = append(cfg.Filters, f.String())
+	}
+	if p := sopts.LazyProbe; p != nil {
+		ttl := p.TTL
+		if ttl <= 0 {
+			ttl = DefaultProbeCacheTTL
+		}
+		cfg.Filters = append(cfg.Filters, fmt.Sprintf("lazy_probe: cache_ttl %s", ttl))
+	}
+	if group.history != nil {
+		cfg.History = len(group.history.events)
+	}
+	for i := range group.nodes {
+		cfg.Nodes = append(cfg.Nodes, group.nodes[i].Config())
+	}
+	return cfg
+}
+
+// config describes the filter with the defaults applied.
+func (f *FailFilter) config() string {
+	maxFails := f.MaxFails
+	if maxFails == 0 {
+		maxFails = DefaultMaxFails
+	}
+	failTimeout := f.FailTimeout
+	if failTimeout == 0 {
+		failTimeout = DefaultFailTimeout
+	}
+	s := fmt.Sprintf("%s: max_fails %d, fail_timeout %s", f.String(), maxFails, failTimeout)
+	if f.RecoverProbe != "" {
+		interval := f.ProbeInterval
+		if interval <= 0 {
+			interval = DefaultProbeInterval
+		}
+		s += fmt.Sprintf(", recover_probe %s, probe_interval %s", f.RecoverProbe, interval)
+	}
+	return s
+}
+
+// ChainConfig is the effective config of a chain.
+type ChainConfig struct {
+	Retries   int               `json:"retries,omitempty"`
+	Mark      int               `json:"mark,omitempty"`
+	Interface string            `json:"interface,omitempty"`
+	Groups    []NodeGroupConfig `json:"groups"`
+	Fallback  *ChainConfig      `json:"fallback,omitempty"`
+}
+
+// Config returns the effective config of the chain, nil for a nil chain.
+func (c *Chain) Config() *ChainConfig {
+	if c == nil {
+		return nil
+	}
+	cfg := &ChainConfig{
+		Retries:   c.Retries,
+		Mark:      c.Mark,
+		Interface: c.Interface,
+		Groups:    []NodeGroupConfig{},
+		Fallback:  c.Fallback.Config(),
+	}
+	for _, group := range c.nodeGroups {
+		cfg.Groups = append(cfg.Groups, group.Config())
+	}
+	return cfg
+}
+
+// configLines splits the multi-line description s, e.g. of the resolver, into non-empty lines.
+func configLines(s string) (lines []string) {
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return
+}
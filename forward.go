@@ -51,14 +51,16 @@ func (h *baseForwardHandler) Init(options ...HandlerOption) {
 	h.group.SetSelector(&defaultSelector{},
 		WithStrategy(h.options.Strategy),
 		WithFilter(&FailFilter{
-			MaxFails:    h.options.MaxFails,
-			FailTimeout: h.options.FailTimeout,
+			MaxFails:     h.options.MaxFails,
+			FailTimeout:  h.options.FailTimeout,
+			RecoverProbe: h.options.RecoverProbe,
 		}),
 	)
 
 	n := 1
 	addrs := append(strings.Split(h.raddr, ","), h.options.IPs...)
 	for _, addr := range addrs {
+		addr = strings.TrimSpace(addr)
 		if addr == "" {
 			continue
 		}
@@ -76,6 +78,27 @@ func (h *baseForwardHandler) Init(options ...HandlerOption) {
 	}
 }
 
+// retries returns the number of the dial attempts through the chain, the retry option overrides the retries of the chain.
+func (h *baseForwardHandler) retries() int {
+	if h.options.Retries <= 0 && h.options.Chain != nil && h.options.Chain.Retries > 0 {
+		return h.options.Chain.Retries
+	}
+	return h.localRetries()
+}
+
+// localRetries returns the number of the dial attempts of the targets dialed from the local host,
+// the retries of the chain do not apply as the targets are not dialed through it.
+// EMOD: with multiple targets and no explicit retries, try each target once so that a down target is skipped.
+func (h *baseForwardHandler) localRetries() int {
+	if h.options.Retries > 0 {
+		return h.options.Retries
+	}
+	if n := len(h.group.Nodes()); n > 1 {
+		return n
+	}
+	return 1
+}
+
 type tcpDirectForwardHandler struct {
 	*baseForwardHandler
 }
@@ -101,38 +124,50 @@ func TCPDirectForwardHandler(raddr string, opts ...HandlerOption) Handler {
 
 func (h *tcpDirectForwardHandler) Init(options ...HandlerOption) {
 	h.baseForwardHandler.Init(options...)
+	h.options.warnSplice("tcp")
 }
 
 func (h *tcpDirectForwardHandler) Handle(conn net.Conn) {
 	defer conn.Close()
 
 	log.Logf("[tcp] %s - %s", conn.RemoteAddr(), conn.LocalAddr())
+	access := h.options.newAccessLog("tcp", conn.RemoteAddr())
 
-	retries := 1
-	if h.options.Chain != nil && h.options.Chain.Retries > 0 {
-		retries = h.options.Chain.Retries
-	}
-	if h.options.Retries > 0 {
-		retries = h.options.Retries
-	}
+	ctx, span := startSpan(context.Background(), "tcp", h.options.SlowLog)
+	defer span.End()
+	span.SetAttr("client.address", conn.RemoteAddr().String())
+
+	retries := h.retries()
 
 	var cc net.Conn
 	var node Node
 	var err error
 	for i := 0; i < retries; i++ {
 		if len(h.group.Nodes()) > 0 {
-			node, err = h.group.Next()
+			node, err = h.group.NextFor(conn.RemoteAddr())
 			if err != nil {
 				log.Logf("[tcp] %s - %s : %s", conn.RemoteAddr(), conn.LocalAddr(), err)
 				return
 			}
 		}
 
-		cc, err = h.options.Chain.Dial(node.Addr,
+		options := []ChainOption{
 			RetryChainOption(h.options.Retries),
 			TimeoutChainOption(h.options.Timeout),
 			ResolverChainOption(h.options.Resolver),
-		)
+			BlockPrivateChainOption(h.options.BlockPrivate),
+			RandomizeSourcePortChainOption(h.options.RandomizeSourcePort),
+		}
+		options = append(options, h.options.transparentEgressOptions("tcp")...)
+		if path := unixSocketPath(node.Addr); path != "" {
+			// EMOD: the Unix socket upstream is local, it is dialed directly without the chain.
+			cc, err = dialUnixSocket(ctx, path, h.options.Timeout)
+		} else {
+			cc, err = h.options.Chain.DialContext(ctx, "tcp", node.Addr, options...)
+		}
+		if err == nil {
+			conn, cc, err = h.options.checkImmediateClose(conn, cc)
+		}
 		if err != nil {
 			log.Logf("[tcp] %s -> %s : %s", conn.RemoteAddr(), conn.LocalAddr(), err)
 			node.MarkDead()
@@ -141,6 +176,8 @@ func (h *tcpDirectForwardHandler) Handle(conn net.Conn) {
 		}
 	}
 	if err != nil {
+		h.options.Metrics.DialFailed()
+		span.SetError(err)
 		return
 	}
 
@@ -151,9 +188,35 @@ func (h *tcpDirectForwardHandler) Handle(conn net.Conn) {
 	if addr == "" {
 		addr = conn.LocalAddr().String()
 	}
+	access.setTarget(addr, cc)
+	if err := h.options.sendProxyProtocol(cc, conn.RemoteAddr(), conn.LocalAddr()); err != nil {
+		log.Logf("[tcp] %s -> %s : proxy protocol: %s", conn.RemoteAddr(), addr, err)
+		span.SetError(err)
+		return
+	}
+	cc = h.options.firstByteConn(cc, node)
+	span.SetAttr("target.address", addr)
 	log.Logf("[tcp] %s <-> %s", conn.RemoteAddr(), addr)
-	transport(conn, cc)
+	h.options.transport(access.countConn(conn), cc)
+	span.AddEvent("close")
 	log.Logf("[tcp] %s >-< %s", conn.RemoteAddr(), addr)
+	access.Log()
+}
+
+// unixSocketPath returns the socket path if addr is a Unix socket address in the form of unix:/path/to.sock.
+func unixSocketPath(addr string) string {
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		return path
+	}
+	return ""
+}
+
+func dialUnixSocket(ctx context.Context, path string, timeout time.Duration) (net.Conn, error) {
+	if timeout <= 0 {
+		timeout = DialTimeout
+	}
+	d := &net.Dialer{Timeout: timeout}
+	return d.DialContext(ctx, "unix", path)
 }
 
 type udpDirectForwardHandler struct {
@@ -191,18 +254,24 @@ func (h *udpDirectForwardHandler) Handle(conn net.Conn) {
 	var node Node
 	var err error
 	if len(h.group.Nodes()) > 0 {
-		node, err = h.group.Next()
+		node, err = h.group.NextFor(conn.RemoteAddr())
 		if err != nil {
 			log.Logf("[udp] %s - %s : %s", conn.RemoteAddr(), conn.LocalAddr(), err)
 			return
 		}
 	}
 
+	options := []ChainOption{
+		ResolverChainOption(h.options.Resolver),
+		BlockPrivateChainOption(h.options.BlockPrivate),
+		RandomizeSourcePortChainOption(h.options.RandomizeSourcePort),
+	}
+	options = append(options, h.options.transparentEgressOptions("udp")...)
 	cc, err := h.options.Chain.DialContext(
 		context.Background(),
 		"udp",
 		node.Addr,
-		ResolverChainOption(h.options.Resolver),
+		options...,
 	)
 	if err != nil {
 		node.MarkDead()
@@ -217,7 +286,7 @@ func (h *udpDirectForwardHandler) Handle(conn net.Conn) {
 		addr = conn.LocalAddr().String()
 	}
 	log.Logf("[udp] %s <-> %s", conn.RemoteAddr(), addr)
-	transport(conn, cc)
+	h.options.transport(h.options.sizeUDPConn(conn), h.options.sizeUDPConn(cc))
 	log.Logf("[udp] %s >-< %s", conn.RemoteAddr(), addr)
 }
 
@@ -251,17 +320,15 @@ func (h *tcpRemoteForwardHandler) Init(options ...HandlerOption) {
 func (h *tcpRemoteForwardHandler) Handle(conn net.Conn) {
 	defer conn.Close()
 
-	retries := 1
-	if h.options.Retries > 0 {
-		retries = h.options.Retries
-	}
+	// the chain carries the remote listener, the targets are dialed from the local host.
+	retries := h.localRetries()
 
 	var cc net.Conn
 	var node Node
 	var err error
 	for i := 0; i < retries; i++ {
 		if len(h.group.Nodes()) > 0 {
-			node, err = h.group.Next()
+			node, err = h.group.NextFor(conn.RemoteAddr())
 			if err != nil {
 				log.Logf("[rtcp] %s - %s : %s", conn.LocalAddr(), h.raddr, err)
 				return
@@ -283,7 +350,7 @@ func (h *tcpRemoteForwardHandler) Handle(conn net.Conn) {
 	node.ResetDead()
 
 	log.Logf("[rtcp] %s <-> %s", conn.LocalAddr(), node.Addr)
-	transport(cc, conn)
+	h.options.transport(conn, cc)
 	log.Logf("[rtcp] %s >-< %s", conn.LocalAddr(), node.Addr)
 }
 
@@ -320,7 +387,7 @@ func (h *udpRemoteForwardHandler) Handle(conn net.Conn) {
 	var node Node
 	var err error
 	if len(h.group.Nodes()) > 0 {
-		node, err = h.group.Next()
+		node, err = h.group.NextFor(conn.RemoteAddr())
 		if err != nil {
 			log.Logf("[rudp] %s - %s : %s", conn.RemoteAddr(), h.raddr, err)
 			return
@@ -343,7 +410,7 @@ func (h *udpRemoteForwardHandler) Handle(conn net.Conn) {
 	node.ResetDead()
 
 	log.Logf("[rudp] %s <-> %s", conn.RemoteAddr(), node.Addr)
-	transport(conn, cc)
+	h.options.transport(h.options.sizeUDPConn(conn), h.options.sizeUDPConn(cc))
 	log.Logf("[rudp] %s >-< %s", conn.RemoteAddr(), node.Addr)
 }
 
@@ -687,11 +754,17 @@ func (l *udpRemoteForwardListener) listenLoop() {
 
 				uc, ok := l.connMap.Get(raddr.String())
 				if !ok {
+					if l.config.sessionsFull(l.connMap.Size()) {
+						log.Logf("[rudp] %s - %s: session table is full (%d)", raddr, l.Addr(), l.connMap.Size())
+						continue
+					}
 					uc = newUDPServerConn(conn, raddr, &udpServerConnConfig{
 						ttl:   l.config.TTL,
 						qsize: l.config.QueueSize,
 						onClose: func() {
-							l.connMap.Delete(raddr.String())
+							if l.connMap.Delete(raddr.String()) {
+								l.config.Metrics.addUDPSessions(-1)
+							}
 							log.Logf("[rudp] %s closed (%d)", raddr, l.connMap.Size())
 						},
 					})
@@ -699,6 +772,7 @@ func (l *udpRemoteForwardListener) listenLoop() {
 					select {
 					case l.connChan <- uc:
 						l.connMap.Set(raddr.String(), uc)
+						l.config.Metrics.addUDPSessions(1)
 						log.Logf("[rudp] %s -> %s (%d)", raddr, l.Addr(), l.connMap.Size())
 					default:
 						uc.Close()
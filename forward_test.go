@@ -2,9 +2,15 @@ package gost
 
 import (
 	"crypto/rand"
+	"io"
+	"net"
 	"net/http/httptest"
 	"net/url"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func tcpDirectForwardRoundtrip(targetURL string, data []byte) error {
@@ -315,3 +321,847 @@ func TestUDPRemoteForward(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+// idServer accepts connections and writes the id then closes.
+func idServer(id byte) (net.Listener, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte{id})
+			conn.Close()
+		}
+	}()
+	return ln, nil
+}
+
+func readID(addr string) (byte, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	b := make([]byte, 1)
+	if _, err := conn.Read(b); err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func TestForwardHandlerRetries(t *testing.T) {
+	chain := func(retries int) *Chain {
+		c := NewChain()
+		c.Retries = retries
+		return c
+	}
+	// the rtcp targets are dialed from the local host, not through the chain.
+	for _, tc := range []struct {
+		raddr   string
+		opts    []HandlerOption
+		retries int
+		remote  int
+	}{
+		{"a:1", nil, 1, 1},
+		{"a:1,b:1,c:1", nil, 3, 3},
+		{"a:1,b:1,c:1", []HandlerOption{RetryHandlerOption(2)}, 2, 2},
+		{"a:1,b:1,c:1", []HandlerOption{ChainHandlerOption(chain(1))}, 1, 3},
+		{"a:1,b:1,c:1", []HandlerOption{ChainHandlerOption(chain(0))}, 3, 3},
+		{"a:1", []HandlerOption{ChainHandlerOption(chain(4))}, 4, 1},
+		{"a:1", []HandlerOption{ChainHandlerOption(chain(4)), RetryHandlerOption(2)}, 2, 2},
+	} {
+		direct := TCPDirectForwardHandler(tc.raddr).(*tcpDirectForwardHandler)
+		direct.Init(tc.opts...)
+		if retries := direct.retries(); retries != tc.retries {
+			t.Errorf("tcp %s: retries should be %d, got %d", tc.raddr, tc.retries, retries)
+		}
+		remote := TCPRemoteForwardHandler(tc.raddr).(*tcpRemoteForwardHandler)
+		remote.Init(tc.opts...)
+		if retries := remote.localRetries(); retries != tc.remote {
+			t.Errorf("rtcp %s: retries should be %d, got %d", tc.raddr, tc.remote, retries)
+		}
+	}
+}
+
+func TestTCPDirectForwardMultiTargets(t *testing.T) {
+	var targets []string
+	var lns []net.Listener
+	for _, id := range []byte("abc") {
+		ln, err := idServer(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		lns = append(lns, ln)
+		targets = append(targets, ln.Addr().String())
+	}
+
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := TCPDirectForwardHandler(strings.Join(targets, ", "))
+	h.Init(StrategyHandlerOption(NewStrategy("round")))
+	server := &Server{Listener: ln, Handler: h}
+	go server.Run()
+	defer server.Close()
+
+	counts := map[byte]int{}
+	for i := 0; i < 6; i++ {
+		id, err := readID(ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[id]++
+	}
+	for _, id := range []byte("abc") {
+		if counts[id] != 2 {
+			t.Errorf("target %c should get 2 connections, got %d", id, counts[id])
+		}
+	}
+
+	// target b is down
+	lns[1].Close()
+	for i := 0; i < 6; i++ {
+		id, err := readID(ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id == 'b' {
+			t.Error("down target should be skipped")
+		}
+	}
+}
+
+func TestTCPRemoteForwardMultiTargets(t *testing.T) {
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down.Close()
+	target, err := idServer('b')
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := TCPRemoteForwardHandler(down.Addr().String() + "," + target.Addr().String())
+	h.Init(StrategyHandlerOption(NewStrategy("fifo")))
+	server := &Server{Listener: ln, Handler: h}
+	go server.Run()
+	defer server.Close()
+
+	for i := 0; i < 2; i++ {
+		id, err := readID(ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != 'b' {
+			t.Errorf("down target should be skipped, got %c", id)
+		}
+	}
+}
+
+func TestTCPDirectForwardUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "echo.sock")
+	uln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uln.Close()
+	go func() {
+		for {
+			conn, err := uln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := TCPDirectForwardHandler("unix:" + path)
+	h.Init()
+	server := &Server{Listener: ln, Handler: h}
+	go server.Run()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+
+	data := []byte("hello, unix socket")
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != string(data) {
+		t.Errorf("got %q, want %q", b, data)
+	}
+}
+
+// countEchoServer echoes the data of the first connection, and sends the number of bytes received once it is closed.
+func countEchoServer(t *testing.T) (net.Listener, <-chan int64) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan int64, 1)
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var n int64
+		b := make([]byte, 64)
+		for {
+			nr, err := conn.Read(b)
+			n += int64(nr)
+			if err != nil {
+				break
+			}
+			conn.Write(b[:nr])
+		}
+		received <- n
+	}()
+	return target, received
+}
+
+// testMaxBytes checks the transfer cap of 10 bytes on conn relayed to the countEchoServer.
+func testMaxBytes(t *testing.T, conn net.Conn, received <-chan int64) {
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+
+	// 4 bytes out and 4 bytes back.
+	conn.Write([]byte("abcd"))
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+
+	// only 2 of them fit in the remaining cap, then the connection is closed.
+	conn.Write([]byte("efgh"))
+	io.ReadAll(conn)
+	select {
+	case n := <-received:
+		if n != 6 {
+			t.Errorf("target should receive 6 bytes, got %d", n)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("upstream connection should be closed")
+	}
+}
+
+func TestTCPDirectForwardMaxBytes(t *testing.T) {
+	target, received := countEchoServer(t)
+	defer target.Close()
+
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := TCPDirectForwardHandler(target.Addr().String())
+	h.Init(MaxBytesHandlerOption(10))
+	server := &Server{Listener: ln, Handler: h}
+	go server.Run()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+
+	// 4 bytes out and 4 bytes back.
+	conn.Write([]byte("abcd"))
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+
+	// only 2 of them fit in the remaining cap, then the connection is closed.
+	conn.Write([]byte("efgh"))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case n := <-received:
+		if n != 6 {
+			t.Errorf("target should receive 6 bytes, got %d", n)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("upstream connection should be closed")
+	}
+}
+
+// tcpRemoteForwardConn connects to the remote forward server forwarding to target with the handler options.
+func tcpRemoteForwardConn(t *testing.T, target string, opts ...HandlerOption) net.Conn {
+	ln, err := TCPRemoteForwardListener("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := TCPRemoteForwardHandler(target)
+	h.Init(opts...)
+	server := &Server{Listener: ln, Handler: h}
+	go server.Run()
+	t.Cleanup(func() { server.Close() })
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestTCPRemoteForwardMaxBytes(t *testing.T) {
+	target, received := countEchoServer(t)
+	defer target.Close()
+
+	testMaxBytes(t, tcpRemoteForwardConn(t, target.Addr().String(), MaxBytesHandlerOption(10)), received)
+}
+
+type halfCloseResult struct {
+	data    string
+	elapsed time.Duration
+}
+
+// halfCloseServer writes "hi" to the first connection and half-closes it, then sends the data
+// read until the connection is closed, and the time it is closed after the half-close.
+func halfCloseServer(t *testing.T) (net.Listener, <-chan halfCloseResult) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resc := make(chan halfCloseResult, 1)
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// half-close after the response, but keep reading.
+		conn.Write([]byte("hi"))
+		start := time.Now()
+		conn.(*net.TCPConn).CloseWrite()
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		b, _ := io.ReadAll(conn)
+		resc <- halfCloseResult{string(b), time.Since(start)}
+	}()
+	return target, resc
+}
+
+// testCloseOnEOF checks the client conn can still send in the grace period after the upstream half-closes.
+func testCloseOnEOF(t *testing.T, conn net.Conn, resc <-chan halfCloseResult, grace time.Duration) {
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "hi" {
+		t.Fatalf("unexpected response %q: %v", b, err)
+	}
+	conn.Write([]byte("bye"))
+
+	res := <-resc
+	if res.data != "bye" {
+		t.Errorf("upstream should receive %q, got %q", "bye", res.data)
+	}
+	if res.elapsed < grace/2 || res.elapsed > 2*time.Second {
+		t.Errorf("connection should be closed after the grace period %s, got %s", grace, res.elapsed)
+	}
+}
+
+func TestTCPRemoteForwardCloseOnEOF(t *testing.T) {
+	target, resc := halfCloseServer(t)
+	defer target.Close()
+
+	grace := 300 * time.Millisecond
+	conn := tcpRemoteForwardConn(t, target.Addr().String(), CloseOnEOFHandlerOption(true, grace))
+	testCloseOnEOF(t, conn, resc, grace)
+}
+
+func TestTCPDirectForwardCloseOnEOF(t *testing.T) {
+	target, resc := halfCloseServer(t)
+	defer target.Close()
+
+	grace := 300 * time.Millisecond
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := TCPDirectForwardHandler(target.Addr().String())
+	h.Init(CloseOnEOFHandlerOption(true, grace))
+	server := &Server{Listener: ln, Handler: h}
+	go server.Run()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+
+	// the EOF is propagated to the client.
+	b, err := io.ReadAll(conn)
+	if err != nil || string(b) != "hi" {
+		t.Fatalf("unexpected response %q: %v", b, err)
+	}
+	// the client can still send in the grace period.
+	conn.Write([]byte("bye"))
+
+	res := <-resc
+	if res.data != "bye" {
+		t.Errorf("upstream should receive %q, got %q", "bye", res.data)
+	}
+	if res.elapsed < grace/2 || res.elapsed > 2*time.Second {
+		t.Errorf("connection should be closed after the grace period %s, got %s", grace, res.elapsed)
+	}
+}
+
+// closeServer accepts the connections and closes them, immediately or after reading the request if wait is true.
+func closeServer(wait bool) (net.Listener, *int32, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	var n int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&n, 1)
+			if wait {
+				conn.Read(make([]byte, 64))
+			}
+			conn.Close()
+		}
+	}()
+	return ln, &n, nil
+}
+
+func TestTCPDirectForwardRetryOnImmediateClose(t *testing.T) {
+	closing, _, err := closeServer(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closing.Close()
+	target, err := idServer('b')
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := TCPDirectForwardHandler(closing.Addr().String() + "," + target.Addr().String())
+	h.Init(
+		StrategyHandlerOption(NewStrategy("fifo")),
+		RetryOnImmediateCloseHandlerOption(500*time.Millisecond),
+	)
+	server := &Server{Listener: ln, Handler: h}
+	go server.Run()
+	defer server.Close()
+
+	id, err := readID(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 'b' {
+		t.Errorf("immediately closed upstream should fail over to the next, got %c", id)
+	}
+}
+
+func TestTCPDirectForwardRetryOnImmediateCloseEmptyResponse(t *testing.T) {
+	// the upstream closes with an empty response to the request.
+	empty, _, err := closeServer(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer empty.Close()
+	next, accepted, err := closeServer(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer next.Close()
+
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := TCPDirectForwardHandler(empty.Addr().String() + "," + next.Addr().String())
+	h.Init(
+		StrategyHandlerOption(NewStrategy("fifo")),
+		RetryOnImmediateCloseHandlerOption(50*time.Millisecond),
+	)
+	server := &Server{Listener: ln, Handler: h}
+	go server.Run()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the empty response, got %d, %v", n, err)
+	}
+	if n := atomic.LoadInt32(accepted); n != 0 {
+		t.Errorf("empty response should not be retried, the next upstream got %d connections", n)
+	}
+}
+
+func TestTCPDirectForwardRetryOnImmediateCloseClientFirst(t *testing.T) {
+	target, _ := countEchoServer(t)
+	defer target.Close()
+
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := TCPDirectForwardHandler(target.Addr().String())
+	h.Init(RetryOnImmediateCloseHandlerOption(3 * time.Second))
+	server := &Server{Listener: ln, Handler: h}
+	go server.Run()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+
+	// the client data ends the wait for the upstream, instead of the window.
+	start := time.Now()
+	conn.Write([]byte("ping"))
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "ping" {
+		t.Errorf("got %q, want ping", b)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("client data should end the wait, echoed after %v", d)
+	}
+}
+
+// silentServer accepts the connections but never sends anything.
+func silentServer() (net.Listener, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	return ln, nil
+}
+
+// writeServer accepts connections and writes n bytes then closes.
+func writeServer(n int) (net.Listener, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write(make([]byte, n))
+			}()
+		}
+	}()
+	return ln, nil
+}
+
+// testDownloadLimit checks the download of 50KB over conn is limited to 100KB/s.
+func testDownloadLimit(t *testing.T, conn net.Conn) {
+	start := time.Now()
+	if _, err := io.ReadFull(conn, make([]byte, 50*1024)); err != nil {
+		t.Fatal(err)
+	}
+	// the first burst is free.
+	if d := time.Since(start); d < 350*time.Millisecond {
+		t.Errorf("download should be limited, took %v", d)
+	}
+}
+
+func TestTCPRemoteForwardRateLimit(t *testing.T) {
+	target, err := writeServer(50 * 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	conn := tcpRemoteForwardConn(t, target.Addr().String(), RateLimitHandlerOption(nil, NewBandwidthLimiter(100*1024)))
+	testDownloadLimit(t, conn)
+}
+
+func TestTCPRemoteForwardBandwidth(t *testing.T) {
+	target, err := writeServer(50 * 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	conn := tcpRemoteForwardConn(t, target.Addr().String(),
+		BandwidthHandlerOption(NewBandwidthLimiter(100*1024), PriorityHigh))
+	testDownloadLimit(t, conn)
+}
+
+func TestTCPDirectForwardFirstByteTimeout(t *testing.T) {
+	silent, err := silentServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	target, err := idServer('b')
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := TCPDirectForwardHandler(silent.Addr().String() + "," + target.Addr().String())
+	h.Init(
+		StrategyHandlerOption(NewStrategy("fifo")),
+		FirstByteTimeoutHandlerOption(200*time.Millisecond),
+	)
+	server := &Server{Listener: ln, Handler: h}
+	go server.Run()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	// the wait starts when the client data is sent.
+	time.Sleep(300 * time.Millisecond)
+	start := time.Now()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("silent upstream should be closed, got %d, %v", n, err)
+	}
+	if d := time.Since(start); d < 150*time.Millisecond || d > 2*time.Second {
+		t.Errorf("connection should be closed at the threshold, took %v", d)
+	}
+
+	id, err := readID(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 'b' {
+		t.Errorf("silent upstream should be marked dead and fail over, got %c", id)
+	}
+}
+
+func TestTCPDirectForwardFirstByteClientIdle(t *testing.T) {
+	// the upstream speaks only after the client, e.g. HTTP.
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	target, err := idServer('b')
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := TCPDirectForwardHandler(echo.Addr().String() + "," + target.Addr().String())
+	h.Init(
+		StrategyHandlerOption(NewStrategy("fifo")),
+		FirstByteTimeoutHandlerOption(200*time.Millisecond),
+	)
+	server := &Server{Listener: ln, Handler: h}
+	go server.Run()
+	defer server.Close()
+
+	echoAfter := func(idle time.Duration) (string, error) {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(3 * time.Second))
+		time.Sleep(idle)
+		if _, err := conn.Write([]byte("x")); err != nil {
+			return "", err
+		}
+		b := make([]byte, 1)
+		if _, err := conn.Read(b); err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+
+	// the client idle beyond the timeout neither fails the connection nor marks the upstream dead.
+	if s, err := echoAfter(500 * time.Millisecond); err != nil || s != "x" {
+		t.Fatalf("idle client should be relayed, got %q, %v", s, err)
+	}
+	if s, err := echoAfter(0); err != nil || s != "x" {
+		t.Errorf("upstream should not be marked dead, got %q, %v", s, err)
+	}
+}
+
+func TestTCPDirectForwardFirstBytePrompt(t *testing.T) {
+	target, err := idServer('a')
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := TCPDirectForwardHandler(target.Addr().String())
+	h.Init(FirstByteTimeoutHandlerOption(200 * time.Millisecond))
+	server := &Server{Listener: ln, Handler: h}
+	go server.Run()
+	defer server.Close()
+
+	for i := 0; i < 2; i++ {
+		id, err := readID(ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != 'a' {
+			t.Errorf("prompt upstream should be kept, got %c", id)
+		}
+	}
+}
+
+func TestTCPRemoteForwardIdleTimeout(t *testing.T) {
+	silent, err := silentServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	conn := tcpRemoteForwardConn(t, silent.Addr().String(), IdleTimeoutHandlerOption(300*time.Millisecond))
+	start := time.Now()
+	if !closedWithin(conn, 3*time.Second) {
+		t.Fatal("idle connection should be closed")
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("connection should be closed at the idle timeout, closed after %v", d)
+	}
+}
+
+func TestTCPDirectForwardIdleTimeout(t *testing.T) {
+	silent, err := silentServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := TCPDirectForwardHandler(silent.Addr().String())
+	h.Init(IdleTimeoutHandlerOption(300 * time.Millisecond))
+	server := &Server{Listener: ln, Handler: h}
+	go server.Run()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the data in one direction keeps the connection alive.
+	for i := 0; i < 5; i++ {
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatalf("active connection should not be closed: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	start := time.Now()
+	if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("idle connection should be closed, got %d, %v", n, err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("idle connection should be closed at the timeout, took %v", d)
+	}
+}
+
+func TestTCPRemoteForwardMetrics(t *testing.T) {
+	target, _ := countEchoServer(t)
+	defer target.Close()
+
+	rm := NewMetrics().Router("rtcp://:0", "rtcp", ":0")
+	testMetricsEcho(t, tcpRemoteForwardConn(t, target.Addr().String(), MetricsHandlerOption(rm)), rm)
+}
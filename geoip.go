@@ -0,0 +1,370 @@
+package gost
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// geoipMetadataMarker marks the start of the metadata section of the MaxMind DB file.
+var geoipMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// geoipDataSeparatorSize is the size of the zero bytes between the search tree and the data section.
+const geoipDataSeparatorSize = 16
+
+var errGeoIPInvalid = errors.New("geoip: invalid database")
+
+// GeoIP is a country database in the MaxMind DB format, such as GeoLite2-Country.mmdb.
+// The whole file is loaded into the memory, and the countries of the records are cached once decoded.
+type GeoIP struct {
+	tree       []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint
+	// cache is the country code of the data offset.
+	cache sync.Map
+}
+
+// OpenGeoIP loads the MaxMind DB country database of the path.
+func OpenGeoIP(path string) (*GeoIP, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	db, err := NewGeoIP(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return db, nil
+}
+
+// NewGeoIP creates a GeoIP from the content of the MaxMind DB file.
+func NewGeoIP(b []byte) (*GeoIP, error) {
+	i := bytes.LastIndex(b, geoipMetadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("%w: metadata not found", errGeoIPInvalid)
+	}
+	meta := b[i+len(geoipMetadataMarker):]
+	v, _, err := (&geoipDecoder{buf: meta}).decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%w: metadata: %v", errGeoIPInvalid, err)
+	}
+	m, _ := v.(map[string]interface{})
+	nodeCount, _ := m["node_count"].(uint64)
+	recordSize, _ := m["record_size"].(uint64)
+	ipVersion, _ := m["ip_version"].(uint64)
+
+	switch recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("%w: unsupported record size %d", errGeoIPInvalid, recordSize)
+	}
+	if ipVersion != 4 && ipVersion != 6 {
+		return nil, fmt.Errorf("%w: unsupported IP version %d", errGeoIPInvalid, ipVersion)
+	}
+	treeSize := nodeCount * recordSize / 4
+	if nodeCount == 0 || nodeCount > uint64(i) || treeSize+geoipDataSeparatorSize > uint64(i) {
+		return nil, fmt.Errorf("%w: node count %d", errGeoIPInvalid, nodeCount)
+	}
+
+	db := &GeoIP{
+		tree:       b[:treeSize],
+		data:       b[treeSize+geoipDataSeparatorSize : i],
+		nodeCount:  uint(nodeCount),
+		recordSize: uint(recordSize),
+		ipVersion:  uint(ipVersion),
+	}
+	if db.ipVersion == 6 {
+		// the IPv4 addresses are in the ::/96 subtree of the IPv6 database.
+		node := uint(0)
+		for n := 0; n < 96 && node < db.nodeCount; n++ {
+			node = db.record(node, 0)
+		}
+		db.ipv4Start = node
+	}
+	return db, nil
+}
+
+// record returns the left (bit is 0) or right (bit is 1) record of the node.
+func (db *GeoIP) record(node uint, bit uint) uint {
+	switch db.recordSize {
+	case 24:
+		b := db.tree[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := db.tree[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(db.tree[node*8+bit*4:]))
+	}
+}
+
+// Country returns the ISO 3166-1 country code of the ip, such as "CN".
+// The registered country is returned if the country is unknown,
+// and the empty string is returned if the ip is not found.
+func (db *GeoIP) Country(ip net.IP) (string, error) {
+	if db == nil {
+		return "", nil
+	}
+
+	node := uint(0)
+	bits := ip.To4()
+	if bits != nil {
+		if db.ipVersion == 6 {
+			node = db.ipv4Start
+		}
+	} else {
+		if bits = ip.To16(); bits == nil {
+			return "", fmt.Errorf("geoip: invalid IP %v", ip)
+		}
+		if db.ipVersion == 4 {
+			return "", nil
+		}
+	}
+
+	for i := 0; i < len(bits)*8 && node < db.nodeCount; i++ {
+		node = db.record(node, uint(bits[i/8]>>(7-i%8))&1)
+	}
+	if node <= db.nodeCount {
+		return "", nil
+	}
+
+	offset := node - db.nodeCount - geoipDataSeparatorSize
+	if v, ok := db.cache.Load(offset); ok {
+		return v.(string), nil
+	}
+	v, _, err := (&geoipDecoder{buf: db.data}).decode(offset, 0)
+	if err != nil {
+		return "", fmt.Errorf("geoip: %v: %w", ip, err)
+	}
+	country := geoipCountry(v)
+	db.cache.Store(offset, country)
+	return country, nil
+}
+
+// geoipCountry returns the country.iso_code or registered_country.iso_code of the record.
+func geoipCountry(v interface{}) string {
+	m, _ := v.(map[string]interface{})
+	for _, key := range []string{"country", "registered_country"} {
+		c, _ := m[key].(map[string]interface{})
+		if code, _ := c["iso_code"].(string); code != "" {
+			return code
+		}
+	}
+	return ""
+}
+
+// geoipDecoder decodes the data fields of the MaxMind DB format.
+// The offsets, including the pointers, are relative to the start of the buf.
+type geoipDecoder struct {
+	buf []byte
+}
+
+// geoipMaxDepth limits the nesting of the maps and arrays of the corrupt database.
+const geoipMaxDepth = 32
+
+// The data field types.
+const (
+	geoipExtended = iota
+	geoipPointer
+	geoipString
+	geoipDouble
+	geoipBytes
+	geoipUint16
+	geoipUint32
+	geoipMap
+	geoipInt32
+	geoipUint64
+	geoipUint128
+	geoipArray
+	geoipContainer
+	geoipEndMarker
+	geoipBool
+	geoipFloat
+)
+
+// bytes returns the n bytes at the offset.
+func (d *geoipDecoder) bytes(offset, n uint) ([]byte, error) {
+	if offset+n > uint(len(d.buf)) || offset+n < offset {
+		return nil, errors.New("unexpected end of data")
+	}
+	return d.buf[offset : offset+n], nil
+}
+
+// decode decodes the field at the offset, and returns the offset of the next field.
+func (d *geoipDecoder) decode(offset uint, depth int) (interface{}, uint, error) {
+	if depth > geoipMaxDepth {
+		return nil, 0, errors.New("data is too deep")
+	}
+	b, err := d.bytes(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset++
+	ctrl := b[0]
+	typ := uint(ctrl >> 5)
+
+	if typ == geoipPointer {
+		n := uint(ctrl>>3&0x3) + 1
+		b, err := d.bytes(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		var p uint
+		switch n {
+		case 1:
+			p = uint(ctrl&0x7)<<8 | uint(b[0])
+		case 2:
+			p = (uint(ctrl&0x7)<<16 | uint(b[0])<<8 | uint(b[1])) + 2048
+		case 3:
+			p = (uint(ctrl&0x7)<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336
+		default:
+			p = uint(binary.BigEndian.Uint32(b))
+		}
+		v, _, err := d.decode(p, depth+1)
+		return v, offset + n, err
+	}
+
+	if typ == geoipExtended {
+		b, err := d.bytes(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset++
+		typ = 7 + uint(b[0])
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		b, err := d.bytes(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += n
+		switch n {
+		case 1:
+			size = 29 + uint(b[0])
+		case 2:
+			size = 285 + (uint(b[0])<<8 | uint(b[1]))
+		default:
+			size = 65821 + (uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]))
+		}
+	}
+
+	switch typ {
+	case geoipMap:
+		m := make(map[string]interface{})
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			if m[key], offset, err = d.decode(next, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, offset, nil
+	case geoipArray:
+		var a []interface{}
+		for i := uint(0); i < size; i++ {
+			v, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			offset = next
+		}
+		return a, offset, nil
+	case geoipBool:
+		return size != 0, offset, nil
+	}
+
+	b, err = d.bytes(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += size
+
+	switch typ {
+	case geoipString:
+		return string(b), offset, nil
+	case geoipBytes, geoipUint128:
+		return b, offset, nil
+	case geoipDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("invalid double size %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case geoipFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("invalid float size %d", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case geoipUint16, geoipUint32, geoipUint64:
+		if size > 8 {
+			return nil, 0, fmt.Errorf("invalid unsigned integer size %d", size)
+		}
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, offset, nil
+	case geoipInt32:
+		if size > 4 {
+			return nil, 0, fmt.Errorf("invalid int32 size %d", size)
+		}
+		var n uint32
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+		return int64(int32(n << (32 - 8*size) >> (32 - 8*size))), offset, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported data type %d", typ)
+	}
+}
+
+type geoipMatcher struct {
+	db      *GeoIP
+	country string
+}
+
+// GeoIPMatcher creates a Matcher for the IP addresses located in the country of the ISO code, such as "CN".
+// The domain names are not resolved and never match.
+func GeoIPMatcher(db *GeoIP, country string) Matcher {
+	return &geoipMatcher{
+		db:      db,
+		country: strings.ToUpper(country),
+	}
+}
+
+func (m *geoipMatcher) Match(ip string) bool {
+	if m == nil || m.db == nil {
+		return false
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	country, err := m.db.Country(addr)
+	return err == nil && country == m.country
+}
+
+func (m *geoipMatcher) String() string {
+	return "geoip " + m.country
+}
@@ -0,0 +1,237 @@
+package gost
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// mmdbString encodes the string field of the MaxMind DB format, the strings are shorter than 29 bytes.
+func mmdbString(s string) []byte {
+	return append([]byte{byte(geoipString<<5 | len(s))}, s...)
+}
+
+func mmdbUint16(n uint16) []byte {
+	return []byte{geoipUint16<<5 | 2, byte(n >> 8), byte(n)}
+}
+
+func mmdbUint32(n uint32) []byte {
+	b := []byte{geoipUint32<<5 | 4, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[1:], n)
+	return b
+}
+
+// mmdbMap encodes the map field of the key value pairs.
+func mmdbMap(kvs ...[]byte) []byte {
+	b := []byte{byte(geoipMap<<5 | len(kvs)/2)}
+	for _, kv := range kvs {
+		b = append(b, kv...)
+	}
+	return b
+}
+
+// mmdbCountry encodes the record of the country.
+func mmdbCountry(key, code string) []byte {
+	return mmdbMap(mmdbString(key), mmdbMap(mmdbString("iso_code"), mmdbString(code)))
+}
+
+// buildMMDB builds the MaxMind DB of the ipVersion and recordSize, mapping the CIDRs to the data offsets.
+func buildMMDB(t *testing.T, ipVersion, recordSize int, data []byte, nets map[string]int) []byte {
+	// nodes[i] is the left and right records of node i, -2 is not found, -3-offset is the data of the offset.
+	nodes := [][2]int{{-2, -2}}
+	for cidr, offset := range nets {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip := n.IP
+		ones, _ := n.Mask.Size()
+		if len(ip) == net.IPv6len && ipVersion == 4 {
+			continue
+		}
+		if len(ip) == net.IPv4len && ipVersion == 6 {
+			// the IPv4 addresses are in ::/96.
+			ip = append(make(net.IP, 12), ip...)
+			ones += 96
+		}
+		node := 0
+		for i := 0; i < ones; i++ {
+			bit := int(ip[i/8]>>(7-i%8)) & 1
+			if i == ones-1 {
+				nodes[node][bit] = -3 - offset
+				break
+			}
+			if nodes[node][bit] < 0 {
+				nodes = append(nodes, [2]int{-2, -2})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+	}
+
+	count := len(nodes)
+	var tree []byte
+	for _, node := range nodes {
+		var recs [2]uint32
+		for i, r := range node {
+			switch {
+			case r == -2:
+				recs[i] = uint32(count)
+			case r <= -3:
+				recs[i] = uint32(count + geoipDataSeparatorSize + (-3 - r))
+			default:
+				recs[i] = uint32(r)
+			}
+		}
+		switch recordSize {
+		case 24:
+			tree = append(tree, byte(recs[0]>>16), byte(recs[0]>>8), byte(recs[0]),
+				byte(recs[1]>>16), byte(recs[1]>>8), byte(recs[1]))
+		case 28:
+			tree = append(tree, byte(recs[0]>>16), byte(recs[0]>>8), byte(recs[0]),
+				byte(recs[0]>>20&0xf0|recs[1]>>24&0x0f),
+				byte(recs[1]>>16), byte(recs[1]>>8), byte(recs[1]))
+		default:
+			tree = binary.BigEndian.AppendUint32(tree, recs[0])
+			tree = binary.BigEndian.AppendUint32(tree, recs[1])
+		}
+	}
+
+	b := &bytes.Buffer{}
+	b.Write(tree)
+	b.Write(make([]byte, geoipDataSeparatorSize))
+	b.Write(data)
+	b.Write(geoipMetadataMarker)
+	b.Write(mmdbMap(
+		mmdbString("node_count"), mmdbUint32(uint32(count)),
+		mmdbString("record_size"), mmdbUint16(uint16(recordSize)),
+		mmdbString("ip_version"), mmdbUint16(uint16(ipVersion)),
+		mmdbString("database_type"), mmdbString("GeoLite2-Country"),
+	))
+	return b.Bytes()
+}
+
+func TestGeoIPCountry(t *testing.T) {
+	cn := mmdbCountry("country", "CN")
+	us := mmdbCountry("registered_country", "US")
+	// the JP record is a pointer to the country map of the CN record.
+	jp := mmdbMap(mmdbString("continent"), mmdbString("AS"), mmdbString("country"), []byte{geoipPointer << 5, byte(len(mmdbString("country")) + 1)})
+	data := append(append(append([]byte{}, cn...), us...), jp...)
+	nets := map[string]int{
+		"1.0.1.0/24":     0,
+		"8.8.0.0/16":     len(cn),
+		"36.0.0.0/8":     len(cn) + len(us),
+		"2400:da00::/32": 0,
+	}
+
+	tests := []struct {
+		ip      string
+		country string
+	}{
+		{"1.0.1.1", "CN"},
+		{"1.0.2.1", ""},
+		{"8.8.8.8", "US"},
+		{"36.1.2.3", "CN"},
+		{"2400:da00::1", "CN"},
+		{"2400:db00::1", ""},
+	}
+
+	for _, ipVersion := range []int{4, 6} {
+		for _, recordSize := range []int{24, 28, 32} {
+			db, err := NewGeoIP(buildMMDB(t, ipVersion, recordSize, data, nets))
+			if err != nil {
+				t.Fatalf("v%d/%d: %v", ipVersion, recordSize, err)
+			}
+			for _, tc := range tests {
+				want := tc.country
+				if ipVersion == 4 && strings.Contains(tc.ip, ":") {
+					want = ""
+				}
+				for i := 0; i < 2; i++ { // the second lookup is cached
+					country, err := db.Country(net.ParseIP(tc.ip))
+					if err != nil || country != want {
+						t.Errorf("v%d/%d %s: got %q, %v, want %q", ipVersion, recordSize, tc.ip, country, err, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestGeoIPInvalid(t *testing.T) {
+	if _, err := NewGeoIP([]byte("not a database")); err == nil {
+		t.Error("want error for the missing metadata")
+	}
+
+	// the tree is cut off.
+	meta := append(append([]byte{}, geoipMetadataMarker...), mmdbMap(
+		mmdbString("node_count"), mmdbUint32(1000),
+		mmdbString("record_size"), mmdbUint16(24),
+		mmdbString("ip_version"), mmdbUint16(4),
+	)...)
+	if _, err := NewGeoIP(meta); err == nil {
+		t.Error("want error for the truncated tree")
+	}
+
+	b := buildMMDB(t, 4, 24, mmdbCountry("country", "CN"), map[string]int{"1.0.0.0/8": 0})
+
+	dir := t.TempDir()
+	if _, err := OpenGeoIP(filepath.Join(dir, "missing.mmdb")); err == nil {
+		t.Error("want error for the missing file")
+	}
+	path := filepath.Join(dir, "corrupt.mmdb")
+	os.WriteFile(path, append(b[:len(b)-4:len(b)-4], "\xff\xff"...), 0644)
+	if _, err := OpenGeoIP(path); err == nil || !strings.Contains(err.Error(), path) {
+		t.Errorf("want error naming %s, got %v", path, err)
+	}
+}
+
+func TestBypassGeoIP(t *testing.T) {
+	data := append(mmdbCountry("country", "CN"), mmdbCountry("country", "HK")...)
+	db, err := NewGeoIP(buildMMDB(t, 6, 28, data, map[string]int{
+		"1.0.1.0/24": 0,
+		"1.0.2.0/24": len(mmdbCountry("country", "CN")),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bp := NewBypass(false)
+	if _, err := bp.ParseMatcher("geoip:CN"); err == nil {
+		t.Error("want error for geoip pattern without the database")
+	}
+	bp.SetGeoIP(db)
+	for _, pattern := range []string{"geoip:cn", "example.com"} {
+		m, err := bp.ParseMatcher(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bp.AddMatchers(m)
+	}
+
+	for addr, bypassed := range map[string]bool{
+		"1.0.1.1:443": true,
+		"1.0.2.1:443": false,
+		"9.9.9.9:53":  false,
+		"example.com": true,
+		"cn.com:80":   false,
+	} {
+		if bp.Contains(addr) != bypassed {
+			t.Errorf("%s: got %v, want %v", addr, !bypassed, bypassed)
+		}
+	}
+
+	if err := bp.Reload(strings.NewReader("reverse true\ngeoip:HK\n")); err != nil {
+		t.Fatal(err)
+	}
+	if bp.Contains("1.0.2.1") || !bp.Contains("1.0.1.1") {
+		t.Error("reversed geoip:HK should bypass all but the HK IPs")
+	}
+	if err := bp.Reload(strings.NewReader("geoip:\n")); err == nil {
+		t.Error("want error for geoip pattern without the country")
+	}
+}
@@ -67,6 +67,8 @@ var (
 	PingTimeout = 30 * time.Second
 	// PingRetries is the reties of ping.
 	PingRetries = 1
+	// DialParallelDelay is the delay before racing the next candidate of the parallel dialing (RFC 8305).
+	DialParallelDelay = 250 * time.Millisecond
 	// default udp node TTL in second for udp port forwarding.
 	defaultTTL       = 60 * time.Second
 	defaultBacklog   = 128
@@ -189,6 +191,42 @@ func (c *nopConn) SetWriteDeadline(t time.Time) error {
 	return &net.OpError{Op: "set", Net: "nop", Source: nil, Addr: nil, Err: errors.New("deadline not supported")}
 }
 
+// streamConn adapts a stream which is not a net.Conn (e.g. a HTTP2 stream or a SSH channel) to net.Conn,
+// so the stream can be relayed with the per-connection limits of the handler.
+type streamConn struct {
+	nopConn
+	rw    io.ReadWriter
+	laddr net.Addr
+	raddr net.Addr
+}
+
+func (c *streamConn) Read(b []byte) (n int, err error) {
+	return c.rw.Read(b)
+}
+
+func (c *streamConn) Write(b []byte) (n int, err error) {
+	return c.rw.Write(b)
+}
+
+func (c *streamConn) Close() error {
+	if cl, ok := c.rw.(io.Closer); ok {
+		return cl.Close()
+	}
+	return nil
+}
+
+func (c *streamConn) CloseWrite() error {
+	return closeWrite(c.rw)
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
 // splitLine splits a line text by white space, mainly used by config parser.
 func splitLine(line string) []string {
 	if line == "" {
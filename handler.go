@@ -3,8 +3,12 @@ package gost
 import (
 	"bufio"
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"net"
 	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-gost/gosocks4"
@@ -20,35 +24,85 @@ type Handler interface {
 
 // HandlerOptions describes the options for Handler.
 type HandlerOptions struct {
-	Addr          string
-	Chain         *Chain
-	Users         []*url.Userinfo
-	Authenticator Authenticator
-	TLSConfig     *tls.Config
-	Whitelist     *Permissions
-	Blacklist     *Permissions
-	Strategy      Strategy
-	MaxFails      int
-	FailTimeout   time.Duration
-	Bypass        *Bypass
-	Retries       int
-	Timeout       time.Duration
-	Resolver      Resolver
-	Hosts         *Hosts
-	ProbeResist   string
-	KnockingHost  string
-	Node          Node
-	Host          string
-	IPs           []string
-	TCPMode       bool
-	IPRoutes      []IPRoute
-	ProxyAgent    string
-	HTTPTunnel    bool
+	Addr                string
+	Chain               *Chain
+	Users               []*url.Userinfo
+	Authenticator       Authenticator
+	TLSConfig           *tls.Config
+	Whitelist           *Permissions
+	Blacklist           *Permissions
+	Strategy            Strategy
+	MaxFails            int
+	FailTimeout         time.Duration
+	RecoverProbe        string
+	BlockPrivate        bool
+	RandomizeSourcePort bool
+	Bypass              *Bypass
+	Retries             int
+	Timeout             time.Duration
+	Resolver            Resolver
+	Hosts               *Hosts
+	ProbeResist         string
+	KnockingHost        string
+	Node                Node
+	Host                string
+	IPs                 []string
+	TCPMode             bool
+	TunBatch            int
+	IPRoutes            []IPRoute
+	ProxyAgent          string
+	HTTPTunnel          bool
 	// EMOD:
 	// 是否用原来的src ip +src port发起proxy请求。
-	PreserveSrc  bool
+	PreserveSrc bool
 	// 发起Proxy连接时需要使用的netns。
-	ProxyNetns   string
+	ProxyNetns string
+	// 要求relay客户端携带nonce和时间戳，拒绝过期或重放的握手。
+	RelayAntiReplay bool
+	// 单个连接双向传输的总字节数上限，达到后关闭连接。
+	MaxBytes int64
+	// 一个方向EOF后关闭整个连接，关闭前向另一端传递半关闭，并最多等待CloseOnEOFGrace。
+	CloseOnEOF      bool
+	CloseOnEOFGrace time.Duration
+	// 空闲时发送保活：relay UDP模式发送空帧，TCP流只启用TCP keepalive探测，不注入数据。
+	AppKeepalive time.Duration
+	// UDP数据报的最大长度，超过时按UDPOversize处理（drop、truncate或frag）。
+	UDPMaxSize  int
+	UDPOversize string
+	// 只记录建立或持续时间超过该阈值的慢连接。
+	SlowLog time.Duration
+	// 所有连接共享的带宽上限，达到上限时高优先级（Priority为high）的连接优先调度。
+	Bandwidth *BandwidthLimiter
+	Priority  string
+	// sni转发时将ClientHello中的SNI改写为SNIRewrite，没有SNI时若SNIRewriteInsert为真则插入。
+	SNIRewrite       string
+	SNIRewriteInsert bool
+	// relay转发时携带的租户ID的来源：user为认证的用户名，static:<id>为固定值，为空时沿用下游relay头部中的租户ID。
+	Tenant string
+	// 上游在该时间窗口内未发送任何数据即关闭时视为失败，换下一个节点重试。
+	RetryOnImmediateClose time.Duration
+	// 连接上游后等待其第一个字节的最长时间，超时则关闭连接并将节点标记为失败，后续连接转移到其他节点。
+	FirstByteTimeout time.Duration
+	// 路由器的指标，统计转发的字节数和上游连接失败次数。
+	Metrics *RouterMetrics
+	// 出站连接设置IP_TRANSPARENT，非空时使用该地址作为源地址（未指定地址除外）。
+	TransparentEgress net.IP
+	// 已建立的连接双向都没有数据的最长时间，超时则关闭连接，0表示不限制。
+	IdleTimeout time.Duration
+	// SNI代理按SNI选择转发链，均不匹配时拒绝连接，为空时使用Chain。
+	SNIRoutes []SNIRoute
+	// 节点所有连接共享的上行（客户端到上游）和下行带宽限制。
+	RateLimitUp   *BandwidthLimiter
+	RateLimitDown *BandwidthLimiter
+	// 转发到上游时先发送PROXY protocol头部（1或2），携带客户端的源地址，0表示不发送。
+	ProxyProtocol int
+	// 从文件加载并随文件变化重新加载的白名单和黑名单，非空时替代Whitelist和Blacklist。
+	WhitelistReloader *PermissionsReloader
+	BlacklistReloader *PermissionsReloader
+	// 连接关闭时记录一条访问日志：客户端源地址、目标地址、上游节点、双向字节数和持续时间。
+	AccessLog bool
+	// TCP转发时两端都是原始TCP连接且没有逐连接的字节处理（限速、统计、访问日志等）时，用splice(2)零拷贝转发。
+	Splice bool
 }
 
 // HandlerOption allows a common way to set handler options.
@@ -113,6 +167,27 @@ func BlacklistHandlerOption(blacklist *Permissions) HandlerOption {
 	}
 }
 
+// PermissionsReloaderHandlerOption sets the whitelist and blacklist reloaded from the files,
+// they take the place of the Whitelist and Blacklist options if not nil.
+func PermissionsReloaderHandlerOption(whitelist, blacklist *PermissionsReloader) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.WhitelistReloader = whitelist
+		opts.BlacklistReloader = blacklist
+	}
+}
+
+// can tests whether the action on addr is allowed by the current whitelist and blacklist.
+func (opts *HandlerOptions) can(action string, addr string) bool {
+	whitelist, blacklist := opts.Whitelist, opts.Blacklist
+	if opts.WhitelistReloader != nil {
+		whitelist = opts.WhitelistReloader.Permissions()
+	}
+	if opts.BlacklistReloader != nil {
+		blacklist = opts.BlacklistReloader.Permissions()
+	}
+	return Can(action, addr, whitelist, blacklist)
+}
+
 // BypassHandlerOption sets the bypass option of HandlerOptions.
 func BypassHandlerOption(bypass *Bypass) HandlerOption {
 	return func(opts *HandlerOptions) {
@@ -141,6 +216,29 @@ func FailTimeoutHandlerOption(d time.Duration) HandlerOption {
 	}
 }
 
+// BlockPrivateHandlerOption rejects the destinations resolved to private addresses.
+func BlockPrivateHandlerOption(b bool) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.BlockPrivate = b
+	}
+}
+
+// RandomizeSourcePortHandlerOption draws the source port of the outbound connections
+// randomly from the ephemeral port range.
+func RandomizeSourcePortHandlerOption(b bool) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.RandomizeSourcePort = b
+	}
+}
+
+// RecoverProbeHandlerOption sets the recovery probe address for the dead nodes.
+// The probe is dialed directly, so it is only valid when the forward targets are not dialed through a chain.
+func RecoverProbeHandlerOption(probe string) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.RecoverProbe = probe
+	}
+}
+
 // RetryHandlerOption sets the retry option of HandlerOptions.
 func RetryHandlerOption(retries int) HandlerOption {
 	return func(opts *HandlerOptions) {
@@ -211,6 +309,13 @@ func TCPModeHandlerOption(b bool) HandlerOption {
 	}
 }
 
+// TunBatchHandlerOption sets the max number of packets coalesced in one tunnel write for tun tunnel.
+func TunBatchHandlerOption(n int) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.TunBatch = n
+	}
+}
+
 // IPRoutesHandlerOption sets the IP routes for tun tunnel.
 func IPRoutesHandlerOption(routes ...IPRoute) HandlerOption {
 	return func(opts *HandlerOptions) {
@@ -244,6 +349,509 @@ func ProxyNetnsHandlerOption(proxyNetns string) HandlerOption {
 	}
 }
 
+// RelayAntiReplayHandlerOption requires a fresh nonce in relay handshakes.
+func RelayAntiReplayHandlerOption(b bool) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.RelayAntiReplay = b
+	}
+}
+
+// TransparentEgressHandlerOption sets IP_TRANSPARENT on the outbound connections,
+// and binds them to the source IP src unless it is unspecified.
+func TransparentEgressHandlerOption(src net.IP) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.TransparentEgress = src
+	}
+}
+
+// transparentEgressOptions returns the chain options for the transparent egress on network.
+func (opts *HandlerOptions) transparentEgressOptions(network string) []ChainOption {
+	src := opts.TransparentEgress
+	if src == nil {
+		return nil
+	}
+	options := []ChainOption{TransparentChainOption(true)}
+	if !src.IsUnspecified() {
+		var srcAddr net.Addr = &net.TCPAddr{IP: src}
+		if strings.HasPrefix(network, "udp") {
+			srcAddr = &net.UDPAddr{IP: src}
+		}
+		options = append(options, SrcAddrChainOption(srcAddr))
+	}
+	return options
+}
+
+// preserveSrcOptions returns the chain options to dial from the client source address src if PreserveSrc is set,
+// the foreign address is bound by IP_TRANSPARENT.
+func (opts *HandlerOptions) preserveSrcOptions(src net.Addr) []ChainOption {
+	if !opts.PreserveSrc {
+		return nil
+	}
+	return []ChainOption{
+		TransparentChainOption(true),
+		SrcAddrChainOption(src),
+		NetnsChainOption(opts.ProxyNetns),
+	}
+}
+
+// SlowLogHandlerOption sets the threshold of the slow log,
+// only the connections whose setup or total duration exceeds it are logged with the timing breakdown.
+func SlowLogHandlerOption(d time.Duration) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.SlowLog = d
+	}
+}
+
+// MaxBytesHandlerOption sets the cap of the bytes transferred in both directions per connection,
+// the connection is closed once the cap is reached.
+func MaxBytesHandlerOption(n int64) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.MaxBytes = n
+	}
+}
+
+// capConn wraps conn with the transfer cap if MaxBytes is set.
+func (opts *HandlerOptions) capConn(conn net.Conn) net.Conn {
+	if opts.MaxBytes <= 0 {
+		return conn
+	}
+	return newByteCapConn(conn, opts.MaxBytes)
+}
+
+// CloseOnEOFHandlerOption closes the whole connection once one direction reaches EOF,
+// the EOF is propagated to the other side, which can still send in the grace period.
+func CloseOnEOFHandlerOption(b bool, grace time.Duration) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.CloseOnEOF = b
+		opts.CloseOnEOFGrace = grace
+	}
+}
+
+// AppKeepaliveHandlerOption sets the interval of the keepalives for the idle tunnels,
+// they are only injected where the protocol tolerates (the UDP mode of relay),
+// the TCP streams use the TCP keepalive probes instead, as they can not tolerate any injected data.
+func AppKeepaliveHandlerOption(interval time.Duration) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.AppKeepalive = interval
+	}
+}
+
+// RateLimitHandlerOption limits the upload (from the clients) and download (to the clients)
+// bandwidth of all the connections of the handler, nil means no limit.
+func RateLimitHandlerOption(up, down *BandwidthLimiter) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.RateLimitUp = up
+		opts.RateLimitDown = down
+	}
+}
+
+// ProxyProtocolHandlerOption sends the PROXY protocol header of the version (1 or 2)
+// carrying the client source to the upstream before forwarding, 0 means no header.
+func ProxyProtocolHandlerOption(version int) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.ProxyProtocol = version
+	}
+}
+
+// sendProxyProtocol writes the PROXY protocol header of the client src and the destination dst to cc if it is enabled.
+func (opts *HandlerOptions) sendProxyProtocol(cc net.Conn, src, dst net.Addr) error {
+	if opts.ProxyProtocol <= 0 {
+		return nil
+	}
+	return writeProxyProtoHeader(cc, opts.ProxyProtocol, src, dst)
+}
+
+// BandwidthHandlerOption limits the connections by the shared bandwidth limiter with the priority,
+// the high priority connections are scheduled first when the limit is reached.
+func BandwidthHandlerOption(limiter *BandwidthLimiter, priority string) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.Bandwidth = limiter
+		opts.Priority = priority
+	}
+}
+
+// SNIRewriteHandlerOption rewrites the SNI of the ClientHello forwarded by the sni handler to name,
+// the SNI is inserted if the ClientHello has none and insert is true.
+func SNIRewriteHandlerOption(name string, insert bool) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.SNIRewrite = name
+		opts.SNIRewriteInsert = insert
+	}
+}
+
+// TenantHandlerOption sets the derivation of the tenant ID carried in the relay header to the upstream,
+// TenantUser for the authenticated user name, or TenantStaticPrefix followed by a fixed ID.
+// If it is empty, only the tenant ID received from an authenticated downstream relay is kept.
+// An unauthenticated peer gets no tenant ID. The tenant ID is sent only to the relayExt upstreams.
+func TenantHandlerOption(tenant string) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.Tenant = tenant
+	}
+}
+
+// tenant derives the tenant ID of the connection from the authenticated user and the received tenant ID,
+// both of which are empty for an unauthenticated peer.
+func (opts *HandlerOptions) tenant(user, received string) string {
+	switch {
+	case opts.Tenant == TenantUser:
+		return user
+	case strings.HasPrefix(opts.Tenant, TenantStaticPrefix):
+		return strings.TrimPrefix(opts.Tenant, TenantStaticPrefix)
+	default:
+		return received
+	}
+}
+
+// ErrImmediateClose is an error that implies the upstream closed the connection before sending any data,
+// within the RetryOnImmediateClose window.
+var ErrImmediateClose = errors.New("upstream closed immediately")
+
+// RetryOnImmediateCloseHandlerOption treats the upstream closing within the window before any data as a dial failure,
+// so that the next node is tried. Nothing from the client is forwarded within the window,
+// thus a legitimate empty response to the client data is never retried.
+// The wait ends as soon as the upstream or the client sends data, so it adds up to the window of latency
+// only to the protocols in which the server speaks first, e.g. SSH or SMTP.
+func RetryOnImmediateCloseHandlerOption(window time.Duration) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.RetryOnImmediateClose = window
+	}
+}
+
+// checkImmediateClose waits up to the RetryOnImmediateClose window for the first data from the upstream cc
+// or the client conn, cc is closed and ErrImmediateClose is returned if the upstream closes before.
+// The data read ahead, if any, is kept in the returned conns, the client one is returned even on error.
+func (opts *HandlerOptions) checkImmediateClose(conn, cc net.Conn) (net.Conn, net.Conn, error) {
+	if opts.RetryOnImmediateClose <= 0 {
+		return conn, cc, nil
+	}
+
+	// the client speaking first ends the wait, the peek is left to the reads of the client conn.
+	pc, ok := conn.(*peekingConn)
+	if !ok {
+		pc = &peekingConn{Conn: conn, br: bufio.NewReader(conn), peeked: make(chan struct{})}
+		go func() {
+			defer close(pc.peeked)
+			pc.br.Peek(1)
+		}()
+	}
+
+	br := bufio.NewReader(cc)
+	cc.SetReadDeadline(time.Now().Add(opts.RetryOnImmediateClose))
+	errc := make(chan error, 1)
+	go func() {
+		_, err := br.Peek(1)
+		errc <- err
+	}()
+	var err error
+	select {
+	case err = <-errc:
+	case <-pc.peeked:
+		cc.SetReadDeadline(time.Now())
+		err = <-errc
+	}
+	cc.SetReadDeadline(time.Time{})
+
+	if ne, ok := err.(net.Error); err != nil && !(ok && ne.Timeout()) {
+		cc.Close()
+		return pc, nil, fmt.Errorf("%w: %v", ErrImmediateClose, err)
+	}
+	return pc, &bufferdConn{Conn: cc, br: br}, nil
+}
+
+// peekingConn is the client conn of which the first data is peeked in the background,
+// the reads wait for the peek.
+type peekingConn struct {
+	net.Conn
+	br     *bufio.Reader
+	peeked chan struct{}
+}
+
+func (c *peekingConn) Read(b []byte) (int, error) {
+	<-c.peeked
+	return c.br.Read(b)
+}
+
+func (c *peekingConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// AccessLogHandlerOption enables the access log, one line per forwarded connection when it closes.
+func AccessLogHandlerOption(enabled bool) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.AccessLog = enabled
+	}
+}
+
+// SpliceHandlerOption enables the splice(2) zero-copy relay of the TCP forwarding,
+// it takes effect only if no per-connection transform of the bytes is enabled.
+func SpliceHandlerOption(enabled bool) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.Splice = enabled
+	}
+}
+
+// MetricsHandlerOption sets the counters of the router updated by the handler.
+func MetricsHandlerOption(rm *RouterMetrics) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.Metrics = rm
+	}
+}
+
+// ErrFirstByteTimeout is an error that implies the upstream sent nothing within the FirstByteTimeout.
+var ErrFirstByteTimeout = errors.New("upstream first byte timeout")
+
+// FirstByteTimeoutHandlerOption bounds the wait for the first byte from the upstream after the client data is sent to it,
+// the connection is closed and the node is marked dead on timeout, so that the following connections fail over.
+// The wait starts at the first write to the upstream, so an idle client never times out a healthy upstream.
+func FirstByteTimeoutHandlerOption(timeout time.Duration) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.FirstByteTimeout = timeout
+	}
+}
+
+// firstByteConn wraps the upstream cc of the node with the first byte timeout if it is set.
+// It should wrap cc after the handler writes its own data (e.g. the PROXY protocol header) to it.
+func (opts *HandlerOptions) firstByteConn(cc net.Conn, node Node) net.Conn {
+	if opts.FirstByteTimeout <= 0 {
+		return cc
+	}
+	return &firstByteConn{Conn: cc, node: node, timeout: opts.FirstByteTimeout}
+}
+
+// firstByteConn is an upstream connection with a read deadline from the first write until the first byte is received.
+type firstByteConn struct {
+	net.Conn
+	node     Node
+	timeout  time.Duration
+	sent     bool
+	received bool
+	mux      sync.Mutex
+}
+
+func (c *firstByteConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	if n > 0 {
+		c.mux.Lock()
+		if !c.sent && !c.received {
+			c.sent = true
+			c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		}
+		c.mux.Unlock()
+	}
+	return
+}
+
+func (c *firstByteConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.received {
+		return
+	}
+	if n > 0 {
+		c.received = true
+		c.Conn.SetReadDeadline(time.Time{})
+		return
+	}
+	// the deadline is set only after the client data is sent.
+	if ne, ok := err.(net.Error); ok && ne.Timeout() && c.sent {
+		log.Logf("[first-byte] %s : no data in time, marked dead", c.node.String())
+		c.node.MarkDead()
+		err = ErrFirstByteTimeout
+	}
+	return
+}
+
+func (c *firstByteConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// transport relays the data between the client conn and the upstream cc with the per-connection limits.
+func (opts *HandlerOptions) transport(conn, cc net.Conn) error {
+	if opts.AppKeepalive > 0 {
+		setTCPKeepAlive(conn, opts.AppKeepalive)
+		setTCPKeepAlive(cc, opts.AppKeepalive)
+	}
+	if tc, tcc, ok := opts.spliceConns(conn, cc); ok {
+		// io.Copy between the raw TCP connections is spliced by the runtime on linux.
+		conn, cc = tc, tcc
+	} else {
+		conn, cc = opts.idleConns(conn, cc)
+		cc = opts.capConn(cc)
+		conn = opts.limitClientConn(conn)
+	}
+	if opts.CloseOnEOF {
+		return transportGrace(conn, cc, opts.CloseOnEOFGrace)
+	}
+	return transport(conn, cc)
+}
+
+// limitClientConn wraps the client conn with the bandwidth, the rate limit and the byte counters.
+func (opts *HandlerOptions) limitClientConn(conn net.Conn) net.Conn {
+	conn = newBandwidthConn(conn, opts.Bandwidth, opts.Priority)
+	conn = newRateLimitConn(conn, opts.RateLimitUp, opts.RateLimitDown)
+	return opts.Metrics.countConn(conn)
+}
+
+// limitConn wraps the client conn of the relays without an upstream net.Conn (e.g. the UDP tunnels)
+// with all the per-connection limits, as all the data of such a relay passes through the client conn.
+func (opts *HandlerOptions) limitConn(conn net.Conn) net.Conn {
+	if opts.IdleTimeout > 0 {
+		timeout := opts.IdleTimeout
+		t := time.AfterFunc(timeout, func() {
+			log.Logf("[idle] %s - %s : idle for %s, closing", conn.RemoteAddr(), conn.LocalAddr(), timeout)
+			conn.Close()
+		})
+		conn = &idleConn{Conn: conn, timer: t, timeout: timeout}
+	}
+	return opts.limitClientConn(opts.capConn(conn))
+}
+
+// limitPacketConn is the limitConn of the client side pc of a UDP relay.
+func (opts *HandlerOptions) limitPacketConn(pc net.PacketConn) net.PacketConn {
+	c := &packetConnIO{PacketConn: pc}
+	return &limitedPacketConn{PacketConn: pc, io: c, conn: opts.limitConn(c)}
+}
+
+// packetConnIO reads and writes the datagrams of a net.PacketConn as a net.Conn,
+// the peer of the last datagram read and of the next one to write are kept aside.
+type packetConnIO struct {
+	net.PacketConn
+	raddr net.Addr
+	waddr net.Addr
+}
+
+func (c *packetConnIO) Read(b []byte) (n int, err error) {
+	n, c.raddr, err = c.PacketConn.ReadFrom(b)
+	return
+}
+
+func (c *packetConnIO) Write(b []byte) (int, error) {
+	return c.PacketConn.WriteTo(b, c.waddr)
+}
+
+func (c *packetConnIO) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+// limitedPacketConn passes the datagrams of pc through the limits wrapping its packetConnIO,
+// the reads and the writes are each done by a single goroutine.
+type limitedPacketConn struct {
+	net.PacketConn
+	io   *packetConnIO
+	conn net.Conn
+}
+
+func (c *limitedPacketConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	n, err = c.conn.Read(b)
+	return n, c.io.raddr, err
+}
+
+func (c *limitedPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.io.waddr = addr
+	return c.conn.Write(b)
+}
+
+func (c *limitedPacketConn) Close() error {
+	return c.conn.Close()
+}
+
+// IdleTimeoutHandlerOption sets the idle timeout of the established connections,
+// the connections are closed if no data flows in either direction for the duration.
+func IdleTimeoutHandlerOption(d time.Duration) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.IdleTimeout = d
+	}
+}
+
+// idleConns wraps the connection pair with the shared idle timer if the idle timeout is set,
+// the data in either direction keeps both of them alive.
+func (opts *HandlerOptions) idleConns(conn, cc net.Conn) (net.Conn, net.Conn) {
+	if opts.IdleTimeout <= 0 {
+		return conn, cc
+	}
+	timeout := opts.IdleTimeout
+	t := time.AfterFunc(timeout, func() {
+		log.Logf("[idle] %s <-> %s : idle for %s, closing", conn.RemoteAddr(), cc.RemoteAddr(), timeout)
+		conn.Close()
+		cc.Close()
+	})
+	return &idleConn{Conn: conn, timer: t, timeout: timeout},
+		&idleConn{Conn: cc, timer: t, timeout: timeout}
+}
+
+// idleConn resets the shared idle timer on every read and write.
+type idleConn struct {
+	net.Conn
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	if n > 0 {
+		c.timer.Reset(c.timeout)
+	}
+	return
+}
+
+func (c *idleConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	if n > 0 {
+		c.timer.Reset(c.timeout)
+	}
+	return
+}
+
+// Close stops the idle timer and closes the connection.
+func (c *idleConn) Close() error {
+	c.timer.Stop()
+	return c.Conn.Close()
+}
+
+func (c *idleConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// setTCPKeepAlive enables the TCP keepalive probes with the period if conn is a TCP connection.
+func setTCPKeepAlive(conn net.Conn, period time.Duration) bool {
+	if c, ok := conn.(*chainConn); ok {
+		conn = c.Conn
+	}
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return false
+	}
+	tc.SetKeepAlive(true)
+	tc.SetKeepAlivePeriod(period)
+	return true
+}
+
+// UDPMaxSizeHandlerOption sets the max datagram size of the UDP forwarding,
+// the oversized datagrams are dropped, truncated or fragmented according to the mode.
+func UDPMaxSizeHandlerOption(max int, mode string) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.UDPMaxSize = max
+		opts.UDPOversize = mode
+	}
+}
+
+// isPacketConn reports whether conn carries datagrams, the limits must not split or truncate them.
+func isPacketConn(conn net.Conn) bool {
+	_, ok := conn.LocalAddr().(*net.UDPAddr)
+	return ok
+}
+
+// sizeUDPConn wraps the UDP conn with the max datagram size if it is set.
+func (opts *HandlerOptions) sizeUDPConn(conn net.Conn) net.Conn {
+	if opts.UDPMaxSize <= 0 {
+		return conn
+	}
+	return &udpSizeConn{Conn: conn, max: opts.UDPMaxSize, mode: opts.UDPOversize}
+}
+
 type autoHandler struct {
 	options *HandlerOptions
 }
@@ -301,3 +909,7 @@ type bufferdConn struct {
 func (c *bufferdConn) Read(b []byte) (int, error) {
 	return c.br.Read(b)
 }
+
+func (c *bufferdConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
@@ -0,0 +1,45 @@
+package gost
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// HealthStatus is the health of the chain nodes.
+type HealthStatus struct {
+	// Healthy is true if every group has an available node.
+	Healthy bool         `json:"healthy"`
+	Nodes   []NodeStatus `json:"nodes"`
+}
+
+// Health returns the health of the node groups.
+func Health(groups ...*NodeGroup) HealthStatus {
+	hs := HealthStatus{Healthy: true, Nodes: []NodeStatus{}}
+	for _, group := range groups {
+		status := group.Status()
+		if len(status) == 0 {
+			continue
+		}
+		available := false
+		for _, st := range status {
+			available = available || st.Available
+		}
+		hs.Healthy = hs.Healthy && available
+		hs.Nodes = append(hs.Nodes, status...)
+	}
+	return hs
+}
+
+// HealthHandler serves the health of the node groups returned by groups in JSON,
+// the status code is 503 if any group has no available node, so that the load balancers
+// can take the gateway out of rotation when the upstreams are down.
+func HealthHandler(groups func() []*NodeGroup) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hs := Health(groups()...)
+		w.Header().Set("Content-Type", "application/json")
+		if !hs.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(hs)
+	})
+}
@@ -0,0 +1,54 @@
+package gost
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthHandler(t *testing.T) {
+	var nodes []Node
+	for i, addr := range []string{"127.0.0.1:1081", "127.0.0.1:1082"} {
+		node, err := ParseNode(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		node.ID = i + 1
+		nodes = append(nodes, node)
+	}
+	group := NewNodeGroup(nodes...)
+	group.ID = 1
+	group.SetSelector(nil, WithFilter(&FailFilter{MaxFails: 1, FailTimeout: time.Minute}))
+	handler := HealthHandler(func() []*NodeGroup { return []*NodeGroup{group} })
+
+	get := func() (int, HealthStatus) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		var hs HealthStatus
+		if err := json.NewDecoder(rec.Body).Decode(&hs); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code, hs
+	}
+
+	nodes[0].MarkDead()
+	code, hs := get()
+	if code != http.StatusOK || !hs.Healthy {
+		t.Errorf("one available node should be healthy, got %d %v", code, hs.Healthy)
+	}
+	if len(hs.Nodes) != 2 || hs.Nodes[0].Available || hs.Nodes[0].FailCount != 1 || !hs.Nodes[1].Available {
+		t.Errorf("unexpected node status %+v", hs.Nodes)
+	}
+
+	nodes[1].MarkDead()
+	if code, hs := get(); code != http.StatusServiceUnavailable || hs.Healthy {
+		t.Errorf("no available node should be unhealthy, got %d %v", code, hs.Healthy)
+	}
+
+	nodes[0].ResetDead()
+	if code, _ := get(); code != http.StatusOK {
+		t.Errorf("recovered node should be healthy, got %d", code)
+	}
+}
@@ -77,6 +77,7 @@ func (c *httpConnector) ConnectContext(ctx context.Context, conn net.Conn, netwo
 		req.Header.Set("Proxy-Authorization",
 			"Basic "+base64.StdEncoding.EncodeToString([]byte(u+":"+p)))
 	}
+	opts.setHeader(req.Header)
 
 	if err := req.Write(conn); err != nil {
 		return nil, err
@@ -180,7 +181,7 @@ func (h *httpHandler) handleRequest(conn net.Conn, req *http.Request) {
 	}
 	resp.Header.Add("Proxy-Agent", proxyAgent)
 
-	if !Can("tcp", host, h.options.Whitelist, h.options.Blacklist) {
+	if !h.options.can("tcp", host) {
 		log.Logf("[http] %s - %s : Unauthorized to tcp connect to %s",
 			conn.RemoteAddr(), conn.LocalAddr(), host)
 		resp.StatusCode = http.StatusForbidden
@@ -272,6 +273,8 @@ func (h *httpHandler) handleRequest(conn net.Conn, req *http.Request) {
 			TimeoutChainOption(h.options.Timeout),
 			HostsChainOption(h.options.Hosts),
 			ResolverChainOption(h.options.Resolver),
+			BlockPrivateChainOption(h.options.BlockPrivate),
+			RandomizeSourcePortChainOption(h.options.RandomizeSourcePort),
 		)
 		if err == nil {
 			break
@@ -280,6 +283,7 @@ func (h *httpHandler) handleRequest(conn net.Conn, req *http.Request) {
 	}
 
 	if err != nil {
+		h.options.Metrics.DialFailed()
 		resp.StatusCode = http.StatusServiceUnavailable
 
 		if Debug {
@@ -309,7 +313,7 @@ func (h *httpHandler) handleRequest(conn net.Conn, req *http.Request) {
 	}
 
 	log.Logf("[http] %s <-> %s", conn.RemoteAddr(), host)
-	transport(conn, cc)
+	h.options.transport(conn, cc)
 	log.Logf("[http] %s >-< %s", conn.RemoteAddr(), host)
 }
 
@@ -347,7 +351,7 @@ func (h *httpHandler) authenticate(conn net.Conn, req *http.Request, resp *http.
 				req.Write(cc)
 				log.Logf("[http] %s <-> %s : forward to %s",
 					conn.RemoteAddr(), conn.LocalAddr(), ss[1])
-				transport(conn, cc)
+				h.options.transport(conn, cc)
 				log.Logf("[http] %s >-< %s : forward to %s",
 					conn.RemoteAddr(), conn.LocalAddr(), ss[1])
 				return
@@ -57,6 +57,14 @@ func (c *http2Connector) ConnectContext(ctx context.Context, conn net.Conn, netw
 		return nil, errors.New("wrong connection type")
 	}
 
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = ConnectTimeout
+	}
+	if err := cc.streams.acquire(ctx, timeout); err != nil {
+		return nil, err
+	}
+
 	pr, pw := io.Pipe()
 	req := &http.Request{
 		Method:        http.MethodConnect,
@@ -82,12 +90,14 @@ func (c *http2Connector) ConnectContext(ctx context.Context, conn net.Conn, netw
 		req.Header.Set("Proxy-Authorization",
 			"Basic "+base64.StdEncoding.EncodeToString([]byte(u+":"+p)))
 	}
+	opts.setHeader(req.Header)
 	if Debug {
 		dump, _ := httputil.DumpRequest(req, false)
 		log.Log("[http2]", string(dump))
 	}
 	resp, err := cc.client.Do(req)
 	if err != nil {
+		cc.streams.release()
 		cc.Close()
 		return nil, err
 	}
@@ -97,13 +107,15 @@ func (c *http2Connector) ConnectContext(ctx context.Context, conn net.Conn, netw
 	}
 
 	if resp.StatusCode != http.StatusOK {
+		cc.streams.release()
 		resp.Body.Close()
 		return nil, errors.New(resp.Status)
 	}
 	hc := &http2Conn{
-		r:      resp.Body,
-		w:      pw,
-		closed: make(chan struct{}),
+		r:       resp.Body,
+		w:       pw,
+		closed:  make(chan struct{}),
+		onClose: cc.streams.release,
 	}
 
 	hc.remoteAddr, _ = net.ResolveTCPAddr("tcp", address)
@@ -112,20 +124,96 @@ func (c *http2Connector) ConnectContext(ctx context.Context, conn net.Conn, netw
 	return hc, nil
 }
 
+// HTTP2Options describes the HTTP/2 settings for the http2, h2 and h2c transports.
+type HTTP2Options struct {
+	// MaxStreams is the maximum number of concurrent streams per HTTP/2 connection,
+	// zero means the default of the underlying HTTP/2 implementation.
+	MaxStreams int
+}
+
+// HTTP2Option allows a common way to set HTTP2Options.
+type HTTP2Option func(opts *HTTP2Options)
+
+// MaxStreamsHTTP2Option sets the maximum number of concurrent streams per HTTP/2 connection.
+// Beyond the limit, clients queue new streams until one is closed or the connect timeout expires.
+func MaxStreamsHTTP2Option(n int) HTTP2Option {
+	return func(opts *HTTP2Options) {
+		opts.MaxStreams = n
+	}
+}
+
+func newHTTP2Options(options ...HTTP2Option) *HTTP2Options {
+	opts := &HTTP2Options{}
+	for _, option := range options {
+		option(opts)
+	}
+	return opts
+}
+
+// streamLimiter bounds the concurrent streams of an HTTP/2 client, a nil limiter means no limit.
+type streamLimiter chan struct{}
+
+func newStreamLimiter(n int) streamLimiter {
+	if n <= 0 {
+		return nil
+	}
+	return make(streamLimiter, n)
+}
+
+func (l streamLimiter) acquire(ctx context.Context, timeout time.Duration) error {
+	if l == nil {
+		return nil
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case l <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return errors.New("http2: too many concurrent streams")
+	}
+}
+
+func (l streamLimiter) release() {
+	if l == nil {
+		return
+	}
+	<-l
+}
+
+type http2Client struct {
+	*http.Client
+	streams streamLimiter
+}
+
+func newHTTP2Transport(config *tls.Config, opts *HTTP2Options) *http2.Transport {
+	return &http2.Transport{
+		TLSClientConfig: config,
+		// queue the streams beyond the limit advertised by the server,
+		// instead of opening new connections.
+		StrictMaxConcurrentStreams: opts.MaxStreams > 0,
+	}
+}
+
 type http2Transporter struct {
-	clients     map[string]*http.Client
+	clients     map[string]*http2Client
 	clientMutex sync.Mutex
 	tlsConfig   *tls.Config
+	options     *HTTP2Options
 }
 
 // HTTP2Transporter creates a Transporter that is used by HTTP2 h2 proxy client.
-func HTTP2Transporter(config *tls.Config) Transporter {
+func HTTP2Transporter(config *tls.Config, options ...HTTP2Option) Transporter {
 	if config == nil {
 		config = &tls.Config{InsecureSkipVerify: true}
 	}
 	return &http2Transporter{
-		clients:   make(map[string]*http.Client),
+		clients:   make(map[string]*http2Client),
 		tlsConfig: config,
+		options:   newHTTP2Options(options...),
 	}
 }
 
@@ -153,26 +241,28 @@ func (tr *http2Transporter) Dial(addr string, options ...DialOption) (net.Conn,
 		if timeout <= 0 {
 			timeout = DialTimeout
 		}
-		transport := http2.Transport{
-			TLSClientConfig: tr.tlsConfig,
-			DialTLS: func(network, adr string, cfg *tls.Config) (net.Conn, error) {
-				conn, err := opts.Chain.Dial(adr)
-				if err != nil {
-					return nil, err
-				}
-				return wrapTLSClient(conn, cfg, timeout)
-			},
+		transport := newHTTP2Transport(tr.tlsConfig, tr.options)
+		transport.DialTLS = func(network, adr string, cfg *tls.Config) (net.Conn, error) {
+			conn, err := opts.Chain.Dial(adr)
+			if err != nil {
+				return nil, err
+			}
+			return wrapTLSClient(conn, cfg, timeout)
 		}
-		client = &http.Client{
-			Transport: &transport,
-			// Timeout:   timeout,
+		client = &http2Client{
+			Client: &http.Client{
+				Transport: transport,
+				// Timeout:   timeout,
+			},
+			streams: newStreamLimiter(tr.options.MaxStreams),
 		}
 		tr.clients[addr] = client
 	}
 
 	return &http2ClientConn{
-		addr:   addr,
-		client: client,
+		addr:    addr,
+		client:  client.Client,
+		streams: client.streams,
 		onClose: func() {
 			tr.clientMutex.Lock()
 			defer tr.clientMutex.Unlock()
@@ -191,29 +281,32 @@ func (tr *http2Transporter) Multiplex() bool {
 
 // TODO: clean closed clients
 type h2Transporter struct {
-	clients     map[string]*http.Client
+	clients     map[string]*http2Client
 	clientMutex sync.Mutex
 	tlsConfig   *tls.Config
 	path        string
+	options     *HTTP2Options
 }
 
 // H2Transporter creates a Transporter that is used by HTTP2 h2 tunnel client.
-func H2Transporter(config *tls.Config, path string) Transporter {
+func H2Transporter(config *tls.Config, path string, options ...HTTP2Option) Transporter {
 	if config == nil {
 		config = &tls.Config{InsecureSkipVerify: true}
 	}
 	return &h2Transporter{
-		clients:   make(map[string]*http.Client),
+		clients:   make(map[string]*http2Client),
 		tlsConfig: config,
 		path:      path,
+		options:   newHTTP2Options(options...),
 	}
 }
 
 // H2CTransporter creates a Transporter that is used by HTTP2 h2c tunnel client.
-func H2CTransporter(path string) Transporter {
+func H2CTransporter(path string, options ...HTTP2Option) Transporter {
 	return &h2Transporter{
-		clients: make(map[string]*http.Client),
+		clients: make(map[string]*http2Client),
 		path:    path,
+		options: newHTTP2Options(options...),
 	}
 }
 
@@ -231,27 +324,36 @@ func (tr *h2Transporter) Dial(addr string, options ...DialOption) (net.Conn, err
 			timeout = DialTimeout
 		}
 
-		transport := http2.Transport{
-			TLSClientConfig: tr.tlsConfig,
-			DialTLS: func(network, adr string, cfg *tls.Config) (net.Conn, error) {
-				conn, err := opts.Chain.Dial(addr)
-				if err != nil {
-					return nil, err
-				}
-				if tr.tlsConfig == nil {
-					return conn, nil
-				}
-				return wrapTLSClient(conn, cfg, timeout)
-			},
+		transport := newHTTP2Transport(tr.tlsConfig, tr.options)
+		transport.DialTLS = func(network, adr string, cfg *tls.Config) (net.Conn, error) {
+			conn, err := opts.Chain.Dial(addr)
+			if err != nil {
+				return nil, err
+			}
+			if tr.tlsConfig == nil {
+				return conn, nil
+			}
+			return wrapTLSClient(conn, cfg, timeout)
 		}
-		client = &http.Client{
-			Transport: &transport,
-			// Timeout:   timeout,
+		client = &http2Client{
+			Client: &http.Client{
+				Transport: transport,
+				// Timeout:   timeout,
+			},
+			streams: newStreamLimiter(tr.options.MaxStreams),
 		}
 		tr.clients[addr] = client
 	}
 	tr.clientMutex.Unlock()
 
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = DialTimeout
+	}
+	if err := client.streams.acquire(context.Background(), timeout); err != nil {
+		return nil, err
+	}
+
 	pr, pw := io.Pipe()
 	req := &http.Request{
 		Method:        http.MethodConnect,
@@ -275,6 +377,7 @@ func (tr *h2Transporter) Dial(addr string, options ...DialOption) (net.Conn, err
 	}
 	resp, err := client.Do(req)
 	if err != nil {
+		client.streams.release()
 		return nil, err
 	}
 	if Debug {
@@ -283,13 +386,15 @@ func (tr *h2Transporter) Dial(addr string, options ...DialOption) (net.Conn, err
 	}
 
 	if resp.StatusCode != http.StatusOK {
+		client.streams.release()
 		resp.Body.Close()
 		return nil, errors.New(resp.Status)
 	}
 	conn := &http2Conn{
-		r:      resp.Body,
-		w:      pw,
-		closed: make(chan struct{}),
+		r:       resp.Body,
+		w:       pw,
+		closed:  make(chan struct{}),
+		onClose: client.streams.release,
 	}
 	conn.remoteAddr, _ = net.ResolveTCPAddr("tcp", addr)
 	conn.localAddr = &net.TCPAddr{IP: net.IPv4zero, Port: 0}
@@ -370,7 +475,7 @@ func (h *http2Handler) roundTrip(w http.ResponseWriter, r *http.Request) {
 	}
 	w.Header().Set("Proxy-Agent", proxyAgent)
 
-	if !Can("tcp", host, h.options.Whitelist, h.options.Blacklist) {
+	if !h.options.can("tcp", host) {
 		log.Logf("[http2] %s - %s : Unauthorized to tcp connect to %s",
 			r.RemoteAddr, laddr, host)
 		w.WriteHeader(http.StatusForbidden)
@@ -463,13 +568,15 @@ func (h *http2Handler) roundTrip(w http.ResponseWriter, r *http.Request) {
 			defer conn.Close()
 
 			log.Logf("[http2] %s <-> %s : downgrade to HTTP/1.1", r.RemoteAddr, host)
-			transport(conn, cc)
+			h.options.transport(conn, cc)
 			log.Logf("[http2] %s >-< %s", r.RemoteAddr, host)
 			return
 		}
 
 		log.Logf("[http2] %s <-> %s", r.RemoteAddr, host)
-		transport(&readWriter{r: r.Body, w: flushWriter{w}}, cc)
+		raddr, _ := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+		stream := &streamConn{rw: &readWriter{r: r.Body, w: flushWriter{w}}, raddr: raddr}
+		h.options.transport(stream, cc)
 		log.Logf("[http2] %s >-< %s", r.RemoteAddr, host)
 		return
 	}
@@ -591,7 +698,7 @@ type http2Listener struct {
 }
 
 // HTTP2Listener creates a Listener for HTTP2 proxy server.
-func HTTP2Listener(addr string, config *tls.Config) (Listener, error) {
+func HTTP2Listener(addr string, config *tls.Config, options ...HTTP2Option) (Listener, error) {
 	l := &http2Listener{
 		connChan: make(chan *http2ServerConn, 1024),
 		errChan:  make(chan error, 1),
@@ -604,7 +711,10 @@ func HTTP2Listener(addr string, config *tls.Config) (Listener, error) {
 		Handler:   http.HandlerFunc(l.handleFunc),
 		TLSConfig: config,
 	}
-	if err := http2.ConfigureServer(server, nil); err != nil {
+	opts := newHTTP2Options(options...)
+	if err := http2.ConfigureServer(server, &http2.Server{
+		MaxConcurrentStreams: uint32(opts.MaxStreams),
+	}); err != nil {
 		return nil, err
 	}
 	l.server = server
@@ -678,7 +788,7 @@ type h2Listener struct {
 }
 
 // H2Listener creates a Listener for HTTP2 h2 tunnel server.
-func H2Listener(addr string, config *tls.Config, path string) (Listener, error) {
+func H2Listener(addr string, config *tls.Config, path string, options ...HTTP2Option) (Listener, error) {
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
 		return nil, err
@@ -690,7 +800,7 @@ func H2Listener(addr string, config *tls.Config, path string) (Listener, error)
 	l := &h2Listener{
 		Listener: tcpKeepAliveListener{ln.(*net.TCPListener)},
 		server: &http2.Server{
-			// MaxConcurrentStreams:         1000,
+			MaxConcurrentStreams:         uint32(newHTTP2Options(options...).MaxStreams),
 			PermitProhibitedCipherSuites: true,
 			IdleTimeout:                  5 * time.Minute,
 		},
@@ -705,15 +815,15 @@ func H2Listener(addr string, config *tls.Config, path string) (Listener, error)
 }
 
 // H2CListener creates a Listener for HTTP2 h2c tunnel server.
-func H2CListener(addr string, path string) (Listener, error) {
+func H2CListener(addr string, path string, options ...HTTP2Option) (Listener, error) {
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
 		return nil, err
 	}
 	l := &h2Listener{
 		Listener: tcpKeepAliveListener{ln.(*net.TCPListener)},
-		server:   &http2.Server{
-			// MaxConcurrentStreams:         1000,
+		server: &http2.Server{
+			MaxConcurrentStreams: uint32(newHTTP2Options(options...).MaxStreams),
 		},
 		path:     path,
 		connChan: make(chan net.Conn, 1024),
@@ -833,6 +943,7 @@ type http2Conn struct {
 	remoteAddr net.Addr
 	localAddr  net.Addr
 	closed     chan struct{}
+	onClose    func()
 }
 
 func (c *http2Conn) Read(b []byte) (n int, err error) {
@@ -850,6 +961,9 @@ func (c *http2Conn) Close() (err error) {
 	default:
 		close(c.closed)
 	}
+	if c.onClose != nil {
+		c.onClose()
+	}
 	if rc, ok := c.r.(io.Closer); ok {
 		err = rc.Close()
 	}
@@ -930,6 +1044,7 @@ type http2ClientConn struct {
 	nopConn
 	addr    string
 	client  *http.Client
+	streams streamLimiter
 	onClose func()
 }
 
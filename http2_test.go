@@ -11,6 +11,9 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
 )
 
 func http2ProxyRoundtrip(targetURL string, data []byte, clientInfo *url.Userinfo, serverInfo []*url.Userinfo) error {
@@ -37,6 +40,92 @@ func http2ProxyRoundtrip(targetURL string, data []byte, clientInfo *url.Userinfo
 	return proxyRoundtrip(client, server, targetURL, data)
 }
 
+// http2TunnelConn connects to target through the HTTP2 proxy with the handler options.
+func http2TunnelConn(t *testing.T, target string, opts ...HandlerOption) net.Conn {
+	ln, err := HTTP2Listener("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &Client{
+		Connector:   HTTP2Connector(nil),
+		Transporter: HTTP2Transporter(nil),
+	}
+	server := &Server{
+		Listener: ln,
+		Handler:  HTTP2Handler(opts...),
+	}
+	go server.Run()
+	t.Cleanup(func() { server.Close() })
+
+	conn, err := proxyConn(client, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err = client.Connect(conn, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestHTTP2ProxyMaxBytes(t *testing.T) {
+	target, received := countEchoServer(t)
+	defer target.Close()
+
+	testMaxBytes(t, http2TunnelConn(t, target.Addr().String(), MaxBytesHandlerOption(10)), received)
+}
+
+func TestHTTP2ProxyIdleTimeout(t *testing.T) {
+	silent, err := silentServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	conn := http2TunnelConn(t, silent.Addr().String(), IdleTimeoutHandlerOption(300*time.Millisecond))
+	start := time.Now()
+	if !closedWithin(conn, 3*time.Second) {
+		t.Fatal("idle stream should be closed")
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("stream should be closed at the idle timeout, closed after %v", d)
+	}
+}
+
+func TestHTTP2ProxyRateLimit(t *testing.T) {
+	target, err := writeServer(50 * 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	conn := http2TunnelConn(t, target.Addr().String(), RateLimitHandlerOption(nil, NewBandwidthLimiter(100*1024)))
+	testDownloadLimit(t, conn)
+}
+
+func TestHTTP2ProxyCloseOnEOF(t *testing.T) {
+	target, resc := halfCloseServer(t)
+	defer target.Close()
+
+	// the stream can not be half-closed, but the client can still send in the grace period.
+	grace := 300 * time.Millisecond
+	conn := http2TunnelConn(t, target.Addr().String(), CloseOnEOFHandlerOption(true, grace))
+	testCloseOnEOF(t, conn, resc, grace)
+}
+
+func TestHTTP2ProxyBandwidth(t *testing.T) {
+	target, err := writeServer(50 * 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	conn := http2TunnelConn(t, target.Addr().String(),
+		BandwidthHandlerOption(NewBandwidthLimiter(100*1024), PriorityNormal))
+	testDownloadLimit(t, conn)
+}
+
 func TestHTTP2ProxyAuth(t *testing.T) {
 	httpSrv := httptest.NewServer(httpTestHandler)
 	defer httpSrv.Close()
@@ -1149,3 +1238,116 @@ func TestHTTP2ProxyWithBypass(t *testing.T) {
 		t.Error("should failed")
 	}
 }
+
+func TestH2MaxStreamsOption(t *testing.T) {
+	ln, err := H2CListener("127.0.0.1:0", "/h2c", MaxStreamsHTTP2Option(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if n := ln.(*h2Listener).server.MaxConcurrentStreams; n != 5 {
+		t.Errorf("listener max streams should be 5, got %d", n)
+	}
+
+	tr := H2CTransporter("/h2c", MaxStreamsHTTP2Option(5)).(*h2Transporter)
+	if tr.options.MaxStreams != 5 {
+		t.Errorf("transporter max streams should be 5, got %d", tr.options.MaxStreams)
+	}
+}
+
+func TestH2CMaxStreamsClient(t *testing.T) {
+	ln, err := H2CListener("127.0.0.1:0", "/h2c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	addr := ln.Addr().String()
+
+	tr := H2CTransporter("/h2c", MaxStreamsHTTP2Option(1))
+	c1, err := tr.Dial(addr, TimeoutDialOption(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the second stream is queued until the timeout.
+	if c2, err := tr.Dial(addr, TimeoutDialOption(200*time.Millisecond)); err == nil {
+		c2.Close()
+		t.Fatal("stream beyond the limit should fail")
+	}
+
+	c1.Close()
+	c3, err := tr.Dial(addr, TimeoutDialOption(time.Second))
+	if err != nil {
+		t.Fatal("stream should be available after close:", err)
+	}
+	c3.Close()
+}
+
+func TestH2CMaxStreamsServer(t *testing.T) {
+	ln, err := H2CListener("127.0.0.1:0", "/h2c", MaxStreamsHTTP2Option(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	addr := ln.Addr().String()
+
+	client := &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP:                  true,
+			StrictMaxConcurrentStreams: true,
+			DialTLS: func(network, _ string, _ *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			},
+		},
+	}
+	stream := func() (*http.Response, error) {
+		pr, _ := io.Pipe()
+		req, _ := http.NewRequest(http.MethodGet, "http://"+addr+"/h2c", pr)
+		return client.Do(req)
+	}
+
+	resp1, err := stream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp1.Body.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		resp, err := stream()
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("stream beyond the server limit should be queued")
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	// close the first stream on the server side.
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("queued stream should proceed after the first one is closed")
+	}
+}
+
+func TestHTTP2ProxyMetrics(t *testing.T) {
+	target, _ := countEchoServer(t)
+	defer target.Close()
+
+	rm := NewMetrics().Router("http2://:0", "http2", ":0")
+	testMetricsEcho(t, http2TunnelConn(t, target.Addr().String(), MetricsHandlerOption(rm)), rm)
+}
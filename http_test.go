@@ -1,6 +1,7 @@
 package gost
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/rand"
 	"fmt"
@@ -376,3 +377,52 @@ func TestHTTPProxyWithBypass(t *testing.T) {
 		t.Error("should failed")
 	}
 }
+
+func TestHTTPConnectorHeader(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	reqs := make(chan *http.Request, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		reqs <- req
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = HTTPConnector(url.UserPassword("admin", "123456")).Connect(conn, "example.com:443",
+		HeaderConnectOption(http.Header{"Proxy-Authorization": {"Bearer token"}}),
+		HeaderConnectOption(http.Header{"X-Gateway": {"a"}}),
+		HeaderConnectOption(http.Header{"X-Gateway": {"b"}}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := <-reqs
+	if got := req.Header.Values("Proxy-Authorization"); len(got) != 1 || got[0] != "Bearer token" {
+		t.Errorf("got Proxy-Authorization %q, want the custom header replacing the basic auth", got)
+	}
+	if got := req.Header.Values("X-Gateway"); len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Errorf("got X-Gateway %q, want [a b]", got)
+	}
+	if req.Header.Get("User-Agent") != DefaultUserAgent {
+		t.Errorf("got User-Agent %q", req.Header.Get("User-Agent"))
+	}
+}
@@ -3,8 +3,10 @@ package gost
 import (
 	"crypto/sha1"
 	"encoding/csv"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"time"
@@ -51,6 +53,55 @@ type KCPConfig struct {
 	SnmpPeriod   int    `json:"snmpperiod"`
 	Signal       bool   `json:"signal"` // Signal enables the signal SIGUSR1 feature.
 	TCP          bool   `json:"tcp"`
+	// EMOD: session establishment timeouts, separate from the data timeout.
+	// They are set by the kcpDialTimeout/kcpDialTimeoutMax node options.
+	// On a lossy link a new session needs several retransmissions (one RTO each,
+	// starting at kcpInitialRTO) before the first frame is acknowledged, and small
+	// sndwnd/rcvwnd values stall the sender earlier, so the establishment timeout
+	// doubles on each consecutive failure up to DialTimeoutMax.
+	DialTimeout    time.Duration `json:"-"`
+	DialTimeoutMax time.Duration `json:"-"`
+}
+
+// kcpInitialRTO is the initial retransmission timeout of a KCP connection.
+const kcpInitialRTO = 200 * time.Millisecond
+
+// Validate checks the establishment timeouts of the KCP config.
+// The dial timeout must leave room for at least one retransmission.
+func (c *KCPConfig) Validate() error {
+	if c.DialTimeout < 0 || c.DialTimeoutMax < 0 {
+		return errors.New("kcp: negative dial timeout")
+	}
+	if c.DialTimeout == 0 {
+		return nil
+	}
+	if min := 2*kcpInitialRTO + time.Duration(c.Interval)*time.Millisecond; c.DialTimeout < min {
+		return fmt.Errorf("kcp: dial timeout %s is less than %s", c.DialTimeout, min)
+	}
+	if c.DialTimeoutMax > 0 && c.DialTimeoutMax < c.DialTimeout {
+		return fmt.Errorf("kcp: max dial timeout %s is less than dial timeout %s", c.DialTimeoutMax, c.DialTimeout)
+	}
+	return nil
+}
+
+// EstablishTimeout returns the session establishment timeout after the given
+// number of consecutive failures. Zero means the data timeout is used.
+func (c *KCPConfig) EstablishTimeout(fails int) time.Duration {
+	d := c.DialTimeout
+	if d <= 0 {
+		return 0
+	}
+	max := c.DialTimeoutMax
+	if max < d {
+		max = d
+	}
+	for i := 0; i < fails && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
 }
 
 // Init initializes the KCP config.
@@ -74,6 +125,9 @@ func (c *KCPConfig) Init() {
 	if c.StreamBuf <= 0 {
 		c.StreamBuf = c.SockBuf / 2
 	}
+	if c.DialTimeout > 0 && c.DialTimeoutMax <= 0 {
+		c.DialTimeoutMax = 4 * c.DialTimeout
+	}
 	log.Logf("%#v", c)
 }
 
@@ -107,10 +161,23 @@ var (
 	}
 )
 
+// ParseKCPConfig parses the KCP config in JSON format from r.
+// The config may be partial, the fields absent from it keep the values of DefaultKCPConfig,
+// while the fields present (even with zero values) override the defaults.
+func ParseKCPConfig(r io.Reader) (*KCPConfig, error) {
+	config := DefaultKCPConfig
+	if err := json.NewDecoder(r).Decode(&config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
 type kcpTransporter struct {
 	sessions     map[string]*muxSession
 	sessionMutex sync.Mutex
 	config       *KCPConfig
+	// EMOD: consecutive session establishment failures per address.
+	fails map[string]int
 }
 
 // KCPTransporter creates a Transporter that is used by KCP proxy client.
@@ -129,6 +196,7 @@ func KCPTransporter(config *KCPConfig) Transporter {
 	return &kcpTransporter{
 		config:   config,
 		sessions: make(map[string]*muxSession),
+		fails:    make(map[string]int),
 	}
 }
 
@@ -189,15 +257,24 @@ func (tr *kcpTransporter) Handshake(conn net.Conn, options ...HandshakeOption) (
 	if timeout <= 0 {
 		timeout = HandshakeTimeout
 	}
+
+	session, ok := tr.sessions[opts.Addr]
+	establish := !ok || session.session == nil
+	// EMOD: a new session uses the (ramping) establishment timeout if configured.
+	if establish {
+		if d := config.EstablishTimeout(tr.fails[opts.Addr]); d > 0 {
+			timeout = d
+		}
+	}
 	conn.SetDeadline(time.Now().Add(timeout))
 	defer conn.SetDeadline(time.Time{})
 
-	session, ok := tr.sessions[opts.Addr]
-	if !ok || session.session == nil {
+	if establish {
 		s, err := tr.initSession(opts.Addr, conn, config)
 		if err != nil {
 			conn.Close()
 			delete(tr.sessions, opts.Addr)
+			tr.fails[opts.Addr]++
 			return nil, err
 		}
 		session = s
@@ -207,8 +284,14 @@ func (tr *kcpTransporter) Handshake(conn net.Conn, options ...HandshakeOption) (
 	if err != nil {
 		session.Close()
 		delete(tr.sessions, opts.Addr)
+		if establish {
+			tr.fails[opts.Addr]++
+		}
 		return nil, err
 	}
+	if establish {
+		delete(tr.fails, opts.Addr)
+	}
 
 	return cc, nil
 }
@@ -3,9 +3,12 @@ package gost
 import (
 	"crypto/rand"
 	"fmt"
+	"net"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
+	"time"
 )
 
 func httpOverKCPRoundtrip(targetURL string, data []byte,
@@ -406,3 +409,150 @@ func TestKCPForwardTunnel(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestKCPTransporterDialTimeout(t *testing.T) {
+	config := DefaultKCPConfig
+	config.DialTimeout = 2 * time.Second
+	config.DialTimeoutMax = 10 * time.Second
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := KCPTransporter(&config).(*kcpTransporter)
+	if tr.config.DialTimeout != 2*time.Second || tr.config.DialTimeoutMax != 10*time.Second {
+		t.Fatalf("unexpected dial timeouts %s/%s", tr.config.DialTimeout, tr.config.DialTimeoutMax)
+	}
+
+	expected := []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, d := range expected {
+		if v := tr.config.EstablishTimeout(i); v != d {
+			t.Errorf("#%d: establish timeout should be %s, got %s", i, d, v)
+		}
+	}
+}
+
+// deadlineConn records the timeout of the last deadline set on the conn.
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *deadlineConn) SetDeadline(t time.Time) error {
+	if !t.IsZero() {
+		c.timeout = time.Until(t).Round(time.Second)
+	}
+	return c.Conn.SetDeadline(t)
+}
+
+func TestKCPTransporterDialTimeoutRamp(t *testing.T) {
+	ln, err := KCPListener("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	addr := ln.Addr().String()
+
+	config := DefaultKCPConfig
+	config.DialTimeout = 2 * time.Second
+	config.DialTimeoutMax = 10 * time.Second
+	tr := KCPTransporter(&config).(*kcpTransporter)
+
+	// the session can not be established over a stream conn.
+	fail := func(addr string) time.Duration {
+		c1, c2 := net.Pipe()
+		defer c2.Close()
+		conn := &deadlineConn{Conn: c1}
+		if _, err := tr.Handshake(conn, AddrHandshakeOption(addr)); err == nil {
+			t.Fatal("handshake should fail")
+		}
+		return conn.timeout
+	}
+
+	expected := []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, d := range expected {
+		if v := fail(addr); v != d {
+			t.Errorf("#%d: establish timeout should be %s, got %s", i, d, v)
+		}
+	}
+	// the failures are counted per address.
+	if v := fail("127.0.0.1:9"); v != 2*time.Second {
+		t.Errorf("establish timeout of another address should be 2s, got %s", v)
+	}
+
+	conn, err := tr.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc, err := tr.Handshake(conn, AddrHandshakeOption(addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	// the success resets the ramp.
+	if v := tr.config.EstablishTimeout(tr.fails[addr]); v != 2*time.Second {
+		t.Errorf("establish timeout should be reset to 2s, got %s", v)
+	}
+}
+
+func TestKCPConfigDialTimeoutDefault(t *testing.T) {
+	config := DefaultKCPConfig
+	config.DialTimeout = time.Second
+	tr := KCPTransporter(&config).(*kcpTransporter)
+	if tr.config.DialTimeoutMax != 4*time.Second {
+		t.Errorf("max dial timeout should default to 4s, got %s", tr.config.DialTimeoutMax)
+	}
+
+	config = DefaultKCPConfig
+	tr = KCPTransporter(&config).(*kcpTransporter)
+	if v := tr.config.EstablishTimeout(3); v != 0 {
+		t.Errorf("establish timeout should be disabled, got %s", v)
+	}
+}
+
+func TestKCPConfigValidate(t *testing.T) {
+	tests := []struct {
+		timeout time.Duration
+		max     time.Duration
+		ok      bool
+	}{
+		{0, 0, true},
+		{time.Second, 0, true},
+		{time.Second, 5 * time.Second, true},
+		{-time.Second, 0, false},
+		{10 * time.Millisecond, 0, false},
+		{5 * time.Second, time.Second, false},
+	}
+	for i, tc := range tests {
+		config := DefaultKCPConfig
+		config.DialTimeout = tc.timeout
+		config.DialTimeoutMax = tc.max
+		if err := config.Validate(); (err == nil) != tc.ok {
+			t.Errorf("#%d: unexpected result %v", i, err)
+		}
+	}
+}
+
+func TestParseKCPConfigPartial(t *testing.T) {
+	config, err := ParseKCPConfig(strings.NewReader(`{"mode": "fast2", "mtu": 1200, "datashard": 0, "tcp": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := DefaultKCPConfig
+	want.Mode = "fast2"
+	want.MTU = 1200
+	want.DataShard = 0 // explicitly present
+	want.TCP = true
+	if *config != want {
+		t.Errorf("got %+v, want %+v", *config, want)
+	}
+
+	// the defaults are not modified.
+	if DefaultKCPConfig.MTU != 1350 || DefaultKCPConfig.DataShard != 10 {
+		t.Error("the default config should not be modified")
+	}
+
+	if _, err := ParseKCPConfig(strings.NewReader(`{"mtu": "1200"}`)); err == nil {
+		t.Error("invalid config should fail")
+	}
+}
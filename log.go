@@ -1,8 +1,16 @@
 package gost
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	golog "github.com/go-log/log"
 )
 
 func init() {
@@ -34,3 +42,69 @@ func (l *NopLogger) Log(v ...interface{}) {
 // Logf does nothing
 func (l *NopLogger) Logf(format string, v ...interface{}) {
 }
+
+// Fields are the structured fields of a log entry, e.g. node, protocol and addr.
+type Fields map[string]interface{}
+
+// FieldLogger is a logger which supports the structured fields.
+type FieldLogger interface {
+	golog.Logger
+	LogfFields(fields Fields, format string, v ...interface{})
+}
+
+// LogfWith logs the message with the structured fields if the logger supports,
+// otherwise the fields are dropped and the message is logged as Logf does.
+func LogfWith(fields Fields, format string, v ...interface{}) {
+	if l, ok := golog.DefaultLogger.(FieldLogger); ok {
+		l.LogfFields(fields, format, v...)
+		return
+	}
+	golog.Logf(format, v...)
+}
+
+// JSONLogger writes each log entry as a JSON object in a line,
+// with the time, level, message and the structured fields.
+type JSONLogger struct {
+	// Writer is the output, os.Stderr if nil.
+	Writer io.Writer
+	mux    sync.Mutex
+}
+
+// Log logs the values as fmt.Sprint does.
+func (l *JSONLogger) Log(v ...interface{}) {
+	l.LogfFields(nil, "%s", strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
+
+// Logf logs the formatted message.
+func (l *JSONLogger) Logf(format string, v ...interface{}) {
+	l.LogfFields(nil, format, v...)
+}
+
+// LogfFields logs the formatted message with the structured fields,
+// the fields named time, level or msg are ignored.
+func (l *JSONLogger) LogfFields(fields Fields, format string, v ...interface{}) {
+	entry := make(map[string]interface{}, len(fields)+3)
+	for k, v := range fields {
+		entry[k] = v
+	}
+	entry["time"] = time.Now().Format(time.RFC3339Nano)
+	entry["level"] = "info"
+	entry["msg"] = fmt.Sprintf(format, v...)
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		b, _ = json.Marshal(map[string]interface{}{
+			"time":  entry["time"],
+			"level": "error",
+			"msg":   fmt.Sprintf("log: %s: %s", err, entry["msg"]),
+		})
+	}
+
+	w := l.Writer
+	if w == nil {
+		w = os.Stderr
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	w.Write(append(b, '\n'))
+}
@@ -0,0 +1,43 @@
+package gost
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	golog "github.com/go-log/log"
+)
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := &JSONLogger{Writer: &buf}
+
+	old := golog.DefaultLogger
+	golog.DefaultLogger = l
+	defer func() { golog.DefaultLogger = old }()
+
+	LogfWith(Fields{"node": "red://:12345", "protocol": "red", "addr": ":12345", "msg": "ignored"},
+		"red node %v preserve src %v", "red://:12345", true)
+	l.Log("a", 1)
+
+	dec := json.NewDecoder(&buf)
+	var entry map[string]interface{}
+	if err := dec.Decode(&entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["msg"] != "red node red://:12345 preserve src true" || entry["level"] != "info" ||
+		entry["node"] != "red://:12345" || entry["protocol"] != "red" || entry["addr"] != ":12345" {
+		t.Errorf("unexpected entry %v", entry)
+	}
+	if _, ok := entry["time"].(string); !ok {
+		t.Errorf("entry should have the time, got %v", entry)
+	}
+
+	entry = nil
+	if err := dec.Decode(&entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["msg"] != "a 1" {
+		t.Errorf("unexpected entry %v", entry)
+	}
+}
@@ -0,0 +1,193 @@
+package gost
+
+import (
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics holds the counters of the routers, exported in the Prometheus text format.
+// It is a dedicated registry, so it does not collide with the other metrics of the process.
+type Metrics struct {
+	registry     *prometheus.Registry
+	handler      http.Handler
+	active       *prometheus.GaugeVec
+	maxConns     *prometheus.GaugeVec
+	accepted     *prometheus.CounterVec
+	bytesIn      *prometheus.CounterVec
+	bytesOut     *prometheus.CounterVec
+	dialFailures *prometheus.CounterVec
+	udpSessions  *prometheus.GaugeVec
+	routers      []*RouterMetrics
+	mux          sync.Mutex
+}
+
+var routerLabels = []string{"node", "protocol", "addr"}
+
+// NewMetrics creates an empty Metrics.
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		active: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gost_router_active_connections",
+			Help: "Number of the active connections.",
+		}, routerLabels),
+		maxConns: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gost_router_max_connections",
+			Help: "Max number of the active connections, 0 for unlimited.",
+		}, routerLabels),
+		accepted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gost_router_accepted_connections_total",
+			Help: "Total number of the accepted connections.",
+		}, routerLabels),
+		bytesIn: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gost_router_received_bytes_total",
+			Help: "Total bytes received from the clients.",
+		}, routerLabels),
+		bytesOut: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gost_router_sent_bytes_total",
+			Help: "Total bytes sent to the clients.",
+		}, routerLabels),
+		dialFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gost_router_dial_failures_total",
+			Help: "Total number of the failures to dial the upstream.",
+		}, routerLabels),
+		udpSessions: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gost_router_udp_sessions",
+			Help: "Number of the active UDP sessions.",
+		}, routerLabels),
+	}
+	m.registry.MustRegister(m.active, m.maxConns, m.accepted,
+		m.bytesIn, m.bytesOut, m.dialFailures, m.udpSessions)
+	m.handler = promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+	return m
+}
+
+// Router returns the counters of the router, which are created on the first call.
+// It returns nil for a nil Metrics, and the methods of a nil RouterMetrics do nothing.
+func (m *Metrics) Router(node, protocol, addr string) *RouterMetrics {
+	if m == nil {
+		return nil
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	for _, rm := range m.routers {
+		if rm.Node == node && rm.Protocol == protocol && rm.Addr == addr {
+			return rm
+		}
+	}
+	rm := &RouterMetrics{
+		Node:         node,
+		Protocol:     protocol,
+		Addr:         addr,
+		active:       m.active.WithLabelValues(node, protocol, addr),
+		maxConns:     m.maxConns.WithLabelValues(node, protocol, addr),
+		accepted:     m.accepted.WithLabelValues(node, protocol, addr),
+		bytesIn:      m.bytesIn.WithLabelValues(node, protocol, addr),
+		bytesOut:     m.bytesOut.WithLabelValues(node, protocol, addr),
+		dialFailures: m.dialFailures.WithLabelValues(node, protocol, addr),
+		udpSessions:  m.udpSessions.WithLabelValues(node, protocol, addr),
+	}
+	m.routers = append(m.routers, rm)
+	return rm
+}
+
+// ServeHTTP serves the metrics, e.g. on GET /metrics.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.handler.ServeHTTP(w, r)
+}
+
+// RouterMetrics is the counters of a router.
+type RouterMetrics struct {
+	Node         string
+	Protocol     string
+	Addr         string
+	active       prometheus.Gauge
+	maxConns     prometheus.Gauge
+	accepted     prometheus.Counter
+	bytesIn      prometheus.Counter
+	bytesOut     prometheus.Counter
+	dialFailures prometheus.Counter
+	udpSessions  prometheus.Gauge
+}
+
+// SetMaxConns sets the max number of the active connections of the router.
+func (rm *RouterMetrics) SetMaxConns(n int) {
+	if rm == nil {
+		return
+	}
+	rm.maxConns.Set(float64(n))
+}
+
+// DialFailed counts a failure to dial the upstream.
+func (rm *RouterMetrics) DialFailed() {
+	if rm == nil {
+		return
+	}
+	rm.dialFailures.Inc()
+}
+
+// addUDPSessions adds n to the number of the active UDP sessions.
+func (rm *RouterMetrics) addUDPSessions(n int64) {
+	if rm == nil {
+		return
+	}
+	rm.udpSessions.Add(float64(n))
+}
+
+// countConn counts the bytes transferred over the client connection conn.
+func (rm *RouterMetrics) countConn(conn net.Conn) net.Conn {
+	if rm == nil {
+		return conn
+	}
+	return &metricsConn{Conn: conn, metrics: rm}
+}
+
+type metricsConn struct {
+	net.Conn
+	metrics *RouterMetrics
+}
+
+func (c *metricsConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	c.metrics.bytesIn.Add(float64(n))
+	return
+}
+
+func (c *metricsConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	c.metrics.bytesOut.Add(float64(n))
+	return
+}
+
+func (c *metricsConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+type metricsHandler struct {
+	Handler
+	metrics *RouterMetrics
+}
+
+// MetricsHandler wraps the handler to count the accepted and active connections,
+// it returns h if rm is nil. The bytes and dial failures are counted by the handler
+// with the MetricsHandlerOption.
+func MetricsHandler(h Handler, rm *RouterMetrics) Handler {
+	if rm == nil {
+		return h
+	}
+	return &metricsHandler{Handler: h, metrics: rm}
+}
+
+func (h *metricsHandler) Handle(conn net.Conn) {
+	h.metrics.accepted.Inc()
+	h.metrics.active.Inc()
+	defer h.metrics.active.Dec()
+
+	h.Handler.Handle(conn)
+}
@@ -0,0 +1,131 @@
+package gost
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// scrapeMetrics returns the metrics served by m.
+func scrapeMetrics(m *Metrics) string {
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	return w.Body.String()
+}
+
+func TestMetrics(t *testing.T) {
+	target, err := idServer('a')
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	m := NewMetrics()
+	rm := m.Router("tcp://:0/"+target.Addr().String(), "tcp", ":0")
+	if m.Router("tcp://:0/"+target.Addr().String(), "tcp", ":0") != rm {
+		t.Fatal("the same router should share the counters")
+	}
+
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the address of a closed listener refuses the connections.
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.Close()
+	h := TCPDirectForwardHandler(target.Addr().String())
+	h.Init(MetricsHandlerOption(rm))
+	server := &Server{Listener: ln}
+	go server.Serve(MetricsHandler(h, rm))
+	defer server.Close()
+
+	for i := 0; i < 2; i++ {
+		if id, err := readID(ln.Addr().String()); err != nil || id != 'a' {
+			t.Fatalf("got %c, %v", id, err)
+		}
+	}
+
+	deadLn, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dh := TCPDirectForwardHandler(dead.Addr().String())
+	dh.Init(MetricsHandlerOption(rm))
+	deadServer := &Server{Listener: deadLn}
+	go deadServer.Serve(MetricsHandler(dh, rm))
+	defer deadServer.Close()
+	if conn, err := net.Dial("tcp", deadLn.Addr().String()); err == nil {
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		io.Copy(io.Discard, conn)
+		conn.Close()
+	}
+
+	// wait for the handlers to return.
+	for i := 0; i < 100 && server.Conns()+deadServer.Conns() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	metrics := scrapeMetrics(m)
+	// the labels are sorted by name.
+	labels := `{addr=":0",node="tcp://:0/` + target.Addr().String() + `",protocol="tcp"}`
+	for _, want := range []string{
+		"# TYPE gost_router_active_connections gauge",
+		"gost_router_active_connections" + labels + " 0",
+		"gost_router_accepted_connections_total" + labels + " 3",
+		"gost_router_sent_bytes_total" + labels + " 2",
+		"gost_router_dial_failures_total" + labels + " 1",
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("%q not found in\n%s", want, metrics)
+		}
+	}
+}
+
+func TestMetricsEscapeLabel(t *testing.T) {
+	m := NewMetrics()
+	m.Router("a\"b\\c\nd", "tcp", ":0")
+	if metrics := scrapeMetrics(m); !strings.Contains(metrics, `node="a\"b\\c\nd"`) {
+		t.Errorf("label not escaped:\n%s", metrics)
+	}
+
+	var nilMetrics *Metrics
+	if rm := nilMetrics.Router("", "", ""); rm != nil {
+		t.Error("nil metrics should return nil counters")
+	}
+	var rm *RouterMetrics
+	rm.DialFailed()
+	rm.SetMaxConns(1)
+}
+
+// testMetricsBytes checks the bytes counted by rm, which are added once the relay has read or written them.
+func testMetricsBytes(t *testing.T, rm *RouterMetrics, in, out float64) {
+	var gotIn, gotOut float64
+	for i := 0; i < 100; i++ {
+		gotIn, gotOut = testutil.ToFloat64(rm.bytesIn), testutil.ToFloat64(rm.bytesOut)
+		if gotIn == in && gotOut == out {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("got %v bytes in and %v bytes out, want %v and %v", gotIn, gotOut, in, out)
+}
+
+// testMetricsEcho echoes 4 bytes on conn relayed to the countEchoServer, and checks they are counted by rm.
+func testMetricsEcho(t *testing.T, conn net.Conn, rm *RouterMetrics) {
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	conn.Write([]byte("abcd"))
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+	testMetricsBytes(t, rm, 4, 4)
+}
@@ -0,0 +1,400 @@
+package gost
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-log/log"
+)
+
+// MgmtServer is the HTTP server for the management endpoints (admin, metrics).
+// If TLSConfig is set, the endpoints are served over TLS,
+// and client certificates are verified according to TLSConfig.ClientAuth.
+type MgmtServer struct {
+	Addr      string
+	TLSConfig *tls.Config
+	mux       *http.ServeMux
+	srv       *http.Server
+	once      sync.Once
+	servers   map[string][]*Server
+	resolvers []CacheResolver
+	groups    []*NodeGroup
+	listeners []mgmtListener
+	smux      sync.RWMutex
+}
+
+// NewMgmtServer creates a management server listening on addr.
+func NewMgmtServer(addr string, tlsConfig *tls.Config) *MgmtServer {
+	s := &MgmtServer{
+		Addr:      addr,
+		TLSConfig: tlsConfig,
+	}
+	s.init()
+	return s
+}
+
+func (s *MgmtServer) init() {
+	s.once.Do(func() {
+		s.mux = http.NewServeMux()
+		s.mux.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(Version + "\n"))
+		})
+		s.mux.HandleFunc("/admin/routers/", s.handleRouter)
+		s.mux.HandleFunc("/admin/dnscache", s.handleDNSCache)
+		s.mux.HandleFunc("/admin/selector/history", s.handleSelectorHistory)
+		s.mux.HandleFunc("/admin/listeners", s.handleListeners)
+		s.srv = &http.Server{
+			Handler:           s.mux,
+			ReadHeaderTimeout: 30 * time.Second,
+		}
+	})
+}
+
+// Handle registers the handler for the given pattern.
+func (s *MgmtServer) Handle(pattern string, handler http.Handler) {
+	s.init()
+	s.mux.Handle(pattern, handler)
+}
+
+// HandleFunc registers the handler function for the given pattern.
+func (s *MgmtServer) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	s.init()
+	s.mux.HandleFunc(pattern, handler)
+}
+
+// AddServer registers the server under the address addr for the admin endpoints,
+// e.g. POST /admin/routers/{addr}/pause. The servers of the same address, such as
+// the routers expanded from one serve node, are paused and resumed together.
+func (s *MgmtServer) AddServer(addr string, server *Server) {
+	s.smux.Lock()
+	defer s.smux.Unlock()
+
+	if s.servers == nil {
+		s.servers = make(map[string][]*Server)
+	}
+	for _, v := range s.servers[addr] {
+		if v == server {
+			return
+		}
+	}
+	s.servers[addr] = append(s.servers[addr], server)
+}
+
+type mgmtListener struct {
+	node   Node
+	server *Server
+}
+
+// ListenerStatus is a listener in GET /admin/listeners, the effective address
+// may differ from the configured one, e.g. after the sourceInterface substitution.
+type ListenerStatus struct {
+	Addr      string `json:"addr"`
+	Effective string `json:"effective"`
+	Transport string `json:"transport"`
+	Protocol  string `json:"protocol"`
+	Status    string `json:"status"`
+}
+
+// AddListener registers the server of the serve node for the admin endpoints,
+// e.g. GET /admin/listeners, and under the node address as AddServer does.
+func (s *MgmtServer) AddListener(node Node, server *Server) {
+	s.AddServer(node.Addr, server)
+
+	s.smux.Lock()
+	defer s.smux.Unlock()
+	s.listeners = append(s.listeners, mgmtListener{node: node, server: server})
+}
+
+// RemoveListener unregisters the server, e.g. of a router removed on reload.
+func (s *MgmtServer) RemoveListener(server *Server) {
+	s.smux.Lock()
+	defer s.smux.Unlock()
+
+	for addr, servers := range s.servers {
+		var kept []*Server
+		for _, v := range servers {
+			if v != server {
+				kept = append(kept, v)
+			}
+		}
+		if len(kept) > 0 {
+			s.servers[addr] = kept
+		} else {
+			delete(s.servers, addr)
+		}
+	}
+	for i, l := range s.listeners {
+		if l.server == server {
+			s.listeners = append(s.listeners[:i], s.listeners[i+1:]...)
+			break
+		}
+	}
+}
+
+// handleListeners handles GET /admin/listeners, which lists the configured and effective address,
+// the transport, protocol and status (running or paused) of each listener.
+func (s *MgmtServer) handleListeners(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.smux.RLock()
+	listeners := append([]mgmtListener(nil), s.listeners...)
+	s.smux.RUnlock()
+
+	statuses := []ListenerStatus{}
+	for _, l := range listeners {
+		status := ListenerStatus{
+			Addr:      l.node.Addr,
+			Transport: l.node.Transport,
+			Protocol:  l.node.Protocol,
+			Status:    "running",
+		}
+		if l.server.Listener != nil {
+			status.Effective = l.server.Addr().String()
+		}
+		if l.server.Paused() {
+			status.Status = "paused"
+		}
+		statuses = append(statuses, status)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
+
+// getServers returns the servers registered under addr, or the one listening on addr.
+func (s *MgmtServer) getServers(addr string) []*Server {
+	s.smux.RLock()
+	defer s.smux.RUnlock()
+
+	if servers := s.servers[addr]; len(servers) > 0 {
+		return append([]*Server(nil), servers...)
+	}
+	for _, servers := range s.servers {
+		for _, server := range servers {
+			if server.Listener != nil && server.Addr().String() == addr {
+				return []*Server{server}
+			}
+		}
+	}
+	return nil
+}
+
+// handleRouter handles POST /admin/routers/{addr}/pause|resume.
+func (s *MgmtServer) handleRouter(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/admin/routers/")
+	n := strings.LastIndexByte(path, '/')
+	if n <= 0 {
+		http.NotFound(w, r)
+		return
+	}
+	addr, action := path[:n], path[n+1:]
+	if action != "pause" && action != "resume" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	servers := s.getServers(addr)
+	if len(servers) == 0 {
+		http.Error(w, "router "+addr+" not found", http.StatusNotFound)
+		return
+	}
+	for _, server := range servers {
+		if action == "pause" {
+			server.Pause()
+		} else {
+			server.Resume()
+		}
+	}
+	log.Logf("[mgmt] router %s %sd", addr, action)
+	w.Write([]byte(action + "d\n"))
+}
+
+// AddResolver registers the resolver for the admin endpoints,
+// e.g. GET /admin/dnscache. The resolver without inspectable cache is ignored.
+func (s *MgmtServer) AddResolver(r Resolver) {
+	cr, ok := r.(CacheResolver)
+	if !ok {
+		return
+	}
+
+	s.smux.Lock()
+	defer s.smux.Unlock()
+
+	for _, v := range s.resolvers {
+		if v == cr {
+			return
+		}
+	}
+	s.resolvers = append(s.resolvers, cr)
+}
+
+// RemoveResolver unregisters the resolver.
+func (s *MgmtServer) RemoveResolver(r Resolver) {
+	cr, ok := r.(CacheResolver)
+	if !ok {
+		return
+	}
+
+	s.smux.Lock()
+	defer s.smux.Unlock()
+
+	// a new slice, the handlers iterate the old one without the lock.
+	resolvers := make([]CacheResolver, 0, len(s.resolvers))
+	for _, v := range s.resolvers {
+		if v != cr {
+			resolvers = append(resolvers, v)
+		}
+	}
+	s.resolvers = resolvers
+}
+
+// handleDNSCache handles GET /admin/dnscache to list the resolver cache entries,
+// and DELETE /admin/dnscache[?name=example.com] to flush the entries of the name or the whole cache.
+func (s *MgmtServer) handleDNSCache(w http.ResponseWriter, r *http.Request) {
+	s.smux.RLock()
+	resolvers := s.resolvers
+	s.smux.RUnlock()
+
+	switch r.Method {
+	case http.MethodGet:
+		entries := []ResolverCacheEntry{}
+		for _, cr := range resolvers {
+			entries = append(entries, cr.CacheEntries()...)
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			if entries[i].Name != entries[j].Name {
+				return entries[i].Name < entries[j].Name
+			}
+			return entries[i].Type < entries[j].Type
+		})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	case http.MethodDelete:
+		name := r.URL.Query().Get("name")
+		n := 0
+		for _, cr := range resolvers {
+			n += cr.FlushCache(name)
+		}
+		log.Logf("[mgmt] dns cache %q flushed, %d entries removed", name, n)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"flushed": n})
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// AddNodeGroup registers the node groups for the admin endpoints,
+// e.g. GET /admin/selector/history. The groups without history are ignored.
+func (s *MgmtServer) AddNodeGroup(groups ...*NodeGroup) {
+	s.smux.Lock()
+	defer s.smux.Unlock()
+
+	for _, group := range groups {
+		if group == nil || group.History() == nil {
+			continue
+		}
+		dup := false
+		for _, g := range s.groups {
+			dup = dup || g == group
+		}
+		if !dup {
+			s.groups = append(s.groups, group)
+		}
+	}
+}
+
+// RemoveNodeGroup unregisters the node groups.
+func (s *MgmtServer) RemoveNodeGroup(groups ...*NodeGroup) {
+	s.smux.Lock()
+	defer s.smux.Unlock()
+
+	kept := make([]*NodeGroup, 0, len(s.groups))
+	for _, g := range s.groups {
+		removed := false
+		for _, group := range groups {
+			removed = removed || g == group
+		}
+		if !removed {
+			kept = append(kept, g)
+		}
+	}
+	s.groups = kept
+}
+
+// handleSelectorHistory handles GET /admin/selector/history,
+// which lists the selection and failover events of each group.
+func (s *MgmtServer) handleSelectorHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	type groupHistory struct {
+		Group  int             `json:"group"`
+		Events []SelectorEvent `json:"events"`
+	}
+
+	s.smux.RLock()
+	groups := append([]*NodeGroup(nil), s.groups...)
+	s.smux.RUnlock()
+
+	history := []groupHistory{}
+	for _, group := range groups {
+		history = append(history, groupHistory{Group: group.ID, Events: group.History()})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
+// Listen announces on the server address.
+func (s *MgmtServer) Listen() (net.Listener, error) {
+	addr := s.Addr
+	if addr == "" {
+		addr = ":0"
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if s.TLSConfig != nil {
+		ln = tls.NewListener(ln, s.TLSConfig)
+	}
+	return ln, nil
+}
+
+// Serve serves the management endpoints on the listener ln.
+func (s *MgmtServer) Serve(ln net.Listener) error {
+	s.init()
+	return s.srv.Serve(ln)
+}
+
+// ListenAndServe listens on the server address and then serves the management endpoints.
+func (s *MgmtServer) ListenAndServe() error {
+	ln, err := s.Listen()
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Close closes the server.
+func (s *MgmtServer) Close() error {
+	s.init()
+	return s.srv.Close()
+}
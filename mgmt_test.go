@@ -0,0 +1,478 @@
+package gost
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// genTestCert creates a certificate for the DNS names signed by parent,
+// it is self-signed (and a CA) if parent is nil.
+func genTestCert(parent *tls.Certificate, usage x509.ExtKeyUsage, dnsNames ...string) (tls.Certificate, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"gost"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{usage},
+		BasicConstraintsValid: true,
+		DNSNames:              dnsNames,
+	}
+
+	signer, signerKey := tmpl, interface{}(priv)
+	if parent == nil {
+		tmpl.IsCA = true
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &priv.PublicKey, signerKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  priv,
+		Leaf:        leaf,
+	}, nil
+}
+
+func mgmtGet(url string, cert *tls.Certificate) (int, error) {
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	if cert != nil {
+		tr.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+	}
+	defer tr.CloseIdleConnections()
+
+	client := &http.Client{Transport: tr, Timeout: 3 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
+
+func TestMgmtServerClientCert(t *testing.T) {
+	ca, err := genTestCert(nil, x509.ExtKeyUsageAny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := genTestCert(&ca, x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rogueCA, err := genTestCert(nil, x509.ExtKeyUsageAny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rogue, err := genTestCert(&rogueCA, x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, err := GenCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	s := NewMgmtServer("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	ln, err := s.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+	defer s.Close()
+
+	addr := ln.Addr().String()
+
+	if status, err := mgmtGet("https://"+addr+"/version", &client); err != nil || status != http.StatusOK {
+		t.Errorf("valid client cert should be accepted, got %d, %v", status, err)
+	}
+	if _, err := mgmtGet("https://"+addr+"/version", nil); err == nil {
+		t.Error("request without client cert should be rejected")
+	}
+	if _, err := mgmtGet("https://"+addr+"/version", &rogue); err == nil {
+		t.Error("request with untrusted client cert should be rejected")
+	}
+	if status, err := mgmtGet("http://"+addr+"/version", nil); err == nil && status == http.StatusOK {
+		t.Error("plaintext request should be rejected")
+	}
+}
+
+func TestMgmtServerPlain(t *testing.T) {
+	s := NewMgmtServer("127.0.0.1:0", nil)
+	s.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("pong"))
+	})
+	ln, err := s.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+	defer s.Close()
+
+	if status, err := mgmtGet("http://"+ln.Addr().String()+"/ping", nil); err != nil || status != http.StatusOK {
+		t.Errorf("got %d, %v", status, err)
+	}
+}
+
+func TestMgmtServerPauseRouter(t *testing.T) {
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &blockHandler{release: make(chan struct{})}
+	defer close(h.release)
+	server := &Server{Listener: ln}
+	go server.Serve(h)
+	defer server.Close()
+
+	other := &Server{}
+
+	s := NewMgmtServer("127.0.0.1:0", nil)
+	s.AddServer(":8080", other)
+	s.AddServer(ln.Addr().String(), server)
+	mln, err := s.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(mln)
+	defer s.Close()
+
+	post := func(path string) int {
+		resp, err := http.Post("http://"+mln.Addr().String()+path, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	addr := ln.Addr().String()
+	if status := post("/admin/routers/" + addr + "/pause"); status != http.StatusOK {
+		t.Fatalf("pause: got %d", status)
+	}
+	if !server.Paused() || other.Paused() {
+		t.Error("only the specified router should be paused")
+	}
+	if _, ok := accepted(addr); ok {
+		t.Error("paused router should refuse new connections")
+	}
+
+	if status := post("/admin/routers/" + addr + "/resume"); status != http.StatusOK {
+		t.Fatalf("resume: got %d", status)
+	}
+	conn, ok := accepted(addr)
+	if !ok {
+		t.Fatal("resumed router should accept new connections")
+	}
+	conn.Close()
+
+	if status := post("/admin/routers/127.0.0.1:1/pause"); status != http.StatusNotFound {
+		t.Errorf("unknown router: got %d", status)
+	}
+	if status := post("/admin/routers/" + addr + "/stop"); status != http.StatusNotFound {
+		t.Errorf("unknown action: got %d", status)
+	}
+	if status, _ := mgmtGet("http://"+mln.Addr().String()+"/admin/routers/"+addr+"/pause", nil); status != http.StatusMethodNotAllowed {
+		t.Errorf("GET: got %d", status)
+	}
+}
+
+func TestMgmtServerPauseSameAddr(t *testing.T) {
+	// the routers expanded from one serve node, e.g. by sourceInterfaceFamily=both.
+	s1, s2 := &Server{}, &Server{}
+
+	s := NewMgmtServer("127.0.0.1:0", nil)
+	s.AddServer(":8080", s1)
+	s.AddServer(":8080", s2)
+	mln, err := s.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(mln)
+	defer s.Close()
+
+	post := func(path string) int {
+		resp, err := http.Post("http://"+mln.Addr().String()+path, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := post("/admin/routers/:8080/pause"); status != http.StatusOK {
+		t.Fatalf("pause: got %d", status)
+	}
+	if !s1.Paused() || !s2.Paused() {
+		t.Error("the routers of the same address should be paused together")
+	}
+
+	s.RemoveListener(s1)
+	if status := post("/admin/routers/:8080/resume"); status != http.StatusOK {
+		t.Fatalf("resume: got %d", status)
+	}
+	if !s1.Paused() || s2.Paused() {
+		t.Error("only the registered router should be resumed")
+	}
+	s.RemoveListener(s2)
+	if status := post("/admin/routers/:8080/resume"); status != http.StatusNotFound {
+		t.Errorf("removed routers should not be found, got %d", status)
+	}
+}
+
+func TestMgmtServerDNSCache(t *testing.T) {
+	ex := &stubExchanger{}
+	r := newResolver(0, NameServer{exchanger: ex})
+	if _, err := r.Resolve("example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// an expired entry not evicted yet.
+	mr := &dns.Msg{}
+	mr.SetQuestion("stale.example.com.", dns.TypeA)
+	mr.Answer = append(mr.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "stale.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(192, 168, 1, 2),
+	})
+	r.cache.m.Store(newResolverCacheKey(&mr.Question[0]), &resolverCacheItem{
+		mr: mr,
+		ts: time.Now().Add(-2 * time.Minute).Unix(),
+	})
+
+	s := NewMgmtServer("127.0.0.1:0", nil)
+	s.AddResolver(r)
+	s.AddResolver(r)
+	ln, err := s.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+	defer s.Close()
+
+	url := "http://" + ln.Addr().String() + "/admin/dnscache"
+	list := func() map[string]ResolverCacheEntry {
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var entries []ResolverCacheEntry
+		if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+			t.Fatal(err)
+		}
+		m := make(map[string]ResolverCacheEntry)
+		for _, e := range entries {
+			m[e.Name+e.Type] = e
+		}
+		return m
+	}
+	flush := func(query string) int {
+		req, _ := http.NewRequest(http.MethodDelete, url+query, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var v map[string]int
+		json.NewDecoder(resp.Body).Decode(&v)
+		return v["flushed"]
+	}
+
+	// the empty AAAA reply has no TTL and is not cached.
+	entries := list()
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %v", entries)
+	}
+	e := entries["example.com.A"]
+	if len(e.Addresses) != 1 || e.Addresses[0] != "192.168.1.1" || e.TTL <= 0 || e.TTL > 60 || e.Stale {
+		t.Errorf("unexpected entry %+v", e)
+	}
+	if e := entries["stale.example.com.A"]; !e.Stale || e.TTL != 0 {
+		t.Errorf("entry should be stale, got %+v", e)
+	}
+
+	if n := flush("?name=Example.com"); n != 1 {
+		t.Errorf("expected 1 entry flushed, got %d", n)
+	}
+	if entries := list(); len(entries) != 1 {
+		t.Errorf("expected 1 entry left, got %v", entries)
+	}
+	if n := flush(""); n != 1 {
+		t.Errorf("expected 1 entry flushed, got %d", n)
+	}
+	if entries := list(); len(entries) != 0 {
+		t.Errorf("cache should be empty, got %v", entries)
+	}
+}
+
+func TestMgmtServerSelectorHistory(t *testing.T) {
+	node, err := ParseNode("http://1.1.1.1:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.ID = 1
+	group := NewNodeGroup(node)
+	group.ID = 2
+	group.SetHistory(8)
+	noHistory := NewNodeGroup(node)
+
+	s := NewMgmtServer("127.0.0.1:0", nil)
+	s.AddNodeGroup(group, noHistory, group)
+	ln, err := s.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+	defer s.Close()
+
+	n, _ := group.Next()
+	n.MarkDead()
+
+	resp, err := http.Get("http://" + ln.Addr().String() + "/admin/selector/history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var history []struct {
+		Group  int
+		Events []SelectorEvent
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].Group != 2 {
+		t.Fatalf("only the group with history should be listed, got %+v", history)
+	}
+	events := history[0].Events
+	if len(events) != 2 || events[0].Event != "select" || events[1].Event != "fail" || events[1].Fails != 1 {
+		t.Errorf("unexpected events %+v", events)
+	}
+
+	resp, err = http.Post("http://"+ln.Addr().String()+"/admin/selector/history", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST should not be allowed, got %d", resp.StatusCode)
+	}
+}
+
+func TestMgmtServerRemove(t *testing.T) {
+	r := newResolver(0, NameServer{exchanger: &stubExchanger{}})
+	other := newResolver(0, NameServer{exchanger: &stubExchanger{}})
+	group := NewNodeGroup()
+	group.SetHistory(8)
+	kept := NewNodeGroup()
+	kept.SetHistory(8)
+
+	s := NewMgmtServer("127.0.0.1:0", nil)
+	s.AddResolver(r)
+	s.AddResolver(other)
+	s.AddNodeGroup(group, kept)
+
+	resolvers := s.resolvers
+	s.RemoveResolver(r)
+	s.RemoveNodeGroup(group)
+	if len(s.resolvers) != 1 || s.resolvers[0] != other {
+		t.Errorf("resolvers %v, want only the other one", s.resolvers)
+	}
+	if len(s.groups) != 1 || s.groups[0] != kept {
+		t.Errorf("groups %v, want only the kept one", s.groups)
+	}
+	// the slice being iterated by the handlers is not changed.
+	if len(resolvers) != 2 || resolvers[0] != r {
+		t.Errorf("the old resolver list is changed: %v", resolvers)
+	}
+}
+
+func TestMgmtServerListeners(t *testing.T) {
+	// the listener bound to the interface address substituted for the configured one.
+	node, err := ParseNode("relay+tcp://:0?sourceInterface=lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{Listener: ln}
+	defer server.Close()
+
+	s := NewMgmtServer("127.0.0.1:0", nil)
+	s.AddListener(node, server)
+	mln, err := s.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(mln)
+	defer s.Close()
+
+	list := func() []ListenerStatus {
+		resp, err := http.Get("http://" + mln.Addr().String() + "/admin/listeners")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var statuses []ListenerStatus
+		if err := json.NewDecoder(resp.Body).Decode(&statuses); err != nil {
+			t.Fatal(err)
+		}
+		if len(statuses) != 1 {
+			t.Fatalf("unexpected listeners %+v", statuses)
+		}
+		return statuses
+	}
+
+	status := list()[0]
+	want := ListenerStatus{
+		Addr:      ":0",
+		Effective: ln.Addr().String(),
+		Transport: "tcp",
+		Protocol:  "relay",
+		Status:    "running",
+	}
+	if status != want {
+		t.Errorf("got %+v, want %+v", status, want)
+	}
+
+	server.Pause()
+	if status := list()[0]; status.Status != "paused" {
+		t.Errorf("paused listener should be listed as paused, got %s", status.Status)
+	}
+}
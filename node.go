@@ -3,6 +3,7 @@ package gost
 import (
 	"errors"
 	"fmt"
+	"net"
 	"net/url"
 	"strconv"
 	"strings"
@@ -33,8 +34,16 @@ type Node struct {
 	marker           *failMarker
 	Bypass           *Bypass
 	// EMOD:
-	PreserveSrc      bool
-	ProxyNetns       string
+	PreserveSrc bool
+	ProxyNetns  string
+	// the resolver for the node address, the system resolver is used if it is nil.
+	Resolver Resolver
+	// the weight of the node for the weighted strategy.
+	Weight int
+	// race the available nodes of the group (one per IP) when it is the first hop.
+	DialParallel bool
+	// the TCP keepalive period of the connections to the node, zero keeps the default, negative disables it.
+	KeepAlive time.Duration
 }
 
 // ParseNode parses the node info.
@@ -94,6 +103,10 @@ func ParseNode(s string) (node Node, err error) {
 	case "dns":
 	case "redu", "redirectu": // UDP tproxy
 	case "vsock":
+	case "quic": // QUIC over UDP
+	case "unix": // the address is the path of the socket file
+		node.Addr = u.Path
+		node.Remote = ""
 	default:
 		node.Transport = "tcp"
 	}
@@ -192,6 +205,7 @@ type NodeGroup struct {
 	nodes           []Node
 	selectorOptions []SelectOption
 	selector        NodeSelector
+	history         *selectorHistory
 	mux             sync.RWMutex
 }
 
@@ -211,6 +225,7 @@ func (group *NodeGroup) AddNode(node ...Node) {
 	defer group.mux.Unlock()
 
 	group.nodes = append(group.nodes, node...)
+	group.attachHistory(node)
 }
 
 // SetNodes replaces the group nodes to the specified nodes,
@@ -225,9 +240,106 @@ func (group *NodeGroup) SetNodes(nodes ...Node) []Node {
 
 	old := group.nodes
 	group.nodes = nodes
+	group.attachHistory(nodes)
 	return old
 }
 
+// SetHistory keeps the history of the last size selection and failover events of the group,
+// zero size disables the history.
+func (group *NodeGroup) SetHistory(size int) {
+	if group == nil {
+		return
+	}
+	group.mux.Lock()
+	defer group.mux.Unlock()
+
+	group.history = nil
+	if size > 0 {
+		group.history = newSelectorHistory(size)
+	}
+	group.attachHistory(group.nodes)
+}
+
+// History returns the selection and failover events of the group, from the oldest to the latest.
+func (group *NodeGroup) History() []SelectorEvent {
+	if group == nil {
+		return nil
+	}
+	group.mux.RLock()
+	defer group.mux.RUnlock()
+
+	return group.history.list()
+}
+
+func (group *NodeGroup) attachHistory(nodes []Node) {
+	for i := range nodes {
+		nodes[i].marker.attach(group.history, group.ID, nodes[i])
+	}
+}
+
+// NodeStatus is the status of a node in the group.
+type NodeStatus struct {
+	Group     int    `json:"group"`
+	ID        int    `json:"id"`
+	Addr      string `json:"addr"`
+	FailCount uint32 `json:"failCount"`
+	Available bool   `json:"available"`
+}
+
+// Status returns the status of the nodes in the group,
+// a node is available if the filters of the selector keep it.
+func (group *NodeGroup) Status() []NodeStatus {
+	if group == nil {
+		return nil
+	}
+
+	group.mux.RLock()
+	defer group.mux.RUnlock()
+
+	available := group.available()
+
+	status := make([]NodeStatus, 0, len(group.nodes))
+	for _, node := range group.nodes {
+		st := NodeStatus{Group: group.ID, ID: node.ID, Addr: node.Addr}
+		if node.marker != nil {
+			st.FailCount = node.marker.FailCount()
+		}
+		for _, nd := range available {
+			if nd.ID == node.ID && nd.Addr == node.Addr {
+				st.Available = true
+				break
+			}
+		}
+		status = append(status, st)
+	}
+	return status
+}
+
+// available returns the nodes passing the filters of the selector, the caller holds the lock.
+func (group *NodeGroup) available() []Node {
+	var sopts SelectOptions
+	for _, opt := range group.selectorOptions {
+		opt(&sopts)
+	}
+	available := group.nodes
+	for _, filter := range sopts.Filters {
+		available = filter.Filter(available)
+	}
+	return available
+}
+
+// Available returns the nodes of the group passing the filters of the selector, e.g. the FailFilter.
+func (group *NodeGroup) Available() []Node {
+	if group == nil {
+		return nil
+	}
+
+	group.mux.RLock()
+	defer group.mux.RUnlock()
+
+	return append([]Node(nil), group.available()...)
+}
+
 // SetSelector sets node selector with options for the group.
 func (group *NodeGroup) SetSelector(selector NodeSelector, opts ...SelectOption) {
 	if group == nil {
@@ -266,6 +378,11 @@ func (group *NodeGroup) GetNode(i int) Node {
 // Next selects a node from group.
 // It also selects IP if the IP list exists.
 func (group *NodeGroup) Next() (node Node, err error) {
+	return group.NextFor(nil)
+}
+
+// NextFor selects a node from group for the client, e.g. by the sourcehash strategy.
+func (group *NodeGroup) NextFor(client net.Addr) (node Node, err error) {
 	if group == nil {
 		return
 	}
@@ -279,10 +396,15 @@ func (group *NodeGroup) Next() (node Node, err error) {
 	}
 
 	// select node from node group
-	node, err = selector.Select(group.nodes, group.selectorOptions...)
+	opts := group.selectorOptions
+	if client != nil {
+		opts = append(opts[:len(opts):len(opts)], WithClientAddr(client))
+	}
+	node, err = selector.Select(group.nodes, opts...)
 	if err != nil {
 		return
 	}
+	group.history.add(SelectorEvent{Group: group.ID, Node: node.ID, Addr: node.Addr, Event: "select"})
 
 	return
 }
@@ -28,6 +28,8 @@ var nodeTests = []struct {
 	{"rtcp://:8080/:8081", Node{Addr: ":8080", Remote: ":8081", Protocol: "rtcp", Transport: "rtcp"}, false},
 	{"rudp://:8080/:8081", Node{Addr: ":8080", Remote: ":8081", Protocol: "rudp", Transport: "rudp"}, false},
 	{"redirect://:8080", Node{Addr: ":8080", Protocol: "redirect", Transport: "tcp"}, false},
+	{"unix:///run/gost.sock", Node{Addr: "/run/gost.sock", Transport: "unix"}, false},
+	{"socks5+unix:///run/gost.sock", Node{Addr: "/run/gost.sock", Protocol: "socks5", Transport: "unix"}, false},
 }
 
 func TestParseNode(t *testing.T) {
@@ -1,11 +1,17 @@
 package gost
 
 import (
+	"bufio"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/netip"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	glob "github.com/ryanuber/go-glob"
 )
@@ -143,7 +149,7 @@ func ParsePermissions(s string) (*Permissions, error) {
 	perms := strings.Split(s, " ")
 
 	for _, perm := range perms {
-		parts := strings.Split(perm, ":")
+		parts := splitPermission(perm)
 
 		switch len(parts) {
 		case 3:
@@ -156,7 +162,15 @@ func ParsePermissions(s string) (*Permissions, error) {
 			hosts, err := ParseStringSet(parts[1])
 
 			if err != nil {
-				return nil, fmt.Errorf("hosts list must look like google.pl,*.google.com given: %s", parts[1])
+				return nil, fmt.Errorf("hosts list must look like google.pl,*.google.com,.internal,10.0.0.0/8 given: %s", parts[1])
+			}
+
+			for _, host := range *hosts {
+				if strings.Contains(host, "/") {
+					if _, err := netip.ParsePrefix(host); err != nil {
+						return nil, fmt.Errorf("invalid CIDR %q in hosts of %s", host, perm)
+					}
+				}
 			}
 
 			ports, err := ParsePortSet(parts[2])
@@ -176,10 +190,54 @@ func ParsePermissions(s string) (*Permissions, error) {
 	return ps, nil
 }
 
+// splitPermission splits the permission into the actions, hosts and ports,
+// the hosts may contain the colons of the IPv6 addresses and CIDRs.
+func splitPermission(perm string) []string {
+	i := strings.Index(perm, ":")
+	j := strings.LastIndex(perm, ":")
+	if i < 0 || i == j {
+		return []string{perm}
+	}
+	return []string{perm[:i], perm[i+1 : j], perm[j+1:]}
+}
+
+// matchHost checks whether the host matches the pattern.
+// The pattern may be a CIDR such as 10.0.0.0/8 matching the IP host within it,
+// a domain suffix such as .internal matching the domain and its subdomains, or a glob pattern.
+func matchHost(pattern, host string) bool {
+	if strings.Contains(pattern, "/") {
+		prefix, err := netip.ParsePrefix(pattern)
+		if err != nil {
+			return false
+		}
+		ip, err := netip.ParseAddr(host)
+		if err != nil {
+			return false
+		}
+		return prefix.Contains(ip.Unmap().WithZone(""))
+	}
+	if strings.HasPrefix(pattern, ".") && len(pattern) > 1 {
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		suffix := strings.ToLower(pattern)
+		return host == suffix[1:] || strings.HasSuffix(host, suffix)
+	}
+	return glob.Glob(pattern, host)
+}
+
+// containsHost checks whether the host matches one of the host patterns of this Permission.
+func (p *Permission) containsHost(host string) bool {
+	for _, pattern := range p.Hosts {
+		if matchHost(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
 // Can tests whether the given action and host:port is allowed by this Permissions.
 func (ps *Permissions) Can(action string, host string, port int) bool {
 	for _, p := range *ps {
-		if p.Actions.Contains(action) && p.Hosts.Contains(host) && p.Ports.Contains(port) {
+		if p.Actions.Contains(action) && p.containsHost(host) && p.Ports.Contains(port) {
 			return true
 		}
 	}
@@ -187,6 +245,93 @@ func (ps *Permissions) Can(action string, host string, port int) bool {
 	return false
 }
 
+// PermissionsReloader is the Permissions reloaded from a file,
+// the reloaded Permissions is swapped atomically so that the checks in progress are not affected.
+type PermissionsReloader struct {
+	ps      atomic.Pointer[Permissions]
+	period  atomic.Int64
+	stopped chan struct{}
+}
+
+// NewPermissionsReloader creates a PermissionsReloader with the initial Permissions ps.
+func NewPermissionsReloader(ps *Permissions) *PermissionsReloader {
+	pr := &PermissionsReloader{stopped: make(chan struct{})}
+	pr.ps.Store(ps)
+	return pr
+}
+
+// Permissions returns the current Permissions, nil if pr is nil.
+func (pr *PermissionsReloader) Permissions() *Permissions {
+	if pr == nil {
+		return nil
+	}
+	return pr.ps.Load()
+}
+
+// Reload parses the permissions, one or more per line, and the reload period option.
+// The current Permissions is kept if any permission is invalid.
+func (pr *PermissionsReloader) Reload(r io.Reader) error {
+	var perms []string
+	var period time.Duration
+
+	if r == nil || pr.Stopped() {
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		ss := splitLine(scanner.Text())
+		if len(ss) == 0 {
+			continue
+		}
+		if ss[0] == "reload" { // reload option
+			if len(ss) > 1 {
+				period, _ = time.ParseDuration(ss[1])
+			}
+			continue
+		}
+		perms = append(perms, ss...)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	ps, err := ParsePermissions(strings.Join(perms, " "))
+	if err != nil {
+		return err
+	}
+	pr.ps.Store(ps)
+	pr.period.Store(int64(period))
+	return nil
+}
+
+// Period returns the reload period.
+func (pr *PermissionsReloader) Period() time.Duration {
+	if pr.Stopped() {
+		return -1
+	}
+	return time.Duration(pr.period.Load())
+}
+
+// Stop stops reloading.
+func (pr *PermissionsReloader) Stop() {
+	select {
+	case <-pr.stopped:
+	default:
+		close(pr.stopped)
+	}
+}
+
+// Stopped checks whether the reloader is stopped.
+func (pr *PermissionsReloader) Stopped() bool {
+	select {
+	case <-pr.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
 func minint(x, y int) int {
 	if x < y {
 		return x
@@ -221,3 +366,98 @@ func Can(action string, addr string, whitelist, blacklist *Permissions) bool {
 	return (whitelist == nil || whitelist.Can(action, host, port)) &&
 		(blacklist == nil || !blacklist.Can(action, host, port))
 }
+
+// PeerAllow is an allowlist of the peers, which gates the connections before any handshake.
+// A peer is allowed if its source IP matches one of the IPs or CIDRs,
+// or the identity (common name or DNS SAN) of its TLS client certificate matches one of the names.
+type PeerAllow struct {
+	nets  []*net.IPNet
+	names StringSet
+}
+
+// ParsePeerAllow parses the comma-separated list of IPs, CIDRs and client certificate identities
+// with the prefix "cert:", e.g. "10.0.0.0/8,192.168.1.1,cert:relay.example.com".
+func ParsePeerAllow(s string) (*PeerAllow, error) {
+	pa := &PeerAllow{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if name := strings.TrimPrefix(item, "cert:"); name != item {
+			pa.names = append(pa.names, name)
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid peer: %s", item)
+			}
+			if ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		pa.nets = append(pa.nets, ipNet)
+	}
+	if len(pa.nets) == 0 && len(pa.names) == 0 {
+		return nil, errors.New("empty peer allowlist")
+	}
+	return pa, nil
+}
+
+// AllowAddr tests whether the source address is allowed.
+func (pa *PeerAllow) AllowAddr(addr net.Addr) bool {
+	if pa == nil {
+		return true
+	}
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+			ip = net.ParseIP(host)
+		}
+	}
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range pa.nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasNames reports whether the allowlist contains client certificate identities.
+func (pa *PeerAllow) HasNames() bool {
+	return pa != nil && len(pa.names) > 0
+}
+
+// AllowCert tests whether the identity of the client certificate is allowed.
+func (pa *PeerAllow) AllowCert(cert *x509.Certificate) bool {
+	if pa == nil {
+		return true
+	}
+	if cert == nil {
+		return false
+	}
+	if pa.names.Contains(cert.Subject.CommonName) {
+		return true
+	}
+	for _, name := range cert.DNSNames {
+		if pa.names.Contains(name) {
+			return true
+		}
+	}
+	return false
+}
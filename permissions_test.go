@@ -1,8 +1,13 @@
 package gost
 
 import (
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"fmt"
+	"net"
+	"strings"
 	"testing"
+	"time"
 )
 
 var portRangeTests = []struct {
@@ -150,3 +155,141 @@ func TestPermissionsParse(t *testing.T) {
 		}
 	}
 }
+
+func TestPermissionsCIDRAndSuffix(t *testing.T) {
+	ps, err := ParsePermissions("connect:10.0.0.0/8,fd00::/8,.internal:* connect:127.0.0.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		addr string
+		can  bool
+	}{
+		{"10.1.2.3:443", true},
+		{"11.1.2.3:443", false},
+		{"[fd00::1]:22", true},
+		{"[fe80::1]:22", false},
+		{"internal:80", true},
+		{"svc.internal:80", true},
+		{"a.svc.INTERNAL:8080", true},
+		{"myinternal:80", false},
+		{"internal.com:80", false},
+		{"127.0.0.1:80", true},
+		{"127.0.0.1:81", false},
+	}
+	for _, test := range tests {
+		if can := Can("connect", test.addr, ps, nil); can != test.can {
+			t.Errorf("Can(connect, %s): got %v, want %v", test.addr, can, test.can)
+		}
+		if can := Can("connect", test.addr, nil, ps); can == test.can {
+			t.Errorf("Can(connect, %s) by blacklist: got %v, want %v", test.addr, can, !test.can)
+		}
+	}
+
+	for _, s := range []string{"connect:10.0.0.0/33:*", "connect:foo/8:80"} {
+		_, err := ParsePermissions(s)
+		if err == nil || !strings.Contains(err.Error(), "invalid CIDR") {
+			t.Errorf("ParsePermissions(%q): got error %v, want invalid CIDR", s, err)
+		}
+	}
+}
+
+func TestPeerAllow(t *testing.T) {
+	pa, err := ParsePeerAllow("10.0.0.0/8, 192.168.1.1,::1,cert:*.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		addr    string
+		allowed bool
+	}{
+		{"10.1.2.3:1234", true},
+		{"192.168.1.1:1234", true},
+		{"192.168.1.2:1234", false},
+		{"[::1]:1234", true},
+		{"127.0.0.1:1234", false},
+	} {
+		addr, _ := net.ResolveTCPAddr("tcp", tc.addr)
+		if v := pa.AllowAddr(addr); v != tc.allowed {
+			t.Errorf("%s: allowed should be %v", tc.addr, tc.allowed)
+		}
+	}
+
+	for _, tc := range []struct {
+		cert    *x509.Certificate
+		allowed bool
+	}{
+		{nil, false},
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "relay.example.com"}}, true},
+		{&x509.Certificate{DNSNames: []string{"other.com", "relay.example.com"}}, true},
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "relay.example.org"}}, false},
+	} {
+		if v := pa.AllowCert(tc.cert); v != tc.allowed {
+			t.Errorf("%v: allowed should be %v", tc.cert, tc.allowed)
+		}
+	}
+
+	for _, s := range []string{"", "10.0.0.0/33", "example.com"} {
+		if _, err := ParsePeerAllow(s); err == nil {
+			t.Errorf("%q should be invalid", s)
+		}
+	}
+}
+
+func TestPermissionsReloader(t *testing.T) {
+	pr := NewPermissionsReloader(nil)
+	if pr.Permissions() != nil || (*PermissionsReloader)(nil).Permissions() != nil {
+		t.Fatal("the initial permissions should be nil")
+	}
+
+	err := pr.Reload(strings.NewReader(`
+# allow the web ports
+tcp:*.example.com:80,443
+udp:*:53   tcp:10.0.0.1:22
+reload 10s
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &HandlerOptions{WhitelistReloader: pr}
+	for _, tc := range []struct {
+		action, addr string
+		can          bool
+	}{
+		{"tcp", "www.example.com:443", true},
+		{"tcp", "www.example.com:8080", false},
+		{"udp", "1.1.1.1:53", true},
+		{"tcp", "10.0.0.1:22", true},
+		{"tcp", "10.0.0.2:22", false},
+	} {
+		if can := opts.can(tc.action, tc.addr); can != tc.can {
+			t.Errorf("%s %s: got %v, want %v", tc.action, tc.addr, can, tc.can)
+		}
+	}
+	if period := pr.Period(); period != 10*time.Second {
+		t.Errorf("period: got %v, want 10s", period)
+	}
+
+	// the invalid permissions do not replace the current ones.
+	ps := pr.Permissions()
+	if err := pr.Reload(strings.NewReader("tcp:*.example.com")); err == nil {
+		t.Error("the invalid permission should fail")
+	}
+	if pr.Permissions() != ps {
+		t.Error("the current permissions should be kept")
+	}
+
+	// the reloaded permissions replace the current ones.
+	if err := pr.Reload(strings.NewReader("tcp:*:8080")); err != nil {
+		t.Fatal(err)
+	}
+	if opts.can("tcp", "www.example.com:443") || !opts.can("tcp", "www.example.com:8080") {
+		t.Error("the reloaded permissions should be used")
+	}
+
+	pr.Stop()
+	if pr.Period() >= 0 {
+		t.Error("the stopped reloader should have a negative period")
+	}
+}
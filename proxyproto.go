@@ -0,0 +1,328 @@
+package gost
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-log/log"
+)
+
+// proxyProtoV2Sig is the signature of the PROXY protocol v2 header.
+var proxyProtoV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// The PROXY protocol v2 command and address family bytes.
+const (
+	proxyProtoV2Local = 0x20
+	proxyProtoV2Proxy = 0x21
+	proxyProtoV2TCP4  = 0x11
+	proxyProtoV2TCP6  = 0x21
+)
+
+// proxyProtoAddrs returns the IPs and ports of the TCP addresses src and dst in the same family,
+// the IPv4 addresses are mapped to IPv6 if the other one is IPv6. ok is false if any one is not a TCP address.
+func proxyProtoAddrs(src, dst net.Addr) (srcIP, dstIP net.IP, srcPort, dstPort int, ok bool) {
+	s, _ := src.(*net.TCPAddr)
+	d, _ := dst.(*net.TCPAddr)
+	if s == nil || d == nil || s.IP == nil || d.IP == nil {
+		return
+	}
+	srcIP, dstIP = s.IP.To4(), d.IP.To4()
+	if srcIP == nil || dstIP == nil {
+		srcIP, dstIP = s.IP.To16(), d.IP.To16()
+	}
+	return srcIP, dstIP, s.Port, d.Port, true
+}
+
+// proxyProtoIP returns the text of the IP in the family of its length,
+// the IPv4-mapped IPv6 address is not shortened to the IPv4 form as net.IP does.
+func proxyProtoIP(ip net.IP) string {
+	addr, _ := netip.AddrFromSlice(ip)
+	return addr.String()
+}
+
+// proxyProtoHeader returns the PROXY protocol header of the given version (1 or 2)
+// carrying the client source src and the destination dst. If they are not TCP addresses,
+// the header of the unknown (v1) or local (v2) connection is returned.
+func proxyProtoHeader(version int, src, dst net.Addr) ([]byte, error) {
+	srcIP, dstIP, srcPort, dstPort, ok := proxyProtoAddrs(src, dst)
+
+	switch version {
+	case 1:
+		if !ok {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		proto := "TCP4"
+		if len(srcIP) == net.IPv6len {
+			proto = "TCP6"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto,
+			proxyProtoIP(srcIP), proxyProtoIP(dstIP), srcPort, dstPort)), nil
+	case 2:
+		b := &bytes.Buffer{}
+		b.Write(proxyProtoV2Sig)
+		if !ok {
+			b.Write([]byte{proxyProtoV2Local, 0, 0, 0})
+			return b.Bytes(), nil
+		}
+		fam := byte(proxyProtoV2TCP4)
+		if len(srcIP) == net.IPv6len {
+			fam = proxyProtoV2TCP6
+		}
+		b.Write([]byte{proxyProtoV2Proxy, fam})
+		binary.Write(b, binary.BigEndian, uint16(2*len(srcIP)+4))
+		b.Write(srcIP)
+		b.Write(dstIP)
+		binary.Write(b, binary.BigEndian, uint16(srcPort))
+		binary.Write(b, binary.BigEndian, uint16(dstPort))
+		return b.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("proxy protocol: unsupported version %d", version)
+	}
+}
+
+// writeProxyProtoHeader writes the PROXY protocol header of the version to w.
+func writeProxyProtoHeader(w io.Writer, version int, src, dst net.Addr) error {
+	header, err := proxyProtoHeader(version, src, dst)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(header)
+	return err
+}
+
+// proxyProtoV1MaxLen is the maximum length of the PROXY protocol v1 header line, including the CRLF.
+const proxyProtoV1MaxLen = 107
+
+// errProxyProtoHeader is returned when the PROXY protocol header is missing or malformed.
+var errProxyProtoHeader = errors.New("proxy protocol: invalid header")
+
+// readProxyProtoHeader reads and strips the PROXY protocol v1 or v2 header from r,
+// and returns the source and destination addresses carried by it.
+// The addresses are nil for the unknown (v1) or local (v2) connection, and the non-TCP v2 addresses.
+func readProxyProtoHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	sig, err := r.Peek(len(proxyProtoV2Sig))
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.Equal(sig, proxyProtoV2Sig) {
+		return readProxyProtoV2(r)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return readProxyProtoV1(r)
+	}
+	return nil, nil, fmt.Errorf("%w: no PROXY protocol header", errProxyProtoHeader)
+}
+
+func readProxyProtoV1(r *bufio.Reader) (src, dst net.Addr, err error) {
+	var line []byte
+	for len(line) < proxyProtoV1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, fmt.Errorf("%w: v1 header is too long", errProxyProtoHeader)
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("%w: %q", errProxyProtoHeader, line)
+	}
+	srcAddr, err1 := proxyProtoV1Addr(fields[1], fields[2], fields[4])
+	dstAddr, err2 := proxyProtoV1Addr(fields[1], fields[3], fields[5])
+	if err1 != nil || err2 != nil {
+		return nil, nil, fmt.Errorf("%w: %q", errProxyProtoHeader, line)
+	}
+	return srcAddr, dstAddr, nil
+}
+
+// proxyProtoV1Addr parses the IP and port of the v1 header in the family of proto (TCP4 or TCP6).
+func proxyProtoV1Addr(proto, host, port string) (*net.TCPAddr, error) {
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return nil, err
+	}
+	if ip.Is4() != (proto == "TCP4") {
+		return nil, fmt.Errorf("%s is not %s", host, proto)
+	}
+	// the ports are decimal without the leading zeros.
+	if len(port) > 1 && port[0] == '0' {
+		return nil, fmt.Errorf("invalid port %s", port)
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(n))), nil
+}
+
+func readProxyProtoV2(r *bufio.Reader) (src, dst net.Addr, err error) {
+	header := make([]byte, len(proxyProtoV2Sig)+4)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return
+	}
+	verCmd, fam := header[12], header[13]
+	length := int(binary.BigEndian.Uint16(header[14:]))
+	if verCmd>>4 != 2 || (verCmd != proxyProtoV2Local && verCmd != proxyProtoV2Proxy) {
+		return nil, nil, fmt.Errorf("%w: v2 version and command 0x%02x", errProxyProtoHeader, verCmd)
+	}
+
+	payload := make([]byte, length)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+	if verCmd == proxyProtoV2Local {
+		return nil, nil, nil
+	}
+
+	var n int
+	switch fam {
+	case proxyProtoV2TCP4:
+		n = net.IPv4len
+	case proxyProtoV2TCP6:
+		n = net.IPv6len
+	default:
+		// UDP, UNIX or unspecified, the addresses are not usable as the TCP client address.
+		return nil, nil, nil
+	}
+	if length < 2*n+4 {
+		return nil, nil, fmt.Errorf("%w: v2 address length %d", errProxyProtoHeader, length)
+	}
+	src = &net.TCPAddr{
+		IP:   net.IP(payload[:n]),
+		Port: int(binary.BigEndian.Uint16(payload[2*n:])),
+	}
+	dst = &net.TCPAddr{
+		IP:   net.IP(payload[n : 2*n]),
+		Port: int(binary.BigEndian.Uint16(payload[2*n+2:])),
+	}
+	return
+}
+
+// proxyProtoListener is a Listener accepting the connections with a leading PROXY protocol header.
+type proxyProtoListener struct {
+	net.Listener
+	trusted  *PeerAllow
+	connChan chan net.Conn
+	errChan  chan error
+}
+
+// ProxyProtocolListener wraps the TCP listener ln to strip and parse the PROXY protocol v1 or v2 header
+// of each accepted connection, the source carried by the header is used as the remote address of the connection.
+// The connection with a missing or malformed header is closed.
+// The header of any peer is trusted, see ProxyProtocolTrustedListener to accept it only from the load balancers.
+func ProxyProtocolListener(ln net.Listener) Listener {
+	return ProxyProtocolTrustedListener(ln, nil)
+}
+
+// ProxyProtocolTrustedListener is like ProxyProtocolListener, but only accepts the connections
+// whose TCP peer address is allowed by trusted, e.g. the L4 load balancers in front, so that the source
+// in the header can not be spoofed by the clients connecting directly. A nil trusted allows any peer.
+func ProxyProtocolTrustedListener(ln net.Listener, trusted *PeerAllow) Listener {
+	l := &proxyProtoListener{
+		Listener: ln,
+		trusted:  trusted,
+		connChan: make(chan net.Conn, 1024),
+		errChan:  make(chan error, 1),
+	}
+	go l.listenLoop()
+	return l
+}
+
+func (l *proxyProtoListener) listenLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.errChan <- err
+			close(l.errChan)
+			return
+		}
+		// the sender is checked by the address of the TCP peer, before the header is read.
+		if !l.trusted.AllowAddr(conn.RemoteAddr()) {
+			log.Logf("[proxy-protocol] %s - %s : untrusted sender", conn.RemoteAddr(), conn.LocalAddr())
+			conn.Close()
+			continue
+		}
+		// the header is read in its own goroutine, so that a slow client does not block the others.
+		go l.handshake(conn)
+	}
+}
+
+func (l *proxyProtoListener) handshake(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(HandshakeTimeout))
+	r := bufio.NewReader(conn)
+	src, _, err := readProxyProtoHeader(r)
+	if err != nil {
+		log.Logf("[proxy-protocol] %s - %s : %s", conn.RemoteAddr(), conn.LocalAddr(), err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	cc := &proxyProtoConn{Conn: conn, r: r, src: src}
+	select {
+	case l.connChan <- cc:
+	default:
+		cc.Close()
+		log.Logf("[proxy-protocol] %s - %s: connection queue is full", conn.RemoteAddr(), conn.LocalAddr())
+	}
+}
+
+func (l *proxyProtoListener) Accept() (conn net.Conn, err error) {
+	var ok bool
+	select {
+	case conn = <-l.connChan:
+	case err, ok = <-l.errChan:
+		if !ok {
+			err = errors.New("accept on closed listener")
+		}
+	}
+	return
+}
+
+// proxyProtoConn is a connection whose addresses are carried by the PROXY protocol header.
+type proxyProtoConn struct {
+	net.Conn
+	// r holds the data read after the header.
+	r   *bufio.Reader
+	src net.Addr
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	if c.r != nil {
+		if c.r.Buffered() > 0 {
+			return c.r.Read(b)
+		}
+		c.r = nil
+	}
+	return c.Conn.Read(b)
+}
+
+// RemoteAddr returns the client source carried by the header, or the address of the peer if it is not carried.
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	if c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtoConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
@@ -0,0 +1,254 @@
+package gost
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxyProtoHeader(t *testing.T) {
+	v4src := &net.TCPAddr{IP: net.ParseIP("192.168.1.2"), Port: 51234}
+	v4dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}
+	v6src := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 51234}
+	v6dst := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+	unixAddr := &net.UnixAddr{Name: "/run/gost.sock", Net: "unix"}
+
+	v2 := func(b ...byte) []byte {
+		return append(append([]byte{}, proxyProtoV2Sig...), b...)
+	}
+
+	tests := []struct {
+		version  int
+		src, dst net.Addr
+		header   []byte
+	}{
+		{1, v4src, v4dst, []byte("PROXY TCP4 192.168.1.2 10.0.0.1 51234 443\r\n")},
+		{1, v6src, v6dst, []byte("PROXY TCP6 2001:db8::2 2001:db8::1 51234 443\r\n")},
+		{1, v4src, v6dst, []byte("PROXY TCP6 ::ffff:192.168.1.2 2001:db8::1 51234 443\r\n")},
+		{1, unixAddr, unixAddr, []byte("PROXY UNKNOWN\r\n")},
+		{2, v4src, v4dst, v2(0x21, 0x11, 0, 12,
+			192, 168, 1, 2, 10, 0, 0, 1, 0xc8, 0x22, 0x01, 0xbb)},
+		{2, v6src, v6dst, v2(0x21, 0x21, 0, 36,
+			0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2,
+			0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+			0xc8, 0x22, 0x01, 0xbb)},
+		{2, unixAddr, v4dst, v2(0x20, 0, 0, 0)},
+	}
+	for _, test := range tests {
+		header, err := proxyProtoHeader(test.version, test.src, test.dst)
+		if err != nil {
+			t.Errorf("v%d %s -> %s: %v", test.version, test.src, test.dst, err)
+			continue
+		}
+		if !bytes.Equal(header, test.header) {
+			t.Errorf("v%d %s -> %s: got %q, want %q", test.version, test.src, test.dst, header, test.header)
+		}
+	}
+
+	if _, err := proxyProtoHeader(3, v4src, v4dst); err == nil {
+		t.Error("version 3 should fail")
+	}
+}
+
+func TestTCPDirectForwardProxyProtocol(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := TCPDirectForwardHandler(upstream.Addr().String())
+	h.Init(ProxyProtocolHandlerOption(1))
+	server := &Server{Listener: ln, Handler: h}
+	go server.Run()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	cc, err := upstream.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	want, _ := proxyProtoHeader(1, conn.LocalAddr(), conn.RemoteAddr())
+	want = append(want, "data"...)
+	got := make([]byte, len(want))
+	cc.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := io.ReadFull(cc, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestReadProxyProtoHeader(t *testing.T) {
+	addrs := []struct {
+		src, dst *net.TCPAddr
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.168.1.2").To4(), Port: 51234}, &net.TCPAddr{IP: net.ParseIP("10.0.0.1").To4(), Port: 443}},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 1}, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 65535}},
+	}
+	for _, version := range []int{1, 2} {
+		for _, addr := range addrs {
+			header, _ := proxyProtoHeader(version, addr.src, addr.dst)
+			r := bufio.NewReader(bytes.NewReader(append(header, "data"...)))
+			src, dst, err := readProxyProtoHeader(r)
+			if err != nil {
+				t.Errorf("v%d %s: %v", version, addr.src, err)
+				continue
+			}
+			if src.String() != addr.src.String() || dst.String() != addr.dst.String() {
+				t.Errorf("v%d: got %s -> %s, want %s -> %s", version, src, dst, addr.src, addr.dst)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != "data" {
+				t.Errorf("v%d: the data after the header: got %q", version, rest)
+			}
+		}
+	}
+
+	// the unknown and local connections carry no address.
+	for _, header := range []string{
+		"PROXY UNKNOWN\r\n",
+		"PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n",
+		string(proxyProtoV2Sig) + "\x20\x00\x00\x00",
+		string(proxyProtoV2Sig) + "\x21\x12\x00\x0c" + strings.Repeat("\x00", 12), // UDP over IPv4
+	} {
+		src, dst, err := readProxyProtoHeader(bufio.NewReader(strings.NewReader(header)))
+		if err != nil || src != nil || dst != nil {
+			t.Errorf("%q: got %v -> %v, %v", header, src, dst, err)
+		}
+	}
+
+	for _, header := range []string{
+		"GET / HTTP/1.1\r\n\r\n",
+		"PROXY TCP4 192.168.1.2 10.0.0.1 51234 443\n",
+		"PROXY TCP4 192.168.1.2 10.0.0.1 51234\r\n",
+		"PROXY TCP4 2001:db8::2 10.0.0.1 51234 443\r\n",
+		"PROXY TCP6 192.168.1.2 2001:db8::1 51234 443\r\n",
+		"PROXY TCP4 192.168.1.2 10.0.0.1 65536 443\r\n",
+		"PROXY TCP4 192.168.1.2 10.0.0.1 051234 443\r\n",
+		"PROXY UDP4 192.168.1.2 10.0.0.1 51234 443\r\n",
+		"PROXY TCP4 " + strings.Repeat("1", proxyProtoV1MaxLen) + "\r\n",
+		string(proxyProtoV2Sig) + "\x11\x11\x00\x0c" + strings.Repeat("\x00", 12), // version 1
+		string(proxyProtoV2Sig) + "\x22\x11\x00\x0c" + strings.Repeat("\x00", 12), // command 2
+		string(proxyProtoV2Sig) + "\x21\x21\x00\x0c" + strings.Repeat("\x00", 12), // short IPv6 addresses
+	} {
+		_, _, err := readProxyProtoHeader(bufio.NewReader(strings.NewReader(header)))
+		if !errors.Is(err, errProxyProtoHeader) {
+			t.Errorf("%q: should be invalid, got %v", header, err)
+		}
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := ProxyProtocolListener(tcpLn)
+	defer ln.Close()
+
+	// the malformed connection is closed without being accepted.
+	bad, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bad.Close()
+	bad.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	bad.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if n, err := bad.Read(make([]byte, 1)); err == nil {
+		t.Errorf("the malformed connection should be closed, got %d bytes", n)
+	}
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 51234}
+	header, _ := proxyProtoHeader(2, client, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443})
+	conn.Write(append(header, "data"...))
+
+	cc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	if cc.RemoteAddr().String() != client.String() {
+		t.Errorf("remote address: got %s, want %s", cc.RemoteAddr(), client)
+	}
+	b := make([]byte, 4)
+	cc.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := io.ReadFull(cc, b); err != nil || string(b) != "data" {
+		t.Errorf("read: %q, %v", b, err)
+	}
+}
+
+func TestProxyProtocolTrustedListener(t *testing.T) {
+	for _, tc := range []struct {
+		trusted string
+		ok      bool
+	}{
+		{"127.0.0.0/8", true},
+		{"10.0.0.1,192.168.0.0/16", false},
+	} {
+		trusted, err := ParsePeerAllow(tc.trusted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln := ProxyProtocolTrustedListener(tcpLn, trusted)
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 51234}
+		header, _ := proxyProtoHeader(1, client, &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 443})
+		conn.Write(header)
+
+		// the header from the untrusted sender is not used, even if its source is trusted.
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			if cc, err := ln.Accept(); err == nil {
+				accepted <- cc
+			}
+		}()
+		select {
+		case cc := <-accepted:
+			if !tc.ok {
+				t.Errorf("%s: the untrusted sender should be rejected", tc.trusted)
+			} else if cc.RemoteAddr().String() != client.String() {
+				t.Errorf("%s: remote address: got %s, want %s", tc.trusted, cc.RemoteAddr(), client)
+			}
+			cc.Close()
+		case <-time.After(500 * time.Millisecond):
+			if tc.ok {
+				t.Errorf("%s: the trusted sender should be accepted", tc.trusted)
+			}
+		}
+		conn.Close()
+		ln.Close()
+	}
+}
@@ -0,0 +1,380 @@
+package gost
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-log/log"
+	"github.com/quic-go/quic-go"
+)
+
+var errQUICSessionFailed = errors.New("quic: session failed")
+
+// quicNextProtos is the ALPN of the QUIC transport, which is required by QUIC.
+// It is the one of the upstream gost, so the nodes can talk to each other.
+var quicNextProtos = []string{"http/3", "quic/v1"}
+
+// QUICConfig is the config for the QUIC client and server.
+// The QUIC transport runs over UDP, so the UDP port of the node must be reachable through the firewalls.
+type QUICConfig struct {
+	TLSConfig *tls.Config
+	// Timeout is the timeout of the QUIC handshake, HandshakeTimeout is used if it is not positive.
+	Timeout time.Duration
+	// KeepAlivePeriod is the period of the keepalive packets, which keep the idle sessions
+	// (and the NAT bindings on the path) alive, no keepalive is sent if it is not positive.
+	KeepAlivePeriod time.Duration
+	// IdleTimeout is the timeout of the idle session, the default of quic-go (30s) is used if it is not positive.
+	IdleTimeout time.Duration
+}
+
+// quicConfig returns the quic-go config of c with the handshake timeout.
+func (c *QUICConfig) quicConfig(timeout time.Duration) *quic.Config {
+	config := &quic.Config{
+		HandshakeIdleTimeout: timeout,
+	}
+	if c.KeepAlivePeriod > 0 {
+		config.KeepAlivePeriod = c.KeepAlivePeriod
+	}
+	if c.IdleTimeout > 0 {
+		config.MaxIdleTimeout = c.IdleTimeout
+	}
+	return config
+}
+
+// quicTLSConfig returns a copy of config with the ALPN of the QUIC transport.
+func quicTLSConfig(config *tls.Config) *tls.Config {
+	config = config.Clone()
+	config.NextProtos = quicNextProtos
+	return config
+}
+
+type quicSession struct {
+	conn    net.Conn
+	session quic.Connection
+	// timeout is the dial timeout of the session, which bounds the QUIC handshake.
+	timeout time.Duration
+	// ready is closed when the handshake of the session in flight is done.
+	ready chan struct{}
+}
+
+func (session *quicSession) GetConn(ctx context.Context) (net.Conn, error) {
+	stream, err := session.session.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &quicConn{
+		Stream: stream,
+		laddr:  session.session.LocalAddr(),
+		raddr:  session.session.RemoteAddr(),
+	}, nil
+}
+
+func (session *quicSession) Close() error {
+	if session.session != nil {
+		session.session.CloseWithError(0, "closed")
+	}
+	// the UDP socket is not closed with the session which is dialed on it.
+	return session.conn.Close()
+}
+
+func (session *quicSession) IsClosed() bool {
+	if session.session == nil {
+		return false
+	}
+	return session.session.Context().Err() != nil
+}
+
+type quicTransporter struct {
+	config       *QUICConfig
+	sessionMutex sync.Mutex
+	sessions     map[string]*quicSession
+}
+
+// QUICTransporter creates a Transporter that is used by QUIC proxy client.
+// QUIC is a multiplexed transport, the streams of a node are carried by a single session.
+func QUICTransporter(config *QUICConfig) Transporter {
+	if config == nil {
+		config = &QUICConfig{}
+	}
+	return &quicTransporter{
+		config:   config,
+		sessions: make(map[string]*quicSession),
+	}
+}
+
+// Dial creates the UDP socket of the session to addr, which is shared by the streams of the session.
+// The socket is bound to the source IP and marked by the DSCP and the mark of the options,
+// and the dial timeout of the options bounds the QUIC handshake on it.
+func (tr *quicTransporter) Dial(addr string, options ...DialOption) (conn net.Conn, err error) {
+	opts := &DialOptions{}
+	for _, option := range options {
+		option(opts)
+	}
+
+	tr.sessionMutex.Lock()
+	defer tr.sessionMutex.Unlock()
+
+	session, ok := tr.sessions[addr]
+	if session != nil && session.IsClosed() {
+		session.Close()
+		delete(tr.sessions, addr) // session is dead
+		ok = false
+	}
+	if !ok {
+		conn, err = opts.listenUDP()
+		if err != nil {
+			return
+		}
+		session = &quicSession{conn: conn, timeout: opts.Timeout}
+		tr.sessions[addr] = session
+	}
+	return session.conn, nil
+}
+
+// listenUDP creates the UDP socket from the source IP of the options, with the DSCP and the mark of the options.
+func (opts *DialOptions) listenUDP() (net.Conn, error) {
+	laddr := ""
+	if opts.LocalAddr != nil {
+		host, _, err := net.SplitHostPort(opts.LocalAddr.String())
+		if err != nil {
+			return nil, err
+		}
+		laddr = net.JoinHostPort(host, "0")
+	}
+	lc := net.ListenConfig{Control: joinControl(markControl(opts.Mark), dscpControl(opts.DSCP))}
+	pc, err := lc.ListenPacket(context.Background(), "udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+// Handshake opens a stream of the session of the node, the session is created by the first handshake on the socket,
+// and the concurrent handshakes wait for it without holding the sessions of the other nodes.
+func (tr *quicTransporter) Handshake(conn net.Conn, options ...HandshakeOption) (net.Conn, error) {
+	opts := &HandshakeOptions{}
+	for _, option := range options {
+		option(opts)
+	}
+
+	tlsConfig := opts.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = tr.config.TLSConfig
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = tr.config.Timeout
+	}
+	if timeout <= 0 {
+		timeout = HandshakeTimeout
+	}
+
+	tr.sessionMutex.Lock()
+	session, ok := tr.sessions[opts.Addr]
+	if !ok || session.conn != conn {
+		// the session of the socket has failed and been removed.
+		tr.sessionMutex.Unlock()
+		conn.Close()
+		return nil, errQUICSessionFailed
+	}
+	// the handshake is bounded by the dial timeout as well.
+	ctxTimeout := timeout
+	if session.timeout > 0 && session.timeout < ctxTimeout {
+		ctxTimeout = session.timeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
+	defer cancel()
+
+	if ready := session.ready; ready != nil {
+		tr.sessionMutex.Unlock()
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		tr.sessionMutex.Lock()
+	}
+	if session.session == nil && session.ready == nil {
+		if _, ok := tr.sessions[opts.Addr]; !ok {
+			tr.sessionMutex.Unlock()
+			return nil, errQUICSessionFailed
+		}
+		ready := make(chan struct{})
+		session.ready = ready
+		tr.sessionMutex.Unlock()
+
+		s, err := tr.initSession(ctx, opts.Addr, conn, quicTLSConfig(tlsConfig), tr.config.quicConfig(timeout))
+
+		tr.sessionMutex.Lock()
+		session.ready = nil
+		if err != nil {
+			if tr.sessions[opts.Addr] == session {
+				delete(tr.sessions, opts.Addr)
+			}
+			tr.sessionMutex.Unlock()
+			close(ready)
+			conn.Close()
+			return nil, err
+		}
+		session.session = s
+		close(ready)
+	}
+	tr.sessionMutex.Unlock()
+
+	cc, err := session.GetConn(ctx)
+	if err != nil {
+		session.Close()
+		tr.sessionMutex.Lock()
+		if tr.sessions[opts.Addr] == session {
+			delete(tr.sessions, opts.Addr)
+		}
+		tr.sessionMutex.Unlock()
+		return nil, err
+	}
+
+	return cc, nil
+}
+
+func (tr *quicTransporter) initSession(ctx context.Context, addr string, conn net.Conn, tlsConfig *tls.Config, config *quic.Config) (quic.Connection, error) {
+	pc, ok := conn.(net.PacketConn)
+	if !ok {
+		return nil, errors.New("quic: wrong connection type")
+	}
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := quic.Dial(ctx, pc, raddr, tlsConfig, config)
+	if err != nil {
+		log.Logf("[quic] %s : %s", addr, err)
+		return nil, err
+	}
+	return session, nil
+}
+
+func (tr *quicTransporter) Multiplex() bool {
+	return true
+}
+
+type quicListener struct {
+	ln       *quic.Listener
+	connChan chan net.Conn
+	errChan  chan error
+}
+
+// QUICListener creates a Listener for QUIC proxy server.
+func QUICListener(addr string, config *QUICConfig) (Listener, error) {
+	if config == nil {
+		config = &QUICConfig{}
+	}
+	tlsConfig := config.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = DefaultTLSConfig
+	}
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = HandshakeTimeout
+	}
+
+	ln, err := quic.ListenAddr(addr, quicTLSConfig(tlsConfig), config.quicConfig(timeout))
+	if err != nil {
+		return nil, err
+	}
+
+	l := &quicListener{
+		ln:       ln,
+		connChan: make(chan net.Conn, 1024),
+		errChan:  make(chan error, 1),
+	}
+	go l.listenLoop()
+
+	return l, nil
+}
+
+func (l *quicListener) listenLoop() {
+	for {
+		session, err := l.ln.Accept(context.Background())
+		if err != nil {
+			log.Log("[quic] accept:", err)
+			l.errChan <- err
+			close(l.errChan)
+			return
+		}
+		go l.sessionLoop(session)
+	}
+}
+
+func (l *quicListener) sessionLoop(session quic.Connection) {
+	log.Logf("[quic] %s <-> %s", session.RemoteAddr(), session.LocalAddr())
+	defer log.Logf("[quic] %s >-< %s", session.RemoteAddr(), session.LocalAddr())
+
+	for {
+		stream, err := session.AcceptStream(context.Background())
+		if err != nil {
+			log.Log("[quic] accept stream:", err)
+			session.CloseWithError(0, "closed")
+			return
+		}
+
+		cc := &quicConn{Stream: stream, laddr: session.LocalAddr(), raddr: session.RemoteAddr()}
+		select {
+		case l.connChan <- cc:
+		default:
+			cc.Close()
+			log.Logf("[quic] %s - %s: connection queue is full", session.RemoteAddr(), session.LocalAddr())
+		}
+	}
+}
+
+func (l *quicListener) Accept() (conn net.Conn, err error) {
+	var ok bool
+	select {
+	case conn = <-l.connChan:
+	case err, ok = <-l.errChan:
+		if !ok {
+			err = errors.New("accept on closed listener")
+		}
+	}
+	return
+}
+
+func (l *quicListener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+func (l *quicListener) Close() error {
+	return l.ln.Close()
+}
+
+// quicConn is a stream of a QUIC session.
+type quicConn struct {
+	quic.Stream
+	laddr net.Addr
+	raddr net.Addr
+}
+
+// Close closes both directions of the stream, as the Close of the stream only closes the write direction.
+func (c *quicConn) Close() error {
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
+
+func (c *quicConn) CloseWrite() error {
+	return c.Stream.Close()
+}
+
+func (c *quicConn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+func (c *quicConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
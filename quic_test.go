@@ -0,0 +1,326 @@
+package gost
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func httpOverQUICRoundtrip(targetURL string, data []byte,
+	clientInfo *url.Userinfo, serverInfo []*url.Userinfo) error {
+
+	ln, err := QUICListener("localhost:0", nil)
+	if err != nil {
+		return err
+	}
+
+	client := &Client{
+		Connector:   HTTPConnector(clientInfo),
+		Transporter: QUICTransporter(nil),
+	}
+
+	server := &Server{
+		Listener: ln,
+		Handler: HTTPHandler(
+			UsersHandlerOption(serverInfo...),
+		),
+	}
+
+	go server.Run()
+	defer server.Close()
+
+	return proxyRoundtrip(client, server, targetURL, data)
+}
+
+func TestHTTPOverQUIC(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+
+	sendData := make([]byte, 128)
+	rand.Read(sendData)
+
+	for i, tc := range httpProxyTests {
+		err := httpOverQUICRoundtrip(httpSrv.URL, sendData, tc.cliUser, tc.srvUsers)
+		if err == nil {
+			if tc.errStr != "" {
+				t.Errorf("#%d should failed with error %s", i, tc.errStr)
+			}
+		} else {
+			if tc.errStr == "" {
+				t.Errorf("#%d got error %v", i, err)
+			}
+			if err.Error() != tc.errStr {
+				t.Errorf("#%d got error %v, want %v", i, err, tc.errStr)
+			}
+		}
+	}
+}
+
+func quicForwardTunnelRoundtrip(targetURL string, data []byte) error {
+	ln, err := QUICListener("localhost:0", nil)
+	if err != nil {
+		return err
+	}
+
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return err
+	}
+
+	client := &Client{
+		Connector:   ForwardConnector(),
+		Transporter: QUICTransporter(nil),
+	}
+
+	server := &Server{
+		Listener: ln,
+		Handler:  TCPDirectForwardHandler(u.Host),
+	}
+	server.Handler.Init()
+
+	go server.Run()
+	defer server.Close()
+
+	return proxyRoundtrip(client, server, targetURL, data)
+}
+
+func TestQUICForwardTunnel(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+
+	sendData := make([]byte, 128)
+	rand.Read(sendData)
+
+	err := quicForwardTunnelRoundtrip(httpSrv.URL, sendData)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// quicEcho dials a stream to the QUIC listener ln by tr, and checks the echo of the stream.
+func quicEcho(tr Transporter, ln Listener, options ...HandshakeOption) error {
+	addr := ln.Addr().String()
+	conn, err := tr.Dial(addr)
+	if err != nil {
+		return err
+	}
+	cc, err := tr.Handshake(conn, append(options, AddrHandshakeOption(addr))...)
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+
+	cc.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err := cc.Write([]byte("ping")); err != nil {
+		return err
+	}
+	b := make([]byte, 4)
+	if _, err := cc.Read(b); err != nil {
+		return err
+	}
+	if string(b) != "ping" {
+		return errors.New("unexpected echo " + string(b))
+	}
+	return nil
+}
+
+// quicEchoListener creates a QUIC listener which echoes the accepted streams.
+func quicEchoListener(t *testing.T, config *QUICConfig) Listener {
+	ln, err := QUICListener("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestQUICTransporterSession(t *testing.T) {
+	ln := quicEchoListener(t, nil)
+	defer ln.Close()
+	addr := ln.Addr().String()
+
+	tr := QUICTransporter(nil).(*quicTransporter)
+	if !tr.Multiplex() {
+		t.Error("QUIC transporter should be multiplexed")
+	}
+	for i := 0; i < 3; i++ {
+		if err := quicEcho(tr, ln); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+	session := tr.sessions[addr]
+	if session == nil || session.session == nil {
+		t.Fatal("session should be kept")
+	}
+	if len(tr.sessions) != 1 {
+		t.Errorf("streams should share one session, got %d", len(tr.sessions))
+	}
+
+	// the dead session is replaced on the next dial.
+	session.session.CloseWithError(0, "closed")
+	<-session.session.Context().Done()
+	if err := quicEcho(tr, ln); err != nil {
+		t.Fatal(err)
+	}
+	if tr.sessions[addr] == session {
+		t.Error("dead session should be replaced")
+	}
+}
+
+func TestQUICTransporterTimeout(t *testing.T) {
+	// the server never answers the handshake.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	addr := pc.LocalAddr().String()
+
+	tests := []struct {
+		name    string
+		config  *QUICConfig
+		options []HandshakeOption
+	}{
+		{"config", &QUICConfig{Timeout: 300 * time.Millisecond}, nil},
+		{"option", &QUICConfig{Timeout: time.Minute}, []HandshakeOption{TimeoutHandshakeOption(300 * time.Millisecond)}},
+		{"dial", &QUICConfig{Timeout: time.Minute}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := QUICTransporter(tt.config).(*quicTransporter)
+			var dialOpts []DialOption
+			if tt.name == "dial" {
+				dialOpts = append(dialOpts, TimeoutDialOption(300*time.Millisecond))
+			}
+			conn, err := tr.Dial(addr, dialOpts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := time.Now()
+			if _, err := tr.Handshake(conn, append(tt.options, AddrHandshakeOption(addr))...); err == nil {
+				t.Fatal("handshake should time out")
+			}
+			if d := time.Since(start); d > 2*time.Second {
+				t.Errorf("handshake should time out in 300ms, took %s", d)
+			}
+			if len(tr.sessions) != 0 {
+				t.Error("failed session should be removed")
+			}
+		})
+	}
+}
+
+func TestQUICTransporterConcurrent(t *testing.T) {
+	ln := quicEchoListener(t, nil)
+	defer ln.Close()
+
+	// the concurrent streams share the session of the first handshake.
+	tr := QUICTransporter(nil).(*quicTransporter)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := quicEcho(tr, ln); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	tr.sessionMutex.Lock()
+	defer tr.sessionMutex.Unlock()
+	if len(tr.sessions) != 1 {
+		t.Errorf("streams should share one session, got %d", len(tr.sessions))
+	}
+}
+
+func TestQUICTransporterLocalAddr(t *testing.T) {
+	ln := quicEchoListener(t, nil)
+	defer ln.Close()
+
+	tr := QUICTransporter(nil)
+	conn, err := tr.Dial(ln.Addr().String(), LocalAddrDialOption(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := conn.LocalAddr().(*net.UDPAddr).IP; !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("socket should be bound to 127.0.0.1, got %s", ip)
+	}
+	if err := quicEcho(tr, ln); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestQUICConfigKeepAlive(t *testing.T) {
+	tests := []struct {
+		keepAlive time.Duration
+		period    time.Duration
+	}{
+		{0, 0},
+		{-1, 0},
+		{15 * time.Second, 15 * time.Second},
+	}
+	for i, tc := range tests {
+		config := (&QUICConfig{KeepAlivePeriod: tc.keepAlive}).quicConfig(3 * time.Second)
+		if config.KeepAlivePeriod != tc.period {
+			t.Errorf("#%d: keepalive period should be %s, got %s", i, tc.period, config.KeepAlivePeriod)
+		}
+		if config.HandshakeIdleTimeout != 3*time.Second {
+			t.Errorf("#%d: handshake timeout should be 3s, got %s", i, config.HandshakeIdleTimeout)
+		}
+	}
+
+	ln := quicEchoListener(t, &QUICConfig{IdleTimeout: 500 * time.Millisecond})
+	defer ln.Close()
+	for _, keepAlive := range []time.Duration{0, 100 * time.Millisecond} {
+		tr := QUICTransporter(&QUICConfig{
+			IdleTimeout:     500 * time.Millisecond,
+			KeepAlivePeriod: keepAlive,
+		}).(*quicTransporter)
+		if err := quicEcho(tr, ln); err != nil {
+			t.Fatal(err)
+		}
+		session := tr.sessions[ln.Addr().String()]
+		time.Sleep(1500 * time.Millisecond)
+		// the keepalive keeps the idle session alive beyond the idle timeout.
+		if closed := session.IsClosed(); closed != (keepAlive == 0) {
+			t.Errorf("keepalive %s: session closed %v", keepAlive, closed)
+		}
+		session.Close()
+	}
+}
+
+func TestQUICTLSConfig(t *testing.T) {
+	ln := quicEchoListener(t, nil)
+	defer ln.Close()
+
+	// the handshake option overrides the config of the transporter.
+	tr := QUICTransporter(&QUICConfig{TLSConfig: &tls.Config{InsecureSkipVerify: true}})
+	if err := quicEcho(tr, ln, TLSConfigHandshakeOption(&tls.Config{RootCAs: x509.NewCertPool()})); err == nil {
+		t.Error("handshake should fail with an unknown CA")
+	}
+	tr = QUICTransporter(&QUICConfig{TLSConfig: &tls.Config{RootCAs: x509.NewCertPool()}})
+	if err := quicEcho(tr, ln, TLSConfigHandshakeOption(&tls.Config{InsecureSkipVerify: true})); err != nil {
+		t.Error(err)
+	}
+}
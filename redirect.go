@@ -1,18 +1,21 @@
+//go:build linux
 // +build linux
 
 package gost
 
 import (
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/LiamHaworth/go-tproxy"
 	"github.com/go-log/log"
+	"golang.org/x/sys/unix"
 )
 
 type tcpRedirectHandler struct {
@@ -35,6 +38,7 @@ func (h *tcpRedirectHandler) Init(options ...HandlerOption) {
 	for _, opt := range options {
 		opt(h.options)
 	}
+	h.options.warnSplice("red-tcp")
 }
 
 func (h *tcpRedirectHandler) Handle(c net.Conn) {
@@ -52,29 +56,54 @@ func (h *tcpRedirectHandler) Handle(c net.Conn) {
 	defer conn.Close()
 
 	log.Logf("[red-tcp] %s -> %s", srcAddr, dstAddr)
+	access := h.options.newAccessLog("red-tcp", srcAddr)
+
+	ctx, span := startSpan(context.Background(), "red-tcp", h.options.SlowLog)
+	defer span.End()
+	span.SetAttr("client.address", srcAddr.String())
+	span.SetAttr("target.address", dstAddr.String())
 
 	// EMOD: 打开preserveSrc时，需要传递相应的参数
 	options := make([]ChainOption, 0)
 	options = append(options, RetryChainOption(h.options.Retries))
 	options = append(options, TimeoutChainOption(h.options.Timeout))
-	if h.options.PreserveSrc {
-		options = append(options, SrcAddrChainOption(srcAddr))
-		options = append(options, NetnsChainOption(h.options.ProxyNetns))
+	options = append(options, BlockPrivateChainOption(h.options.BlockPrivate))
+	options = append(options, RandomizeSourcePortChainOption(h.options.RandomizeSourcePort))
+	options = append(options, ClientAddrChainOption(srcAddr))
+	options = append(options, h.options.transparentEgressOptions("tcp")...)
+	// EMOD: the PROXY protocol header carries the client source instead,
+	// it takes precedence over preserveSrc as it survives the non-transparent routing.
+	if h.options.ProxyProtocol <= 0 {
+		options = append(options, h.options.preserveSrcOptions(srcAddr)...)
 	}
-	cc, err := h.options.Chain.DialContext(context.Background(),
+	cc, err := h.options.Chain.DialContext(ctx,
 		"tcp", dstAddr.String(),
 		// EMOD: use dynamic options.
 		options...,
 	)
 	if err != nil {
+		h.options.Metrics.DialFailed()
+		span.SetError(err)
+		if h.options.PreserveSrc && errors.Is(err, syscall.EPERM) {
+			err = fmt.Errorf("%w, preserveSrc binds the client source address by IP_TRANSPARENT, which requires CAP_NET_ADMIN", err)
+		}
 		log.Logf("[red-tcp] %s -> %s : %s", srcAddr, dstAddr, err)
 		return
 	}
 	defer cc.Close()
+	access.setTarget(dstAddr.String(), cc)
+
+	if err := h.options.sendProxyProtocol(cc, srcAddr, dstAddr); err != nil {
+		span.SetError(err)
+		log.Logf("[red-tcp] %s -> %s : proxy protocol: %s", srcAddr, dstAddr, err)
+		return
+	}
 
 	log.Logf("[red-tcp] %s <-> %s", srcAddr, dstAddr)
-	transport(conn, cc)
+	h.options.transport(access.countConn(conn), cc)
+	span.AddEvent("close")
 	log.Logf("[red-tcp] %s >-< %s", srcAddr, dstAddr)
+	access.Log()
 }
 
 func (h *tcpRedirectHandler) getOriginalDstAddr(conn *net.TCPConn) (addr net.Addr, c *net.TCPConn, err error) {
@@ -86,15 +115,16 @@ func (h *tcpRedirectHandler) getOriginalDstAddr(conn *net.TCPConn) (addr net.Add
 	}
 	defer fc.Close()
 
-	mreq, err := syscall.GetsockoptIPv6Mreq(int(fc.Fd()), syscall.IPPROTO_IP, 80)
-	if err != nil {
-		return
+	// EMOD: the original destination of the IPv6 connection is got by IP6T_SO_ORIGINAL_DST.
+	if laddr, _ := conn.LocalAddr().(*net.TCPAddr); laddr != nil && laddr.IP.To4() == nil {
+		addr, err = originalDstAddr6(int(fc.Fd()))
+	} else {
+		addr, err = originalDstAddr4(int(fc.Fd()))
+	}
+	if errors.Is(err, syscall.ENOENT) {
+		// not NATed by REDIRECT, e.g. intercepted by TPROXY, the local address is the original destination.
+		addr, err = conn.LocalAddr(), nil
 	}
-
-	// only ipv4 support
-	ip := net.IPv4(mreq.Multiaddr[4], mreq.Multiaddr[5], mreq.Multiaddr[6], mreq.Multiaddr[7])
-	port := uint16(mreq.Multiaddr[2])<<8 + uint16(mreq.Multiaddr[3])
-	addr, err = net.ResolveTCPAddr("tcp4", fmt.Sprintf("%s:%d", ip.String(), port))
 	if err != nil {
 		return
 	}
@@ -111,6 +141,41 @@ func (h *tcpRedirectHandler) getOriginalDstAddr(conn *net.TCPConn) (addr net.Add
 	return
 }
 
+// originalDstAddr4 gets the original destination of the IPv4 connection by SO_ORIGINAL_DST.
+func originalDstAddr4(fd int) (net.Addr, error) {
+	mreq, err := syscall.GetsockoptIPv6Mreq(fd, syscall.IPPROTO_IP, unix.SO_ORIGINAL_DST)
+	if err != nil {
+		return nil, err
+	}
+
+	ip := net.IPv4(mreq.Multiaddr[4], mreq.Multiaddr[5], mreq.Multiaddr[6], mreq.Multiaddr[7])
+	port := uint16(mreq.Multiaddr[2])<<8 + uint16(mreq.Multiaddr[3])
+	return net.ResolveTCPAddr("tcp4", fmt.Sprintf("%s:%d", ip.String(), port))
+}
+
+// ip6tSoOriginalDst is IP6T_SO_ORIGINAL_DST of linux/netfilter_ipv6/ip6_tables.h.
+const ip6tSoOriginalDst = 80
+
+// originalDstAddr6 gets the original destination of the IPv6 connection by IP6T_SO_ORIGINAL_DST,
+// the sockaddr_in6 is read by the IPv6 MTU info, which starts with it.
+func originalDstAddr6(fd int) (net.Addr, error) {
+	info, err := unix.GetsockoptIPv6MTUInfo(fd, unix.SOL_IPV6, ip6tSoOriginalDst)
+	if err != nil {
+		return nil, err
+	}
+
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, info.Addr.Addr[:])
+	return &net.TCPAddr{IP: ip, Port: int(ntohs(info.Addr.Port))}, nil
+}
+
+// ntohs converts the port in the network byte order to the host byte order.
+func ntohs(port uint16) uint16 {
+	b := make([]byte, 2)
+	binary.NativeEndian.PutUint16(b, port)
+	return binary.BigEndian.Uint16(b)
+}
+
 type udpRedirectHandler struct {
 	options *HandlerOptions
 }
@@ -142,25 +207,40 @@ func (h *udpRedirectHandler) Handle(conn net.Conn) {
 		return
 	}
 
-	cc, err := h.options.Chain.DialContext(context.Background(),
-		"udp", raddr.String(),
+	options := []ChainOption{
 		RetryChainOption(h.options.Retries),
 		TimeoutChainOption(h.options.Timeout),
+		BlockPrivateChainOption(h.options.BlockPrivate),
+		RandomizeSourcePortChainOption(h.options.RandomizeSourcePort),
+		ClientAddrChainOption(conn.RemoteAddr()),
+	}
+	options = append(options, h.options.transparentEgressOptions("udp")...)
+	// EMOD: 打开preserveSrc时，以客户端的源地址(IP_TRANSPARENT)发往上游。
+	options = append(options, h.options.preserveSrcOptions(conn.RemoteAddr())...)
+	cc, err := h.options.Chain.DialContext(context.Background(),
+		"udp", raddr.String(),
+		options...,
 	)
 	if err != nil {
+		h.options.Metrics.DialFailed()
+		if h.options.PreserveSrc && errors.Is(err, syscall.EPERM) {
+			err = fmt.Errorf("%w, preserveSrc binds the client source address by IP_TRANSPARENT, which requires CAP_NET_ADMIN", err)
+		}
 		log.Logf("[red-udp] %s - %s : %s", conn.RemoteAddr(), raddr, err)
 		return
 	}
 	defer cc.Close()
 
 	log.Logf("[red-udp] %s <-> %s", conn.RemoteAddr(), raddr)
-	transport(conn, cc)
+	h.options.transport(conn, cc)
 	log.Logf("[red-udp] %s >-< %s", conn.RemoteAddr(), raddr)
 }
 
 type udpRedirectListener struct {
 	*net.UDPConn
 	config *UDPListenConfig
+	// the number of the active sessions.
+	sessions int64
 }
 
 // UDPRedirectListener creates a Listener for UDP transparent proxy server.
@@ -170,14 +250,28 @@ func UDPRedirectListener(addr string, cfg *UDPListenConfig) (Listener, error) {
 		return nil, err
 	}
 
-	ln, err := tproxy.ListenUDP("udp", laddr)
-	if err != nil {
-		return nil, err
+	// EMOD: adopt the socket handed over by the old process on upgrade, it is transparent already.
+	ln := takeInheritedPacketConn(laddr)
+	if ln == nil {
+		lc := net.ListenConfig{Control: transparentUDPControl(true)}
+		pc, err := lc.ListenPacket(context.Background(), "udp", laddr.String())
+		if err != nil {
+			return nil, err
+		}
+		ln = pc.(*net.UDPConn)
 	}
 
 	if cfg == nil {
 		cfg = &UDPListenConfig{}
 	}
+	if err := markUDPConn(ln, cfg.Mark); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if err := dscpUDPConn(ln, cfg.DSCP); err != nil {
+		ln.Close()
+		return nil, err
+	}
 	return &udpRedirectListener{
 		UDPConn: ln,
 		config:  cfg,
@@ -187,30 +281,166 @@ func UDPRedirectListener(addr string, cfg *UDPListenConfig) (Listener, error) {
 func (l *udpRedirectListener) Accept() (conn net.Conn, err error) {
 	b := make([]byte, mediumBufferSize)
 
-	n, raddr, dstAddr, err := tproxy.ReadFromUDP(l.UDPConn, b)
+	for {
+		n, raddr, dstAddr, err := readFromUDPOrigDst(l.UDPConn, b)
+		if err != nil {
+			log.Logf("[red-udp] %s : %s", l.Addr(), err)
+			return nil, err
+		}
+		// EMOD: the sessions are the connected sockets of the client tuples, drop the datagrams of the new ones when full.
+		if sessions := atomic.LoadInt64(&l.sessions); l.config.sessionsFull(sessions) {
+			log.Logf("[red-udp] %s - %s: session table is full (%d)", raddr, dstAddr, sessions)
+			continue
+		}
+		log.Logf("[red-udp] %s: %s -> %s", l.Addr(), raddr, dstAddr)
+
+		c, err := dialTransparentUDP(dstAddr, raddr)
+		if err != nil {
+			log.Logf("[red-udp] %s -> %s : %s", raddr, dstAddr, err)
+			return nil, err
+		}
+		// EMOD: the replies are sent by this socket, mark it as the listener.
+		if err = markUDPConn(c, l.config.Mark); err == nil {
+			err = dscpUDPConn(c, l.config.DSCP)
+		}
+		if err != nil {
+			log.Logf("[red-udp] %s -> %s : %s", raddr, dstAddr, err)
+			c.Close()
+			return nil, err
+		}
+
+		ttl := l.config.TTL
+		if ttl <= 0 {
+			ttl = defaultTTL
+		}
+
+		atomic.AddInt64(&l.sessions, 1)
+		l.config.Metrics.addUDPSessions(1)
+		return &udpRedirectServerConn{
+			Conn: c,
+			buf:  b[:n],
+			ttl:  ttl,
+			onClose: func() {
+				atomic.AddInt64(&l.sessions, -1)
+				l.config.Metrics.addUDPSessions(-1)
+			},
+		}, nil
+	}
+}
+
+// transparentUDPControl returns the control function making the UDP socket transparent (IP_TRANSPARENT),
+// to bind the foreign addresses. If recvOrigDst is true, the original destinations of the datagrams
+// are received as the control messages, IPv4 ones are also received by the dual-stack IPv6 socket.
+func transparentUDPControl(recvOrigDst bool) func(network, address string, c syscall.RawConn) error {
+	return func(network, _ string, c syscall.RawConn) error {
+		var err error
+		if e := c.Control(func(fd uintptr) {
+			if err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+				return
+			}
+			ipv6 := network == "udp6"
+			if err = setSocketTransparent(int(fd), ipv6); err != nil {
+				err = fmt.Errorf("set transparent (requires CAP_NET_ADMIN): %w", err)
+				return
+			}
+			if !recvOrigDst {
+				return
+			}
+			if err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, unix.IP_RECVORIGDSTADDR, 1); err != nil && !ipv6 {
+				return
+			}
+			if ipv6 {
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR, 1)
+			}
+		}); e != nil {
+			return e
+		}
+		return err
+	}
+}
+
+// readFromUDPOrigDst reads a datagram from conn with its source and original destination address.
+func readFromUDPOrigDst(conn *net.UDPConn, b []byte) (n int, raddr, dstAddr *net.UDPAddr, err error) {
+	oob := make([]byte, 1024)
+	n, oobn, _, raddr, err := conn.ReadMsgUDP(b, oob)
 	if err != nil {
-		log.Logf("[red-udp] %s : %s", l.Addr(), err)
 		return
 	}
-	log.Logf("[red-udp] %s: %s -> %s", l.Addr(), raddr, dstAddr)
+	dstAddr, err = parseOrigDstAddr(oob[:oobn])
+	return
+}
 
-	c, err := tproxy.DialUDP("udp", dstAddr, raddr)
+// parseOrigDstAddr gets the original destination from the IP_ORIGDSTADDR or IPV6_ORIGDSTADDR control message.
+func parseOrigDstAddr(oob []byte) (dstAddr *net.UDPAddr, err error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
 	if err != nil {
-		log.Logf("[red-udp] %s -> %s : %s", raddr, dstAddr, err)
 		return
 	}
+	for _, msg := range msgs {
+		switch {
+		case msg.Header.Level == syscall.SOL_IP && msg.Header.Type == unix.IP_ORIGDSTADDR && len(msg.Data) >= 8:
+			// struct sockaddr_in
+			dstAddr = &net.UDPAddr{
+				IP:   net.IPv4(msg.Data[4], msg.Data[5], msg.Data[6], msg.Data[7]),
+				Port: int(binary.BigEndian.Uint16(msg.Data[2:4])),
+			}
+		case msg.Header.Level == syscall.SOL_IPV6 && msg.Header.Type == unix.IPV6_ORIGDSTADDR && len(msg.Data) >= 24:
+			// struct sockaddr_in6
+			ip := make(net.IP, net.IPv6len)
+			copy(ip, msg.Data[8:24])
+			dstAddr = &net.UDPAddr{
+				IP:   ip,
+				Port: int(binary.BigEndian.Uint16(msg.Data[2:4])),
+			}
+		}
+	}
+	if dstAddr == nil {
+		err = errors.New("original destination not found")
+	}
+	return
+}
+
+// dialTransparentUDP dials raddr from the foreign address laddr, e.g. to reply from the original destination.
+func dialTransparentUDP(laddr, raddr *net.UDPAddr) (*net.UDPConn, error) {
+	network := "udp4"
+	if laddr.IP.To4() == nil {
+		network = "udp6"
+	}
+	d := net.Dialer{LocalAddr: laddr, Control: transparentUDPControl(false)}
+	c, err := d.Dial(network, raddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return c.(*net.UDPConn), nil
+}
 
-	ttl := l.config.TTL
-	if ttl <= 0 {
-		ttl = defaultTTL
+// markUDPConn sets the mark on the socket of conn if mark is positive.
+func markUDPConn(conn *net.UDPConn, mark int) error {
+	if mark <= 0 {
+		return nil
+	}
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
 	}
+	return setRawConnMark(rc, mark)
+}
 
-	conn = &udpRedirectServerConn{
-		Conn: c,
-		buf:  b[:n],
-		ttl:  ttl,
+// dscpUDPConn sets the DSCP on the socket of conn if dscp is positive.
+func dscpUDPConn(conn *net.UDPConn, dscp int) error {
+	if dscp <= 0 {
+		return nil
 	}
-	return
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	addr, _ := conn.LocalAddr().(*net.UDPAddr)
+	return setRawConnDSCP(rc, addr != nil && addr.IP.To4() == nil, dscp)
+}
+
+func (l *udpRedirectListener) udpConn() *net.UDPConn {
+	return l.UDPConn
 }
 
 func (l *udpRedirectListener) Addr() net.Addr {
@@ -219,9 +449,11 @@ func (l *udpRedirectListener) Addr() net.Addr {
 
 type udpRedirectServerConn struct {
 	net.Conn
-	buf  []byte
-	ttl  time.Duration
-	once sync.Once
+	buf       []byte
+	ttl       time.Duration
+	once      sync.Once
+	onClose   func()
+	closeOnce sync.Once
 }
 
 func (c *udpRedirectServerConn) Read(b []byte) (n int, err error) {
@@ -247,3 +479,12 @@ func (c *udpRedirectServerConn) Write(b []byte) (n int, err error) {
 	}
 	return c.Conn.Write(b)
 }
+
+func (c *udpRedirectServerConn) Close() error {
+	c.closeOnce.Do(func() {
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,166 @@
+//go:build linux
+// +build linux
+
+package gost
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// cmsg encodes the socket control message of the level and type with data.
+func cmsg(level, typ int, data []byte) []byte {
+	b := make([]byte, syscall.CmsgSpace(len(data)))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = int32(level)
+	h.Type = int32(typ)
+	h.SetLen(syscall.CmsgLen(len(data)))
+	copy(b[syscall.CmsgLen(0):], data)
+	return b
+}
+
+// sockaddrIn encodes the struct sockaddr_in of ip and port.
+func sockaddrIn(ip net.IP, port uint16) []byte {
+	b := make([]byte, syscall.SizeofSockaddrInet4)
+	binary.NativeEndian.PutUint16(b, syscall.AF_INET)
+	binary.BigEndian.PutUint16(b[2:], port)
+	copy(b[4:], ip.To4())
+	return b
+}
+
+// sockaddrIn6 encodes the struct sockaddr_in6 of ip and port.
+func sockaddrIn6(ip net.IP, port uint16) []byte {
+	b := make([]byte, syscall.SizeofSockaddrInet6)
+	binary.NativeEndian.PutUint16(b, syscall.AF_INET6)
+	binary.BigEndian.PutUint16(b[2:], port)
+	copy(b[8:], ip.To16())
+	return b
+}
+
+func TestParseOrigDstAddr(t *testing.T) {
+	tests := []struct {
+		name string
+		oob  []byte
+		addr string
+	}{
+		{"ipv4", cmsg(syscall.SOL_IP, unix.IP_ORIGDSTADDR, sockaddrIn(net.IPv4(10, 0, 0, 1), 8080)), "10.0.0.1:8080"},
+		{"ipv4 port order", cmsg(syscall.SOL_IP, unix.IP_ORIGDSTADDR, sockaddrIn(net.IPv4(10, 0, 0, 1), 0x1234)), "10.0.0.1:4660"},
+		{"ipv6", cmsg(syscall.SOL_IPV6, unix.IPV6_ORIGDSTADDR, sockaddrIn6(net.ParseIP("2001:db8::1"), 53)), "[2001:db8::1]:53"},
+		{"ipv6 port order", cmsg(syscall.SOL_IPV6, unix.IPV6_ORIGDSTADDR, sockaddrIn6(net.ParseIP("::1"), 0xff00)), "[::1]:65280"},
+		{"after other message", append(cmsg(syscall.SOL_IP, syscall.IP_TTL, []byte{64, 0, 0, 0}),
+			cmsg(syscall.SOL_IP, unix.IP_ORIGDSTADDR, sockaddrIn(net.IPv4(192, 168, 1, 1), 443))...), "192.168.1.1:443"},
+		{"short ipv4", cmsg(syscall.SOL_IP, unix.IP_ORIGDSTADDR, sockaddrIn(net.IPv4(10, 0, 0, 1), 80)[:6]), ""},
+		{"short ipv6", cmsg(syscall.SOL_IPV6, unix.IPV6_ORIGDSTADDR, sockaddrIn6(net.ParseIP("::1"), 80)[:20]), ""},
+		{"other message", cmsg(syscall.SOL_IP, syscall.IP_TTL, []byte{64, 0, 0, 0}), ""},
+		{"empty", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, err := parseOrigDstAddr(tt.oob)
+			if tt.addr == "" {
+				if err == nil {
+					t.Errorf("expected an error, got %v", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if addr.String() != tt.addr {
+				t.Errorf("got %s, want %s", addr, tt.addr)
+			}
+		})
+	}
+}
+
+func TestNtohs(t *testing.T) {
+	tests := []struct {
+		b    [2]byte
+		port uint16
+	}{
+		{[2]byte{0x00, 0x50}, 80},
+		{[2]byte{0x1f, 0x90}, 8080},
+		{[2]byte{0x12, 0x34}, 0x1234},
+		{[2]byte{0xff, 0x00}, 0xff00},
+	}
+	for _, tt := range tests {
+		// the port field of the sockaddr_in6 read by the native byte order.
+		if port := ntohs(binary.NativeEndian.Uint16(tt.b[:])); port != tt.port {
+			t.Errorf("%x: got %d, want %d", tt.b, port, tt.port)
+		}
+	}
+}
+
+// udpRedirectRoundtrip sends a datagram to the UDP redirect listener on the loopback address addr,
+// and checks it is accepted with its original destination, and the reply is sent from it.
+// The datagram is not redirected, so the original destination is the listener address.
+func udpRedirectRoundtrip(t *testing.T, addr string) {
+	ln, err := UDPRedirectListener(addr, nil)
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("requires CAP_NET_ADMIN:", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	ln.(*udpRedirectListener).SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	client, err := net.DialUDP("udp", nil, ln.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().String() != client.LocalAddr().String() {
+		t.Errorf("source should be %s, got %s", client.LocalAddr(), conn.RemoteAddr())
+	}
+	if conn.LocalAddr().String() != ln.Addr().String() {
+		t.Errorf("original destination should be %s, got %s", ln.Addr(), conn.LocalAddr())
+	}
+	b := make([]byte, 16)
+	n, err := conn.Read(b)
+	if err != nil || string(b[:n]) != "ping" {
+		t.Fatalf("got %q, %v", b[:n], err)
+	}
+
+	if _, err := conn.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	n, from, err := client.ReadFromUDP(b)
+	if err != nil || string(b[:n]) != "pong" {
+		t.Fatalf("got %q, %v", b[:n], err)
+	}
+	if from.String() != ln.Addr().String() {
+		t.Errorf("reply should be sent from %s, got %s", ln.Addr(), from)
+	}
+}
+
+func TestUDPRedirectListener(t *testing.T) {
+	t.Run("ipv4", func(t *testing.T) {
+		udpRedirectRoundtrip(t, "127.0.0.1:0")
+	})
+	t.Run("ipv6", func(t *testing.T) {
+		if pc, err := net.ListenPacket("udp6", "[::1]:0"); err != nil {
+			t.Skip("IPv6 loopback unavailable:", err)
+		} else {
+			pc.Close()
+		}
+		udpRedirectRoundtrip(t, "[::1]:0")
+	})
+}
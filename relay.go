@@ -1,8 +1,12 @@
 package gost
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -97,15 +101,56 @@ func (c *relayConnector) ConnectContext(ctx context.Context, conn net.Conn, netw
 		Conn: conn,
 	}
 
+	var hdr bytes.Buffer
+	// EMOD: the extension goes in front of the relay request, only to the upstream known to understand it.
+	// Without RelayExt, the trace context and the tenant ID are not propagated.
+	if opts.RelayAntiReplay && !opts.RelayExt {
+		return nil, errRelayExtDisabled
+	}
+	var ext *relayExt
+	if opts.RelayExt {
+		if opts.RelayAntiReplay {
+			var err error
+			if ext, err = newRelayNonceExt(); err != nil {
+				return nil, err
+			}
+		}
+		if span := SpanFromContext(ctx); span.traced() {
+			if ext == nil {
+				ext = &relayExt{}
+			}
+			ext.Traceparent = span.SpanContext().Traceparent()
+		}
+		if tenant := TenantFromContext(ctx); tenant != "" {
+			if ext == nil {
+				ext = &relayExt{}
+			}
+			ext.Tenant = tenant
+		}
+	}
+	var rb bytes.Buffer
+	if _, err := req.WriteTo(&rb); err != nil {
+		return nil, err
+	}
+	if ext != nil {
+		if len(ext.Nonce) > 0 {
+			var pwd string
+			if c.user != nil {
+				pwd, _ = c.user.Password()
+			}
+			ext.MAC = ext.sign(pwd, rb.Bytes())
+		}
+		ext.WriteTo(&hdr)
+	}
+	rb.WriteTo(&hdr)
+
 	// write the header at once.
 	if opts.NoDelay {
-		if _, err := req.WriteTo(rc); err != nil {
+		if _, err := rc.Write(hdr.Bytes()); err != nil {
 			return nil, err
 		}
 	} else {
-		if _, err := req.WriteTo(&rc.wbuf); err != nil {
-			return nil, err
-		}
+		hdr.WriteTo(&rc.wbuf)
 	}
 
 	return rc, nil
@@ -113,6 +158,7 @@ func (c *relayConnector) ConnectContext(ctx context.Context, conn net.Conn, netw
 
 type relayHandler struct {
 	*baseForwardHandler
+	nonces *relayNonceCache
 }
 
 // RelayHandler creates a server Handler for TCP/UDP relay server.
@@ -132,16 +178,46 @@ func RelayHandler(raddr string, opts ...HandlerOption) Handler {
 
 func (h *relayHandler) Init(options ...HandlerOption) {
 	h.baseForwardHandler.Init(options...)
+
+	if h.options.RelayAntiReplay && h.nonces == nil {
+		h.nonces = newRelayNonceCache(DefaultRelayReplayWindow, DefaultRelayNonceCacheSize)
+	}
 }
 
 func (h *relayHandler) Handle(conn net.Conn) {
 	defer conn.Close()
 
+	var ext *relayExt
+	br := bufio.NewReader(conn)
+	if b, _ := br.Peek(1); len(b) > 0 && b[0] == relayExtMagic {
+		ext = &relayExt{}
+		if _, err := ext.ReadFrom(br); err != nil {
+			log.Logf("[relay] %s - %s : %s", conn.RemoteAddr(), conn.LocalAddr(), err)
+			return
+		}
+	}
+	conn = &bufferdConn{Conn: conn, br: br}
+
+	ctx := context.Background()
+	if ext != nil && ext.Traceparent != "" {
+		if sc, err := ParseTraceparent(ext.Traceparent); err == nil {
+			ctx = ContextWithRemoteSpanContext(ctx, sc)
+		}
+	}
+	ctx, span := startSpan(ctx, "relay", h.options.SlowLog)
+	defer span.End()
+	span.SetAttr("client.address", conn.RemoteAddr().String())
+
+	// the raw request is signed along with the nonce.
+	var rb bytes.Buffer
 	req := &relay.Request{}
-	if _, err := req.ReadFrom(conn); err != nil {
+	if _, err := req.ReadFrom(io.TeeReader(conn, &rb)); err != nil {
+		span.AddEvent("handshake", "error", err.Error())
+		span.SetError(err)
 		log.Logf("[relay] %s - %s : %s", conn.RemoteAddr(), conn.LocalAddr(), err)
 		return
 	}
+	span.AddEvent("handshake")
 
 	if req.Version != relay.Version1 {
 		log.Logf("[relay] %s - %s : bad version", conn.RemoteAddr(), conn.LocalAddr())
@@ -172,6 +248,35 @@ func (h *relayHandler) Handle(conn net.Conn) {
 		return
 	}
 
+	if h.nonces != nil {
+		err := ext.verify(pass, rb.Bytes())
+		if err == nil {
+			err = h.nonces.Check(ext)
+		}
+		if err != nil {
+			resp.Status = relay.StatusForbidden
+			resp.WriteTo(conn)
+			log.Logf("[relay] %s -> %s : %s", conn.RemoteAddr(), conn.LocalAddr(), err)
+			return
+		}
+	}
+
+	// the user name and the tenant ID in the relay header are trusted only from an authenticated relay.
+	var authUser, tenant string
+	if h.options.Authenticator != nil {
+		authUser = user
+		if ext != nil {
+			tenant = ext.Tenant
+		}
+	}
+	if tenant = h.options.tenant(authUser, tenant); tenant != "" {
+		ctx = ContextWithTenant(ctx, tenant)
+		span.SetAttr("tenant", tenant)
+		if Debug {
+			log.Logf("[relay] %s - %s : tenant %s", conn.RemoteAddr(), conn.LocalAddr(), tenant)
+		}
+	}
+
 	if raddr != "" {
 		if len(h.group.Nodes()) > 0 {
 			resp.Status = relay.StatusForbidden
@@ -203,7 +308,7 @@ func (h *relayHandler) Handle(conn net.Conn) {
 	if udp {
 		network = "udp"
 	}
-	if !Can(network, raddr, h.options.Whitelist, h.options.Blacklist) {
+	if !h.options.can(network, raddr) {
 		resp.Status = relay.StatusForbidden
 		resp.WriteTo(conn)
 		log.Logf("[relay] %s -> %s : relay to %s is forbidden",
@@ -211,13 +316,12 @@ func (h *relayHandler) Handle(conn net.Conn) {
 		return
 	}
 
-	ctx := context.TODO()
 	var cc net.Conn
 	var node Node
 	var err error
 	for i := 0; i < retries; i++ {
 		if len(h.group.Nodes()) > 0 {
-			node, err = h.group.Next()
+			node, err = h.group.NextFor(conn.RemoteAddr())
 			if err != nil {
 				resp.Status = relay.StatusServiceUnavailable
 				resp.WriteTo(conn)
@@ -226,13 +330,19 @@ func (h *relayHandler) Handle(conn net.Conn) {
 			}
 			raddr = node.Addr
 		}
+		span.SetAttr("target.address", raddr)
 
 		log.Logf("[relay] %s -> %s -> %s", conn.RemoteAddr(), conn.LocalAddr(), raddr)
 		cc, err = h.options.Chain.DialContext(ctx,
 			network, raddr,
 			RetryChainOption(h.options.Retries),
 			TimeoutChainOption(h.options.Timeout),
+			BlockPrivateChainOption(h.options.BlockPrivate),
+			RandomizeSourcePortChainOption(h.options.RandomizeSourcePort),
 		)
+		if err == nil {
+			conn, cc, err = h.options.checkImmediateClose(conn, cc)
+		}
 		if err != nil {
 			log.Logf("[relay] %s -> %s : %s", conn.RemoteAddr(), raddr, err)
 			node.MarkDead()
@@ -241,6 +351,8 @@ func (h *relayHandler) Handle(conn net.Conn) {
 		}
 	}
 	if err != nil {
+		h.options.Metrics.DialFailed()
+		span.SetError(err)
 		resp.Status = relay.StatusServiceUnavailable
 		resp.WriteTo(conn)
 		return
@@ -248,6 +360,7 @@ func (h *relayHandler) Handle(conn net.Conn) {
 
 	node.ResetDead()
 	defer cc.Close()
+	cc = h.options.firstByteConn(cc, node)
 
 	sc := &relayConn{
 		Conn:     conn,
@@ -257,8 +370,15 @@ func (h *relayHandler) Handle(conn net.Conn) {
 	resp.WriteTo(&sc.wbuf)
 	conn = sc
 
+	if h.options.AppKeepalive > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go sc.keepalive(h.options.AppKeepalive, done)
+	}
+
 	log.Logf("[relay] %s <-> %s", conn.RemoteAddr(), raddr)
-	transport(conn, cc)
+	h.options.transport(conn, cc)
+	span.AddEvent("close")
 	log.Logf("[relay] %s >-< %s", conn.RemoteAddr(), raddr)
 }
 
@@ -269,6 +389,8 @@ type relayConn struct {
 	wbuf       bytes.Buffer
 	once       sync.Once
 	headerSent bool
+	wmux       sync.Mutex
+	lastWrite  time.Time
 }
 
 func (c *relayConn) Read(b []byte) (n int, err error) {
@@ -300,11 +422,15 @@ func (c *relayConn) Read(b []byte) (n int, err error) {
 		return c.Conn.Read(b)
 	}
 	var bb [2]byte
-	_, err = io.ReadFull(c.Conn, bb[:])
-	if err != nil {
-		return
+	var dlen int
+	// the zero-length frames are the keepalives.
+	for dlen == 0 {
+		_, err = io.ReadFull(c.Conn, bb[:])
+		if err != nil {
+			return
+		}
+		dlen = int(binary.BigEndian.Uint16(bb[:]))
 	}
-	dlen := int(binary.BigEndian.Uint16(bb[:]))
 	if len(b) >= dlen {
 		return io.ReadFull(c.Conn, b[:dlen])
 	}
@@ -321,6 +447,50 @@ func (c *relayConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
 }
 
 func (c *relayConn) Write(b []byte) (n int, err error) {
+	c.wmux.Lock()
+	defer c.wmux.Unlock()
+
+	c.lastWrite = time.Now()
+	return c.write(b)
+}
+
+// keepalive sends a zero-length frame in the UDP mode if nothing is written in the interval,
+// until done is closed. The TCP mode can not tolerate any injected data, so it is skipped.
+func (c *relayConn) keepalive(interval time.Duration, done <-chan struct{}) {
+	if !c.udp || interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+
+		c.wmux.Lock()
+		var err error
+		if time.Since(c.lastWrite) >= interval && (c.headerSent || c.wbuf.Len() > 0) {
+			c.lastWrite = time.Now()
+			if c.wbuf.Len() > 0 {
+				c.headerSent = true
+				c.wbuf.Write([]byte{0, 0})
+				_, err = c.wbuf.WriteTo(c.Conn)
+			} else {
+				_, err = c.Conn.Write([]byte{0, 0})
+			}
+		}
+		c.wmux.Unlock()
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *relayConn) write(b []byte) (n int, err error) {
 	if len(b) > 0xFFFF {
 		err = errors.New("write: data maximum exceeded")
 		return
@@ -367,3 +537,252 @@ func (c *relayConn) Write(b []byte) (n int, err error) {
 func (c *relayConn) WriteTo(b []byte, addr net.Addr) (n int, err error) {
 	return c.Write(b)
 }
+
+// EMOD: relay anti-replay.
+// A connector with RelayExt enabled sends an extension frame in front of
+// the relay request, if it has the anti-replay nonce, trace context or tenant ID to carry:
+//
+//	magic(1) | length(2) | TLV...
+//
+// with each TLV encoded as type(1) | length(2) | value. The magic byte can not
+// be mistaken for relay.Version1, so the handler detects the frame by peeking,
+// and unknown TLV types are skipped.
+const (
+	relayExtMagic  = 0xE1
+	relayExtNonce  = 0x01 // timestamp(8) | nonce(16)
+	relayExtTrace  = 0x02 // W3C traceparent
+	relayExtTenant = 0x03 // tenant ID
+	relayExtMAC    = 0x04 // HMAC-SHA256(password, timestamp | nonce | relay request)
+	relayNonceSize = 16
+)
+
+var (
+	// DefaultRelayReplayWindow is the maximum age (and clock skew) of a relay nonce timestamp.
+	DefaultRelayReplayWindow = 2 * time.Minute
+	// DefaultRelayNonceCacheSize is the maximum number of seen nonces remembered by a relay handler,
+	// beyond it the oldest nonces are forgotten before they expire.
+	DefaultRelayNonceCacheSize = 65536
+)
+
+var (
+	errRelayExtDisabled   = errors.New("relay anti-replay requires the relay extension (relayExt)")
+	errRelayNonceMissing  = errors.New("relay nonce missing")
+	errRelayNonceStale    = errors.New("relay nonce timestamp out of window")
+	errRelayNonceReplayed = errors.New("relay nonce replayed")
+	errRelayNonceMAC      = errors.New("relay nonce MAC mismatch")
+)
+
+type relayExt struct {
+	Timestamp   int64 // unix seconds
+	Nonce       []byte
+	MAC         []byte
+	Traceparent string
+	Tenant      string
+}
+
+func newRelayNonceExt() (*relayExt, error) {
+	nonce := make([]byte, relayNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &relayExt{
+		Timestamp: time.Now().Unix(),
+		Nonce:     nonce,
+	}, nil
+}
+
+func (e *relayExt) WriteTo(w io.Writer) (int64, error) {
+	b := []byte{relayExtMagic, 0, 0}
+	if len(e.Nonce) > 0 {
+		v := make([]byte, 8, 8+len(e.Nonce))
+		binary.BigEndian.PutUint64(v, uint64(e.Timestamp))
+		b = appendRelayTLV(b, relayExtNonce, append(v, e.Nonce...))
+	}
+	if len(e.MAC) > 0 {
+		b = appendRelayTLV(b, relayExtMAC, e.MAC)
+	}
+	if e.Traceparent != "" {
+		b = appendRelayTLV(b, relayExtTrace, []byte(e.Traceparent))
+	}
+	if e.Tenant != "" {
+		b = appendRelayTLV(b, relayExtTenant, []byte(e.Tenant))
+	}
+	binary.BigEndian.PutUint16(b[1:3], uint16(len(b)-3))
+
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+func (e *relayExt) ReadFrom(r io.Reader) (int64, error) {
+	var hdr [3]byte
+	n, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return int64(n), err
+	}
+	if hdr[0] != relayExtMagic {
+		return int64(n), errors.New("relay: bad extension")
+	}
+
+	b := make([]byte, binary.BigEndian.Uint16(hdr[1:]))
+	nn, err := io.ReadFull(r, b)
+	n += nn
+	if err != nil {
+		return int64(n), err
+	}
+
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return int64(n), errors.New("relay: short extension")
+		}
+		t, l := b[0], int(binary.BigEndian.Uint16(b[1:3]))
+		b = b[3:]
+		if l > len(b) {
+			return int64(n), errors.New("relay: short extension")
+		}
+		v := b[:l]
+		b = b[l:]
+
+		switch t {
+		case relayExtNonce:
+			if l != 8+relayNonceSize {
+				return int64(n), errors.New("relay: bad nonce")
+			}
+			e.Timestamp = int64(binary.BigEndian.Uint64(v))
+			e.Nonce = append([]byte(nil), v[8:]...)
+		case relayExtMAC:
+			if l != sha256.Size {
+				return int64(n), errors.New("relay: bad MAC")
+			}
+			e.MAC = append([]byte(nil), v...)
+		case relayExtTrace:
+			e.Traceparent = string(v)
+		case relayExtTenant:
+			e.Tenant = string(v)
+		}
+	}
+	return int64(n), nil
+}
+
+// sign returns the MAC of the timestamp and nonce of e, and the relay request,
+// keyed by the password of the user.
+func (e *relayExt) sign(secret string, req []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(e.Timestamp))
+	mac.Write(ts[:])
+	mac.Write(e.Nonce)
+	mac.Write(req)
+	return mac.Sum(nil)
+}
+
+// verify checks the MAC of e, so that the timestamp and nonce can not be
+// refreshed, or moved to another request, without the password of the user.
+func (e *relayExt) verify(secret string, req []byte) error {
+	if e == nil || len(e.Nonce) == 0 {
+		return errRelayNonceMissing
+	}
+	if !hmac.Equal(e.MAC, e.sign(secret, req)) {
+		return errRelayNonceMAC
+	}
+	return nil
+}
+
+// Tenant derivations of the relay handler.
+const (
+	// TenantUser uses the authenticated user name as the tenant ID.
+	TenantUser = "user"
+	// TenantStaticPrefix prefixes a fixed tenant ID, e.g. static:acme.
+	TenantStaticPrefix = "static:"
+)
+
+type tenantKey struct{}
+
+// ContextWithTenant returns a copy of ctx carrying the tenant ID,
+// which is sent to the upstream in the relay header.
+func ContextWithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant ID in ctx, or empty if there is none.
+func TenantFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+func appendRelayTLV(b []byte, t byte, v []byte) []byte {
+	b = append(b, t, byte(len(v)>>8), byte(len(v)))
+	return append(b, v...)
+}
+
+// relayNonceCache remembers the nonces seen within the replay window.
+// Once full, the oldest nonce is dropped to make room for the new one, so a flood of handshakes
+// can not lock out the clients, at the cost of a dropped nonce being replayable until it expires.
+type relayNonceCache struct {
+	window time.Duration
+	size   int
+	seen   map[string]int64
+	queue  []string
+	mux    sync.Mutex
+}
+
+func newRelayNonceCache(window time.Duration, size int) *relayNonceCache {
+	return &relayNonceCache{
+		window: window,
+		size:   size,
+		seen:   make(map[string]int64),
+	}
+}
+
+// Check validates the timestamp of ext and records its nonce,
+// it fails if the nonce is missing, stale or has been seen before.
+func (c *relayNonceCache) Check(ext *relayExt) error {
+	if ext == nil || len(ext.Nonce) == 0 {
+		return errRelayNonceMissing
+	}
+
+	now := time.Now()
+	ts := time.Unix(ext.Timestamp, 0)
+	if ts.Before(now.Add(-c.window)) || ts.After(now.Add(c.window)) {
+		return errRelayNonceStale
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	// expired nonces would be rejected as stale anyway.
+	expired := func(k string) bool {
+		return !time.Unix(c.seen[k], 0).After(now.Add(-c.window))
+	}
+	for len(c.queue) > 0 && expired(c.queue[0]) {
+		delete(c.seen, c.queue[0])
+		c.queue = c.queue[1:]
+	}
+
+	key := string(ext.Nonce)
+	if _, ok := c.seen[key]; ok {
+		return errRelayNonceReplayed
+	}
+	if len(c.queue) >= c.size {
+		// the timestamps are not in order, look for the expired ones behind the head.
+		queue := c.queue[:0]
+		for _, k := range c.queue {
+			if expired(k) {
+				delete(c.seen, k)
+				continue
+			}
+			queue = append(queue, k)
+		}
+		c.queue = queue
+		if len(c.queue) >= c.size {
+			delete(c.seen, c.queue[0])
+			c.queue = c.queue[1:]
+		}
+	}
+	c.seen[key] = ext.Timestamp
+	c.queue = append(c.queue, key)
+
+	return nil
+}
@@ -0,0 +1,523 @@
+package gost
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/go-gost/relay"
+)
+
+func relayAntiReplayServer(t *testing.T) (addr string, closer func()) {
+	target, err := idServer('x')
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		target.Close()
+		t.Fatal(err)
+	}
+	h := RelayHandler(target.Addr().String())
+	h.Init(RelayAntiReplayHandlerOption(true))
+	server := &Server{Listener: ln, Handler: h}
+	go server.Run()
+
+	return ln.Addr().String(), func() {
+		server.Close()
+		target.Close()
+	}
+}
+
+// relayHandshake sends a raw relay request, prefixed by ext if not nil,
+// and returns the response status. The nonce of ext is signed if it has no MAC.
+func relayHandshake(addr string, ext *relayExt) (uint8, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	var rb, buf bytes.Buffer
+	req := &relay.Request{Version: relay.Version1}
+	req.WriteTo(&rb)
+	if ext != nil {
+		if ext.MAC == nil && len(ext.Nonce) > 0 {
+			ext.MAC = ext.sign("", rb.Bytes())
+		}
+		ext.WriteTo(&buf)
+	}
+	rb.WriteTo(&buf)
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	resp := &relay.Response{}
+	if _, err := resp.ReadFrom(conn); err != nil {
+		return 0, err
+	}
+	return resp.Status, nil
+}
+
+func TestRelayAntiReplayFresh(t *testing.T) {
+	addr, closer := relayAntiReplayServer(t)
+	defer closer()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	cc, err := RelayConnector(nil).ConnectContext(context.Background(), conn, "tcp", "",
+		RelayExtConnectOption(true), RelayAntiReplayConnectOption(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cc.Write([]byte{0}); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	b := make([]byte, 1)
+	if _, err := cc.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	if b[0] != 'x' {
+		t.Errorf("unexpected data %q", b)
+	}
+}
+
+func TestRelayAntiReplayReplayed(t *testing.T) {
+	addr, closer := relayAntiReplayServer(t)
+	defer closer()
+
+	ext, err := newRelayNonceExt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := relayHandshake(addr, ext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != relay.StatusOK {
+		t.Fatalf("first handshake should be accepted, got status %d", status)
+	}
+
+	status, err = relayHandshake(addr, ext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != relay.StatusForbidden {
+		t.Errorf("replayed handshake should be rejected, got status %d", status)
+	}
+}
+
+func TestRelayAntiReplayStale(t *testing.T) {
+	addr, closer := relayAntiReplayServer(t)
+	defer closer()
+
+	ext, err := newRelayNonceExt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ext.Timestamp = time.Now().Add(-2 * DefaultRelayReplayWindow).Unix()
+	status, err := relayHandshake(addr, ext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != relay.StatusForbidden {
+		t.Errorf("stale handshake should be rejected, got status %d", status)
+	}
+
+	// handshake without nonce
+	status, err = relayHandshake(addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != relay.StatusForbidden {
+		t.Errorf("handshake without nonce should be rejected, got status %d", status)
+	}
+}
+
+func TestRelayAntiReplayMAC(t *testing.T) {
+	addr, closer := relayAntiReplayServer(t)
+	defer closer()
+
+	// the nonce is refreshed without the password.
+	ext, err := newRelayNonceExt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ext.MAC = make([]byte, 32)
+	status, err := relayHandshake(addr, ext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != relay.StatusForbidden {
+		t.Errorf("handshake with a bad MAC should be rejected, got status %d", status)
+	}
+
+	// the MAC is keyed by the password of the user.
+	ext, err = newRelayNonceExt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := []byte{relay.Version1, 0, 0, 0}
+	ext.MAC = ext.sign("s3cr3t", req)
+	if err := ext.verify("", req); err != errRelayNonceMAC {
+		t.Errorf("expected %v, got %v", errRelayNonceMAC, err)
+	}
+	if err := ext.verify("s3cr3t", req); err != nil {
+		t.Error(err)
+	}
+	if err := ext.verify("s3cr3t", []byte{relay.Version1, relay.FUDP, 0, 0}); err != errRelayNonceMAC {
+		t.Errorf("the MAC of another request: expected %v, got %v", errRelayNonceMAC, err)
+	}
+}
+
+func TestRelayNonceCacheBounded(t *testing.T) {
+	c := newRelayNonceCache(time.Minute, 2)
+	var exts []*relayExt
+	for i := 0; i < 3; i++ {
+		ext, err := newRelayNonceExt()
+		if err != nil {
+			t.Fatal(err)
+		}
+		exts = append(exts, ext)
+	}
+	for _, ext := range exts[:2] {
+		if err := c.Check(ext); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the expired nonce makes room, wherever it is in the queue.
+	c.seen[string(exts[1].Nonce)] = time.Now().Add(-2 * time.Minute).Unix()
+	if err := c.Check(exts[2]); err != nil {
+		t.Errorf("expired nonce should be evicted, got %v", err)
+	}
+	if _, ok := c.seen[string(exts[0].Nonce)]; !ok {
+		t.Error("live nonce should be kept while an expired one makes room")
+	}
+}
+
+func TestRelayNonceCacheFull(t *testing.T) {
+	c := newRelayNonceCache(time.Minute, 2)
+	var exts []*relayExt
+	for i := 0; i < 3; i++ {
+		ext, err := newRelayNonceExt()
+		if err != nil {
+			t.Fatal(err)
+		}
+		exts = append(exts, ext)
+	}
+	for _, ext := range exts[:2] {
+		if err := c.Check(ext); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the full cache still accepts the new nonces, by dropping the oldest one.
+	if err := c.Check(exts[2]); err != nil {
+		t.Errorf("full cache should accept a new nonce, got %v", err)
+	}
+	if len(c.seen) != 2 || len(c.queue) != 2 {
+		t.Errorf("cache should hold 2 nonces, got %d", len(c.seen))
+	}
+	if _, ok := c.seen[string(exts[0].Nonce)]; ok {
+		t.Error("oldest nonce should be dropped")
+	}
+	for _, ext := range exts[1:] {
+		if err := c.Check(ext); err != errRelayNonceReplayed {
+			t.Errorf("expected %v, got %v", errRelayNonceReplayed, err)
+		}
+	}
+}
+
+// relayKeepalives sends a datagram (or a segment) through the relay server with the keepalive interval,
+// and returns the number of the keepalive frames read from the raw connection in the period.
+func relayKeepalives(t *testing.T, network string, interval, period time.Duration) int {
+	var target string
+	if network == "udp" {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pc.Close()
+		target = pc.LocalAddr().String()
+	} else {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		go func() {
+			conn, err := ln.Accept()
+			if err == nil {
+				defer conn.Close()
+				time.Sleep(period + time.Second)
+			}
+		}()
+		target = ln.Addr().String()
+	}
+
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := RelayHandler(target)
+	h.Init(AppKeepaliveHandlerOption(interval))
+	server := &Server{Listener: ln, Handler: h}
+	go server.Run()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cc, err := RelayConnector(nil).ConnectContext(context.Background(), conn, network, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cc.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(period))
+	data, _ := io.ReadAll(conn)
+	if len(data) == 0 {
+		return 0
+	}
+	br := bytes.NewReader(data)
+	if _, err := new(relay.Response).ReadFrom(br); err != nil {
+		t.Fatal(err)
+	}
+	rest, _ := io.ReadAll(br)
+	if len(rest)%2 != 0 || !bytes.Equal(rest, make([]byte, len(rest))) {
+		t.Fatalf("only the keepalive frames should be received, got %v", rest)
+	}
+	return len(rest) / 2
+}
+
+func TestRelayAppKeepaliveUDP(t *testing.T) {
+	n := relayKeepalives(t, "udp", 100*time.Millisecond, 550*time.Millisecond)
+	if n < 3 || n > 5 {
+		t.Errorf("about 5 keepalives should be sent in 550ms at 100ms, got %d", n)
+	}
+}
+
+func TestRelayAppKeepaliveTCP(t *testing.T) {
+	if n := relayKeepalives(t, "tcp", 100*time.Millisecond, 350*time.Millisecond); n != 0 {
+		t.Errorf("no keepalive should be injected into the TCP stream, got %d", n)
+	}
+}
+
+func TestRelayConnSkipsKeepalives(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	go c2.Write([]byte{0, 0, 0, 0, 0, 2, 'h', 'i'})
+	rc := &relayConn{Conn: c1, isServer: true, udp: true}
+	b := make([]byte, 16)
+	n, err := rc.Read(b)
+	if err != nil || string(b[:n]) != "hi" {
+		t.Errorf("keepalives should be skipped, got %q: %v", b[:n], err)
+	}
+}
+
+// relayTenant relays through an entry relay handler with the handler options to an upstream relay server
+// with the relay extension, and returns the tenant ID the upstream receives in the relay header,
+// empty if there is no extension frame.
+func relayTenant(t *testing.T, user *url.Userinfo, ext *relayExt, opts ...HandlerOption) string {
+	return relayUpstreamTenant(t, []ConnectOption{RelayExtConnectOption(true)}, user, ext, opts...)
+}
+
+// relayUpstreamTenant is relayTenant to the upstream node with the connect options.
+func relayUpstreamTenant(t *testing.T, connectOpts []ConnectOption, user *url.Userinfo, ext *relayExt, opts ...HandlerOption) string {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	tenants := make(chan string, 1)
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		if b, _ := br.Peek(1); len(b) > 0 && b[0] != relayExtMagic {
+			tenants <- ""
+			return
+		}
+		var ext relayExt
+		if _, err := ext.ReadFrom(br); err != nil {
+			tenants <- "error: " + err.Error()
+			return
+		}
+		tenants <- ext.Tenant
+	}()
+
+	chain := NewChain(Node{
+		Addr: upstream.Addr().String(),
+		Client: &Client{
+			Connector:   RelayConnector(nil),
+			Transporter: TCPTransporter(),
+		},
+		ConnectOptions: connectOpts,
+	})
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := RelayHandler("127.0.0.1:9")
+	h.Init(append(opts, ChainHandlerOption(chain))...)
+	server := &Server{Listener: ln, Handler: h}
+	go server.Run()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var buf bytes.Buffer
+	if ext != nil {
+		ext.WriteTo(&buf)
+	}
+	req := &relay.Request{Version: relay.Version1}
+	if user != nil {
+		pass, _ := user.Password()
+		req.Features = append(req.Features, &relay.UserAuthFeature{Username: user.Username(), Password: pass})
+	}
+	req.WriteTo(&buf)
+	buf.WriteByte(0)
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case tenant := <-tenants:
+		return tenant
+	case <-time.After(3 * time.Second):
+		t.Fatal("upstream receives no relay header")
+	}
+	return ""
+}
+
+func TestRelayTenant(t *testing.T) {
+	au := NewLocalAuthenticator(map[string]string{"alice": "pass"})
+
+	if tenant := relayTenant(t, url.UserPassword("alice", "pass"), nil,
+		AuthenticatorHandlerOption(au), TenantHandlerOption(TenantUser)); tenant != "alice" {
+		t.Errorf("tenant should be the user name, got %q", tenant)
+	}
+	if tenant := relayTenant(t, nil, nil, TenantHandlerOption(TenantStaticPrefix+"acme")); tenant != "acme" {
+		t.Errorf("tenant should be the static ID, got %q", tenant)
+	}
+	if tenant := relayTenant(t, url.UserPassword("alice", "pass"), &relayExt{Tenant: "downstream"},
+		AuthenticatorHandlerOption(au)); tenant != "downstream" {
+		t.Errorf("tenant should be propagated from the authenticated downstream, got %q", tenant)
+	}
+	if tenant := relayTenant(t, url.UserPassword("alice", "pass"), nil, AuthenticatorHandlerOption(au)); tenant != "" {
+		t.Errorf("tenant should not be derived without the tenant option, got %q", tenant)
+	}
+	if tenant := relayTenant(t, nil, &relayExt{Tenant: "downstream"},
+		TenantHandlerOption(TenantStaticPrefix+"acme")); tenant != "acme" {
+		t.Errorf("derived tenant should override the downstream one, got %q", tenant)
+	}
+}
+
+func TestRelayTenantPlain(t *testing.T) {
+	au := NewLocalAuthenticator(map[string]string{"alice": "pass"})
+
+	// the upstream without relayExt gets the plain relay request, even with a tenant to carry.
+	if tenant := relayUpstreamTenant(t, nil, url.UserPassword("alice", "pass"), nil,
+		AuthenticatorHandlerOption(au), TenantHandlerOption(TenantUser)); tenant != "" {
+		t.Errorf("extension frame should not be sent without relayExt, got tenant %q", tenant)
+	}
+	if tenant := relayUpstreamTenant(t, nil, url.UserPassword("alice", "pass"), nil,
+		AuthenticatorHandlerOption(au)); tenant != "" {
+		t.Errorf("extension frame should not be sent, got tenant %q", tenant)
+	}
+}
+
+func TestRelayTenantSpoofed(t *testing.T) {
+	if tenant := relayTenant(t, nil, &relayExt{Tenant: "spoofed"}); tenant != "" {
+		t.Errorf("tenant from an unauthenticated peer should be ignored, got %q", tenant)
+	}
+	if tenant := relayTenant(t, url.UserPassword("mallory", "x"), nil, TenantHandlerOption(TenantUser)); tenant != "" {
+		t.Errorf("unauthenticated user name should not be the tenant, got %q", tenant)
+	}
+}
+
+func TestRelayExtTenant(t *testing.T) {
+	var buf bytes.Buffer
+	(&relayExt{Traceparent: "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", Tenant: "acme"}).WriteTo(&buf)
+	var ext relayExt
+	if _, err := ext.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if ext.Tenant != "acme" || ext.Traceparent == "" {
+		t.Errorf("unexpected extension %+v", ext)
+	}
+}
+
+// relayConnectHeader returns the header written by the relay connector with the connect options.
+func relayConnectHeader(ctx context.Context, options ...ConnectOption) ([]byte, error) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	hdr := make(chan []byte, 1)
+	go func() {
+		b := make([]byte, 1024)
+		c2.SetReadDeadline(time.Now().Add(3 * time.Second))
+		n, _ := c2.Read(b)
+		hdr <- b[:n]
+	}()
+	if _, err := RelayConnector(nil).ConnectContext(ctx, c1, "tcp", "",
+		append(options, NoDelayConnectOption(true))...); err != nil {
+		return nil, err
+	}
+	return <-hdr, nil
+}
+
+func TestRelayExtDisabled(t *testing.T) {
+	ctx, span := NewTracer(&memSpanExporter{}).Start(ContextWithTenant(context.Background(), "acme"), "client")
+	defer span.End()
+
+	// a stock relay server takes the extension frame for a bad version.
+	b, err := relayConnectHeader(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) == 0 || b[0] != relay.Version1 {
+		t.Errorf("plain relay request expected, got %x", b)
+	}
+	if _, err := relayConnectHeader(ctx, RelayAntiReplayConnectOption(true)); err == nil {
+		t.Error("anti-replay without the relay extension should fail")
+	}
+
+	b, err = relayConnectHeader(ctx, RelayExtConnectOption(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ext relayExt
+	if _, err := ext.ReadFrom(bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	if ext.Tenant != "acme" || ext.Traceparent != span.SpanContext().Traceparent() {
+		t.Errorf("unexpected extension %+v", ext)
+	}
+}
@@ -1,8 +1,13 @@
 package gost
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
 	"io"
+	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/go-log/log"
@@ -20,11 +25,54 @@ type Stoppable interface {
 	Stopped() bool
 }
 
+var (
+	// minReloadPeriod is the lower bound of the reloading period.
+	minReloadPeriod = time.Second
+	// remoteConfigClient is the HTTP client fetching the remote configs.
+	remoteConfigClient = &http.Client{Timeout: 30 * time.Second}
+)
+
+// isRemoteConfig reports whether the config is an HTTP(S) URL.
+func isRemoteConfig(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// OpenConfig opens the config file, or fetches the config if it is an HTTP(S) URL.
+func OpenConfig(name string) (io.ReadCloser, error) {
+	if !isRemoteConfig(name) {
+		return os.Open(name)
+	}
+	data, err := fetchConfig(name)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// fetchConfig fetches the remote config, only a successful response is accepted.
+func fetchConfig(url string) ([]byte, error) {
+	resp, err := remoteConfigClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
 // PeriodReload reloads the config configFile periodically according to the period of the Reloader r.
+// The config can also be an HTTP(S) URL, it is fetched on each period and reloaded if the content changes,
+// the last good config is kept if the fetch or the reloading fails.
 func PeriodReload(r Reloader, configFile string) error {
 	if r == nil || configFile == "" {
 		return nil
 	}
+	if isRemoteConfig(configFile) {
+		return periodReloadRemote(r, configFile)
+	}
 
 	var lastMod time.Time
 	for {
@@ -57,9 +105,45 @@ func PeriodReload(r Reloader, configFile string) error {
 			log.Log("[reload] disabled:", configFile)
 			return nil
 		}
-		if period < time.Second {
-			period = time.Second
+		if period < minReloadPeriod {
+			period = minReloadPeriod
+		}
+		<-time.After(period)
+	}
+}
+
+func periodReloadRemote(r Reloader, url string) error {
+	var lastSum [sha256.Size]byte
+	for {
+		period := r.Period()
+		if period < 0 {
+			log.Log("[reload] stopped:", url)
+			return nil
+		}
+		if period == 0 {
+			log.Log("[reload] disabled:", url)
+			return nil
+		}
+		if period < minReloadPeriod {
+			period = minReloadPeriod
 		}
 		<-time.After(period)
+
+		data, err := fetchConfig(url)
+		if err != nil {
+			log.Logf("[reload] %s: %s", url, err)
+			continue
+		}
+		sum := sha256.Sum256(data)
+		if sum == lastSum {
+			continue
+		}
+
+		log.Log("[reload]", url)
+		if err := r.Reload(bytes.NewReader(data)); err != nil {
+			log.Logf("[reload] %s: %s", url, err)
+			continue
+		}
+		lastSum = sum
 	}
 }
@@ -0,0 +1,132 @@
+package gost
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// nodeListReloader keeps the node list of the last good config.
+type nodeListReloader struct {
+	nodes   []string
+	reloads int
+	stopped bool
+	mux     sync.Mutex
+}
+
+func (r *nodeListReloader) Reload(rd io.Reader) error {
+	data, err := io.ReadAll(rd)
+	if err != nil {
+		return err
+	}
+	nodes := strings.Fields(string(data))
+	for _, node := range nodes {
+		if _, err := ParseNode(node); err != nil || !strings.Contains(node, "://") {
+			return errors.New("invalid node " + node)
+		}
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.nodes = nodes
+	r.reloads++
+	return nil
+}
+
+func (r *nodeListReloader) Period() time.Duration {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.stopped {
+		return -1
+	}
+	return 20 * time.Millisecond
+}
+
+func (r *nodeListReloader) Stop() {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.stopped = true
+}
+
+func (r *nodeListReloader) state() ([]string, int) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.nodes, r.reloads
+}
+
+func TestPeriodReloadRemote(t *testing.T) {
+	defer func(d time.Duration) { minReloadPeriod = d }(minReloadPeriod)
+	minReloadPeriod = 10 * time.Millisecond
+
+	var mux sync.Mutex
+	body, status := "http://1.1.1.1:8080", http.StatusOK
+	set := func(b string, code int) {
+		mux.Lock()
+		defer mux.Unlock()
+		body, status = b, code
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		defer mux.Unlock()
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}))
+	defer ts.Close()
+
+	r := &nodeListReloader{}
+	f, err := OpenConfig(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Reload(f)
+	f.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- PeriodReload(r, ts.URL) }()
+	defer func() {
+		r.Stop()
+		<-done
+	}()
+
+	wait := func(want string) {
+		t.Helper()
+		for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if nodes, _ := r.state(); strings.Join(nodes, " ") == want {
+				return
+			}
+		}
+		nodes, _ := r.state()
+		t.Fatalf("nodes should be %q, got %q", want, nodes)
+	}
+
+	wait("http://1.1.1.1:8080")
+	set("http://2.2.2.2:8080 socks5://3.3.3.3:1080", http.StatusOK)
+	wait("http://2.2.2.2:8080 socks5://3.3.3.3:1080")
+
+	// the last good list is kept on the fetch failure and the invalid content.
+	_, reloads := r.state()
+	set("http://4.4.4.4:8080", http.StatusInternalServerError)
+	time.Sleep(100 * time.Millisecond)
+	set("4.4.4.4", http.StatusOK)
+	time.Sleep(100 * time.Millisecond)
+	if nodes, n := r.state(); n != reloads || strings.Join(nodes, " ") != "http://2.2.2.2:8080 socks5://3.3.3.3:1080" {
+		t.Errorf("last good list should be kept, got %q after %d reloads", nodes, n-reloads)
+	}
+
+	set("http://5.5.5.5:8080", http.StatusOK)
+	wait("http://5.5.5.5:8080")
+}
+
+func TestOpenConfigRemoteFailure(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	if _, err := OpenConfig(ts.URL); err == nil {
+		t.Error("fetching config should fail on 404")
+	}
+}
@@ -17,11 +17,16 @@ import (
 
 	"github.com/go-log/log"
 	"github.com/miekg/dns"
+	"golang.org/x/sync/singleflight"
 )
 
 var (
 	// DefaultResolverTimeout is the default timeout for name resolution.
 	DefaultResolverTimeout = 5 * time.Second
+	// DefaultDNSTimeout is the default timeout for a single DNS query.
+	DefaultDNSTimeout = 2 * time.Second
+	// NameServerDownTime is the time a failed name server is tried after the others.
+	NameServerDownTime = 30 * time.Second
 )
 
 type nameServerOptions struct {
@@ -92,9 +97,10 @@ func (ns *NameServer) Init(opts ...NameServerOption) error {
 			return err
 		}
 		u.Scheme = "https"
+		// EMOD: verify the certificate of the endpoint by its host, the queries should be private.
 		cfg := &tls.Config{ServerName: ns.Hostname}
 		if cfg.ServerName == "" {
-			cfg.InsecureSkipVerify = true
+			cfg.ServerName = u.Hostname()
 		}
 		ns.exchanger = NewDoHExchanger(u, cfg, options...)
 	case "udp", "udp-chain":
@@ -124,6 +130,13 @@ type resolverOptions struct {
 	ttl     time.Duration
 	prefer  string
 	srcIP   net.IP
+	// EMOD: the options below are added by the fork, see their ResolverOption funcs.
+	singleflight bool
+	dnsTimeout   time.Duration
+	minTTL       time.Duration
+	maxTTL       time.Duration
+	negTTL       time.Duration
+	parallel     bool
 }
 
 // ResolverOption allows a common way to set Resolver options.
@@ -136,7 +149,8 @@ func ChainResolverOption(chain *Chain) ResolverOption {
 	}
 }
 
-// TimeoutResolverOption sets the timeout for Resolver.
+// TimeoutResolverOption sets the connection timeout for Resolver.
+// It only caps the query timeout when DNSTimeoutResolverOption is not set.
 func TimeoutResolverOption(timeout time.Duration) ResolverOption {
 	return func(opts *resolverOptions) {
 		opts.timeout = timeout
@@ -164,6 +178,48 @@ func SrcIPResolverOption(ip net.IP) ResolverOption {
 	}
 }
 
+// SingleflightResolverOption sets whether concurrent lookups for the same host
+// share one upstream query.
+func SingleflightResolverOption(b bool) ResolverOption {
+	return func(opts *resolverOptions) {
+		opts.singleflight = b
+	}
+}
+
+// DNSTimeoutResolverOption sets the timeout for a single DNS query,
+// independent of the connection timeout.
+func DNSTimeoutResolverOption(timeout time.Duration) ResolverOption {
+	return func(opts *resolverOptions) {
+		opts.dnsTimeout = timeout
+	}
+}
+
+// ParallelResolverOption sets whether the name servers are queried at the same time
+// instead of one by one, the first answer with the addresses is used.
+func ParallelResolverOption(b bool) ResolverOption {
+	return func(opts *resolverOptions) {
+		opts.parallel = b
+	}
+}
+
+// TTLBoundsResolverOption clamps the TTL of the positive answers in the cache to [min, max],
+// zero means no bound. The answer with the zero TTL is not cached unless min is set.
+func TTLBoundsResolverOption(min, max time.Duration) ResolverOption {
+	return func(opts *resolverOptions) {
+		opts.minTTL = min
+		opts.maxTTL = max
+	}
+}
+
+// NegativeTTLResolverOption caches the negative answers (NXDOMAIN, no data or server failure)
+// for at most ttl, or the SOA minimum TTL in the answer if it is less (RFC 2308).
+// Zero keeps them as the positive answers, negative means they are not cached.
+func NegativeTTLResolverOption(ttl time.Duration) ResolverOption {
+	return func(opts *resolverOptions) {
+		opts.negTTL = ttl
+	}
+}
+
 // Resolver is a name resolver for domain name.
 // It contains a list of name servers.
 type Resolver interface {
@@ -195,6 +251,16 @@ type resolver struct {
 	prefer  string // ipv4 or ipv6
 	srcIP   net.IP // for edns0 subnet option
 	options resolverOptions
+	// EMOD: collapse duplicate concurrent lookups.
+	singleflight bool
+	group        singleflight.Group
+	dnsTimeout   time.Duration
+	minTTL       time.Duration
+	maxTTL       time.Duration
+	negTTL       time.Duration
+	parallel     bool
+	// the time until which the failed name servers are tried last, keyed by NameServer.String().
+	down sync.Map
 }
 
 // NewResolver create a new Resolver with the given name servers and resolution timeout.
@@ -223,13 +289,19 @@ func (r *resolver) Init(opts ...ResolverOption) error {
 		opt(&r.options)
 	}
 
-	timeout := r.timeout
-	if r.options.timeout != 0 {
-		timeout = r.options.timeout
+	// EMOD: DNS queries time out much faster than connections,
+	// the connection timeout only caps the default query timeout.
+	timeout := r.options.dnsTimeout
+	if timeout <= 0 {
+		timeout = r.timeout
 	}
 	if timeout <= 0 {
-		timeout = DefaultResolverTimeout
+		timeout = DefaultDNSTimeout
+		if r.options.timeout > 0 && r.options.timeout < timeout {
+			timeout = r.options.timeout
+		}
 	}
+	r.dnsTimeout = timeout
 
 	if r.options.ttl != 0 {
 		r.ttl = r.options.ttl
@@ -240,6 +312,10 @@ func (r *resolver) Init(opts ...ResolverOption) error {
 	if r.options.srcIP != nil {
 		r.srcIP = r.options.srcIP
 	}
+	r.singleflight = r.options.singleflight
+	r.minTTL, r.maxTTL = r.options.minTTL, r.options.maxTTL
+	r.negTTL = r.options.negTTL
+	r.parallel = r.options.parallel
 
 	var nss []NameServer
 	for _, ns := range r.servers {
@@ -267,6 +343,30 @@ func (r *resolver) copyServers() []NameServer {
 	return servers
 }
 
+// orderedServers returns the name servers to try in order, the recently failed ones are moved to the end,
+// so that an unreachable server (e.g. a DoH endpoint) does not delay every query until its time out.
+func (r *resolver) orderedServers() []NameServer {
+	servers := r.copyServers()
+	var up, down []NameServer
+	for _, ns := range servers {
+		if t, ok := r.down.Load(ns.String()); ok && time.Now().Before(t.(time.Time)) {
+			down = append(down, ns)
+			continue
+		}
+		up = append(up, ns)
+	}
+	return append(up, down...)
+}
+
+// markServer records the result of the query via the name server.
+func (r *resolver) markServer(ns NameServer, err error) {
+	if err != nil {
+		r.down.Store(ns.String(), time.Now().Add(NameServerDownTime))
+		return
+	}
+	r.down.Delete(ns.String())
+}
+
 func (r *resolver) Resolve(host string) (ips []net.IP, err error) {
 	r.mux.RLock()
 	domain := r.domain
@@ -280,25 +380,108 @@ func (r *resolver) Resolve(host string) (ips []net.IP, err error) {
 		host = host + "." + domain
 	}
 
+	r.mux.RLock()
+	sf := r.singleflight
+	r.mux.RUnlock()
+	if !sf {
+		return r.lookup(host)
+	}
+
+	v, err, shared := r.group.Do(host, func() (interface{}, error) {
+		return r.lookup(host)
+	})
+	if shared && Debug {
+		log.Logf("[resolver] %s shared lookup", host)
+	}
+	if v != nil {
+		// the result may be shared by other callers.
+		ips = append(ips, v.([]net.IP)...)
+	}
+	return
+}
+
+func (r *resolver) lookup(host string) (ips []net.IP, err error) {
+	servers := r.orderedServers()
+
+	r.mux.RLock()
+	parallel := r.parallel
+	r.mux.RUnlock()
+	if parallel && len(servers) > 1 {
+		return r.lookupParallel(host, servers)
+	}
+
 	ctx := context.Background()
-	for _, ns := range r.copyServers() {
-		ips, err = r.resolve(ctx, ns.exchanger, host)
+	var errs []error
+	for _, ns := range servers {
+		ips, err = r.lookupServer(ctx, ns, host)
 		if err != nil {
-			log.Logf("[resolver] %s via %s : %s", host, ns.String(), err)
+			errs = append(errs, err)
 			continue
 		}
+		if len(ips) > 0 {
+			return ips, nil
+		}
+	}
+	return nil, lookupError(servers, errs)
+}
+
+// lookupParallel queries all the name servers at the same time, the first one with the addresses wins.
+func (r *resolver) lookupParallel(host string, servers []NameServer) ([]net.IP, error) {
+	type result struct {
+		ips []net.IP
+		err error
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	results := make(chan result, len(servers))
+	for _, ns := range servers {
+		go func(ns NameServer) {
+			ips, err := r.lookupServer(ctx, ns, host)
+			results <- result{ips: ips, err: err}
+		}(ns)
+	}
 
-		if Debug {
-			log.Logf("[resolver] %s via %s %v", host, ns.String(), ips)
+	var errs []error
+	for range servers {
+		res := <-results
+		if res.err != nil {
+			errs = append(errs, res.err)
+			continue
 		}
-		if len(ips) > 0 {
-			break
+		if len(res.ips) > 0 {
+			return res.ips, nil
 		}
 	}
+	return nil, lookupError(servers, errs)
+}
 
+// lookupServer resolves the host via the name server.
+func (r *resolver) lookupServer(ctx context.Context, ns NameServer, host string) (ips []net.IP, err error) {
+	ips, err = r.resolve(ctx, ns.exchanger, host)
+	if ctx.Err() != nil {
+		return // canceled by the parallel lookup, the name server is not blamed.
+	}
+	r.markServer(ns, err)
+	if err != nil {
+		log.Logf("[resolver] %s via %s : %s", host, ns.String(), err)
+		return nil, fmt.Errorf("%s: %w", ns.String(), err)
+	}
+	if Debug {
+		log.Logf("[resolver] %s via %s %v", host, ns.String(), ips)
+	}
 	return
 }
 
+// lookupError returns the error of the lookup without any address,
+// it is nil if any name server answered, e.g. the domain does not exist.
+func lookupError(servers []NameServer, errs []error) error {
+	if len(errs) == 0 || len(errs) < len(servers) {
+		return nil
+	}
+	return fmt.Errorf("all %d name servers failed: %w", len(servers), errors.Join(errs...))
+}
+
 func (r *resolver) resolve(ctx context.Context, ex Exchanger, host string) (ips []net.IP, err error) {
 	if ex == nil {
 		return
@@ -342,7 +525,8 @@ func (r *resolver) resolveIPs(ctx context.Context, ex Exchanger, mq *dns.Msg) (i
 		if err != nil {
 			return
 		}
-		r.cache.storeCache(key, mr, r.TTL())
+		ttl, fixed := r.cacheTTL(mr)
+		r.cache.storeCache(key, mr, ttl, fixed)
 	}
 
 	for _, ans := range mr.Answer {
@@ -402,16 +586,18 @@ func (r *resolver) Exchange(ctx context.Context, query []byte) (reply []byte, er
 
 		defer func() {
 			if mr != nil {
-				r.cache.storeCache(key, mr, r.TTL())
+				ttl, fixed := r.cacheTTL(mr)
+				r.cache.storeCache(key, mr, ttl, fixed)
 			}
 		}()
 	}
 
 	r.addSubnetOpt(mq)
 
-	for _, ns := range r.copyServers() {
+	for _, ns := range r.orderedServers() {
 		log.Logf("[dns] exchange message %d via %s: %s", mq.Id, ns.String(), mq.Question[0].String())
 		mr, err = r.exchangeMsg(ctx, ns.exchanger, mq)
+		r.markServer(ns, err)
 		if err == nil {
 			break
 		}
@@ -428,6 +614,16 @@ func (r *resolver) exchangeMsg(ctx context.Context, ex Exchanger, mq *dns.Msg) (
 	if err != nil {
 		return
 	}
+
+	r.mux.RLock()
+	timeout := r.dnsTimeout
+	r.mux.RUnlock()
+	if timeout <= 0 {
+		timeout = DefaultDNSTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
 	reply, err := ex.Exchange(ctx, query)
 	if err != nil {
 		return
@@ -439,12 +635,75 @@ func (r *resolver) exchangeMsg(ctx context.Context, ex Exchanger, mq *dns.Msg) (
 	return
 }
 
+func (r *resolver) CacheEntries() []ResolverCacheEntry {
+	return r.cache.entries()
+}
+
+func (r *resolver) FlushCache(name string) int {
+	return r.cache.flush(name)
+}
+
 func (r *resolver) TTL() time.Duration {
 	r.mux.RLock()
 	defer r.mux.RUnlock()
 	return r.ttl
 }
 
+// cacheTTL returns the time to cache the reply mr, and whether the TTLs of the answers are folded in,
+// so that the entry expires by the time only. A negative time means mr is not cached.
+func (r *resolver) cacheTTL(mr *dns.Msg) (ttl time.Duration, fixed bool) {
+	r.mux.RLock()
+	ttl, minTTL, maxTTL, negTTL := r.ttl, r.minTTL, r.maxTTL, r.negTTL
+	r.mux.RUnlock()
+
+	if ttl < 0 {
+		return ttl, false
+	}
+
+	if mr.Rcode != dns.RcodeSuccess || len(mr.Answer) == 0 {
+		if negTTL == 0 {
+			return ttl, false
+		}
+		if negTTL < 0 {
+			return -1, false
+		}
+		for _, rr := range mr.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				d := time.Duration(min(soa.Hdr.Ttl, soa.Minttl)) * time.Second
+				negTTL = min(negTTL, d)
+			}
+		}
+		if ttl > 0 {
+			negTTL = min(negTTL, ttl)
+		}
+		if negTTL <= 0 {
+			return -1, false
+		}
+		return negTTL, true
+	}
+
+	if minTTL <= 0 && maxTTL <= 0 {
+		return ttl, false
+	}
+	answer := time.Duration(mr.Answer[0].Header().Ttl) * time.Second
+	for _, rr := range mr.Answer[1:] {
+		answer = min(answer, time.Duration(rr.Header().Ttl)*time.Second)
+	}
+	if minTTL > 0 {
+		answer = max(answer, minTTL)
+	}
+	if maxTTL > 0 {
+		answer = min(answer, maxTTL)
+	}
+	if ttl > 0 {
+		answer = min(answer, ttl)
+	}
+	if answer <= 0 {
+		return -1, false
+	}
+	return answer, true
+}
+
 func (r *resolver) Reload(rd io.Reader) error {
 	var ttl, timeout, period time.Duration
 	var domain, prefer string
@@ -600,6 +859,8 @@ type resolverCacheItem struct {
 	mr  *dns.Msg
 	ts  int64
 	ttl time.Duration
+	// the TTLs of the answers are folded in ttl.
+	fixed bool
 }
 
 type resolverCache struct {
@@ -627,7 +888,7 @@ func (rc *resolverCache) loadCache(key resolverCacheKey) *dns.Msg {
 		return nil
 	}
 	for _, rr := range item.mr.Answer {
-		if elapsed > time.Duration(rr.Header().Ttl)*time.Second {
+		if !item.fixed && elapsed > time.Duration(rr.Header().Ttl)*time.Second {
 			rc.m.Delete(key)
 			return nil
 		}
@@ -640,21 +901,98 @@ func (rc *resolverCache) loadCache(key resolverCacheKey) *dns.Msg {
 	return item.mr.Copy()
 }
 
-func (rc *resolverCache) storeCache(key resolverCacheKey, mr *dns.Msg, ttl time.Duration) {
+func (rc *resolverCache) storeCache(key resolverCacheKey, mr *dns.Msg, ttl time.Duration, fixed bool) {
 	if key == "" || mr == nil || ttl < 0 {
 		return
 	}
 
 	rc.m.Store(key, &resolverCacheItem{
-		mr:  mr.Copy(),
-		ts:  time.Now().Unix(),
-		ttl: ttl,
+		mr:    mr.Copy(),
+		ts:    time.Now().Unix(),
+		ttl:   ttl,
+		fixed: fixed,
 	})
 	if Debug {
 		log.Logf("[resolver] cache store %s", key)
 	}
 }
 
+// ResolverCacheEntry is an entry of the resolver cache.
+type ResolverCacheEntry struct {
+	Name      string   `json:"name"`
+	Type      string   `json:"type"`
+	Addresses []string `json:"addresses"`
+	// TTL is the remaining TTL in seconds, -1 means the entry never expires.
+	TTL int64 `json:"ttl"`
+	// Stale indicates the entry is expired but not evicted yet.
+	Stale bool `json:"stale"`
+}
+
+// CacheResolver is a Resolver with inspectable cache.
+type CacheResolver interface {
+	Resolver
+	// CacheEntries returns the entries of the cache.
+	CacheEntries() []ResolverCacheEntry
+	// FlushCache removes the entries of the name from the cache,
+	// or all the entries if name is empty. It returns the number of removed entries.
+	FlushCache(name string) int
+}
+
+func (rc *resolverCache) entries() (entries []ResolverCacheEntry) {
+	rc.m.Range(func(k, v interface{}) bool {
+		item, ok := v.(*resolverCacheItem)
+		if !ok || item.mr == nil || len(item.mr.Question) == 0 {
+			return true
+		}
+
+		elapsed := time.Since(time.Unix(item.ts, 0))
+		remaining, expires := item.ttl-elapsed, item.ttl > 0
+		entry := ResolverCacheEntry{
+			Name:      item.mr.Question[0].Name,
+			Type:      dns.Type(item.mr.Question[0].Qtype).String(),
+			Addresses: []string{},
+		}
+		for _, rr := range item.mr.Answer {
+			if d := time.Duration(rr.Header().Ttl)*time.Second - elapsed; !item.fixed && (!expires || d < remaining) {
+				remaining, expires = d, true
+			}
+			switch ar := rr.(type) {
+			case *dns.A:
+				entry.Addresses = append(entry.Addresses, ar.A.String())
+			case *dns.AAAA:
+				entry.Addresses = append(entry.Addresses, ar.AAAA.String())
+			}
+		}
+		switch {
+		case !expires:
+			entry.TTL = -1
+		case remaining <= 0:
+			entry.Stale = true
+		default:
+			entry.TTL = int64(remaining / time.Second)
+		}
+		entries = append(entries, entry)
+		return true
+	})
+	return
+}
+
+func (rc *resolverCache) flush(name string) (n int) {
+	if name != "" {
+		name = dns.Fqdn(strings.ToLower(name))
+	}
+	rc.m.Range(func(k, v interface{}) bool {
+		item, ok := v.(*resolverCacheItem)
+		if name == "" || (ok && item.mr != nil && len(item.mr.Question) > 0 &&
+			strings.ToLower(item.mr.Question[0].Name) == name) {
+			rc.m.Delete(k)
+			n++
+		}
+		return true
+	})
+	return
+}
+
 // Exchanger is an interface for DNS synchronous query.
 type Exchanger interface {
 	Exchange(ctx context.Context, query []byte) ([]byte, error)
@@ -2,11 +2,18 @@ package gost
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/miekg/dns"
 )
 
 var dnsTests = []struct {
@@ -268,3 +275,257 @@ func compareNameServer(n1, n2 *NameServer) bool {
 		n1.Hostname == n2.Hostname &&
 		n1.Protocol == n2.Protocol
 }
+
+// stubExchanger answers every A query with a fixed address (192.168.1.1 by default) after a delay.
+type stubExchanger struct {
+	delay   time.Duration
+	ip      net.IP
+	queries int32
+}
+
+func (ex *stubExchanger) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	atomic.AddInt32(&ex.queries, 1)
+	select {
+	case <-time.After(ex.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	mq := &dns.Msg{}
+	if err := mq.Unpack(query); err != nil {
+		return nil, err
+	}
+	mr := &dns.Msg{}
+	mr.SetReply(mq)
+	if mq.Question[0].Qtype == dns.TypeA {
+		ip := ex.ip
+		if ip == nil {
+			ip = net.IPv4(192, 168, 1, 1)
+		}
+		mr.Answer = append(mr.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: mq.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   ip,
+		})
+	}
+	return mr.Pack()
+}
+
+func resolveConcurrently(r *resolver, host string, n int) (errs int32) {
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			ips, err := r.Resolve(host)
+			if err != nil || len(ips) != 1 || !ips[0].Equal(net.IPv4(192, 168, 1, 1)) {
+				atomic.AddInt32(&errs, 1)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	return
+}
+
+func TestResolverSingleflight(t *testing.T) {
+	ex := &stubExchanger{delay: 200 * time.Millisecond}
+	r := newResolver(0, NameServer{exchanger: ex})
+	r.singleflight = true
+
+	if errs := resolveConcurrently(r, "example.com", 50); errs > 0 {
+		t.Errorf("%d lookups failed", errs)
+	}
+	if n := atomic.LoadInt32(&ex.queries); n != 1 {
+		t.Errorf("expected 1 upstream query, got %d", n)
+	}
+}
+
+func TestResolverWithoutSingleflight(t *testing.T) {
+	ex := &stubExchanger{delay: 200 * time.Millisecond}
+	r := newResolver(0, NameServer{exchanger: ex})
+
+	if errs := resolveConcurrently(r, "example.com", 10); errs > 0 {
+		t.Errorf("%d lookups failed", errs)
+	}
+	if n := atomic.LoadInt32(&ex.queries); n != 10 {
+		t.Errorf("expected 10 upstream queries, got %d", n)
+	}
+}
+
+func TestResolverDNSTimeout(t *testing.T) {
+	ex := &stubExchanger{delay: 500 * time.Millisecond}
+	r := newResolver(0, NameServer{exchanger: ex})
+	r.dnsTimeout = 100 * time.Millisecond
+
+	start := time.Now()
+	if _, err := r.Resolve("example.com"); err == nil {
+		t.Error("slow query should time out")
+	}
+	// both A and AAAA queries time out.
+	if d := time.Since(start); d >= 2*ex.delay {
+		t.Errorf("query timeout does not fire, took %v", d)
+	}
+
+	r.dnsTimeout = time.Second
+	ips, err := r.Resolve("example.com")
+	if err != nil || len(ips) != 1 {
+		t.Errorf("query should succeed within the timeout, got %v, %v", ips, err)
+	}
+}
+
+func TestResolverDNSTimeoutOption(t *testing.T) {
+	for _, tc := range []struct {
+		timeout    time.Duration
+		dnsTimeout time.Duration
+		want       time.Duration
+	}{
+		{0, 0, DefaultDNSTimeout},
+		{30 * time.Second, 0, DefaultDNSTimeout},
+		{time.Second, 0, time.Second},
+		{30 * time.Second, 300 * time.Millisecond, 300 * time.Millisecond},
+	} {
+		r := newResolver(0, NameServer{Addr: "127.0.0.1:53"})
+		r.Init(TimeoutResolverOption(tc.timeout), DNSTimeoutResolverOption(tc.dnsTimeout))
+		if r.dnsTimeout != tc.want {
+			t.Errorf("timeout %v, dnsTimeout %v: got %v, want %v",
+				tc.timeout, tc.dnsTimeout, r.dnsTimeout, tc.want)
+		}
+	}
+}
+
+func TestResolverServerDown(t *testing.T) {
+	down := &stubExchanger{delay: time.Second}
+	up := &stubExchanger{ip: net.IPv4(192, 168, 1, 2)}
+	r := newResolver(0,
+		NameServer{Addr: "https://dns.example.com/dns-query", Protocol: "https", exchanger: down},
+		NameServer{Addr: "192.168.1.53:53", exchanger: up},
+	)
+	r.dnsTimeout = 100 * time.Millisecond
+
+	for i := 0; i < 2; i++ {
+		ips, err := r.Resolve(fmt.Sprintf("example%d.com", i))
+		if err != nil || len(ips) != 1 || !ips[0].Equal(up.ip) {
+			t.Fatalf("#%d: should fall back to the next name server, got %v, %v", i, ips, err)
+		}
+	}
+	// A and AAAA queries of the first lookup, the failed server is tried last in the second lookup.
+	if n := atomic.LoadInt32(&down.queries); n != 2 {
+		t.Errorf("the failed name server should be skipped, got %d queries", n)
+	}
+}
+
+func TestResolverCacheTTL(t *testing.T) {
+	answer := func(ttls ...uint32) *dns.Msg {
+		mr := &dns.Msg{}
+		mr.SetQuestion("example.com.", dns.TypeA)
+		for _, ttl := range ttls {
+			mr.Answer = append(mr.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+				A:   net.IPv4(192, 168, 1, 1),
+			})
+		}
+		return mr
+	}
+	nxdomain := func(soaTTL, minTTL uint32) *dns.Msg {
+		mr := answer()
+		mr.Rcode = dns.RcodeNameError
+		if soaTTL > 0 {
+			mr.Ns = append(mr.Ns, &dns.SOA{
+				Hdr:    dns.RR_Header{Name: "com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: soaTTL},
+				Minttl: minTTL,
+			})
+		}
+		return mr
+	}
+
+	for i, tc := range []struct {
+		ttl, minTTL, maxTTL, negTTL time.Duration
+		mr                          *dns.Msg
+		want                        time.Duration
+		fixed                       bool
+	}{
+		// the answer TTLs are used as is without the bounds.
+		{0, 0, 0, 0, answer(60), 0, false},
+		{30 * time.Second, 0, 0, 0, answer(60), 30 * time.Second, false},
+		{-1, 10 * time.Second, 0, 0, answer(60), -1, false},
+		// the smallest answer TTL is clamped.
+		{0, 10 * time.Second, 0, 0, answer(60, 5), 10 * time.Second, true},
+		{0, 0, 30 * time.Second, 0, answer(60, 300), 30 * time.Second, true},
+		{0, 10 * time.Second, 30 * time.Second, 0, answer(20), 20 * time.Second, true},
+		{15 * time.Second, 10 * time.Second, 30 * time.Second, 0, answer(20), 15 * time.Second, true},
+		// the zero TTL is not cached unless the min TTL is set.
+		{0, 0, 30 * time.Second, 0, answer(0), -1, false},
+		{0, 10 * time.Second, 0, 0, answer(0), 10 * time.Second, true},
+		// the negative answers.
+		{0, 0, 0, 0, nxdomain(0, 0), 0, false},
+		{0, 0, 0, -1, nxdomain(0, 0), -1, false},
+		{0, 0, 0, 30 * time.Second, nxdomain(0, 0), 30 * time.Second, true},
+		{0, 0, 0, 30 * time.Second, nxdomain(3600, 10), 10 * time.Second, true},
+		{0, 0, 0, 30 * time.Second, nxdomain(5, 900), 5 * time.Second, true},
+		{0, 0, 0, 30 * time.Second, nxdomain(3600, 900), 30 * time.Second, true},
+		{0, 0, 0, 30 * time.Second, answer(), 30 * time.Second, true},
+		{20 * time.Second, 0, 0, 30 * time.Second, nxdomain(0, 0), 20 * time.Second, true},
+	} {
+		r := newResolver(0)
+		r.Init(TTLResolverOption(tc.ttl), TTLBoundsResolverOption(tc.minTTL, tc.maxTTL), NegativeTTLResolverOption(tc.negTTL))
+		ttl, fixed := r.cacheTTL(tc.mr)
+		if ttl != tc.want || fixed != tc.fixed {
+			t.Errorf("#%d: got %v, %v, want %v, %v", i, ttl, fixed, tc.want, tc.fixed)
+		}
+	}
+
+	// the folded TTL overrides the answer TTLs.
+	r := newResolver(0)
+	r.Init(TTLBoundsResolverOption(10*time.Second, 0))
+	mr := answer(0)
+	key := newResolverCacheKey(&mr.Question[0])
+	ttl, fixed := r.cacheTTL(mr)
+	r.cache.storeCache(key, mr, ttl, fixed)
+	time.Sleep(1100 * time.Millisecond)
+	if r.cache.loadCache(key) == nil {
+		t.Error("the zero TTL answer should be cached for the min TTL")
+	}
+}
+
+func TestResolverParallel(t *testing.T) {
+	slow := &stubExchanger{delay: 500 * time.Millisecond}
+	fast := &stubExchanger{ip: net.IPv4(192, 168, 1, 2)}
+	r := newResolver(0,
+		NameServer{Addr: "192.168.1.53:53", exchanger: slow},
+		NameServer{Addr: "tls://192.168.1.54:853", Protocol: "tls", exchanger: fast},
+	)
+	r.parallel = true
+
+	start := time.Now()
+	ips, err := r.Resolve("example.com")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(fast.ip) {
+		t.Fatalf("the fast name server should win, got %v, %v", ips, err)
+	}
+	if d := time.Since(start); d >= slow.delay {
+		t.Errorf("the name servers should be queried at the same time, took %v", d)
+	}
+}
+
+func TestResolverAllFailed(t *testing.T) {
+	for _, parallel := range []bool{false, true} {
+		r := newResolver(0,
+			NameServer{Addr: "192.168.1.53:53", exchanger: &stubExchanger{delay: time.Second}},
+			NameServer{Addr: "https://dns.example.com/dns-query", Protocol: "https", exchanger: &stubExchanger{delay: time.Second}},
+		)
+		r.parallel = parallel
+		r.dnsTimeout = 100 * time.Millisecond
+
+		_, err := r.Resolve("example.com")
+		if err == nil || !strings.Contains(err.Error(), "all 2 name servers failed") ||
+			!strings.Contains(err.Error(), "dns.example.com") {
+			t.Errorf("parallel %v: should report all the failed name servers, got %v", parallel, err)
+		}
+
+		_, err = (&Chain{}).resolve("example.com:80", r, nil)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("parallel %v: the dial should fail with the lookup error, got %v", parallel, err)
+		}
+	}
+}
@@ -2,12 +2,15 @@ package gost
 
 import (
 	"errors"
+	"hash/fnv"
 	"math/rand"
 	"net"
 	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/go-log/log"
 )
 
 var (
@@ -39,7 +42,25 @@ func (s *defaultSelector) Select(nodes []Node, opts ...SelectOption) (Node, erro
 	if strategy == nil {
 		strategy = &RoundStrategy{}
 	}
-	return strategy.Apply(nodes), nil
+	if sopts.LazyProbe == nil {
+		return applyStrategy(strategy, nodes, sopts.ClientAddr), nil
+	}
+
+	// the unreachable nodes are excluded and the strategy is applied again to the rest.
+	for len(nodes) > 0 {
+		node := applyStrategy(strategy, nodes, sopts.ClientAddr)
+		if sopts.LazyProbe.check(node) {
+			return node, nil
+		}
+		rest := make([]Node, 0, len(nodes)-1)
+		for i := range nodes {
+			if nodes[i].ID != node.ID || nodes[i].Addr != node.Addr {
+				rest = append(rest, nodes[i])
+			}
+		}
+		nodes = rest
+	}
+	return Node{}, ErrNoneAvailable
 }
 
 // SelectOption is the option used when making a select call.
@@ -47,8 +68,11 @@ type SelectOption func(*SelectOptions)
 
 // SelectOptions is the options for node selection.
 type SelectOptions struct {
-	Filters  []Filter
-	Strategy Strategy
+	Filters   []Filter
+	Strategy  Strategy
+	LazyProbe *LazyProbe
+	// the address of the client, used by the ClientStrategy.
+	ClientAddr net.Addr
 }
 
 // WithFilter adds a filter function to the list of filters
@@ -66,12 +90,41 @@ func WithStrategy(s Strategy) SelectOption {
 	}
 }
 
+// WithLazyProbe verifies the reachability of the selected node by the probe.
+func WithLazyProbe(p *LazyProbe) SelectOption {
+	return func(o *SelectOptions) {
+		o.LazyProbe = p
+	}
+}
+
+// WithClientAddr sets the address of the client the node is selected for.
+func WithClientAddr(addr net.Addr) SelectOption {
+	return func(o *SelectOptions) {
+		o.ClientAddr = addr
+	}
+}
+
 // Strategy is a selection strategy e.g random, round-robin.
 type Strategy interface {
 	Apply([]Node) Node
 	String() string
 }
 
+// ClientStrategy is a Strategy selecting the node by the client address.
+type ClientStrategy interface {
+	Strategy
+	// ApplyFor selects the node for the client, the client may be nil.
+	ApplyFor(nodes []Node, client net.Addr) Node
+}
+
+// applyStrategy applies the strategy for the nodes, with the client address if it is a ClientStrategy.
+func applyStrategy(strategy Strategy, nodes []Node, client net.Addr) Node {
+	if cs, ok := strategy.(ClientStrategy); ok {
+		return cs.ApplyFor(nodes, client)
+	}
+	return strategy.Apply(nodes)
+}
+
 // NewStrategy creates a Strategy by the name s.
 func NewStrategy(s string) Strategy {
 	switch s {
@@ -79,6 +132,10 @@ func NewStrategy(s string) Strategy {
 		return &RandomStrategy{}
 	case "fifo":
 		return &FIFOStrategy{}
+	case "weighted":
+		return &WeightedStrategy{}
+	case "sourcehash":
+		return &SourceHashStrategy{}
 	case "round":
 		fallthrough
 	default:
@@ -156,6 +213,88 @@ func (s *FIFOStrategy) String() string {
 	return "fifo"
 }
 
+// WeightedStrategy is a strategy for node selector.
+// The nodes are selected by the smooth weighted round-robin algorithm,
+// in proportion to their weights (1 if not set).
+type WeightedStrategy struct {
+	current map[string]int
+	mux     sync.Mutex
+}
+
+// Apply applies the weighted round-robin strategy for the nodes.
+func (s *WeightedStrategy) Apply(nodes []Node) Node {
+	if len(nodes) == 0 {
+		return Node{}
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.current == nil {
+		s.current = make(map[string]int)
+	}
+	total, best, bestKey := 0, -1, ""
+	for i := range nodes {
+		weight := nodes[i].Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		total += weight
+		key := strconv.Itoa(nodes[i].ID) + "@" + nodes[i].Addr
+		s.current[key] += weight
+		if best < 0 || s.current[key] > s.current[bestKey] {
+			best, bestKey = i, key
+		}
+	}
+	s.current[bestKey] -= total
+	return nodes[best]
+}
+
+func (s *WeightedStrategy) String() string {
+	return "weighted"
+}
+
+// SourceHashStrategy is a strategy for node selector.
+// The node is selected by the hash of the client IP (rendezvous hashing), so a client
+// sticks to the same node as long as it is available, and only the clients of a failed node
+// are moved to the rest. It falls back to round-robin if the client is unknown.
+type SourceHashStrategy struct {
+	round RoundStrategy
+}
+
+// Apply applies the round-robin strategy for the nodes, as the client is unknown.
+func (s *SourceHashStrategy) Apply(nodes []Node) Node {
+	return s.round.Apply(nodes)
+}
+
+// ApplyFor selects the node with the highest hash of the client IP and the node.
+func (s *SourceHashStrategy) ApplyFor(nodes []Node, client net.Addr) Node {
+	if client == nil || len(nodes) == 0 {
+		return s.Apply(nodes)
+	}
+	ip := client.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	var best int
+	var bestScore uint32
+	for i := range nodes {
+		h := fnv.New32a()
+		h.Write([]byte(ip))
+		h.Write([]byte{0})
+		h.Write([]byte(strconv.Itoa(nodes[i].ID) + "@" + nodes[i].Addr))
+		if score := h.Sum32(); i == 0 || score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return nodes[best]
+}
+
+func (s *SourceHashStrategy) String() string {
+	return "sourcehash"
+}
+
 // Filter is used to filter a node during the selection process
 type Filter interface {
 	Filter([]Node) []Node
@@ -164,15 +303,25 @@ type Filter interface {
 
 // default options for FailFilter
 const (
-	DefaultMaxFails    = 1
-	DefaultFailTimeout = 30 * time.Second
+	DefaultMaxFails      = 1
+	DefaultFailTimeout   = 30 * time.Second
+	DefaultProbeInterval = 1 * time.Second
 )
 
 // FailFilter filters the dead node.
 // A node is marked as dead if its failed count is greater than MaxFails.
+//
+// If RecoverProbe is set, dead nodes are probed in the background by TCP connect,
+// and a node returns to service as soon as its probe succeeds instead of waiting out FailTimeout.
+// RecoverProbe is the address to probe, "node" means the node address itself,
+// an empty host or port is taken from the node address.
+// The probe is dialed directly from the local host, not through the chain,
+// so it is only valid for the first hop of a chain and the targets dialed from the local host.
 type FailFilter struct {
-	MaxFails    int
-	FailTimeout time.Duration
+	MaxFails      int
+	FailTimeout   time.Duration
+	RecoverProbe  string
+	ProbeInterval time.Duration
 }
 
 // Filter filters dead nodes.
@@ -196,11 +345,63 @@ func (f *FailFilter) Filter(nodes []Node) []Node {
 		if marker.FailCount() < uint32(maxFails) ||
 			time.Since(time.Unix(marker.FailTime(), 0)) >= failTimeout {
 			nl = append(nl, nodes[i])
+			continue
 		}
+		f.probe(nodes[i])
 	}
 	return nl
 }
 
+// probe starts a recovery probe for the dead node,
+// at most one probe is in flight for a node within the probe interval.
+func (f *FailFilter) probe(node Node) {
+	if f.RecoverProbe == "" || node.marker == nil {
+		return
+	}
+	interval := f.ProbeInterval
+	if interval <= 0 {
+		interval = DefaultProbeInterval
+	}
+	if !node.marker.startProbe(interval) {
+		return
+	}
+
+	addr := recoverProbeAddr(f.RecoverProbe, node.Addr)
+	go func() {
+		defer node.marker.endProbe()
+
+		conn, err := net.DialTimeout("tcp", addr, interval)
+		if err != nil {
+			if Debug {
+				log.Logf("[probe] %s: %s", node.String(), err)
+			}
+			return
+		}
+		conn.Close()
+
+		node.marker.Reset()
+		log.Logf("[probe] %s: %s is reachable, node recovered", node.String(), addr)
+	}()
+}
+
+func recoverProbeAddr(probe, addr string) string {
+	if probe == "node" {
+		return addr
+	}
+	host, port, err := net.SplitHostPort(probe)
+	if err != nil {
+		return probe
+	}
+	nhost, nport, _ := net.SplitHostPort(addr)
+	if host == "" {
+		host = nhost
+	}
+	if port == "" {
+		port = nport
+	}
+	return net.JoinHostPort(host, port)
+}
+
 func (f *FailFilter) String() string {
 	return "fail"
 }
@@ -225,10 +426,97 @@ func (f *InvalidFilter) String() string {
 	return "invalid"
 }
 
+// DefaultProbeCacheTTL is the default duration the lazy probe result is cached for.
+const DefaultProbeCacheTTL = 60 * time.Second
+
+// LazyProbe verifies the reachability of a node by TCP connect on its first selection,
+// instead of probing all the nodes in advance. The node is dialed directly from the local host,
+// so it is only valid for the nodes of the first hop of a chain. The result is cached for TTL,
+// the nodes cached as unreachable are skipped by the selector until it expires.
+type LazyProbe struct {
+	TTL     time.Duration
+	Timeout time.Duration
+	dial    func(network, address string, timeout time.Duration) (net.Conn, error)
+}
+
+// check reports whether the node is reachable, from the cache if it is not expired.
+// The probe is dialed without holding the lock of the node, the concurrent checks of a node share one probe,
+// and the expired result is still used while it is probed again in the background.
+func (p *LazyProbe) check(node Node) bool {
+	m := node.marker
+	if m == nil {
+		return true
+	}
+	ttl := p.TTL
+	if ttl <= 0 {
+		ttl = DefaultProbeCacheTTL
+	}
+
+	m.reachMux.Lock()
+	if !m.reachTime.IsZero() && time.Since(m.reachTime) < ttl {
+		reachable := m.reachable
+		m.reachMux.Unlock()
+		return reachable
+	}
+	done := m.reachDone
+	if done == nil {
+		done = make(chan struct{})
+		m.reachDone = done
+		go p.probe(node, ttl, done)
+	}
+	cached, reachable := !m.reachTime.IsZero(), m.reachable
+	m.reachMux.Unlock()
+
+	if cached {
+		return reachable
+	}
+	<-done
+
+	m.reachMux.Lock()
+	defer m.reachMux.Unlock()
+	return m.reachable
+}
+
+// probe dials the node and caches the result with its time, done is closed when it is cached.
+func (p *LazyProbe) probe(node Node, ttl time.Duration, done chan struct{}) {
+	defer close(done)
+
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = DialTimeout
+	}
+	dial := p.dial
+	if dial == nil {
+		dial = net.DialTimeout
+	}
+	conn, err := dial("tcp", node.Addr, timeout)
+	if err == nil {
+		conn.Close()
+	} else {
+		log.Logf("[probe] %s unreachable for %s: %s", node.String(), ttl, err)
+	}
+
+	m := node.marker
+	m.reachMux.Lock()
+	m.reachable, m.reachTime, m.reachDone = err == nil, time.Now(), nil
+	m.reachMux.Unlock()
+}
+
 type failMarker struct {
 	failTime  int64
 	failCount uint32
+	probing   bool
+	probeTime time.Time
 	mux       sync.RWMutex
+	// the cached result of the lazy probe.
+	reachable bool
+	reachTime time.Time
+	reachDone chan struct{} // the probe in flight
+	reachMux  sync.Mutex
+	// the history of the group the node belongs to, it records the fail status changes.
+	history *selectorHistory
+	group   int
+	node    Node
 }
 
 func (m *failMarker) FailTime() int64 {
@@ -259,10 +547,12 @@ func (m *failMarker) Mark() {
 	}
 
 	m.mux.Lock()
-	defer m.mux.Unlock()
-
 	m.failTime = time.Now().Unix()
 	m.failCount++
+	fails, history := m.failCount, m.history
+	m.mux.Unlock()
+
+	history.add(SelectorEvent{Group: m.group, Node: m.node.ID, Addr: m.node.Addr, Event: "fail", Fails: fails})
 }
 
 func (m *failMarker) Reset() {
@@ -271,10 +561,49 @@ func (m *failMarker) Reset() {
 	}
 
 	m.mux.Lock()
-	defer m.mux.Unlock()
-
+	fails, history := m.failCount, m.history
 	m.failTime = 0
 	m.failCount = 0
+	m.mux.Unlock()
+
+	if fails > 0 {
+		history.add(SelectorEvent{Group: m.group, Node: m.node.ID, Addr: m.node.Addr, Event: "recover"})
+	}
+}
+
+// attach attaches the marker to the history of the group.
+func (m *failMarker) attach(history *selectorHistory, group int, node Node) {
+	if m == nil {
+		return
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.history = history
+	m.group = group
+	m.node = Node{ID: node.ID, Addr: node.Addr}
+}
+
+// startProbe reports whether a new probe can be started,
+// no probe is started if one is in flight or the last one is within the interval.
+func (m *failMarker) startProbe(interval time.Duration) bool {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if m.probing || time.Since(m.probeTime) < interval {
+		return false
+	}
+	m.probing = true
+	m.probeTime = time.Now()
+	return true
+}
+
+func (m *failMarker) endProbe() {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.probing = false
 }
 
 func (m *failMarker) Clone() *failMarker {
@@ -292,3 +621,63 @@ func (m *failMarker) Clone() *failMarker {
 		failTime:  ft,
 	}
 }
+
+// SelectorEvent is an entry of the node selection history.
+type SelectorEvent struct {
+	Time  time.Time `json:"time"`
+	Group int       `json:"group"`
+	Node  int       `json:"node"`
+	Addr  string    `json:"addr"`
+	// Event is one of select, fail and recover.
+	Event string `json:"event"`
+	// Fails is the fail count of the node after a fail event.
+	Fails uint32 `json:"fails,omitempty"`
+}
+
+// selectorHistory is a ring buffer of the selection and failover events.
+type selectorHistory struct {
+	events []SelectorEvent
+	next   int
+	full   bool
+	mux    sync.Mutex
+}
+
+func newSelectorHistory(size int) *selectorHistory {
+	return &selectorHistory{
+		events: make([]SelectorEvent, size),
+	}
+}
+
+func (h *selectorHistory) add(ev SelectorEvent) {
+	if h == nil || len(h.events) == 0 {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	h.events[h.next] = ev
+	h.next = (h.next + 1) % len(h.events)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// list returns the events from the oldest to the latest.
+func (h *selectorHistory) list() []SelectorEvent {
+	if h == nil {
+		return nil
+	}
+
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	events := make([]SelectorEvent, 0, len(h.events))
+	if h.full {
+		events = append(events, h.events[h.next:]...)
+	}
+	return append(events, h.events[:h.next]...)
+}
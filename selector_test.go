@@ -1,6 +1,12 @@
 package gost
 
 import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -65,6 +71,97 @@ func TestFIFOStrategy(t *testing.T) {
 	}
 }
 
+func TestWeightedStrategy(t *testing.T) {
+	nodes := []Node{
+		Node{ID: 1, Weight: 3, marker: &failMarker{}},
+		Node{ID: 2, marker: &failMarker{}},
+		Node{ID: 3, Weight: 2, marker: &failMarker{}},
+	}
+	s := NewStrategy("weighted")
+	t.Log(s.String())
+
+	if node := s.Apply(nil); node.ID > 0 {
+		t.Error("unexpected node", node.String())
+	}
+	counts := map[int]int{}
+	for i := 0; i < 60; i++ {
+		counts[s.Apply(nodes).ID]++
+	}
+	if counts[1] != 30 || counts[2] != 10 || counts[3] != 20 {
+		t.Errorf("selections should be in proportion to the weights, got %v", counts)
+	}
+
+	// the dead node is skipped by the fail filter.
+	nodes[0].MarkDead()
+	selector := &defaultSelector{}
+	for i := 0; i < 10; i++ {
+		node, err := selector.Select(nodes,
+			WithStrategy(s),
+			WithFilter(&FailFilter{MaxFails: 1, FailTimeout: time.Minute}),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if node.ID == 1 {
+			t.Error("dead node should be skipped")
+		}
+	}
+}
+
+func TestSourceHashStrategy(t *testing.T) {
+	nodes := []Node{
+		Node{ID: 1, Addr: "10.0.0.1:80", marker: &failMarker{}},
+		Node{ID: 2, Addr: "10.0.0.2:80", marker: &failMarker{}},
+		Node{ID: 3, Addr: "10.0.0.3:80", marker: &failMarker{}},
+	}
+	s := NewStrategy("sourcehash")
+	t.Log(s.String())
+
+	cs, ok := s.(ClientStrategy)
+	if !ok {
+		t.Fatal("sourcehash should be a ClientStrategy")
+	}
+	if node := cs.ApplyFor(nil, nil); node.ID > 0 {
+		t.Error("unexpected node", node.String())
+	}
+
+	selected := map[string]int{}
+	counts := map[int]int{}
+	for i := 0; i < 100; i++ {
+		client := &net.TCPAddr{IP: net.IPv4(192, 168, 0, byte(i)), Port: 1000 + i}
+		node := cs.ApplyFor(nodes, client)
+		// the port of the client is ignored.
+		client.Port++
+		if cs.ApplyFor(nodes, client).ID != node.ID {
+			t.Fatalf("client %s should stick to the node %d", client.IP, node.ID)
+		}
+		selected[client.IP.String()] = node.ID
+		counts[node.ID]++
+	}
+	for _, node := range nodes {
+		if counts[node.ID] < 10 {
+			t.Errorf("clients should be distributed across the nodes, got %v", counts)
+		}
+	}
+
+	// only the clients of the dead node are moved.
+	nodes[0].MarkDead()
+	selector := &defaultSelector{}
+	for ip, id := range selected {
+		node, err := selector.Select(nodes,
+			WithStrategy(s),
+			WithFilter(&FailFilter{MaxFails: 1, FailTimeout: time.Minute}),
+			WithClientAddr(&net.TCPAddr{IP: net.ParseIP(ip)}),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if node.ID == 1 || (id != 1 && node.ID != id) {
+			t.Errorf("client %s: node %d selected, was %d", ip, node.ID, id)
+		}
+	}
+}
+
 func TestFailFilter(t *testing.T) {
 	nodes := []Node{
 		Node{ID: 1, marker: &failMarker{}},
@@ -149,3 +246,244 @@ func TestSelector(t *testing.T) {
 		t.Error("unexpected node:", node)
 	}
 }
+
+func TestFailFilterRecoverProbe(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close() // the node is unreachable
+
+	nodes := []Node{
+		Node{ID: 1, Addr: addr, marker: &failMarker{}},
+		Node{ID: 2, Addr: "127.0.0.1:1", marker: &failMarker{}},
+	}
+	filter := &FailFilter{
+		FailTimeout:   time.Minute,
+		RecoverProbe:  "node",
+		ProbeInterval: 50 * time.Millisecond,
+	}
+
+	hasNode := func(nodes []Node, id int) bool {
+		for _, node := range nodes {
+			if node.ID == id {
+				return true
+			}
+		}
+		return false
+	}
+
+	nodes[0].MarkDead()
+	for i := 0; i < 3; i++ {
+		if hasNode(filter.Filter(nodes), 1) {
+			t.Fatal("dead node should be filtered while the probe fails")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// the node is reachable again
+	ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ln.Close()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for !hasNode(filter.Filter(nodes), 1) {
+		if time.Now().After(deadline) {
+			t.Fatal("node should be restored by the probe before fail_timeout")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if n := nodes[0].marker.FailCount(); n != 0 {
+		t.Errorf("fail count should be reset, got %d", n)
+	}
+}
+
+func TestRecoverProbeAddr(t *testing.T) {
+	for _, tc := range []struct {
+		probe, addr, want string
+	}{
+		{"node", "10.0.0.1:8080", "10.0.0.1:8080"},
+		{":22", "10.0.0.1:8080", "10.0.0.1:22"},
+		{"10.0.0.2:", "10.0.0.1:8080", "10.0.0.2:8080"},
+		{"10.0.0.2:22", "10.0.0.1:8080", "10.0.0.2:22"},
+	} {
+		if v := recoverProbeAddr(tc.probe, tc.addr); v != tc.want {
+			t.Errorf("recoverProbeAddr(%q, %q) = %q, want %q", tc.probe, tc.addr, v, tc.want)
+		}
+	}
+}
+
+func TestNodeGroupHistory(t *testing.T) {
+	var nodes []Node
+	for i, addr := range []string{"http://1.1.1.1:8080", "http://2.2.2.2:8080"} {
+		node, err := ParseNode(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		node.ID = i + 1
+		nodes = append(nodes, node)
+	}
+	group := NewNodeGroup()
+	group.ID = 1
+	group.AddNode(nodes...)
+	group.SetSelector(nil, WithStrategy(&RoundStrategy{}))
+
+	if group.History() != nil {
+		t.Error("history should be disabled by default")
+	}
+	group.SetHistory(4)
+
+	node, err := group.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.MarkDead()
+	node.MarkDead()
+	node.ResetDead()
+	node.ResetDead() // not failing, not recorded
+
+	var events []string
+	for _, ev := range group.History() {
+		if ev.Group != 1 || ev.Node != node.ID || ev.Addr != node.Addr || ev.Time.IsZero() {
+			t.Errorf("unexpected event %+v", ev)
+		}
+		events = append(events, fmt.Sprintf("%s/%d", ev.Event, ev.Fails))
+	}
+	if want := "select/0 fail/1 fail/2 recover/0"; strings.Join(events, " ") != want {
+		t.Errorf("history should be %s, got %v", want, events)
+	}
+
+	// the history is bounded, the oldest events are dropped.
+	for i := 0; i < 3; i++ {
+		group.Next()
+	}
+	history := group.History()
+	if len(history) != 4 {
+		t.Fatalf("history should be bounded to 4 events, got %d", len(history))
+	}
+	if history[0].Event != "recover" {
+		t.Errorf("the oldest event should be recover, got %+v", history[0])
+	}
+	for _, ev := range history[1:] {
+		if ev.Event != "select" {
+			t.Errorf("unexpected event %+v", ev)
+		}
+	}
+}
+
+func TestLazyProbe(t *testing.T) {
+	var mux sync.Mutex
+	probes := make(map[string]int)
+	count := func(addr string) int {
+		mux.Lock()
+		defer mux.Unlock()
+		return probes[addr]
+	}
+	p := &LazyProbe{
+		TTL: 100 * time.Millisecond,
+		dial: func(network, address string, timeout time.Duration) (net.Conn, error) {
+			mux.Lock()
+			probes[address]++
+			mux.Unlock()
+			if address == "1.1.1.1:1" {
+				return nil, errors.New("connection refused")
+			}
+			c1, c2 := net.Pipe()
+			c2.Close()
+			return c1, nil
+		},
+	}
+
+	down, _ := ParseNode("1.1.1.1:1")
+	down.ID = 1
+	up, _ := ParseNode("2.2.2.2:2")
+	up.ID = 2
+	group := NewNodeGroup(down, up)
+	group.SetSelector(nil, WithStrategy(NewStrategy("fifo")), WithLazyProbe(p))
+
+	for i := 0; i < 10; i++ {
+		node, err := group.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if node.ID != up.ID {
+			t.Fatalf("#%d: unreachable node %s should be skipped", i, node)
+		}
+	}
+	if count("1.1.1.1:1") != 1 || count("2.2.2.2:2") != 1 {
+		t.Errorf("each node should be probed once, got %v", probes)
+	}
+
+	// the expired result is probed again in the background.
+	time.Sleep(150 * time.Millisecond)
+	if _, err := group.Next(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && count("1.1.1.1:1") != 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if count("1.1.1.1:1") != 2 {
+		t.Errorf("expired result should be probed again, got %v", probes)
+	}
+
+	group = NewNodeGroup(down)
+	group.SetSelector(nil, WithLazyProbe(&LazyProbe{TTL: time.Minute, dial: p.dial}))
+	if _, err := group.Next(); err != ErrNoneAvailable {
+		t.Errorf("expected %v, got %v", ErrNoneAvailable, err)
+	}
+}
+
+func TestLazyProbeConcurrent(t *testing.T) {
+	var probes int32
+	release := make(chan struct{})
+	p := &LazyProbe{
+		TTL: 100 * time.Millisecond,
+		dial: func(network, address string, timeout time.Duration) (net.Conn, error) {
+			atomic.AddInt32(&probes, 1)
+			<-release
+			c1, c2 := net.Pipe()
+			c2.Close()
+			return c1, nil
+		},
+	}
+	node := Node{ID: 1, Addr: "1.1.1.1:1", marker: &failMarker{}}
+
+	// the first checks wait for the shared probe.
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !p.check(node) {
+				t.Error("node should be reachable")
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&probes); n != 1 {
+		t.Errorf("concurrent checks should share one probe, got %d", n)
+	}
+
+	// the expired result is used without waiting for the probe.
+	release = make(chan struct{})
+	defer close(release)
+	time.Sleep(150 * time.Millisecond)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if !p.check(node) {
+			t.Error("expired result should be used while probing")
+		}
+	}
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("check should not wait for the probe in flight, took %s", d)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&probes); n != 2 {
+		t.Errorf("expired result should be probed once, got %d", n)
+	}
+}
@@ -0,0 +1,9 @@
+package gost
+
+// TProxyCheck is the result of a tproxy prerequisite check.
+type TProxyCheck struct {
+	Name string
+	OK   bool
+	// Detail describes the result, or how to fix the failure.
+	Detail string
+}
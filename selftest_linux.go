@@ -0,0 +1,172 @@
+package gost
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// capNetAdmin and capNetRaw are the capability bits of CAP_NET_ADMIN and CAP_NET_RAW.
+const (
+	capNetRaw   = 13
+	capNetAdmin = 12
+)
+
+// tproxySystem reads the system state checked by the tproxy self-test.
+type tproxySystem struct {
+	setTransparent func() error
+	procStatus     func() (string, error)
+	ipRules        func() (string, error)
+	ipRoutes       func(table string) (string, error)
+}
+
+var defaultTProxySystem = &tproxySystem{
+	setTransparent: func() error {
+		fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+		if err != nil {
+			return err
+		}
+		defer syscall.Close(fd)
+		return setSocketTransparent(fd, false)
+	},
+	procStatus: func() (string, error) {
+		b, err := os.ReadFile("/proc/self/status")
+		return string(b), err
+	},
+	ipRules: func() (string, error) {
+		b, err := exec.Command("ip", "-4", "rule", "show").Output()
+		return string(b), err
+	},
+	ipRoutes: func(table string) (string, error) {
+		b, err := exec.Command("ip", "-4", "route", "show", "table", table).Output()
+		return string(b), err
+	},
+}
+
+// TProxySelfTest checks the kernel prerequisites of the tproxy (red/redu) listeners.
+func TProxySelfTest() []TProxyCheck {
+	return defaultTProxySystem.selfTest()
+}
+
+func (sys *tproxySystem) selfTest() []TProxyCheck {
+	checks := []TProxyCheck{
+		checkTransparent(sys.setTransparent()),
+	}
+
+	status, err := sys.procStatus()
+	if err != nil {
+		checks = append(checks, TProxyCheck{Name: "capabilities", Detail: err.Error()})
+	} else {
+		checks = append(checks, checkCapabilities(status))
+	}
+
+	rules, err := sys.ipRules()
+	if err != nil {
+		return append(checks, TProxyCheck{Name: "route rule", Detail: fmt.Sprintf("ip rule: %s", err)})
+	}
+	table, check := checkRouteRule(rules)
+	checks = append(checks, check)
+	if !check.OK {
+		return checks
+	}
+
+	routes, err := sys.ipRoutes(table)
+	if err != nil {
+		return append(checks, TProxyCheck{Name: "route table", Detail: fmt.Sprintf("ip route: %s", err)})
+	}
+	return append(checks, checkRouteTable(table, routes))
+}
+
+// checkTransparent checks the result of setting IP_TRANSPARENT on a socket.
+func checkTransparent(err error) TProxyCheck {
+	check := TProxyCheck{Name: "IP_TRANSPARENT"}
+	switch {
+	case err == nil:
+		check.OK = true
+		check.Detail = "supported"
+	case errors.Is(err, syscall.EPERM):
+		check.Detail = "permission denied, run as root or grant CAP_NET_ADMIN"
+	case errors.Is(err, syscall.ENOPROTOOPT):
+		check.Detail = "not supported by the kernel"
+	default:
+		check.Detail = err.Error()
+	}
+	return check
+}
+
+// checkCapabilities checks the effective capabilities in the content of /proc/self/status.
+func checkCapabilities(status string) TProxyCheck {
+	check := TProxyCheck{Name: "capabilities"}
+	for _, line := range strings.Split(status, "\n") {
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+		if err != nil {
+			check.Detail = fmt.Sprintf("invalid CapEff: %s", err)
+			return check
+		}
+		if caps&(1<<capNetAdmin) == 0 && caps&(1<<capNetRaw) == 0 {
+			check.Detail = "missing CAP_NET_ADMIN, run as root or use setcap cap_net_admin+ep"
+			return check
+		}
+		check.OK = true
+		check.Detail = fmt.Sprintf("CapEff %016x", caps)
+		return check
+	}
+	check.Detail = "CapEff not found"
+	return check
+}
+
+// checkRouteRule looks for the fwmark rule in the output of `ip rule show`,
+// and returns the table it looks up.
+func checkRouteRule(rules string) (table string, check TProxyCheck) {
+	check.Name = "route rule"
+	for _, line := range strings.Split(rules, "\n") {
+		fields := strings.Fields(line)
+		var mark string
+		for i := 0; i+1 < len(fields); i++ {
+			switch fields[i] {
+			case "fwmark":
+				mark = fields[i+1]
+			case "lookup", "table":
+				table = fields[i+1]
+			}
+		}
+		if mark != "" && table != "" && table != "main" && table != "local" && table != "default" {
+			check.OK = true
+			check.Detail = fmt.Sprintf("fwmark %s lookup %s", mark, table)
+			return
+		}
+		table = ""
+	}
+	check.Detail = "no fwmark rule found, add one like: ip rule add fwmark 1 lookup 100"
+	return
+}
+
+// checkRouteTable looks for the local default route in the output of `ip route show table <table>`.
+func checkRouteTable(table, routes string) TProxyCheck {
+	check := TProxyCheck{Name: "route table"}
+	for _, line := range strings.Split(routes, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "local" {
+			continue
+		}
+		if fields[1] != "default" && fields[1] != "0.0.0.0/0" {
+			continue
+		}
+		for i := 2; i+1 < len(fields); i++ {
+			if fields[i] == "dev" && fields[i+1] == "lo" {
+				check.OK = true
+				check.Detail = fmt.Sprintf("table %s: local default dev lo", table)
+				return check
+			}
+		}
+	}
+	check.Detail = fmt.Sprintf("no local default route in table %s, add one like: ip route add local 0.0.0.0/0 dev lo table %s", table, table)
+	return check
+}
@@ -0,0 +1,91 @@
+package gost
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+)
+
+func TestCheckTransparent(t *testing.T) {
+	if check := checkTransparent(nil); !check.OK {
+		t.Errorf("check should pass: %s", check.Detail)
+	}
+	for _, err := range []error{syscall.EPERM, syscall.ENOPROTOOPT} {
+		if check := checkTransparent(err); check.OK || check.Detail == "" {
+			t.Errorf("check should fail with the diagnostic for %v", err)
+		}
+	}
+}
+
+func TestCheckCapabilities(t *testing.T) {
+	tests := []struct {
+		status string
+		ok     bool
+	}{
+		{"Name:\tgost\nCapEff:\t000001ffffffffff\n", true},
+		{"CapEff:\t0000000000001000\n", true},  // CAP_NET_ADMIN
+		{"CapEff:\t0000000000002000\n", true},  // CAP_NET_RAW
+		{"CapEff:\t0000000000000400\n", false}, // CAP_NET_BIND_SERVICE
+		{"CapEff:\t0000000000000000\n", false},
+		{"CapEff:\tzz\n", false},
+		{"Name:\tgost\n", false},
+	}
+	for _, test := range tests {
+		if check := checkCapabilities(test.status); check.OK != test.ok {
+			t.Errorf("%q: check should be %v: %s", test.status, test.ok, check.Detail)
+		}
+	}
+}
+
+func TestCheckRouteRule(t *testing.T) {
+	rules := "0:\tfrom all lookup local\n" +
+		"32765:\tfrom all fwmark 0x1 lookup 100\n" +
+		"32766:\tfrom all lookup main\n" +
+		"32767:\tfrom all lookup default\n"
+	table, check := checkRouteRule(rules)
+	if !check.OK || table != "100" {
+		t.Errorf("rule should be found with table 100, got %q: %s", table, check.Detail)
+	}
+
+	rules = "0:\tfrom all lookup local\n32766:\tfrom all lookup main\n"
+	if _, check := checkRouteRule(rules); check.OK {
+		t.Error("check should fail without the fwmark rule")
+	}
+}
+
+func TestCheckRouteTable(t *testing.T) {
+	if check := checkRouteTable("100", "local default dev lo scope host\n"); !check.OK {
+		t.Errorf("check should pass: %s", check.Detail)
+	}
+	if check := checkRouteTable("100", "default via 10.0.0.1 dev eth0\n"); check.OK {
+		t.Error("check should fail without the local route")
+	}
+	if check := checkRouteTable("100", ""); check.OK {
+		t.Error("check should fail with the empty table")
+	}
+}
+
+func TestTProxySelfTest(t *testing.T) {
+	var table string
+	sys := &tproxySystem{
+		setTransparent: func() error { return syscall.EPERM },
+		procStatus:     func() (string, error) { return "CapEff:\t0000000000000000\n", nil },
+		ipRules:        func() (string, error) { return "32765:\tfrom all fwmark 0x1/0x1 lookup tproxy\n", nil },
+		ipRoutes: func(t string) (string, error) {
+			table = t
+			return "", errors.New("exit status 2")
+		},
+	}
+	checks := sys.selfTest()
+	if len(checks) != 4 {
+		t.Fatalf("4 checks should be run, got %v", checks)
+	}
+	for i, ok := range []bool{false, false, true, false} {
+		if checks[i].OK != ok {
+			t.Errorf("check %s should be %v: %s", checks[i].Name, ok, checks[i].Detail)
+		}
+	}
+	if table != "tproxy" {
+		t.Errorf("table tproxy should be checked, got %q", table)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package gost
+
+// TProxySelfTest checks the kernel prerequisites of the tproxy (red/redu) listeners.
+func TProxySelfTest() []TProxyCheck {
+	return []TProxyCheck{
+		{Name: "platform", Detail: "tproxy is only supported on Linux"},
+	}
+}
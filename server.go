@@ -1,8 +1,17 @@
 package gost
 
 import (
+	"crypto/tls"
+	"errors"
 	"io"
 	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/go-log/log"
@@ -18,6 +27,15 @@ type Server struct {
 	Listener Listener
 	Handler  Handler
 	options  *ServerOptions
+	// EMOD: number of active connections.
+	conns  int64
+	shed   shedState
+	rate   connRateLimiter
+	limit  connLimitState
+	paused int32
+	// the active connections, closed by CloseGraceful on timeout.
+	active    map[net.Conn]struct{}
+	activeMux sync.Mutex
 }
 
 // Init intializes server with given options.
@@ -40,6 +58,72 @@ func (s *Server) Close() error {
 	return s.Listener.Close()
 }
 
+// ErrGraceTimeout is an error that implies the active connections did not finish in the grace period.
+var ErrGraceTimeout = errors.New("grace period elapsed with active connections")
+
+// CloseGraceful stops accepting new connections and waits at most timeout for the active ones to finish,
+// the remaining connections are closed then and ErrGraceTimeout is returned.
+func (s *Server) CloseGraceful(timeout time.Duration) error {
+	err := s.Close()
+	if errors.Is(err, net.ErrClosed) {
+		// closed already, e.g. to release the address, just drain the connections.
+		err = nil
+	}
+
+	deadline := time.Now().Add(timeout)
+	for s.Conns() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if s.Conns() == 0 {
+		return err
+	}
+
+	s.activeMux.Lock()
+	n := len(s.active)
+	for conn := range s.active {
+		conn.Close()
+	}
+	s.activeMux.Unlock()
+	log.Logf("server: %s grace period elapsed, %d connections closed", s.Addr(), n)
+	return ErrGraceTimeout
+}
+
+func (s *Server) addActive(conn net.Conn) {
+	s.activeMux.Lock()
+	defer s.activeMux.Unlock()
+	if s.active == nil {
+		s.active = make(map[net.Conn]struct{})
+	}
+	s.active[conn] = struct{}{}
+}
+
+func (s *Server) removeActive(conn net.Conn) {
+	s.activeMux.Lock()
+	defer s.activeMux.Unlock()
+	delete(s.active, conn)
+}
+
+// Conns returns the number of active connections of the server.
+func (s *Server) Conns() int64 {
+	return atomic.LoadInt64(&s.conns)
+}
+
+// Pause stops the server from accepting new connections,
+// the new connections are closed immediately, the existing ones are not affected.
+func (s *Server) Pause() {
+	atomic.StoreInt32(&s.paused, 1)
+}
+
+// Resume resumes accepting new connections after Pause.
+func (s *Server) Resume() {
+	atomic.StoreInt32(&s.paused, 0)
+}
+
+// Paused reports whether the server is paused.
+func (s *Server) Paused() bool {
+	return atomic.LoadInt32(&s.paused) == 1
+}
+
 // Serve serves as a proxy server.
 func (s *Server) Serve(h Handler, opts ...ServerOption) error {
 	s.Init(opts...)
@@ -81,7 +165,54 @@ func (s *Server) Serve(h Handler, opts ...ServerOption) error {
 		}
 		tempDelay = 0
 
-		go h.Handle(conn)
+		// EMOD: refuse the connection while paused for maintenance.
+		if s.Paused() {
+			conn.Close()
+			continue
+		}
+
+		// EMOD: drop the connection from a disallowed peer before any handshake,
+		// the client certificate (if any) is verified in the connection goroutine.
+		peerAllow := s.options.PeerAllow
+		if peerAllow != nil && peerAllow.AllowAddr(conn.RemoteAddr()) {
+			peerAllow = nil
+		}
+		if peerAllow != nil && !peerAllow.HasNames() {
+			log.Logf("server: peer %s is not allowed", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+
+		// EMOD: smooth the bursts of new connections.
+		if !s.rate.allow(s.options.ConnRate, s.options.ConnBurst) {
+			conn.Close()
+			continue
+		}
+
+		// EMOD: hard ceiling of the active connections.
+		if s.limit.reached(s.options.MaxConns, s.Conns()) {
+			conn.Close()
+			continue
+		}
+
+		// EMOD: refuse the connection quickly when overloaded.
+		if s.shed.check(s.options, s.Conns()) {
+			conn.Close()
+			continue
+		}
+
+		atomic.AddInt64(&s.conns, 1)
+		s.addActive(conn)
+		go func() {
+			defer atomic.AddInt64(&s.conns, -1)
+			defer s.removeActive(conn)
+			if peerAllow != nil && !allowPeerCert(conn, peerAllow) {
+				log.Logf("server: peer %s is not allowed", conn.RemoteAddr())
+				conn.Close()
+				return
+			}
+			h.Handle(conn)
+		}()
 	}
 }
 
@@ -90,18 +221,273 @@ func (s *Server) Run() error {
 	return s.Serve(s.Handler)
 }
 
+// allowPeerCert completes the TLS handshake of conn,
+// and tests whether the client certificate identity is allowed.
+func allowPeerCert(conn net.Conn, peerAllow *PeerAllow) bool {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return false
+	}
+	tlsConn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer tlsConn.SetDeadline(time.Time{})
+	if err := tlsConn.Handshake(); err != nil {
+		return false
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	return len(certs) > 0 && peerAllow.AllowCert(certs[0])
+}
+
 // ServerOptions holds the options for Server.
 type ServerOptions struct {
+	ShedAtConns int
+	ShedAtLoad  float64
+	PeerAllow   *PeerAllow
+	ConnRate    float64
+	ConnBurst   int
+	MaxConns    int
 }
 
 // ServerOption allows a common way to set server options.
 type ServerOption func(opts *ServerOptions)
 
+// ShedAtConnsServerOption sets the number of active connections
+// at which the server starts to refuse new connections.
+func ShedAtConnsServerOption(n int) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.ShedAtConns = n
+	}
+}
+
+// ShedAtLoadServerOption sets the system load (1-minute load average per CPU)
+// at which the server starts to refuse new connections.
+func ShedAtLoadServerOption(load float64) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.ShedAtLoad = load
+	}
+}
+
+// PeerAllowServerOption sets the allowlist of the peers,
+// the connections from the other peers are dropped before any handshake.
+// The peer is the remote address of the accepted connection, which is the source carried by the PROXY header
+// behind a ProxyProtocolListener, see ProxyProtocolTrustedListener to accept the header only from the load balancers.
+func PeerAllowServerOption(peerAllow *PeerAllow) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.PeerAllow = peerAllow
+	}
+}
+
+// ConnRateServerOption sets the max rate of the new connections per second,
+// the excess connections wait briefly for the rate, and are dropped if it is still exceeded.
+func ConnRateServerOption(rate float64) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.ConnRate = rate
+	}
+}
+
+// ConnBurstServerOption sets the number of the new connections accepted in a burst at the max rate,
+// the bursts are smoothed if it is less than 2.
+func ConnBurstServerOption(burst int) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.ConnBurst = burst
+	}
+}
+
+// MaxConnsServerOption sets the max number of the active connections,
+// the new connections are refused once it is reached. Zero means unlimited.
+func MaxConnsServerOption(n int) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.MaxConns = n
+	}
+}
+
+// loadAverage returns the 1-minute load average per CPU,
+// it is zero if the system does not provide it.
+var loadAverage = func() float64 {
+	b, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0
+	}
+	ss := strings.Fields(string(b))
+	if len(ss) == 0 {
+		return 0
+	}
+	load, _ := strconv.ParseFloat(ss[0], 64)
+	return load / float64(runtime.NumCPU())
+}
+
+// shedState tracks the load shedding of a server.
+type shedState struct {
+	load     float64
+	loadTime time.Time
+	shedded  int
+	logTime  time.Time
+	mux      sync.Mutex
+}
+
+// check reports whether a new connection should be refused.
+// The load is sampled at most once per second,
+// and the refusals are logged at most once per second.
+func (st *shedState) check(opts *ServerOptions, conns int64) bool {
+	if opts == nil || (opts.ShedAtConns <= 0 && opts.ShedAtLoad <= 0) {
+		return false
+	}
+
+	st.mux.Lock()
+	defer st.mux.Unlock()
+
+	now := time.Now()
+	shed := opts.ShedAtConns > 0 && conns >= int64(opts.ShedAtConns)
+	if !shed && opts.ShedAtLoad > 0 {
+		if now.Sub(st.loadTime) >= time.Second {
+			st.load = loadAverage()
+			st.loadTime = now
+		}
+		shed = st.load >= opts.ShedAtLoad
+	}
+	if !shed {
+		return false
+	}
+
+	st.shedded++
+	if now.Sub(st.logTime) >= time.Second {
+		log.Logf("server: overloaded (conns %d, load %.2f), %d connection(s) refused",
+			conns, st.load, st.shedded)
+		st.shedded = 0
+		st.logTime = now
+	}
+	return true
+}
+
+// connLimitState tracks the refusals of the max connections limit.
+// It is only used in the accept loop, so no lock is needed.
+type connLimitState struct {
+	refused int
+	logTime time.Time
+}
+
+// reached reports whether conns reaches the max, the refusals are logged at most once per second.
+func (st *connLimitState) reached(max int, conns int64) bool {
+	if max <= 0 || conns < int64(max) {
+		return false
+	}
+
+	st.refused++
+	if now := time.Now(); now.Sub(st.logTime) >= time.Second {
+		log.Logf("server: max connections %d reached, %d connection(s) refused", max, st.refused)
+		st.refused = 0
+		st.logTime = now
+	}
+	return true
+}
+
+// connRateMaxWait is the max time a new connection waits for the rate limit.
+const connRateMaxWait = 100 * time.Millisecond
+
+// connRateLimiter is a token bucket limiting the rate of the new connections,
+// the bucket holds burst tokens (one at least).
+type connRateLimiter struct {
+	tokens  float64
+	last    time.Time
+	dropped int
+	logTime time.Time
+	// now and sleep can be replaced in tests.
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// allow reports whether a new connection is accepted at the rate,
+// it waits at most connRateMaxWait for a token.
+// It is only called in the accept loop, so no lock is needed.
+func (l *connRateLimiter) allow(rate float64, burst int) bool {
+	if rate <= 0 {
+		return true
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	if l.now == nil {
+		l.now = time.Now
+	}
+	if l.sleep == nil {
+		l.sleep = time.Sleep
+	}
+
+	now := l.now()
+	if l.last.IsZero() {
+		l.tokens = float64(burst)
+	} else {
+		l.tokens += now.Sub(l.last).Seconds() * rate
+		if l.tokens > float64(burst) {
+			l.tokens = float64(burst)
+		}
+	}
+	l.last = now
+
+	if l.tokens >= 1 {
+		l.tokens--
+		return true
+	}
+
+	wait := time.Duration((1 - l.tokens) / rate * float64(time.Second))
+	if wait <= connRateMaxWait {
+		l.sleep(wait)
+		l.tokens = 0
+		l.last = l.now()
+		return true
+	}
+
+	l.dropped++
+	if now.Sub(l.logTime) >= time.Second {
+		log.Logf("server: connection rate %.2f/s exceeded, %d connection(s) dropped", rate, l.dropped)
+		l.dropped = 0
+		l.logTime = now
+	}
+	return false
+}
+
 // Listener is a proxy server listener, just like a net.Listener.
 type Listener interface {
 	net.Listener
 }
 
+var (
+	// bindRetryMinDelay and bindRetryMaxDelay bound the backoff between the bind retries.
+	bindRetryMinDelay = 100 * time.Millisecond
+	bindRetryMaxDelay = 2 * time.Second
+)
+
+// ListenWithRetry calls listen, and retries it with backoff for up to d if the address is in use
+// or not available yet, e.g. the port is still held by the predecessor on restart.
+// The other errors, or the last one after d, are returned immediately.
+func ListenWithRetry(listen func() (Listener, error), d time.Duration) (Listener, error) {
+	deadline := time.Now().Add(d)
+	delay := bindRetryMinDelay
+	for {
+		ln, err := listen()
+		if err == nil || d <= 0 || !isBindRetryable(err) {
+			return ln, err
+		}
+
+		left := time.Until(deadline)
+		if left <= 0 {
+			return nil, err
+		}
+		if delay > left {
+			delay = left
+		}
+		log.Logf("[bind] %s, retry in %s", err, delay)
+		time.Sleep(delay)
+
+		if delay *= 2; delay > bindRetryMaxDelay {
+			delay = bindRetryMaxDelay
+		}
+	}
+}
+
+func isBindRetryable(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE) || errors.Is(err, syscall.EADDRNOTAVAIL)
+}
+
 func transport(rw1, rw2 io.ReadWriter) error {
 	errc := make(chan error, 1)
 	go func() {
@@ -119,6 +505,139 @@ func transport(rw1, rw2 io.ReadWriter) error {
 	return nil
 }
 
+// transportGrace is like transport, but when one direction reaches EOF,
+// it half-closes the other side and waits at most grace for the other direction to finish.
+func transportGrace(rw1, rw2 io.ReadWriter, grace time.Duration) error {
+	errc := make(chan error, 2)
+	go func() {
+		errc <- copyAndCloseWrite(rw1, rw2)
+	}()
+
+	go func() {
+		errc <- copyAndCloseWrite(rw2, rw1)
+	}()
+
+	err := <-errc
+	if err == nil && grace > 0 {
+		select {
+		case err = <-errc:
+		case <-time.After(grace):
+		}
+	}
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	return nil
+}
+
+// copyAndCloseWrite copies src to dst, and propagates the EOF by half-closing dst.
+func copyAndCloseWrite(dst io.Writer, src io.Reader) error {
+	err := copyBuffer(dst, src)
+	if err == nil {
+		closeWrite(dst)
+	}
+	return err
+}
+
+// closeWrite half-closes w if it supports it, and is a no-op otherwise.
+// The connection wrappers pass their CloseWrite down to the wrapped connection through it.
+func closeWrite(w io.Writer) error {
+	if cw, ok := w.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// ErrMaxBytesReached is returned when the transfer cap of a connection is reached.
+var ErrMaxBytesReached = errors.New("transfer cap reached")
+
+// byteCapConn closes the connection once the bytes transferred in both directions reach the cap.
+// Unlike rate limiting, it does not throttle the transfer, it ends the connection.
+type byteCapConn struct {
+	net.Conn
+	max    int64
+	used   int64
+	packet bool
+	mux    sync.Mutex
+	once   sync.Once
+}
+
+func newByteCapConn(conn net.Conn, max int64) *byteCapConn {
+	return &byteCapConn{
+		Conn:   conn,
+		max:    max,
+		packet: isPacketConn(conn),
+	}
+}
+
+func (c *byteCapConn) remaining() int64 {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.max - c.used
+}
+
+// claim counts at most n bytes against the cap, and returns the number of bytes counted.
+func (c *byteCapConn) claim(n int) int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if left := c.max - c.used; int64(n) > left {
+		n = int(left)
+	}
+	c.used += int64(n)
+	return n
+}
+
+// closeIfReached closes the connection once the cap is reached.
+func (c *byteCapConn) closeIfReached() {
+	if c.remaining() > 0 {
+		return
+	}
+	c.once.Do(func() {
+		log.Logf("[maxbytes] %s -> %s : transfer cap of %d bytes reached, closing",
+			c.LocalAddr(), c.RemoteAddr(), c.max)
+		c.Conn.Close()
+	})
+}
+
+func (c *byteCapConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func (c *byteCapConn) Read(b []byte) (n int, err error) {
+	left := c.remaining()
+	if left <= 0 {
+		return 0, ErrMaxBytesReached
+	}
+	if !c.packet && int64(len(b)) > left {
+		b = b[:left]
+	}
+	n, err = c.Conn.Read(b)
+	// the bytes over the cap (read concurrently with a write) are dropped,
+	// and so is the datagram crossing the cap.
+	if m := c.claim(n); m < n {
+		n, err = m, ErrMaxBytesReached
+		if c.packet {
+			n = 0
+		}
+	}
+	c.closeIfReached()
+	return
+}
+
+func (c *byteCapConn) Write(b []byte) (n int, err error) {
+	m := c.claim(len(b))
+	if m > 0 && (m == len(b) || !c.packet) {
+		n, err = c.Conn.Write(b[:m])
+	}
+	c.closeIfReached()
+	if err == nil && n < len(b) {
+		err = ErrMaxBytesReached
+	}
+	return
+}
+
 func copyBuffer(dst io.Writer, src io.Reader) error {
 	buf := lPool.Get().([]byte)
 	defer lPool.Put(buf)
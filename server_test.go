@@ -0,0 +1,546 @@
+package gost
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type blockHandler struct {
+	release chan struct{}
+}
+
+func (h *blockHandler) Init(options ...HandlerOption) {}
+
+func (h *blockHandler) Handle(conn net.Conn) {
+	defer conn.Close()
+	conn.Write([]byte("k"))
+	<-h.release
+}
+
+// accepted reports whether the server handles the connection instead of refusing it.
+func accepted(addr string) (net.Conn, bool) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, false
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, 1)
+	if _, err := conn.Read(b); err != nil {
+		conn.Close()
+		return nil, false
+	}
+	return conn, true
+}
+
+func TestServerShedAtConns(t *testing.T) {
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &blockHandler{release: make(chan struct{})}
+	server := &Server{Listener: ln}
+	go server.Serve(h, ShedAtConnsServerOption(1))
+	defer server.Close()
+
+	conn, ok := accepted(ln.Addr().String())
+	if !ok {
+		t.Fatal("first connection should be accepted")
+	}
+	defer conn.Close()
+
+	if _, ok := accepted(ln.Addr().String()); ok {
+		t.Error("connection above the threshold should be refused")
+	}
+
+	close(h.release)
+	for i := 0; i < 100 && server.Conns() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn2, ok := accepted(ln.Addr().String())
+	if !ok {
+		t.Fatal("connection below the threshold should be accepted")
+	}
+	conn2.Close()
+}
+
+func TestServerShedAtLoad(t *testing.T) {
+	defer func(f func() float64) { loadAverage = f }(loadAverage)
+	loadAverage = func() float64 { return 2.0 }
+
+	tests := []struct {
+		shedAtLoad float64
+		accepted   bool
+	}{
+		{0, true},
+		{1.0, false},
+		{4.0, true},
+	}
+	for i, tc := range tests {
+		ln, err := TCPListener("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := &blockHandler{release: make(chan struct{})}
+		server := &Server{Listener: ln}
+		go server.Serve(h, ShedAtLoadServerOption(tc.shedAtLoad))
+
+		conn, ok := accepted(ln.Addr().String())
+		if ok != tc.accepted {
+			t.Errorf("#%d: accepted should be %v", i, tc.accepted)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+		close(h.release)
+		server.Close()
+	}
+}
+
+func TestServerPauseResume(t *testing.T) {
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &blockHandler{release: make(chan struct{})}
+	defer close(h.release)
+	server := &Server{Listener: ln}
+	go server.Serve(h)
+	defer server.Close()
+
+	conn, ok := accepted(ln.Addr().String())
+	if !ok {
+		t.Fatal("connection should be accepted")
+	}
+	defer conn.Close()
+
+	server.Pause()
+	if _, ok := accepted(ln.Addr().String()); ok {
+		t.Error("paused server should refuse new connections")
+	}
+	// the existing connection is kept.
+	if server.Conns() != 1 {
+		t.Errorf("existing connection should be kept, got %d conns", server.Conns())
+	}
+
+	server.Resume()
+	conn2, ok := accepted(ln.Addr().String())
+	if !ok {
+		t.Fatal("resumed server should accept new connections")
+	}
+	conn2.Close()
+}
+
+func TestServerPeerAllow(t *testing.T) {
+	for _, tc := range []struct {
+		peerAllow string
+		accepted  bool
+	}{
+		{"127.0.0.1", true},
+		{"127.0.0.0/8", true},
+		{"10.0.0.0/8,192.168.1.1", false},
+	} {
+		pa, err := ParsePeerAllow(tc.peerAllow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln, err := TCPListener("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := &blockHandler{release: make(chan struct{})}
+		server := &Server{Listener: ln}
+		go server.Serve(h, PeerAllowServerOption(pa))
+
+		conn, ok := accepted(ln.Addr().String())
+		if ok != tc.accepted {
+			t.Errorf("%s: accepted should be %v", tc.peerAllow, tc.accepted)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+		close(h.release)
+		server.Close()
+	}
+}
+
+func TestServerPeerAllowCert(t *testing.T) {
+	ca, err := genTestCert(nil, x509.ExtKeyUsageAny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := genTestCert(&ca, x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, err := GenCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	for _, tc := range []struct {
+		peerAllow string
+		cert      *tls.Certificate
+		accepted  bool
+	}{
+		{"10.0.0.0/8,cert:*", &client, true},
+		{"10.0.0.0/8,cert:relay.example.com", &client, false},
+		{"10.0.0.0/8,cert:*", nil, false},
+	} {
+		pa, err := ParsePeerAllow(tc.peerAllow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln, err := TLSListener("127.0.0.1:0", &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientCAs:    pool,
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := &blockHandler{release: make(chan struct{})}
+		server := &Server{Listener: ln}
+		go server.Serve(h, PeerAllowServerOption(pa))
+
+		cfg := &tls.Config{InsecureSkipVerify: true}
+		if tc.cert != nil {
+			cfg.Certificates = []tls.Certificate{*tc.cert}
+		}
+		ok := false
+		if conn, err := tls.Dial("tcp", ln.Addr().String(), cfg); err == nil {
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			b := make([]byte, 1)
+			_, err = conn.Read(b)
+			ok = err == nil
+			conn.Close()
+		}
+		if ok != tc.accepted {
+			t.Errorf("%s (cert %v): accepted should be %v", tc.peerAllow, tc.cert != nil, tc.accepted)
+		}
+		close(h.release)
+		server.Close()
+	}
+}
+
+// fakeClock is a clock advanced by the sleeps and the test.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func (c *fakeClock) sleep(d time.Duration) { c.t = c.t.Add(d) }
+
+func TestConnRateLimiter(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	l := &connRateLimiter{now: clock.now, sleep: clock.sleep}
+
+	// a burst of 100 connections in 1 second at 10/s.
+	accepted := 0
+	start := clock.t
+	for i := 0; i < 100; i++ {
+		if l.allow(10, 0) {
+			accepted++
+		}
+		clock.sleep(10 * time.Millisecond)
+	}
+	elapsed := clock.t.Sub(start)
+	if max := int(elapsed.Seconds()*10) + 1; accepted > max {
+		t.Errorf("at most %d connections should be accepted in %s, got %d", max, elapsed, accepted)
+	}
+	if accepted < 9 {
+		t.Errorf("the rate should be used, only %d connections accepted in %s", accepted, elapsed)
+	}
+
+	// the connection within the max wait waits for the token.
+	clock.sleep(time.Second)
+	if !l.allow(10, 0) {
+		t.Fatal("connection should be accepted after idle")
+	}
+	before := clock.t
+	if !l.allow(20, 0) {
+		t.Fatal("connection should wait for the token")
+	}
+	if waited := clock.t.Sub(before); waited != 50*time.Millisecond {
+		t.Errorf("connection should wait 50ms, waited %s", waited)
+	}
+
+	if !l.allow(0, 0) {
+		t.Error("connection should be accepted without the rate limit")
+	}
+}
+
+func TestConnRateLimiterBurst(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	l := &connRateLimiter{now: clock.now, sleep: clock.sleep}
+
+	// a burst of 20 connections at once at 1/s with the burst of 10.
+	accepted := 0
+	for i := 0; i < 20; i++ {
+		if l.allow(1, 10) {
+			accepted++
+		}
+	}
+	if accepted != 10 {
+		t.Errorf("the burst of 10 connections should be accepted, got %d", accepted)
+	}
+
+	// the tokens are refilled at the rate up to the burst.
+	clock.sleep(3 * time.Second)
+	accepted = 0
+	for i := 0; i < 20; i++ {
+		if l.allow(1, 10) {
+			accepted++
+		}
+	}
+	if accepted != 3 {
+		t.Errorf("3 connections should be accepted after 3s, got %d", accepted)
+	}
+}
+
+func TestServerConnRate(t *testing.T) {
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &blockHandler{release: make(chan struct{})}
+	defer close(h.release)
+	server := &Server{Listener: ln}
+	go server.Serve(h, ConnRateServerOption(1))
+	defer server.Close()
+
+	var n int
+	for i := 0; i < 5; i++ {
+		if conn, ok := accepted(ln.Addr().String()); ok {
+			defer conn.Close()
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("1 connection should be accepted at 1/s, got %d", n)
+	}
+}
+
+func TestListenWithRetry(t *testing.T) {
+	minDelay := bindRetryMinDelay
+	bindRetryMinDelay = 10 * time.Millisecond
+	defer func() { bindRetryMinDelay = minDelay }()
+
+	errInUse := &net.OpError{Op: "listen", Net: "tcp", Err: os.NewSyscallError("bind", syscall.EADDRINUSE)}
+
+	// the address is released after two attempts.
+	calls := 0
+	ln, err := ListenWithRetry(func() (Listener, error) {
+		if calls++; calls <= 2 {
+			return nil, errInUse
+		}
+		return TCPListener("127.0.0.1:0")
+	}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	if calls != 3 {
+		t.Errorf("expected 3 attempts, got %d", calls)
+	}
+
+	// the address is never released.
+	calls = 0
+	start := time.Now()
+	_, err = ListenWithRetry(func() (Listener, error) {
+		calls++
+		return nil, errInUse
+	}, 200*time.Millisecond)
+	if !errors.Is(err, syscall.EADDRINUSE) {
+		t.Errorf("expected the bind error, got %v", err)
+	}
+	if d := time.Since(start); d < 200*time.Millisecond || d > time.Second {
+		t.Errorf("should retry for the bounded time, took %v", d)
+	}
+	if calls < 3 {
+		t.Errorf("expected the bind to be retried, got %d attempts", calls)
+	}
+
+	// the other errors and zero duration are not retried.
+	for _, tc := range []struct {
+		err error
+		d   time.Duration
+	}{
+		{errors.New("bad config"), time.Second},
+		{errInUse, 0},
+	} {
+		calls = 0
+		if _, err := ListenWithRetry(func() (Listener, error) {
+			calls++
+			return nil, tc.err
+		}, tc.d); err != tc.err || calls != 1 {
+			t.Errorf("%v in %v: expected a single attempt, got %d, %v", tc.err, tc.d, calls, err)
+		}
+	}
+}
+
+// readHandler reads the connection until it is closed.
+type readHandler struct{}
+
+func (h *readHandler) Init(options ...HandlerOption) {}
+
+func (h *readHandler) Handle(conn net.Conn) {
+	defer conn.Close()
+	conn.Write([]byte("k"))
+	io.Copy(io.Discard, conn)
+}
+
+func TestServerCloseGraceful(t *testing.T) {
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	h := &blockHandler{release: make(chan struct{})}
+	server := &Server{Listener: ln}
+	go server.Serve(h)
+
+	conn, ok := accepted(addr)
+	if !ok {
+		t.Fatal("connection should be accepted")
+	}
+	defer conn.Close()
+
+	time.AfterFunc(200*time.Millisecond, func() { close(h.release) })
+	start := time.Now()
+	if err := server.CloseGraceful(3 * time.Second); err != nil {
+		t.Errorf("active connection finished in the grace period, got %v", err)
+	}
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Errorf("should wait for the active connection, returned in %v", d)
+	}
+	if _, ok := accepted(addr); ok {
+		t.Error("new connection should not be accepted after close")
+	}
+}
+
+func TestServerCloseGracefulTimeout(t *testing.T) {
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{Listener: ln}
+	go server.Serve(&readHandler{})
+
+	conn, ok := accepted(ln.Addr().String())
+	if !ok {
+		t.Fatal("connection should be accepted")
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	if err := server.CloseGraceful(200 * time.Millisecond); err != ErrGraceTimeout {
+		t.Errorf("expected ErrGraceTimeout, got %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("should fall back to the hard close at the timeout, took %v", d)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("active connection should be closed, got %v", err)
+	}
+}
+
+func TestServerMaxConns(t *testing.T) {
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &blockHandler{release: make(chan struct{})}
+	defer close(h.release)
+	server := &Server{Listener: ln}
+	go server.Serve(h, MaxConnsServerOption(2))
+	defer server.Close()
+
+	var n int
+	for i := 0; i < 5; i++ {
+		if conn, ok := accepted(ln.Addr().String()); ok {
+			defer conn.Close()
+			n++
+		}
+	}
+	if n != 2 {
+		t.Errorf("2 connections should be accepted at most, got %d", n)
+	}
+}
+
+func TestRebindListener(t *testing.T) {
+	first, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rebind := NewRebindListener(first)
+	// the wrappers are kept when the listening socket is replaced.
+	ln := ProxyProtocolListener(KeepAliveListener(rebind, time.Minute))
+	defer ln.Close()
+
+	accept := func(addr string) (net.Conn, error) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		client := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 51234}
+		header, _ := proxyProtoHeader(1, client, conn.RemoteAddr())
+		conn.Write(header)
+		cc, err := ln.Accept()
+		if err == nil && cc.RemoteAddr().String() != client.String() {
+			t.Errorf("remote address: got %s, want %s", cc.RemoteAddr(), client)
+		}
+		return cc, err
+	}
+
+	cc, err := accept(first.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.Close()
+
+	second, err := TCPListener("127.0.0.2:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	if err := rebind.Rebind(second); err != nil {
+		t.Fatal(err)
+	}
+	if rebind.Addr().String() != second.Addr().String() {
+		t.Errorf("address %s, want %s", rebind.Addr(), second.Addr())
+	}
+	if _, err := net.Dial("tcp", first.Addr().String()); err == nil {
+		t.Error("the replaced listener should be closed")
+	}
+	cc, err = accept(second.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.Close()
+
+	// the listener rebound after Close is not used.
+	rebind.Close()
+	third, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer third.Close()
+	if err := rebind.Rebind(third); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("rebind after close: %v, want %v", err, net.ErrClosed)
+	}
+	if _, err := rebind.Accept(); err == nil {
+		t.Error("accept after close should fail")
+	}
+}
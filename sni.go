@@ -103,6 +103,15 @@ func (h *sniHandler) Handle(conn net.Conn) {
 			conn.RemoteAddr(), conn.LocalAddr(), err)
 		return
 	}
+	// the connection is still routed by the original SNI.
+	if h.options.SNIRewrite != "" {
+		b, err = rewriteClientHelloSNI(b, h.options.SNIRewrite, h.options.SNIRewriteInsert)
+		if err != nil {
+			log.Logf("[sni] %s -> %s : %s",
+				conn.RemoteAddr(), conn.LocalAddr(), err)
+			return
+		}
+	}
 
 	_, sport, _ := net.SplitHostPort(h.options.Host)
 	if sport == "" {
@@ -113,7 +122,7 @@ func (h *sniHandler) Handle(conn net.Conn) {
 	log.Logf("[sni] %s -> %s -> %s",
 		conn.RemoteAddr(), h.options.Node.String(), host)
 
-	if !Can("tcp", host, h.options.Whitelist, h.options.Blacklist) {
+	if !h.options.can("tcp", host) {
 		log.Logf("[sni] %s -> %s : Unauthorized to tcp connect to %s",
 			conn.RemoteAddr(), conn.LocalAddr(), host)
 		return
@@ -124,9 +133,17 @@ func (h *sniHandler) Handle(conn net.Conn) {
 		return
 	}
 
+	// EMOD: select the chain by the SNI.
+	chain, ok := h.options.sniChain(host)
+	if !ok {
+		log.Logf("[sni] %s -> %s : no route for %s",
+			conn.RemoteAddr(), conn.LocalAddr(), host)
+		return
+	}
+
 	retries := 1
-	if h.options.Chain != nil && h.options.Chain.Retries > 0 {
-		retries = h.options.Chain.Retries
+	if chain != nil && chain.Retries > 0 {
+		retries = chain.Retries
 	}
 	if h.options.Retries > 0 {
 		retries = h.options.Retries
@@ -135,7 +152,7 @@ func (h *sniHandler) Handle(conn net.Conn) {
 	var cc net.Conn
 	var route *Chain
 	for i := 0; i < retries; i++ {
-		route, err = h.options.Chain.selectRouteFor(host)
+		route, err = chain.selectRouteFor(host)
 		if err != nil {
 			log.Logf("[sni] %s -> %s : %s",
 				conn.RemoteAddr(), conn.LocalAddr(), err)
@@ -155,6 +172,8 @@ func (h *sniHandler) Handle(conn net.Conn) {
 			TimeoutChainOption(h.options.Timeout),
 			HostsChainOption(h.options.Hosts),
 			ResolverChainOption(h.options.Resolver),
+			BlockPrivateChainOption(h.options.BlockPrivate),
+			RandomizeSourcePortChainOption(h.options.RandomizeSourcePort),
 		)
 		if err == nil {
 			break
@@ -164,6 +183,7 @@ func (h *sniHandler) Handle(conn net.Conn) {
 	}
 
 	if err != nil {
+		h.options.Metrics.DialFailed()
 		return
 	}
 	defer cc.Close()
@@ -174,10 +194,40 @@ func (h *sniHandler) Handle(conn net.Conn) {
 	}
 
 	log.Logf("[sni] %s <-> %s", cc.LocalAddr(), host)
-	transport(conn, cc)
+	h.options.transport(conn, cc)
 	log.Logf("[sni] %s >-< %s", cc.LocalAddr(), host)
 }
 
+// SNIRoute routes the SNI proxy connections whose SNI matches the Matcher to the Chain.
+type SNIRoute struct {
+	Matcher Matcher
+	Chain   *Chain
+}
+
+// SNIRoutesHandlerOption sets the routes by SNI of the SNI proxy, the first matched route is used,
+// the connections matching no route are rejected. The Chain option is used if routes is empty.
+func SNIRoutesHandlerOption(routes []SNIRoute) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.SNIRoutes = routes
+	}
+}
+
+// sniChain returns the chain of the SNI host (with the port), or false if no route matches.
+func (opts *HandlerOptions) sniChain(host string) (*Chain, bool) {
+	if len(opts.SNIRoutes) == 0 {
+		return opts.Chain, true
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, r := range opts.SNIRoutes {
+		if r.Matcher.Match(host) {
+			return r.Chain, true
+		}
+	}
+	return nil, false
+}
+
 // sniSniffConn is a net.Conn that reads from r, fails on Writes,
 // and crashes otherwise.
 type sniSniffConn struct {
@@ -324,6 +374,48 @@ func readClientHelloRecord(r io.Reader, host string, isClient bool) ([]byte, str
 	return buf.Bytes(), host, nil
 }
 
+// rewriteClientHelloSNI rewrites the SNI of the ClientHello record b to name,
+// the SNI is inserted if the ClientHello has none and insert is true.
+// The lengths of the record, the handshake message and the extensions are recomputed.
+func rewriteClientHelloSNI(b []byte, name string, insert bool) ([]byte, error) {
+	record, err := dissector.ReadRecord(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	clientHello := &dissector.ClientHelloMsg{}
+	if err := clientHello.Decode(record.Opaque); err != nil {
+		return nil, err
+	}
+
+	found := false
+	for _, ext := range clientHello.Extensions {
+		if snExtension, ok := ext.(*dissector.ServerNameExtension); ok {
+			snExtension.Name = name
+			found = true
+			break
+		}
+	}
+	if !found {
+		if !insert {
+			return b, nil
+		}
+		// the server_name extension is placed first as most clients do.
+		clientHello.Extensions = append([]dissector.Extension{
+			&dissector.ServerNameExtension{Name: name},
+		}, clientHello.Extensions...)
+	}
+
+	record.Opaque, err = clientHello.Encode()
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	if _, err := record.WriteTo(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 func encodeServerName(name string) string {
 	buf := &bytes.Buffer{}
 	binary.Write(buf, binary.BigEndian, crc32.ChecksumIEEE([]byte(name)))
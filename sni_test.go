@@ -8,6 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -146,3 +147,137 @@ func TestSNIProxy(t *testing.T) {
 		})
 	}
 }
+
+// clientHelloRecord returns the first record sent by a TLS client with the server name.
+func clientHelloRecord(serverName string) ([]byte, error) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	go tls.Client(c1, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+
+	c2.SetReadDeadline(time.Now().Add(3 * time.Second))
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(c2, hdr); err != nil {
+		return nil, err
+	}
+	b := make([]byte, 5+(int(hdr[3])<<8|int(hdr[4])))
+	copy(b, hdr)
+	if _, err := io.ReadFull(c2, b[5:]); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// clientHelloServerName returns the SNI of the ClientHello record parsed by a TLS server.
+func clientHelloServerName(record []byte) (string, error) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	// the alert sent by the server on the synchronous pipe is drained.
+	go func() {
+		c1.Write(record)
+		io.Copy(io.Discard, c1)
+	}()
+	c2.SetDeadline(time.Now().Add(3 * time.Second))
+
+	var name string
+	errStop := errors.New("stop")
+	err := tls.Server(c2, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = hello.ServerName
+			return nil, errStop
+		},
+	}).Handshake()
+	if !errors.Is(err, errStop) {
+		return "", fmt.Errorf("invalid ClientHello: %v", err)
+	}
+	return name, nil
+}
+
+func TestRewriteClientHelloSNI(t *testing.T) {
+	tests := []struct {
+		serverName string
+		rewrite    string
+		insert     bool
+		want       string
+	}{
+		{"www.example.com", "backend.internal", false, "backend.internal"},
+		{"a.com", "a-much-longer-backend-name.example.internal", false, "a-much-longer-backend-name.example.internal"},
+		{"", "backend.internal", true, "backend.internal"},
+		{"", "backend.internal", false, ""},
+	}
+	for i, tc := range tests {
+		record, err := clientHelloRecord(tc.serverName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name, err := clientHelloServerName(record); err != nil || name != tc.serverName {
+			t.Fatalf("#%d: original ClientHello: %q, %v", i, name, err)
+		}
+
+		b, err := rewriteClientHelloSNI(record, tc.rewrite, tc.insert)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if n := int(b[3])<<8 | int(b[4]); n != len(b)-5 {
+			t.Errorf("#%d: record length %d, want %d", i, n, len(b)-5)
+		}
+		name, err := clientHelloServerName(b)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if name != tc.want {
+			t.Errorf("#%d: SNI %q, want %q", i, name, tc.want)
+		}
+	}
+}
+
+func TestSNIProxyRoutes(t *testing.T) {
+	target, err := idServer('a')
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := SNIHandler(
+		HostHandlerOption(target.Addr().String()),
+		HostsHandlerOption(NewHosts(NewHost(net.IPv4(127, 0, 0, 1), "a.example.com"))),
+		SNIRoutesHandlerOption([]SNIRoute{
+			{Matcher: DomainMatcher("*.example.com"), Chain: NewChain()},
+		}),
+	)
+	server := &Server{Listener: ln, Handler: h}
+	go server.Run()
+	defer server.Close()
+
+	for _, tc := range []struct {
+		serverName string
+		routed     bool
+	}{
+		{"a.example.com", true},
+		{"b.example.org", false},
+	} {
+		record, err := clientHelloRecord(tc.serverName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(3 * time.Second))
+		conn.Write(record)
+		b := make([]byte, 1)
+		n, _ := conn.Read(b)
+		conn.Close()
+		if routed := n == 1 && b[0] == 'a'; routed != tc.routed {
+			t.Errorf("%s: routed should be %v", tc.serverName, tc.routed)
+		}
+	}
+}
@@ -1,11 +1,47 @@
 package gost
 
-import "syscall"
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
 
 func setSocketMark(fd int, value int) (e error) {
 	return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_MARK, value)
 }
 
+// ipv6Transparent is IPV6_TRANSPARENT, which is missing in the syscall package.
+const ipv6Transparent = 0x4b
+
+func setSocketTransparent(fd int, ipv6 bool) (e error) {
+	if ipv6 {
+		return syscall.SetsockoptInt(fd, syscall.SOL_IPV6, ipv6Transparent, 1)
+	}
+	return syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+}
+
+// setSocketTOS sets the TOS (traffic class for IPv6) of the IP packets sent by the socket,
+// IP_TOS is also set on the IPv6 socket for the IPv4-mapped addresses, its error is ignored.
+func setSocketTOS(fd int, ipv6 bool, tos int) (e error) {
+	if !ipv6 {
+		return syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+	}
+	if e = syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos); e != nil {
+		return
+	}
+	syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+	return nil
+}
+
 func setSocketInterface(fd int, value string) (e error) {
 	return syscall.SetsockoptString(fd, syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, value)
-}
\ No newline at end of file
+}
+
+// setSocketVSOCKBuffer sets the buffer size of the VSOCK socket,
+// the max size is raised first, as the size can not exceed it.
+func setSocketVSOCKBuffer(fd int, size uint64) (e error) {
+	if e = unix.SetsockoptUint64(fd, unix.AF_VSOCK, unix.SO_VM_SOCKETS_BUFFER_MAX_SIZE, size); e != nil {
+		return
+	}
+	return unix.SetsockoptUint64(fd, unix.AF_VSOCK, unix.SO_VM_SOCKETS_BUFFER_SIZE, size)
+}
@@ -0,0 +1,366 @@
+package gost
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTransparentEgress(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Addr, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn.RemoteAddr()
+		conn.Close()
+	}()
+
+	var chain *Chain
+	opts := &HandlerOptions{TransparentEgress: net.IPv4(127, 0, 0, 2)}
+	conn, err := chain.DialContext(context.Background(), "tcp", ln.Addr().String(),
+		opts.transparentEgressOptions("tcp")...)
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("IP_TRANSPARENT requires CAP_NET_ADMIN")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	rc, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	rc.Control(func(fd uintptr) {
+		v, err = syscall.GetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 1 {
+		t.Errorf("IP_TRANSPARENT should be set on the outbound connection, got %d", v)
+	}
+
+	if addr := <-accepted; !addr.(*net.TCPAddr).IP.Equal(opts.TransparentEgress) {
+		t.Errorf("source address %s, want %s", addr, opts.TransparentEgress)
+	}
+
+	// not set by default.
+	conn2, err := chain.DialContext(context.Background(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	rc, _ = conn2.(*net.TCPConn).SyscallConn()
+	rc.Control(func(fd uintptr) {
+		v, _ = syscall.GetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT)
+	})
+	if v != 0 {
+		t.Errorf("IP_TRANSPARENT should not be set by default, got %d", v)
+	}
+}
+
+func TestPreserveSrcOptions(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Addr, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn.RemoteAddr()
+		conn.Close()
+	}()
+
+	// the client source address, which is not bound by any local socket.
+	src := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 3), Port: 40000 + int(time.Now().UnixNano()%10000)}
+	var chain *Chain
+	opts := &HandlerOptions{PreserveSrc: true}
+	conn, err := chain.DialContext(context.Background(), "tcp", ln.Addr().String(), opts.preserveSrcOptions(src)...)
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("IP_TRANSPARENT requires CAP_NET_ADMIN")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	rc, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	rc.Control(func(fd uintptr) {
+		v, err = syscall.GetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 1 {
+		t.Errorf("IP_TRANSPARENT should be set with preserveSrc, got %d", v)
+	}
+	if addr := <-accepted; addr.String() != src.String() {
+		t.Errorf("source address %s, want %s", addr, src)
+	}
+
+	opts.PreserveSrc = false
+	if options := opts.preserveSrcOptions(src); len(options) != 0 {
+		t.Errorf("no options without preserveSrc, got %d", len(options))
+	}
+}
+
+func TestMarkedListeners(t *testing.T) {
+	getMark := func(rc syscall.RawConn) int {
+		var v int
+		var err error
+		rc.Control(func(fd uintptr) {
+			v, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	ln, err := MarkedTCPListener("127.0.0.1:0", 0x66)
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("SO_MARK requires CAP_NET_ADMIN")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		if conn, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+			defer conn.Close()
+			conn.Read(make([]byte, 1))
+		}
+	}()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	rc, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := getMark(rc); v != 0x66 {
+		t.Errorf("accepted connection should inherit the mark, got %#x", v)
+	}
+
+	uln, err := UDPListener("127.0.0.1:0", &UDPListenConfig{Mark: 0x67})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uln.Close()
+	rc, err = uln.(*udpListener).ln.(*net.UDPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := getMark(rc); v != 0x67 {
+		t.Errorf("udp listener mark %#x, want 0x67", v)
+	}
+}
+
+// tcpKeepIdle returns SO_KEEPALIVE and TCP_KEEPIDLE (in seconds) of the TCP connection.
+func tcpKeepIdle(t *testing.T, conn net.Conn) (on, idle int) {
+	rc, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Control(func(fd uintptr) {
+		on, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+		if err == nil {
+			idle, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestKeepAliveListener(t *testing.T) {
+	for _, tc := range []struct {
+		period   time.Duration
+		on, idle int
+	}{
+		{42 * time.Second, 1, 42},
+		{-1, 0, 0},
+	} {
+		tl, err := TCPListener("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln := KeepAliveListener(tl, tc.period)
+
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- conn
+		}()
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, ok := <-accepted
+		if !ok {
+			t.Fatal("accept failed")
+		}
+
+		on, idle := tcpKeepIdle(t, conn)
+		if on != tc.on || (tc.on == 1 && idle != tc.idle) {
+			t.Errorf("period %v: keepalive %d idle %d, want %d idle %d", tc.period, on, idle, tc.on, tc.idle)
+		}
+		conn.Close()
+		c.Close()
+		ln.Close()
+	}
+}
+
+func TestChainKeepAlive(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	node := Node{
+		Addr:      ln.Addr().String(),
+		Client:    &Client{Connector: AutoConnector(nil), Transporter: TCPTransporter()},
+		KeepAlive: 30 * time.Second,
+		marker:    &failMarker{},
+	}
+	chain := NewChain(node)
+	conn, err := chain.dialNode(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if on, idle := tcpKeepIdle(t, conn); on != 1 || idle != 30 {
+		t.Errorf("keepalive %d idle %d, want 1 idle 30", on, idle)
+	}
+}
+
+func TestLocalAddrDialOption(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Addr, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn.RemoteAddr()
+		conn.Close()
+	}()
+
+	src := net.IPv4(127, 0, 0, 2)
+	conn, err := TCPTransporter().Dial(ln.Addr().String(), LocalAddrDialOption(&net.TCPAddr{IP: src}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if addr := <-accepted; !addr.(*net.TCPAddr).IP.Equal(src) {
+		t.Errorf("source address %s, want %s", addr, src)
+	}
+}
+
+// ipTOS returns IP_TOS of the connection.
+func ipTOS(t *testing.T, conn syscall.Conn) int {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	rc.Control(func(fd uintptr) {
+		v, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestDSCP(t *testing.T) {
+	const dscp = 46
+
+	ln, err := TCPListenerWithConfig("127.0.0.1:0", &TCPListenConfig{DSCP: dscp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	dialed := make(chan net.Conn, 1)
+	go func() {
+		conn, err := TCPTransporter().Dial(ln.Addr().String(), DSCPDialOption(dscp))
+		if err != nil {
+			t.Error(err)
+		}
+		dialed <- conn
+	}()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if v := ipTOS(t, conn.(*net.TCPConn)); v != dscp<<2 {
+		t.Errorf("accepted connection TOS %#x, want %#x", v, dscp<<2)
+	}
+
+	cc := <-dialed
+	if cc == nil {
+		return
+	}
+	defer cc.Close()
+	if v := ipTOS(t, cc.(*net.TCPConn)); v != dscp<<2 {
+		t.Errorf("dialed connection TOS %#x, want %#x", v, dscp<<2)
+	}
+
+	uln, err := UDPListener("127.0.0.1:0", &UDPListenConfig{DSCP: dscp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uln.Close()
+	if v := ipTOS(t, uln.(*udpListener).ln.(*net.UDPConn)); v != dscp<<2 {
+		t.Errorf("udp listener TOS %#x, want %#x", v, dscp<<2)
+	}
+}
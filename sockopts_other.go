@@ -3,6 +3,8 @@
 
 package gost
 
+import "errors"
+
 func setSocketMark(fd int, value int) (e error) {
 	return nil
 }
@@ -10,3 +12,15 @@ func setSocketMark(fd int, value int) (e error) {
 func setSocketInterface(fd int, value string) (e error) {
 	return nil
 }
+
+func setSocketTransparent(fd int, ipv6 bool) (e error) {
+	return errors.New("transparent socket is only supported on linux")
+}
+
+func setSocketTOS(fd int, ipv6 bool, tos int) (e error) {
+	return errors.New("dscp is only supported on linux")
+}
+
+func setSocketVSOCKBuffer(fd int, size uint64) (e error) {
+	return errors.New("vsock buffer size is only supported on linux")
+}
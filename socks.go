@@ -41,6 +41,9 @@ var (
 	_ net.PacketConn = (*socks5UDPTunnelConn)(nil)
 )
 
+// ErrSOCKS5UDPAssociate is an error that implies the SOCKS5 proxy refused the UDP associate.
+var ErrSOCKS5UDPAssociate = errors.New("socks5: udp associate refused")
+
 type clientSelector struct {
 	methods   []uint8
 	User      *url.Userinfo
@@ -199,6 +202,8 @@ func (selector *serverSelector) OnSelected(method uint8, conn net.Conn) (net.Con
 
 type socks5Connector struct {
 	User *url.Userinfo
+	// EMOD: relay the UDP by the standard UDP associate instead of the UDP-over-TCP extension.
+	udpAssociate bool
 }
 
 // SOCKS5Connector creates a connector for SOCKS5 proxy client.
@@ -207,6 +212,13 @@ func SOCKS5Connector(user *url.Userinfo) Connector {
 	return &socks5Connector{User: user}
 }
 
+// SOCKS5AssociateConnector creates a connector for SOCKS5 proxy client, which relays the UDP
+// by the standard UDP ASSOCIATE command (RFC 1928) as the SOCKS5UDPConnector,
+// instead of the UDP-over-TCP extension of gost, so the third-party SOCKS5 servers are supported.
+func SOCKS5AssociateConnector(user *url.Userinfo) Connector {
+	return &socks5Connector{User: user, udpAssociate: true}
+}
+
 func (c *socks5Connector) Connect(conn net.Conn, address string, options ...ConnectOption) (net.Conn, error) {
 	return c.ConnectContext(context.Background(), conn, "tcp", address, options...)
 }
@@ -214,6 +226,10 @@ func (c *socks5Connector) Connect(conn net.Conn, address string, options ...Conn
 func (c *socks5Connector) ConnectContext(ctx context.Context, conn net.Conn, network, address string, options ...ConnectOption) (net.Conn, error) {
 	switch network {
 	case "udp", "udp4", "udp6":
+		if c.udpAssociate {
+			cnr := &socks5UDPConnector{User: c.User}
+			return cnr.ConnectContext(ctx, conn, network, address, options...)
+		}
 		cnr := &socks5UDPTunConnector{User: c.User}
 		return cnr.ConnectContext(ctx, conn, network, address, options...)
 	}
@@ -429,7 +445,7 @@ func (tr *socks5MuxBindTransporter) Dial(addr string, options ...DialOption) (co
 	}
 	if !ok {
 		if opts.Chain == nil {
-			conn, err = net.DialTimeout("tcp", addr, timeout)
+			conn, err = opts.dialTCP(addr, timeout)
 		} else {
 			conn, err = opts.Chain.Dial(addr)
 		}
@@ -612,12 +628,18 @@ func (c *socks5UDPConnector) ConnectContext(ctx context.Context, conn net.Conn,
 
 	if reply.Rep != gosocks5.Succeeded {
 		log.Logf("[socks5] udp relay failure")
-		return nil, fmt.Errorf("SOCKS5 udp relay failure")
+		return nil, fmt.Errorf("%w: %s refused the udp associate (reply %d)", ErrSOCKS5UDPAssociate, conn.RemoteAddr(), reply.Rep)
 	}
 	baddr, err := net.ResolveUDPAddr("udp", reply.Addr.String())
 	if err != nil {
 		return nil, err
 	}
+	// EMOD: the relay listening on the unspecified address is reached on the address of the proxy.
+	if baddr.IP == nil || baddr.IP.IsUnspecified() {
+		if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+			baddr.IP = net.ParseIP(host)
+		}
+	}
 	log.Logf("[socks5] udp associate on %s OK", baddr)
 
 	uc, err := net.DialUDP("udp", nil, baddr)
@@ -626,7 +648,11 @@ func (c *socks5UDPConnector) ConnectContext(ctx context.Context, conn net.Conn,
 	}
 	// log.Logf("udp laddr:%s, raddr:%s", uc.LocalAddr(), uc.RemoteAddr())
 
-	return &socks5UDPConn{UDPConn: uc, taddr: taddr}, nil
+	// EMOD: the association lasts as long as the control connection,
+	// which is kept with the relay socket, and closes it when the proxy ends the association.
+	c5 := &socks5UDPConn{UDPConn: uc, taddr: taddr, ctrl: conn}
+	go c5.watchCtrl()
+	return c5, nil
 }
 
 type socks5UDPTunConnector struct {
@@ -889,7 +915,7 @@ func (h *socks5Handler) handleConnect(conn net.Conn, req *gosocks5.Request) {
 	log.Logf("[socks5] %s -> %s -> %s",
 		conn.RemoteAddr(), h.options.Node.String(), host)
 
-	if !Can("tcp", host, h.options.Whitelist, h.options.Blacklist) {
+	if !h.options.can("tcp", host) {
 		log.Logf("[socks5] %s - %s : Unauthorized to tcp connect to %s",
 			conn.RemoteAddr(), conn.LocalAddr(), host)
 		rep := gosocks5.NewReply(gosocks5.NotAllowed, nil)
@@ -944,6 +970,8 @@ func (h *socks5Handler) handleConnect(conn net.Conn, req *gosocks5.Request) {
 			TimeoutChainOption(h.options.Timeout),
 			HostsChainOption(h.options.Hosts),
 			ResolverChainOption(h.options.Resolver),
+			BlockPrivateChainOption(h.options.BlockPrivate),
+			RandomizeSourcePortChainOption(h.options.RandomizeSourcePort),
 		)
 		if err == nil {
 			break
@@ -953,6 +981,7 @@ func (h *socks5Handler) handleConnect(conn net.Conn, req *gosocks5.Request) {
 	}
 
 	if err != nil {
+		h.options.Metrics.DialFailed()
 		rep := gosocks5.NewReply(gosocks5.HostUnreachable, nil)
 		rep.Write(conn)
 		if Debug {
@@ -974,7 +1003,7 @@ func (h *socks5Handler) handleConnect(conn net.Conn, req *gosocks5.Request) {
 			conn.RemoteAddr(), conn.LocalAddr(), rep)
 	}
 	log.Logf("[socks5] %s <-> %s", conn.RemoteAddr(), host)
-	transport(conn, cc)
+	h.options.transport(conn, cc)
 	log.Logf("[socks5] %s >-< %s", conn.RemoteAddr(), host)
 }
 
@@ -985,7 +1014,7 @@ func (h *socks5Handler) handleBind(conn net.Conn, req *gosocks5.Request) {
 		conn.RemoteAddr(), h.options.Node.String(), addr)
 
 	if h.options.Chain.IsEmpty() {
-		if !Can("rtcp", addr, h.options.Whitelist, h.options.Blacklist) {
+		if !h.options.can("rtcp", addr) {
 			log.Logf("[socks5-bind] %s - %s : Unauthorized to tcp bind to %s",
 				conn.RemoteAddr(), conn.LocalAddr(), addr)
 			return
@@ -1013,7 +1042,7 @@ func (h *socks5Handler) handleBind(conn net.Conn, req *gosocks5.Request) {
 	defer cc.Close()
 	req.Write(cc)
 	log.Logf("[socks5-bind] %s <-> %s", conn.RemoteAddr(), addr)
-	transport(conn, cc)
+	h.options.transport(conn, cc)
 	log.Logf("[socks5-bind] %s >-< %s", conn.RemoteAddr(), addr)
 }
 
@@ -1098,7 +1127,7 @@ func (h *socks5Handler) bindOn(conn net.Conn, addr string) {
 			log.Logf("[socks5-bind] %s <- %s PEER %s ACCEPTED", conn.RemoteAddr(), socksAddr, pconn.RemoteAddr())
 
 			log.Logf("[socks5-bind] %s <-> %s", conn.RemoteAddr(), pconn.RemoteAddr())
-			if err = transport(pc2, pconn); err != nil {
+			if err = h.options.transport(pc2, pconn); err != nil {
 				log.Logf("[socks5-bind] %s - %s : %v", conn.RemoteAddr(), pconn.RemoteAddr(), err)
 			}
 			log.Logf("[socks5-bind] %s >-< %s", conn.RemoteAddr(), pconn.RemoteAddr())
@@ -1115,7 +1144,7 @@ func (h *socks5Handler) bindOn(conn net.Conn, addr string) {
 
 func (h *socks5Handler) handleUDPRelay(conn net.Conn, req *gosocks5.Request) {
 	addr := req.Addr.String()
-	if !Can("udp", addr, h.options.Whitelist, h.options.Blacklist) {
+	if !h.options.can("udp", addr) {
 		log.Logf("[socks5-udp] Unauthorized to udp connect to %s", addr)
 		rep := gosocks5.NewReply(gosocks5.NotAllowed, nil)
 		rep.Write(conn)
@@ -1158,7 +1187,11 @@ func (h *socks5Handler) handleUDPRelay(conn net.Conn, req *gosocks5.Request) {
 		}
 		defer peer.Close()
 
-		go h.transportUDP(relay, peer)
+		go func() {
+			// the association ends with the relay, e.g. on the idle timeout or the transfer cap.
+			h.transportUDP(h.options.limitPacketConn(relay), peer)
+			conn.Close()
+		}()
 		log.Logf("[socks5-udp] %s <-> %s : associated on %s", conn.RemoteAddr(), conn.LocalAddr(), socksAddr)
 		if err := h.discardClientData(conn); err != nil {
 			log.Logf("[socks5-udp] %s - %s : %s", conn.RemoteAddr(), conn.LocalAddr(), err)
@@ -1209,7 +1242,10 @@ func (h *socks5Handler) handleUDPRelay(conn net.Conn, req *gosocks5.Request) {
 	cc.SetReadDeadline(time.Time{})
 	log.Logf("[socks5-udp] %s <-> %s [tun: %s]", conn.RemoteAddr(), socksAddr, reply.Addr)
 
-	go h.tunnelClientUDP(relay, cc)
+	go func() {
+		h.tunnelClientUDP(h.options.limitPacketConn(relay), cc)
+		conn.Close()
+	}()
 	log.Logf("[socks5-udp] %s <-> %s", conn.RemoteAddr(), socksAddr)
 	if err := h.discardClientData(conn); err != nil {
 		log.Logf("[socks5-udp] %s - %s : %s", conn.RemoteAddr(), socksAddr, err)
@@ -1313,17 +1349,17 @@ func (h *socks5Handler) transportUDP(relay, peer net.PacketConn) (err error) {
 	return
 }
 
-func (h *socks5Handler) tunnelClientUDP(uc *net.UDPConn, cc net.Conn) (err error) {
+func (h *socks5Handler) tunnelClientUDP(uc net.PacketConn, cc net.Conn) (err error) {
 	errc := make(chan error, 2)
 
-	var clientAddr *net.UDPAddr
+	var clientAddr net.Addr
 
 	go func() {
 		b := mPool.Get().([]byte)
 		defer mPool.Put(b)
 
 		for {
-			n, addr, err := uc.ReadFromUDP(b)
+			n, addr, err := uc.ReadFrom(b)
 			if err != nil {
 				log.Logf("[udp-tun] %s <- %s : %s", cc.RemoteAddr(), addr, err)
 				errc <- err
@@ -1378,7 +1414,7 @@ func (h *socks5Handler) tunnelClientUDP(uc *net.UDPConn, cc net.Conn) (err error
 
 			buf := bytes.Buffer{}
 			dgram.Write(&buf)
-			if _, err := uc.WriteToUDP(buf.Bytes(), clientAddr); err != nil {
+			if _, err := uc.WriteTo(buf.Bytes(), clientAddr); err != nil {
 				errc <- err
 				return
 			}
@@ -1400,7 +1436,7 @@ func (h *socks5Handler) handleUDPTunnel(conn net.Conn, req *gosocks5.Request) {
 	if h.options.Chain.IsEmpty() {
 		addr := req.Addr.String()
 
-		if !Can("rudp", addr, h.options.Whitelist, h.options.Blacklist) {
+		if !h.options.can("rudp", addr) {
 			log.Logf("[socks5] udp-tun Unauthorized to udp bind to %s", addr)
 			return
 		}
@@ -1424,7 +1460,7 @@ func (h *socks5Handler) handleUDPTunnel(conn net.Conn, req *gosocks5.Request) {
 			log.Logf("[socks5] udp-tun %s <- %s\n%s", conn.RemoteAddr(), socksAddr, reply)
 		}
 		log.Logf("[socks5] udp-tun %s <-> %s", conn.RemoteAddr(), socksAddr)
-		h.tunnelServerUDP(conn, uc)
+		h.tunnelServerUDP(h.options.limitConn(conn), uc)
 		log.Logf("[socks5] udp-tun %s >-< %s", conn.RemoteAddr(), socksAddr)
 		return
 	}
@@ -1451,7 +1487,7 @@ func (h *socks5Handler) handleUDPTunnel(conn net.Conn, req *gosocks5.Request) {
 	req.Write(cc)
 
 	log.Logf("[socks5] udp-tun %s <-> %s", conn.RemoteAddr(), cc.RemoteAddr())
-	transport(conn, cc)
+	h.options.transport(conn, cc)
 	log.Logf("[socks5] udp-tun %s >-< %s", conn.RemoteAddr(), cc.RemoteAddr())
 }
 
@@ -1527,7 +1563,7 @@ func (h *socks5Handler) tunnelServerUDP(cc net.Conn, pc net.PacketConn) (err err
 func (h *socks5Handler) handleMuxBind(conn net.Conn, req *gosocks5.Request) {
 	if h.options.Chain.IsEmpty() {
 		addr := req.Addr.String()
-		if !Can("rtcp", addr, h.options.Whitelist, h.options.Blacklist) {
+		if !h.options.can("rtcp", addr) {
 			log.Logf("Unauthorized to tcp mbind to %s", addr)
 			return
 		}
@@ -1552,7 +1588,7 @@ func (h *socks5Handler) handleMuxBind(conn net.Conn, req *gosocks5.Request) {
 	defer cc.Close()
 	req.Write(cc)
 	log.Logf("[socks5] mbind %s <-> %s", conn.RemoteAddr(), cc.RemoteAddr())
-	transport(conn, cc)
+	h.options.transport(conn, cc)
 	log.Logf("[socks5] mbind %s >-< %s", conn.RemoteAddr(), cc.RemoteAddr())
 }
 
@@ -1626,7 +1662,7 @@ func (h *socks5Handler) muxBindOn(conn net.Conn, addr string) {
 			}
 			defer sc.Close()
 
-			transport(sc, c)
+			h.options.transport(sc, c)
 		}(cc)
 	}
 }
@@ -1708,7 +1744,7 @@ func (h *socks4Handler) handleConnect(conn net.Conn, req *gosocks4.Request) {
 	log.Logf("[socks4] %s -> %s -> %s",
 		conn.RemoteAddr(), h.options.Node.String(), addr)
 
-	if !Can("tcp", addr, h.options.Whitelist, h.options.Blacklist) {
+	if !h.options.can("tcp", addr) {
 		log.Logf("[socks4] %s - %s : Unauthorized to tcp connect to %s",
 			conn.RemoteAddr(), conn.LocalAddr(), addr)
 		rep := gosocks4.NewReply(gosocks4.Rejected, nil)
@@ -1763,6 +1799,8 @@ func (h *socks4Handler) handleConnect(conn net.Conn, req *gosocks4.Request) {
 			TimeoutChainOption(h.options.Timeout),
 			HostsChainOption(h.options.Hosts),
 			ResolverChainOption(h.options.Resolver),
+			BlockPrivateChainOption(h.options.BlockPrivate),
+			RandomizeSourcePortChainOption(h.options.RandomizeSourcePort),
 		)
 		if err == nil {
 			break
@@ -1772,6 +1810,7 @@ func (h *socks4Handler) handleConnect(conn net.Conn, req *gosocks4.Request) {
 	}
 
 	if err != nil {
+		h.options.Metrics.DialFailed()
 		rep := gosocks4.NewReply(gosocks4.Failed, nil)
 		rep.Write(conn)
 		if Debug {
@@ -1794,7 +1833,7 @@ func (h *socks4Handler) handleConnect(conn net.Conn, req *gosocks4.Request) {
 	}
 
 	log.Logf("[socks4] %s <-> %s", conn.RemoteAddr(), addr)
-	transport(conn, cc)
+	h.options.transport(conn, cc)
 	log.Logf("[socks4] %s >-< %s", conn.RemoteAddr(), addr)
 }
 
@@ -1826,7 +1865,7 @@ func (h *socks4Handler) handleBind(conn net.Conn, req *gosocks4.Request) {
 	req.Write(cc)
 
 	log.Logf("[socks4-bind] %s <-> %s", conn.RemoteAddr(), cc.RemoteAddr())
-	transport(conn, cc)
+	h.options.transport(conn, cc)
 	log.Logf("[socks4-bind] %s >-< %s", conn.RemoteAddr(), cc.RemoteAddr())
 }
 
@@ -2030,6 +2069,21 @@ func (c *socks5BindConn) RemoteAddr() net.Addr {
 type socks5UDPConn struct {
 	*net.UDPConn
 	taddr net.Addr
+	// the control connection of the UDP associate, may be nil.
+	ctrl net.Conn
+}
+
+// watchCtrl closes the relay socket when the control connection is closed.
+func (c *socks5UDPConn) watchCtrl() {
+	io.Copy(io.Discard, c.ctrl)
+	c.UDPConn.Close()
+}
+
+func (c *socks5UDPConn) Close() error {
+	if c.ctrl != nil {
+		c.ctrl.Close()
+	}
+	return c.UDPConn.Close()
 }
 
 func (c *socks5UDPConn) Read(b []byte) (n int, err error) {
@@ -2,13 +2,17 @@ package gost
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"net"
 	"net/http/httptest"
 	"net/url"
 	"testing"
 	"time"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 var socks5ProxyTests = []struct {
@@ -566,6 +570,220 @@ func TestSOCKS5UDP(t *testing.T) {
 	}
 }
 
+func TestSOCKS5AssociateUDPForward(t *testing.T) {
+	udpSrv := newUDPTestServer(udpTestHandler)
+	udpSrv.Start()
+	defer udpSrv.Close()
+
+	user := url.UserPassword("admin", "123456")
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		Handler:  SOCKS5Handler(UsersHandlerOption(user)),
+		Listener: ln,
+	}
+	go server.Run()
+	defer server.Close()
+
+	chain := NewChain(Node{
+		Addr: ln.Addr().String(),
+		Client: &Client{
+			Connector:   SOCKS5AssociateConnector(user),
+			Transporter: TCPTransporter(),
+		},
+	})
+
+	fln, err := UDPListener("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := UDPDirectForwardHandler(udpSrv.Addr())
+	h.Init(ChainHandlerOption(chain))
+	fwd := &Server{Listener: fln, Handler: h}
+	go fwd.Run()
+	defer fwd.Close()
+
+	conn, err := net.Dial("udp", fln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sendData := make([]byte, 128)
+	rand.Read(sendData)
+	if _, err := conn.Write(sendData); err != nil {
+		t.Fatal(err)
+	}
+	recv := make([]byte, len(sendData))
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, err := conn.Read(recv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sendData, recv[:n]) {
+		t.Error("data not equal")
+	}
+
+	// the proxy allowing only TCP refuses the UDP associate.
+	perms, err := ParsePermissions("tcp:*:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpLn, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpServer := &Server{
+		Handler:  SOCKS5Handler(UsersHandlerOption(user), WhitelistHandlerOption(perms)),
+		Listener: tcpLn,
+	}
+	go tcpServer.Run()
+	defer tcpServer.Close()
+
+	tcpChain := NewChain(Node{
+		Addr: tcpLn.Addr().String(),
+		Client: &Client{
+			Connector:   SOCKS5AssociateConnector(user),
+			Transporter: TCPTransporter(),
+		},
+	})
+	if _, err := tcpChain.DialContext(context.Background(), "udp", udpSrv.Addr()); !errors.Is(err, ErrSOCKS5UDPAssociate) {
+		t.Errorf("got %v, want %v", err, ErrSOCKS5UDPAssociate)
+	}
+}
+
+// socks5UDPProxyConn connects to the UDP host through the SOCKS5 proxy with the handler options by the connector.
+func socks5UDPProxyConn(t *testing.T, connector Connector, host string, opts ...HandlerOption) net.Conn {
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &Client{
+		Connector:   connector,
+		Transporter: TCPTransporter(),
+	}
+	server := &Server{
+		Handler:  SOCKS5Handler(opts...),
+		Listener: ln,
+	}
+	go server.Run()
+	t.Cleanup(func() { server.Close() })
+
+	conn, err := proxyConn(client, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err = client.Connect(conn, host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestSOCKS5UDPMaxBytes(t *testing.T) {
+	udpSrv := newUDPTestServer(udpTestHandler)
+	udpSrv.Start()
+	defer udpSrv.Close()
+
+	// a datagram of 100 bytes is 110 bytes with the SOCKS5 UDP header.
+	conn := socks5UDPProxyConn(t, SOCKS5UDPConnector(nil), udpSrv.Addr(), MaxBytesHandlerOption(300))
+	data := make([]byte, 100)
+	rand.Read(data)
+	if err := udpEcho(conn, data); err != nil {
+		t.Fatal(err)
+	}
+	// the datagram crossing the cap is dropped as a whole, and the association is ended.
+	if err := udpEcho(conn, data); err == nil {
+		t.Error("datagram over the cap should be dropped")
+	}
+	if !closedWithin(conn, 3*time.Second) {
+		t.Error("association should be ended at the cap")
+	}
+}
+
+func TestSOCKS5UDPIdleTimeout(t *testing.T) {
+	udpSrv := newUDPTestServer(nil)
+	udpSrv.Start()
+	defer udpSrv.Close()
+
+	for name, connector := range map[string]Connector{
+		"associate": SOCKS5UDPConnector(nil),
+		"udp-tun":   SOCKS5UDPTunConnector(nil),
+	} {
+		t.Run(name, func(t *testing.T) {
+			conn := socks5UDPProxyConn(t, connector, udpSrv.Addr(), IdleTimeoutHandlerOption(300*time.Millisecond))
+			// the datagrams in one direction keep the relay alive.
+			for i := 0; i < 5; i++ {
+				if _, err := conn.Write([]byte("ping")); err != nil {
+					t.Fatalf("active relay should not be closed: %v", err)
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+			start := time.Now()
+			if !closedWithin(conn, 3*time.Second) {
+				t.Fatal("idle relay should be closed")
+			}
+			if d := time.Since(start); d < 200*time.Millisecond {
+				t.Errorf("relay should be closed at the idle timeout, closed after %v", d)
+			}
+		})
+	}
+}
+
+// testUDPUploadLimit checks the upload of 50KB in the datagrams of 5KB over conn is limited to 100KB/s,
+// and the datagrams are relayed whole.
+func testUDPUploadLimit(t *testing.T, conn net.Conn) {
+	data := make([]byte, 5*1024)
+	rand.Read(data)
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if err := udpEcho(conn, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the first burst is free.
+	if d := time.Since(start); d < 350*time.Millisecond {
+		t.Errorf("upload should be limited, took %v", d)
+	}
+}
+
+func TestSOCKS5UDPRateLimit(t *testing.T) {
+	udpSrv := newUDPTestServer(udpTestHandler)
+	udpSrv.Start()
+	defer udpSrv.Close()
+
+	for name, connector := range map[string]Connector{
+		"associate": SOCKS5UDPConnector(nil),
+		"udp-tun":   SOCKS5UDPTunConnector(nil),
+	} {
+		t.Run(name, func(t *testing.T) {
+			conn := socks5UDPProxyConn(t, connector, udpSrv.Addr(),
+				RateLimitHandlerOption(NewBandwidthLimiter(100*1024), nil))
+			testUDPUploadLimit(t, conn)
+		})
+	}
+}
+
+func TestSOCKS5UDPBandwidth(t *testing.T) {
+	udpSrv := newUDPTestServer(udpTestHandler)
+	udpSrv.Start()
+	defer udpSrv.Close()
+
+	for name, connector := range map[string]Connector{
+		"associate": SOCKS5UDPConnector(nil),
+		"udp-tun":   SOCKS5UDPTunConnector(nil),
+	} {
+		t.Run(name, func(t *testing.T) {
+			conn := socks5UDPProxyConn(t, connector, udpSrv.Addr(),
+				BandwidthHandlerOption(NewBandwidthLimiter(100*1024), PriorityNormal))
+			testUDPUploadLimit(t, conn)
+		})
+	}
+}
+
 // TODO: fix a probability of timeout.
 func BenchmarkSOCKS5UDP(b *testing.B) {
 	udpSrv := newUDPTestServer(udpTestHandler)
@@ -788,3 +1006,49 @@ func BenchmarkSOCKS5UDPTunSingleConn(b *testing.B) {
 		}
 	}
 }
+
+func TestSOCKS5ProxyBcrypt(t *testing.T) {
+	httpSrv := httptest.NewServer(httpTestHandler)
+	defer httpSrv.Close()
+
+	sendData := make([]byte, 128)
+	rand.Read(sendData)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("123456"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvUsers := []*url.Userinfo{url.UserPassword("admin", string(hash))}
+
+	if err := socks5ProxyRoundtrip(httpSrv.URL, sendData,
+		url.UserPassword("admin", "123456"), srvUsers); err != nil {
+		t.Errorf("correct password should pass, got %v", err)
+	}
+	if err := socks5ProxyRoundtrip(httpSrv.URL, sendData,
+		url.UserPassword("admin", "654321"), srvUsers); err == nil {
+		t.Error("wrong password should fail")
+	}
+}
+
+func TestSOCKS5UDPMetrics(t *testing.T) {
+	udpSrv := newUDPTestServer(udpTestHandler)
+	udpSrv.Start()
+	defer udpSrv.Close()
+
+	for name, connector := range map[string]Connector{
+		"associate": SOCKS5UDPConnector(nil),
+		"udp-tun":   SOCKS5UDPTunConnector(nil),
+	} {
+		t.Run(name, func(t *testing.T) {
+			rm := NewMetrics().Router("socks5://:0", "socks5", ":0")
+			conn := socks5UDPProxyConn(t, connector, udpSrv.Addr(), MetricsHandlerOption(rm))
+			data := make([]byte, 100)
+			rand.Read(data)
+			if err := udpEcho(conn, data); err != nil {
+				t.Fatal(err)
+			}
+			// a datagram of 100 bytes is 110 bytes with the SOCKS5 UDP header.
+			testMetricsBytes(t, rm, 110, 110)
+		})
+	}
+}
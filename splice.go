@@ -0,0 +1,65 @@
+package gost
+
+import (
+	"net"
+	"strings"
+
+	"github.com/go-log/log"
+)
+
+// spliceConflicts returns the options transforming or counting the bytes per connection,
+// any of which disables the splice.
+func (opts *HandlerOptions) spliceConflicts() (conflicts []string) {
+	if opts.RateLimitUp != nil || opts.RateLimitDown != nil {
+		conflicts = append(conflicts, "rateLimit")
+	}
+	if opts.Bandwidth != nil {
+		conflicts = append(conflicts, "bandwidth")
+	}
+	if opts.AccessLog {
+		conflicts = append(conflicts, "accessLog")
+	}
+	if opts.Metrics != nil {
+		conflicts = append(conflicts, "metrics")
+	}
+	if opts.IdleTimeout > 0 {
+		conflicts = append(conflicts, "idleTimeout")
+	}
+	if opts.MaxBytes > 0 {
+		conflicts = append(conflicts, "maxBytes")
+	}
+	if opts.FirstByteTimeout > 0 {
+		conflicts = append(conflicts, "firstByteTimeout")
+	}
+	if opts.RetryOnImmediateClose > 0 {
+		conflicts = append(conflicts, "retryOnImmediateClose")
+	}
+	return
+}
+
+// warnSplice logs a warning if the splice is enabled but disabled by the other options.
+func (opts *HandlerOptions) warnSplice(tag string) {
+	if !opts.Splice {
+		return
+	}
+	if conflicts := opts.spliceConflicts(); len(conflicts) > 0 {
+		log.Logf("[%s] splice is disabled by %s", tag, strings.Join(conflicts, ", "))
+	}
+}
+
+// spliceConns returns the raw TCP connections of the client conn and the upstream cc for the splice,
+// ok is false if the splice is disabled, or either of them is not a plain TCP connection,
+// e.g. the upstream is reached through a proxy with the encryption.
+func (opts *HandlerOptions) spliceConns(conn, cc net.Conn) (tc, tcc *net.TCPConn, ok bool) {
+	if !opts.Splice || len(opts.spliceConflicts()) > 0 {
+		return
+	}
+	if c, ok := cc.(*chainConn); ok {
+		cc = c.Conn
+	}
+	if tc, ok = conn.(*net.TCPConn); !ok {
+		return
+	}
+	tcc, ok = cc.(*net.TCPConn)
+	return
+}
@@ -0,0 +1,96 @@
+package gost
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSpliceConns(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	tests := []struct {
+		opts     *HandlerOptions
+		conn, cc net.Conn
+		ok       bool
+	}{
+		{&HandlerOptions{Splice: true}, conn, cc, true},
+		{&HandlerOptions{Splice: true}, conn, &chainConn{Conn: cc}, true},
+		{&HandlerOptions{}, conn, cc, false},
+		{&HandlerOptions{Splice: true, AccessLog: true}, conn, cc, false},
+		{&HandlerOptions{Splice: true}, &accessLogConn{Conn: conn}, cc, false},
+		{&HandlerOptions{Splice: true}, conn, &bufferdConn{Conn: cc}, false},
+	}
+	for i, tc := range tests {
+		if _, _, ok := tc.opts.spliceConns(tc.conn, tc.cc); ok != tc.ok {
+			t.Errorf("#%d: got %v, want %v", i, ok, tc.ok)
+		}
+	}
+
+	opts := &HandlerOptions{
+		Splice:        true,
+		RateLimitDown: NewBandwidthLimiter(1024),
+		Metrics:       NewMetrics().Router("tcp://:0", "tcp", ":0"),
+	}
+	if got := strings.Join(opts.spliceConflicts(), ","); got != "rateLimit,metrics" {
+		t.Errorf("got conflicts %s, want rateLimit,metrics", got)
+	}
+}
+
+func TestTCPDirectForwardSplice(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := TCPDirectForwardHandler(target.Addr().String())
+	h.Init(SpliceHandlerOption(true))
+	server := &Server{Listener: ln, Handler: h}
+	go server.Run()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	data := strings.Repeat("splice", 1024)
+	go conn.Write([]byte(data))
+	b := make([]byte, len(data))
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != data {
+		t.Error("data not equal")
+	}
+}
@@ -142,7 +142,7 @@ func (h *shadowHandler) Handle(conn net.Conn) {
 	log.Logf("[ss] %s -> %s",
 		conn.RemoteAddr(), host)
 
-	if !Can("tcp", host, h.options.Whitelist, h.options.Blacklist) {
+	if !h.options.can("tcp", host) {
 		log.Logf("[ss] %s - %s : Unauthorized to tcp connect to %s",
 			conn.RemoteAddr(), conn.LocalAddr(), host)
 		return
@@ -185,6 +185,8 @@ func (h *shadowHandler) Handle(conn net.Conn) {
 			TimeoutChainOption(h.options.Timeout),
 			HostsChainOption(h.options.Hosts),
 			ResolverChainOption(h.options.Resolver),
+			BlockPrivateChainOption(h.options.BlockPrivate),
+			RandomizeSourcePortChainOption(h.options.RandomizeSourcePort),
 		)
 		if err == nil {
 			break
@@ -194,12 +196,13 @@ func (h *shadowHandler) Handle(conn net.Conn) {
 	}
 
 	if err != nil {
+		h.options.Metrics.DialFailed()
 		return
 	}
 	defer cc.Close()
 
 	log.Logf("[ss] %s <-> %s", conn.RemoteAddr(), host)
-	transport(conn, cc)
+	h.options.transport(conn, cc)
 	log.Logf("[ss] %s >-< %s", conn.RemoteAddr(), host)
 }
 
@@ -317,7 +320,7 @@ func (h *shadowUDPHandler) Handle(conn net.Conn) {
 			pc = h.cipher.PacketConn(pc)
 		}
 		log.Logf("[ssu] %s <-> %s", conn.RemoteAddr(), conn.LocalAddr())
-		h.transportPacket(pc, cc)
+		h.transportPacket(h.options.limitPacketConn(pc), cc)
 		log.Logf("[ssu] %s >-< %s", conn.RemoteAddr(), conn.LocalAddr())
 		return
 	}
@@ -329,10 +332,19 @@ func (h *shadowUDPHandler) Handle(conn net.Conn) {
 	}
 
 	log.Logf("[ssu] %s <-> %s", conn.RemoteAddr(), conn.LocalAddr())
-	h.transportUDP(conn, cc)
+	h.transportUDP(h.options.limitConn(conn), cc)
 	log.Logf("[ssu] %s >-< %s", conn.RemoteAddr(), conn.LocalAddr())
 }
 
+// splitDatagram applies the max datagram size to the payload b.
+func (h *shadowUDPHandler) splitDatagram(b []byte) [][]byte {
+	dgrams := splitDatagram(b, h.options.UDPMaxSize, h.options.UDPOversize)
+	if dgrams == nil {
+		log.Logf("[ssu] datagram of %d bytes exceeds %d, dropped", len(b), h.options.UDPMaxSize)
+	}
+	return dgrams
+}
+
 func (h *shadowUDPHandler) transportPacket(conn, cc net.PacketConn) (err error) {
 	errc := make(chan error, 1)
 	var clientAddr net.Addr
@@ -363,8 +375,12 @@ func (h *shadowUDPHandler) transportPacket(conn, cc net.PacketConn) (err error)
 				if Debug {
 					log.Logf("[ssu] %s >>> %s length: %d", addr, taddr, r.Len())
 				}
-				_, err = cc.WriteTo(r.Bytes(), taddr)
-				return err
+				for _, data := range h.splitDatagram(r.Bytes()) {
+					if _, err = cc.WriteTo(data, taddr); err != nil {
+						return err
+					}
+				}
+				return nil
 			}()
 
 			if err != nil {
@@ -392,13 +408,17 @@ func (h *shadowUDPHandler) transportPacket(conn, cc net.PacketConn) (err error)
 					log.Logf("[ssu] %s <<< %s length: %d", clientAddr, addr, n)
 				}
 
-				dgram := gosocks5.NewUDPDatagram(gosocks5.NewUDPHeader(0, 0, toSocksAddr(addr)), b[:n])
-				buf := bytes.Buffer{}
-				if err = dgram.Write(&buf); err != nil {
-					return err
+				for _, data := range h.splitDatagram(b[:n]) {
+					dgram := gosocks5.NewUDPDatagram(gosocks5.NewUDPHeader(0, 0, toSocksAddr(addr)), data)
+					buf := bytes.Buffer{}
+					if err = dgram.Write(&buf); err != nil {
+						return err
+					}
+					if _, err = conn.WriteTo(buf.Bytes()[3:], clientAddr); err != nil {
+						return err
+					}
 				}
-				_, err = conn.WriteTo(buf.Bytes()[3:], clientAddr)
-				return err
+				return nil
 			}()
 
 			if err != nil {
@@ -438,7 +458,11 @@ func (h *shadowUDPHandler) transportUDP(conn net.Conn, cc net.PacketConn) error
 					log.Log("[ssu] bypass", addr)
 					return // bypass
 				}
-				_, err = cc.WriteTo(dgram.Data, addr)
+				for _, data := range h.splitDatagram(dgram.Data) {
+					if _, err = cc.WriteTo(data, addr); err != nil {
+						return
+					}
+				}
 				return
 			}()
 
@@ -466,11 +490,15 @@ func (h *shadowUDPHandler) transportUDP(conn net.Conn, cc net.PacketConn) error
 					log.Log("[ssu] bypass", addr)
 					return // bypass
 				}
-				dgram := gosocks5.NewUDPDatagram(
-					gosocks5.NewUDPHeader(uint16(n), 0, toSocksAddr(addr)), b[:n])
-				buf := bytes.Buffer{}
-				dgram.Write(&buf)
-				_, err = conn.Write(buf.Bytes())
+				for _, data := range h.splitDatagram(b[:n]) {
+					dgram := gosocks5.NewUDPDatagram(
+						gosocks5.NewUDPHeader(uint16(len(data)), 0, toSocksAddr(addr)), data)
+					buf := bytes.Buffer{}
+					dgram.Write(&buf)
+					if _, err = conn.Write(buf.Bytes()); err != nil {
+						return
+					}
+				}
 				return
 			}()
 
@@ -6,8 +6,8 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"os"
 	"net"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
@@ -196,7 +196,7 @@ func (tr *sshForwardTransporter) Dial(addr string, options ...DialOption) (conn
 	session, ok := tr.sessions[addr]
 	if !ok || session.Closed() {
 		if opts.Chain == nil {
-			conn, err = net.DialTimeout("tcp", addr, timeout)
+			conn, err = opts.dialTCP(addr, timeout)
 		} else {
 			conn, err = opts.Chain.Dial(addr)
 		}
@@ -310,7 +310,7 @@ func (tr *sshTunnelTransporter) Dial(addr string, options ...DialOption) (conn n
 	session, ok := tr.sessions[addr]
 	if !ok || session.Closed() {
 		if opts.Chain == nil {
-			conn, err = net.DialTimeout("tcp", addr, timeout)
+			conn, err = opts.dialTCP(addr, timeout)
 		} else {
 			conn, err = opts.Chain.Dial(addr)
 		}
@@ -529,8 +529,8 @@ func (h *sshForwardHandler) Init(options ...HandlerOption) {
 	if tlsConfig == nil {
 		tlsConfig = DefaultTLSConfig
 	}
-	if tlsConfig != nil && len(tlsConfig.Certificates) > 0 {
-		signer, err := ssh.NewSignerFromKey(tlsConfig.Certificates[0].PrivateKey)
+	if cert := tlsCertificate(tlsConfig); cert != nil {
+		signer, err := ssh.NewSignerFromKey(cert.PrivateKey)
 		if err != nil {
 			log.Log("[ssh-forward]", err)
 		}
@@ -589,7 +589,8 @@ func (h *sshForwardHandler) handleForward(conn ssh.Conn, chans <-chan ssh.NewCha
 				}
 
 				go ssh.DiscardRequests(requests)
-				go h.directPortForwardChannel(channel, fmt.Sprintf("%s:%d", p.Host1, p.Port1))
+				cc := &streamConn{rw: channel, laddr: conn.LocalAddr(), raddr: conn.RemoteAddr()}
+				go h.directPortForwardChannel(cc, fmt.Sprintf("%s:%d", p.Host1, p.Port1))
 			default:
 				log.Log("[ssh] Unknown channel type:", t)
 				newChannel.Reject(ssh.UnknownChannelType, fmt.Sprintf("unknown channel type: %s", t))
@@ -600,12 +601,12 @@ func (h *sshForwardHandler) handleForward(conn ssh.Conn, chans <-chan ssh.NewCha
 	conn.Wait()
 }
 
-func (h *sshForwardHandler) directPortForwardChannel(channel ssh.Channel, raddr string) {
+func (h *sshForwardHandler) directPortForwardChannel(channel net.Conn, raddr string) {
 	defer channel.Close()
 
 	log.Logf("[ssh-tcp] %s - %s", h.options.Node.Addr, raddr)
 
-	if !Can("tcp", raddr, h.options.Whitelist, h.options.Blacklist) {
+	if !h.options.can("tcp", raddr) {
 		log.Logf("[ssh-tcp] Unauthorized to tcp connect to %s", raddr)
 		return
 	}
@@ -620,6 +621,8 @@ func (h *sshForwardHandler) directPortForwardChannel(channel ssh.Channel, raddr
 		TimeoutChainOption(h.options.Timeout),
 		HostsChainOption(h.options.Hosts),
 		ResolverChainOption(h.options.Resolver),
+		BlockPrivateChainOption(h.options.BlockPrivate),
+		RandomizeSourcePortChainOption(h.options.RandomizeSourcePort),
 	)
 	if err != nil {
 		log.Logf("[ssh-tcp] %s - %s : %s", h.options.Node.Addr, raddr, err)
@@ -628,7 +631,7 @@ func (h *sshForwardHandler) directPortForwardChannel(channel ssh.Channel, raddr
 	defer conn.Close()
 
 	log.Logf("[ssh-tcp] %s <-> %s", h.options.Node.Addr, raddr)
-	transport(conn, channel)
+	h.options.transport(channel, conn)
 	log.Logf("[ssh-tcp] %s >-< %s", h.options.Node.Addr, raddr)
 }
 
@@ -644,7 +647,7 @@ func (h *sshForwardHandler) tcpipForwardRequest(sshConn ssh.Conn, req *ssh.Reque
 
 	addr := fmt.Sprintf("%s:%d", t.Host, t.Port)
 
-	if !Can("rtcp", addr, h.options.Whitelist, h.options.Blacklist) {
+	if !h.options.can("rtcp", addr) {
 		log.Logf("[ssh-rtcp] Unauthorized to tcp bind to %s", addr)
 		req.Reply(false, nil)
 		return
@@ -709,7 +712,7 @@ func (h *sshForwardHandler) tcpipForwardRequest(sshConn ssh.Conn, req *ssh.Reque
 				go ssh.DiscardRequests(reqs)
 
 				log.Logf("[ssh-rtcp] %s <-> %s", conn.RemoteAddr(), conn.LocalAddr())
-				transport(ch, conn)
+				h.options.transport(conn, &streamConn{rw: ch, laddr: sshConn.LocalAddr(), raddr: sshConn.RemoteAddr()})
 				log.Logf("[ssh-rtcp] %s >-< %s", conn.RemoteAddr(), conn.LocalAddr())
 			}(conn)
 		}
@@ -755,7 +758,12 @@ func SSHTunnelListener(addr string, config *SSHConfig) (Listener, error) {
 
 	signer := config.Key
 	if signer == nil {
-		signer, err = ssh.NewSignerFromKey(DefaultTLSConfig.Certificates[0].PrivateKey)
+		cert := tlsCertificate(DefaultTLSConfig)
+		if cert == nil {
+			ln.Close()
+			return nil, errors.New("ssh: no host key")
+		}
+		signer, err = ssh.NewSignerFromKey(cert.PrivateKey)
 		if err != nil {
 			ln.Close()
 			return nil, err
@@ -1,6 +1,13 @@
 package gost
 
-import "net"
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
 
 // tcpTransporter is a raw TCP transporter.
 type tcpTransporter struct{}
@@ -21,7 +28,7 @@ func (tr *tcpTransporter) Dial(addr string, options ...DialOption) (net.Conn, er
 		timeout = DialTimeout
 	}
 	if opts.Chain == nil {
-		return net.DialTimeout("tcp", addr, timeout)
+		return opts.dialTCP(addr, timeout)
 	}
 	return opts.Chain.Dial(addr)
 }
@@ -38,19 +45,109 @@ type tcpListener struct {
 	net.Listener
 }
 
+// TCPListenConfig is the config for TCP Listener.
+type TCPListenConfig struct {
+	Mark int // mark (SO_MARK) of the listening socket
+	DSCP int // DSCP of the IP packets sent by the listening socket, 0 for the system default
+}
+
 // TCPListener creates a Listener for TCP proxy server.
 func TCPListener(addr string) (Listener, error) {
+	return TCPListenerWithConfig(addr, nil)
+}
+
+// MarkedTCPListener is like TCPListener, and sets the mark (SO_MARK) on the listening socket before binding,
+// which is inherited by the accepted connections, so that their traffic can be policy-routed.
+func MarkedTCPListener(addr string, mark int) (Listener, error) {
+	return TCPListenerWithConfig(addr, &TCPListenConfig{Mark: mark})
+}
+
+// TCPListenerWithConfig is like TCPListener, and sets the socket options of cfg on the listening socket
+// before binding, which are inherited by the accepted connections.
+func TCPListenerWithConfig(addr string, cfg *TCPListenConfig) (Listener, error) {
+	if cfg == nil {
+		cfg = &TCPListenConfig{}
+	}
 	laddr, err := net.ResolveTCPAddr("tcp", addr)
 	if err != nil {
 		return nil, err
 	}
-	ln, err := net.ListenTCP("tcp", laddr)
-	if err != nil {
-		return nil, err
+	// EMOD: adopt the listening socket handed over by the old process on upgrade.
+	ln := takeInheritedListener(laddr)
+	if ln == nil {
+		lc := net.ListenConfig{Control: joinControl(markControl(cfg.Mark), dscpControl(cfg.DSCP))}
+		l, err := lc.Listen(context.Background(), "tcp", laddr.String())
+		if err != nil {
+			return nil, err
+		}
+		ln = l.(*net.TCPListener)
 	}
 	return &tcpListener{Listener: tcpKeepAliveListener{ln}}, nil
 }
 
+// markControl returns the control function setting the mark on the socket, nil if mark is not positive.
+func markControl(mark int) func(network, address string, c syscall.RawConn) error {
+	if mark <= 0 {
+		return nil
+	}
+	return func(_, _ string, c syscall.RawConn) error {
+		return setRawConnMark(c, mark)
+	}
+}
+
+// setRawConnMark sets the mark on the socket of the raw connection.
+func setRawConnMark(c syscall.RawConn, mark int) error {
+	var err error
+	if e := c.Control(func(fd uintptr) {
+		err = setSocketMark(int(fd), mark)
+	}); e != nil {
+		return e
+	}
+	return err
+}
+
+// dscpControl returns the control function setting the DSCP on the socket, nil if dscp is not positive.
+func dscpControl(dscp int) func(network, address string, c syscall.RawConn) error {
+	if dscp <= 0 {
+		return nil
+	}
+	return func(network, _ string, c syscall.RawConn) error {
+		return setRawConnDSCP(c, strings.HasSuffix(network, "6"), dscp)
+	}
+}
+
+// setRawConnDSCP sets the DSCP, the upper 6 bits of the TOS (traffic class), on the socket of the raw connection.
+func setRawConnDSCP(c syscall.RawConn, ipv6 bool, dscp int) error {
+	var err error
+	if e := c.Control(func(fd uintptr) {
+		err = setSocketTOS(int(fd), ipv6, dscp<<2)
+	}); e != nil {
+		return e
+	}
+	return err
+}
+
+// joinControl returns the control function calling the non-nil ones of fns in order, nil if all are nil.
+func joinControl(fns ...func(network, address string, c syscall.RawConn) error) func(network, address string, c syscall.RawConn) error {
+	var control []func(network, address string, c syscall.RawConn) error
+	for _, fn := range fns {
+		if fn != nil {
+			control = append(control, fn)
+		}
+	}
+	if len(control) == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		for _, fn := range control {
+			if err := fn(network, address, c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
 type tcpKeepAliveListener struct {
 	*net.TCPListener
 }
@@ -64,3 +161,107 @@ func (ln tcpKeepAliveListener) Accept() (c net.Conn, err error) {
 	tc.SetKeepAlivePeriod(KeepAliveTime)
 	return tc, nil
 }
+
+// keepAliveListener sets the TCP keepalive of the accepted connections.
+type keepAliveListener struct {
+	Listener
+	period time.Duration
+}
+
+// KeepAliveListener wraps ln to set the TCP keepalive period of the accepted TCP (or TLS over TCP) connections,
+// the keepalive is disabled if period is negative.
+func KeepAliveListener(ln Listener, period time.Duration) Listener {
+	return &keepAliveListener{Listener: ln, period: period}
+}
+
+func (l *keepAliveListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	setConnKeepAlive(conn, l.period)
+	return conn, nil
+}
+
+// RebindListener is the Listener whose listening socket can be replaced while serving,
+// e.g. when the bound address is gone. The accepted connections are not affected by Rebind.
+type RebindListener struct {
+	ln     Listener
+	closed bool
+	mux    sync.Mutex
+}
+
+// NewRebindListener creates a RebindListener serving on ln first.
+func NewRebindListener(ln Listener) *RebindListener {
+	return &RebindListener{ln: ln}
+}
+
+// Rebind replaces the listener with ln, the current one is closed.
+// net.ErrClosed is returned if the RebindListener is closed, then ln is not used.
+func (l *RebindListener) Rebind(ln Listener) error {
+	l.mux.Lock()
+	if l.closed {
+		l.mux.Unlock()
+		return net.ErrClosed
+	}
+	old := l.ln
+	l.ln = ln
+	l.mux.Unlock()
+
+	return old.Close()
+}
+
+func (l *RebindListener) current() Listener {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.ln
+}
+
+func (l *RebindListener) Accept() (net.Conn, error) {
+	for {
+		ln := l.current()
+		conn, err := ln.Accept()
+		if err == nil {
+			return conn, nil
+		}
+		// the listener is closed by Rebind, accept on the new one.
+		l.mux.Lock()
+		rebound := !l.closed && l.ln != ln
+		l.mux.Unlock()
+		if !rebound {
+			return nil, err
+		}
+	}
+}
+
+func (l *RebindListener) Addr() net.Addr {
+	return l.current().Addr()
+}
+
+func (l *RebindListener) Close() error {
+	l.mux.Lock()
+	l.closed = true
+	ln := l.ln
+	l.mux.Unlock()
+
+	return ln.Close()
+}
+
+// setConnKeepAlive sets the TCP keepalive period of conn, or of the TCP connection under the TLS connection conn,
+// the keepalive is disabled if period is negative.
+func setConnKeepAlive(conn net.Conn, period time.Duration) bool {
+	if c, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		conn = c.NetConn()
+	}
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return false
+	}
+	if period < 0 {
+		tc.SetKeepAlive(false)
+		return true
+	}
+	tc.SetKeepAlive(true)
+	tc.SetKeepAlivePeriod(period)
+	return true
+}
@@ -1,9 +1,19 @@
 package gost
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"io"
 	"net"
+	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -72,7 +82,7 @@ func (tr *mtlsTransporter) Dial(addr string, options ...DialOption) (conn net.Co
 		}
 
 		if opts.Chain == nil {
-			conn, err = net.DialTimeout("tcp", addr, timeout)
+			conn, err = opts.dialTCP(addr, timeout)
 		} else {
 			conn, err = opts.Chain.Dial(addr)
 		}
@@ -150,6 +160,7 @@ func (tr *mtlsTransporter) Multiplex() bool {
 
 type tlsListener struct {
 	net.Listener
+	tcp Listener // the TCP listener under TLS, handed over by the upgrade
 }
 
 // TLSListener creates a Listener for TLS proxy server.
@@ -157,17 +168,18 @@ func TLSListener(addr string, config *tls.Config) (Listener, error) {
 	if config == nil {
 		config = DefaultTLSConfig
 	}
-	ln, err := net.Listen("tcp", addr)
+	// EMOD: TCPListener adopts the listening socket handed over by the old process on upgrade.
+	ln, err := TCPListener(addr)
 	if err != nil {
 		return nil, err
 	}
 
-	ln = tls.NewListener(tcpKeepAliveListener{ln.(*net.TCPListener)}, config)
-	return &tlsListener{ln}, nil
+	return &tlsListener{Listener: tls.NewListener(ln, config), tcp: ln}, nil
 }
 
 type mtlsListener struct {
 	ln       net.Listener
+	tcp      Listener // the TCP listener under TLS, handed over by the upgrade
 	connChan chan net.Conn
 	errChan  chan error
 }
@@ -177,13 +189,14 @@ func MTLSListener(addr string, config *tls.Config) (Listener, error) {
 	if config == nil {
 		config = DefaultTLSConfig
 	}
-	ln, err := net.Listen("tcp", addr)
+	ln, err := TCPListener(addr)
 	if err != nil {
 		return nil, err
 	}
 
 	l := &mtlsListener{
-		ln:       tls.NewListener(tcpKeepAliveListener{ln.(*net.TCPListener)}, config),
+		ln:       tls.NewListener(ln, config),
+		tcp:      ln,
 		connChan: make(chan net.Conn, 1024),
 		errChan:  make(chan error, 1),
 	}
@@ -326,3 +339,461 @@ func wrapTLSClient(conn net.Conn, tlsConfig *tls.Config, timeout time.Duration)
 
 	return tlsConn, err
 }
+
+// TLS verification modes of the client.
+const (
+	// TLSVerifyManual verifies the certificate chain against the root CAs, without the hostname check.
+	TLSVerifyManual = "manual"
+	// TLSVerifyStandard uses the standard library verification, including the hostname check.
+	TLSVerifyStandard = "standard"
+	// TLSVerifySkip skips the verification.
+	TLSVerifySkip = "skip"
+)
+
+// SetTLSVerifyMode sets the verification of the client TLS config to the mode,
+// the root CAs of the config are used, or the system roots if it is nil.
+func SetTLSVerifyMode(cfg *tls.Config, mode string) error {
+	switch mode {
+	case TLSVerifyManual:
+		rootCAs := cfg.RootCAs
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = func(state tls.ConnectionState) error {
+			certs := state.PeerCertificates
+			if len(certs) == 0 {
+				return errors.New("tls: no peer certificate")
+			}
+			opts := x509.VerifyOptions{
+				Roots:         rootCAs,
+				CurrentTime:   time.Now(),
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, cert := range certs[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			_, err := certs[0].Verify(opts)
+			return err
+		}
+	case TLSVerifyStandard:
+		cfg.InsecureSkipVerify = false
+		cfg.VerifyConnection = nil
+	case TLSVerifySkip:
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = nil
+	default:
+		return fmt.Errorf("tls: unknown verify mode %q", mode)
+	}
+	return nil
+}
+
+// ErrCertExpiring is an error that implies the peer certificate expires within the required validity window.
+var ErrCertExpiring = errors.New("certificate expires too soon")
+
+// CertMinValidityVerifier returns a tls.Config.VerifyConnection callback which rejects
+// the peer certificate if it expires within d. The verify callback, if not nil, is called first.
+func CertMinValidityVerifier(d time.Duration, verify func(tls.ConnectionState) error) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		if verify != nil {
+			if err := verify(state); err != nil {
+				return err
+			}
+		}
+		if d <= 0 || len(state.PeerCertificates) == 0 {
+			return nil
+		}
+		if notAfter := state.PeerCertificates[0].NotAfter; time.Until(notAfter) < d {
+			return fmt.Errorf("%w: not after %s, min validity %s", ErrCertExpiring, notAfter.Format(time.RFC3339), d)
+		}
+		return nil
+	}
+}
+
+// ErrCertPinMismatch is an error that implies the peer certificate matches none of the pins.
+var ErrCertPinMismatch = errors.New("certificate pin mismatch")
+
+// ParseCertPins parses the comma-separated certificate pins in the form of sha256/<base64>,
+// the SHA-256 digest of the public key (SPKI) or the whole certificate of the peer.
+func ParseCertPins(s string) ([][]byte, error) {
+	var pins [][]byte
+	for _, pin := range strings.Split(s, ",") {
+		if pin = strings.TrimSpace(pin); pin == "" {
+			continue
+		}
+		v := strings.TrimPrefix(pin, "sha256/")
+		if v == pin {
+			return nil, fmt.Errorf("invalid pin %q, should be sha256/<base64>", pin)
+		}
+		b, err := base64.StdEncoding.DecodeString(v)
+		if err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid pin %q, should be the base64 of the SHA-256 digest", pin)
+		}
+		pins = append(pins, b)
+	}
+	if len(pins) == 0 {
+		return nil, errors.New("no pin")
+	}
+	return pins, nil
+}
+
+// CertPinVerifier returns a tls.Config.VerifyConnection callback which rejects the peer
+// unless the SHA-256 digest of the public key or the whole leaf certificate matches any of the pins,
+// regardless of the CA trust. The verify callback, if not nil, is called first.
+func CertPinVerifier(pins [][]byte, verify func(tls.ConnectionState) error) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		if verify != nil {
+			if err := verify(state); err != nil {
+				return err
+			}
+		}
+		if len(state.PeerCertificates) == 0 {
+			return errors.New("tls: no peer certificate")
+		}
+		leaf := state.PeerCertificates[0]
+		spki := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+		cert := sha256.Sum256(leaf.Raw)
+		for _, pin := range pins {
+			if bytes.Equal(pin, spki[:]) || bytes.Equal(pin, cert[:]) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: sha256/%s", ErrCertPinMismatch, base64.StdEncoding.EncodeToString(spki[:]))
+	}
+}
+
+// TLS renegotiation modes of the client TLS config.
+const (
+	// TLSRenegotiateNever disables renegotiation, it is the default.
+	TLSRenegotiateNever = "never"
+	// TLSRenegotiateOnce allows the server to request renegotiation once per connection.
+	TLSRenegotiateOnce = "once"
+	// TLSRenegotiateFreely allows the server to repeatedly request renegotiation.
+	TLSRenegotiateFreely = "freely"
+)
+
+// SetTLSRenegotiation sets the renegotiation and post-handshake authentication support of the client TLS config.
+//
+// The TLS 1.3 post-handshake authentication is not implemented by crypto/tls,
+// so if postHandshakeAuth is set, the version is limited to TLS 1.2 where the server
+// requests the client certificate by renegotiation, which is allowed once if mode is empty.
+// The client certificate must be set in cfg before.
+func SetTLSRenegotiation(cfg *tls.Config, mode string, postHandshakeAuth bool) error {
+	if mode == "" {
+		mode = TLSRenegotiateNever
+		if postHandshakeAuth {
+			mode = TLSRenegotiateOnce
+		}
+	}
+
+	var renegotiation tls.RenegotiationSupport
+	switch mode {
+	case TLSRenegotiateNever:
+		renegotiation = tls.RenegotiateNever
+	case TLSRenegotiateOnce:
+		renegotiation = tls.RenegotiateOnceAsClient
+	case TLSRenegotiateFreely:
+		renegotiation = tls.RenegotiateFreelyAsClient
+	default:
+		return fmt.Errorf("tls: unknown renegotiation mode %q", mode)
+	}
+
+	if postHandshakeAuth {
+		if len(cfg.Certificates) == 0 && cfg.GetClientCertificate == nil {
+			return errors.New("tls: post-handshake auth requires a client certificate")
+		}
+		if renegotiation == tls.RenegotiateNever {
+			return errors.New("tls: post-handshake auth requires renegotiation")
+		}
+		if cfg.MinVersion > tls.VersionTLS12 {
+			return errors.New("tls: post-handshake auth is not supported with TLS 1.3")
+		}
+		if cfg.MaxVersion == 0 || cfg.MaxVersion > tls.VersionTLS12 {
+			cfg.MaxVersion = tls.VersionTLS12
+		}
+	}
+
+	cfg.Renegotiation = renegotiation
+	return nil
+}
+
+// SetTLSMinVersion sets the minimum TLS version of the config, e.g. 1.2 or 1.3,
+// the config is not changed if version is empty, so the Go default is used.
+func SetTLSMinVersion(cfg *tls.Config, version string) error {
+	switch version {
+	case "":
+	case "1.0":
+		cfg.MinVersion = tls.VersionTLS10
+	case "1.1":
+		cfg.MinVersion = tls.VersionTLS11
+	case "1.2":
+		cfg.MinVersion = tls.VersionTLS12
+	case "1.3":
+		cfg.MinVersion = tls.VersionTLS13
+	default:
+		return fmt.Errorf("tls: unknown version %q, should be 1.0, 1.1, 1.2 or 1.3", version)
+	}
+	return nil
+}
+
+// TLSTicketKeys holds the session ticket keys shared by a set of server TLS configs,
+// so that sessions can be resumed across servers (or processes) using the same keys.
+// Each line of the key file is a 32-byte key in hex or base64 encoding,
+// the first key is used to encrypt new tickets, all keys can decrypt.
+// The keys are rotated by adding a new key to the head of the list.
+type TLSTicketKeys struct {
+	configs []*tls.Config
+	keys    [][32]byte
+	period  time.Duration
+	stopped chan struct{}
+	mux     sync.RWMutex
+}
+
+// NewTLSTicketKeys creates a TLSTicketKeys for the given server TLS configs.
+func NewTLSTicketKeys(configs ...*tls.Config) *TLSTicketKeys {
+	return &TLSTicketKeys{
+		configs: configs,
+		stopped: make(chan struct{}),
+	}
+}
+
+// Keys returns the current ticket keys.
+func (k *TLSTicketKeys) Keys() [][32]byte {
+	k.mux.RLock()
+	defer k.mux.RUnlock()
+
+	return k.keys
+}
+
+// Reload parses the keys from r, then applies them to the TLS configs.
+func (k *TLSTicketKeys) Reload(r io.Reader) error {
+	var period time.Duration
+	var keys [][32]byte
+
+	if r == nil || k.Stopped() {
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		ss := splitLine(scanner.Text())
+		if len(ss) == 0 {
+			continue
+		}
+
+		switch ss[0] {
+		case "reload": // reload option
+			if len(ss) > 1 {
+				period, _ = time.ParseDuration(ss[1])
+			}
+		default:
+			key, err := parseTicketKey(ss[0])
+			if err != nil {
+				return err
+			}
+			keys = append(keys, key)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return errors.New("tls: no session ticket key")
+	}
+
+	k.mux.Lock()
+	k.period = period
+	k.keys = keys
+	k.mux.Unlock()
+
+	for _, cfg := range k.configs {
+		cfg.SetSessionTicketKeys(keys)
+	}
+
+	return nil
+}
+
+func parseTicketKey(s string) (key [32]byte, err error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		b, err = base64.StdEncoding.DecodeString(s)
+	}
+	if err != nil || len(b) != len(key) {
+		return key, fmt.Errorf("tls: invalid session ticket key %q", s)
+	}
+	copy(key[:], b)
+	return
+}
+
+// Period returns the reload period.
+func (k *TLSTicketKeys) Period() time.Duration {
+	if k.Stopped() {
+		return -1
+	}
+
+	k.mux.RLock()
+	defer k.mux.RUnlock()
+
+	return k.period
+}
+
+// Stop stops reloading.
+func (k *TLSTicketKeys) Stop() {
+	select {
+	case <-k.stopped:
+	default:
+		close(k.stopped)
+	}
+}
+
+// Stopped checks whether the reloader is stopped.
+func (k *TLSTicketKeys) Stopped() bool {
+	select {
+	case <-k.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// CertReloader serves the certificate loaded from the cert and key files,
+// and reloads it when the files change, e.g. renewed by certbot, without a restart.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	modTime  time.Time
+	stopped  chan struct{}
+	mux      sync.RWMutex
+}
+
+// NewCertReloader creates a CertReloader with the certificate loaded from the cert and key files.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		stopped:  make(chan struct{}),
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *CertReloader) load() error {
+	mt, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.cert = &cert
+	r.modTime = mt
+	return nil
+}
+
+// latestModTime returns the latest modification time of the cert and key files.
+func (r *CertReloader) latestModTime() (time.Time, error) {
+	var mt time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(mt) {
+			mt = fi.ModTime()
+		}
+	}
+	return mt, nil
+}
+
+// Certificate returns the current certificate.
+func (r *CertReloader) Certificate() *tls.Certificate {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	return r.cert
+}
+
+// GetCertificate returns the current certificate, it is used as tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.Certificate(), nil
+}
+
+// GetClientCertificate returns the current certificate, it is used as tls.Config.GetClientCertificate.
+func (r *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.Certificate(), nil
+}
+
+// Watch checks the files every period until stopped. A change is loaded only after the files
+// are unchanged for a period, so a half-written file is not loaded in the middle of a renewal.
+// The current certificate is kept if the loading fails, until the files change again.
+func (r *CertReloader) Watch(period time.Duration) {
+	var pending, failed time.Time
+	for {
+		select {
+		case <-time.After(period):
+		case <-r.stopped:
+			return
+		}
+
+		mt, err := r.latestModTime()
+		r.mux.RLock()
+		changed := err == nil && !mt.Equal(r.modTime) && !mt.Equal(failed)
+		r.mux.RUnlock()
+		if !changed {
+			pending = time.Time{}
+			continue
+		}
+		if !mt.Equal(pending) {
+			pending = mt
+			continue
+		}
+
+		pending = time.Time{}
+		if err := r.load(); err != nil {
+			log.Logf("[tls] reload %s: %s", r.certFile, err)
+			failed = mt
+			continue
+		}
+		log.Logf("[tls] reload %s", r.certFile)
+	}
+}
+
+// Stop stops watching.
+func (r *CertReloader) Stop() {
+	select {
+	case <-r.stopped:
+	default:
+		close(r.stopped)
+	}
+}
+
+// Stopped checks whether the watching is stopped.
+func (r *CertReloader) Stopped() bool {
+	select {
+	case <-r.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// tlsCertificate returns the current server certificate of the config,
+// from GetCertificate if the certificates are not set, or nil if none.
+func tlsCertificate(cfg *tls.Config) *tls.Certificate {
+	if cfg == nil {
+		return nil
+	}
+	if len(cfg.Certificates) > 0 {
+		return &cfg.Certificates[0]
+	}
+	if cfg.GetCertificate != nil {
+		if cert, err := cfg.GetCertificate(&tls.ClientHelloInfo{}); err == nil {
+			return cert
+		}
+	}
+	return nil
+}
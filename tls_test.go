@@ -1,12 +1,25 @@
 package gost
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func httpOverTLSRoundtrip(targetURL string, data []byte, tlsConfig *tls.Config,
@@ -808,3 +821,529 @@ func TestMTLSForwardTunnel(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func ticketTLSServer(config *tls.Config) (net.Listener, error) {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	return ln, nil
+}
+
+func tlsResumeRoundtrip(addr string, cache tls.ClientSessionCache) (bool, error) {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         "example.com",
+		ClientSessionCache: cache,
+		MaxVersion:         tls.VersionTLS12,
+	})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	return conn.ConnectionState().DidResume, nil
+}
+
+func TestTLSTicketsDisabled(t *testing.T) {
+	config := DefaultTLSConfig.Clone()
+	config.SessionTicketsDisabled = true
+
+	ln, err := ticketTLSServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	cache := tls.NewLRUClientSessionCache(8)
+	for i := 0; i < 2; i++ {
+		resumed, err := tlsResumeRoundtrip(ln.Addr().String(), cache)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resumed {
+			t.Errorf("#%d: session should not be resumed", i)
+		}
+	}
+}
+
+func TestTLSTicketKeysResumption(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	config1 := DefaultTLSConfig.Clone()
+	config2 := DefaultTLSConfig.Clone()
+	keys := NewTLSTicketKeys(config1, config2)
+	if err := keys.Reload(strings.NewReader(hex.EncodeToString(key))); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys.Keys()) != 1 {
+		t.Fatalf("expected 1 key, got %d", len(keys.Keys()))
+	}
+
+	ln1, err := ticketTLSServer(config1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln1.Close()
+	ln2, err := ticketTLSServer(config2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln2.Close()
+
+	cache := tls.NewLRUClientSessionCache(8)
+	if resumed, err := tlsResumeRoundtrip(ln1.Addr().String(), cache); err != nil || resumed {
+		t.Fatalf("first handshake: resumed %v, %v", resumed, err)
+	}
+	resumed, err := tlsResumeRoundtrip(ln2.Addr().String(), cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resumed {
+		t.Error("session should be resumed by the second server")
+	}
+}
+
+func TestTLSTicketKeysReload(t *testing.T) {
+	tests := []struct {
+		s  string
+		ok bool
+	}{
+		{"", false},
+		{"# comment only", false},
+		{"invalid", false},
+		{hex.EncodeToString(make([]byte, 16)), false},
+		{hex.EncodeToString(make([]byte, 32)), true},
+		{"reload 1h\n" + strings.Repeat("A", 43) + "=", true},
+	}
+	for i, tc := range tests {
+		keys := NewTLSTicketKeys(DefaultTLSConfig.Clone())
+		if err := keys.Reload(strings.NewReader(tc.s)); (err == nil) != tc.ok {
+			t.Errorf("#%d: unexpected result %v", i, err)
+		}
+	}
+}
+
+func TestCertMinValidity(t *testing.T) {
+	cert, err := genTestCert(nil, x509.ExtKeyUsageServerAuth) // expires in an hour
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := TLSListener("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{Listener: ln}
+	go server.Serve(HTTPHandler())
+	defer server.Close()
+
+	for _, tc := range []struct {
+		minValidity time.Duration
+		accepted    bool
+	}{
+		{0, true},
+		{30 * time.Minute, true},
+		{2 * time.Hour, false},
+	} {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+			InsecureSkipVerify: true,
+			VerifyConnection:   CertMinValidityVerifier(tc.minValidity, nil),
+		})
+		if conn != nil {
+			conn.Close()
+		}
+		if tc.accepted && err != nil {
+			t.Errorf("min validity %v: cert should be accepted, got %v", tc.minValidity, err)
+		}
+		if !tc.accepted && (err == nil || !strings.Contains(err.Error(), ErrCertExpiring.Error())) {
+			t.Errorf("min validity %v: cert should be rejected, got %v", tc.minValidity, err)
+		}
+	}
+
+	// the previous verify callback is called first.
+	errVerify := errors.New("verify failed")
+	verify := CertMinValidityVerifier(time.Minute, func(tls.ConnectionState) error { return errVerify })
+	if err := verify(tls.ConnectionState{}); err != errVerify {
+		t.Errorf("got %v, want %v", err, errVerify)
+	}
+}
+
+func TestTLSVerifyMode(t *testing.T) {
+	ca, err := genTestCert(nil, x509.ExtKeyUsageAny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := genTestCert(&ca, x509.ExtKeyUsageServerAuth, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rogueCA, err := genTestCert(nil, x509.ExtKeyUsageAny)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{cert.Certificate[0], ca.Certificate[0]},
+			PrivateKey:  cert.PrivateKey,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	roguePool := x509.NewCertPool()
+	roguePool.AddCert(rogueCA.Leaf)
+
+	for _, tc := range []struct {
+		mode       string
+		serverName string
+		rootCAs    *x509.CertPool
+		ok         bool
+	}{
+		{TLSVerifyStandard, "example.com", pool, true},
+		{TLSVerifyStandard, "other.com", pool, false},
+		{TLSVerifyStandard, "example.com", roguePool, false},
+		{TLSVerifyManual, "example.com", pool, true},
+		{TLSVerifyManual, "other.com", pool, true},
+		{TLSVerifyManual, "example.com", roguePool, false},
+		{TLSVerifySkip, "example.com", pool, true},
+		{TLSVerifySkip, "other.com", roguePool, true},
+	} {
+		cfg := &tls.Config{
+			ServerName: tc.serverName,
+			RootCAs:    tc.rootCAs,
+		}
+		if err := SetTLSVerifyMode(cfg, tc.mode); err != nil {
+			t.Fatal(err)
+		}
+		conn, err := tls.Dial("tcp", ln.Addr().String(), cfg)
+		if conn != nil {
+			conn.Close()
+		}
+		if (err == nil) != tc.ok {
+			t.Errorf("%s, %s: ok should be %v, got %v", tc.mode, tc.serverName, tc.ok, err)
+		}
+	}
+
+	if err := SetTLSVerifyMode(&tls.Config{}, "strict"); err == nil {
+		t.Error("unknown mode should fail")
+	}
+}
+
+func TestSetTLSMinVersion(t *testing.T) {
+	for _, tc := range []struct {
+		version string
+		want    uint16
+	}{
+		{"", 0},
+		{"1.0", tls.VersionTLS10},
+		{"1.1", tls.VersionTLS11},
+		{"1.2", tls.VersionTLS12},
+		{"1.3", tls.VersionTLS13},
+	} {
+		cfg := &tls.Config{}
+		if err := SetTLSMinVersion(cfg, tc.version); err != nil {
+			t.Fatalf("%q: %v", tc.version, err)
+		}
+		if cfg.MinVersion != tc.want {
+			t.Errorf("%q: min version should be %x, got %x", tc.version, tc.want, cfg.MinVersion)
+		}
+	}
+	if err := SetTLSMinVersion(&tls.Config{}, "1.4"); err == nil {
+		t.Error("unknown version should be rejected")
+	}
+
+	// the client limited to TLS 1.2 fails to handshake with the TLS 1.3-only server.
+	cert, err := GenCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	SetTLSMinVersion(serverCfg, "1.3")
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go tls.Server(c1, serverCfg).Handshake()
+	client := tls.Client(c2, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12})
+	if err := client.Handshake(); err == nil {
+		t.Error("TLS 1.2 client should be rejected by the TLS 1.3-only server")
+	}
+}
+
+func TestSetTLSRenegotiation(t *testing.T) {
+	cert, err := GenCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &tls.Config{}
+	if err := SetTLSRenegotiation(cfg, "", false); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Renegotiation != tls.RenegotiateNever || cfg.MaxVersion != 0 {
+		t.Errorf("unexpected default config: renegotiation %v, max version %x", cfg.Renegotiation, cfg.MaxVersion)
+	}
+
+	cfg = &tls.Config{}
+	if err := SetTLSRenegotiation(cfg, TLSRenegotiateFreely, false); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Renegotiation != tls.RenegotiateFreelyAsClient {
+		t.Errorf("renegotiation: got %v", cfg.Renegotiation)
+	}
+
+	cfg = &tls.Config{Certificates: []tls.Certificate{cert}}
+	if err := SetTLSRenegotiation(cfg, "", true); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Renegotiation != tls.RenegotiateOnceAsClient || cfg.MaxVersion != tls.VersionTLS12 {
+		t.Errorf("post-handshake auth: renegotiation %v, max version %x", cfg.Renegotiation, cfg.MaxVersion)
+	}
+
+	invalid := []struct {
+		cfg  *tls.Config
+		mode string
+		pha  bool
+	}{
+		{&tls.Config{}, "always", false},
+		{&tls.Config{}, "", true},
+		{&tls.Config{Certificates: []tls.Certificate{cert}}, TLSRenegotiateNever, true},
+		{&tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS13}, "", true},
+	}
+	for i, tc := range invalid {
+		if err := SetTLSRenegotiation(tc.cfg, tc.mode, tc.pha); err == nil {
+			t.Errorf("#%d: mode %q, post-handshake auth %v should be rejected", i, tc.mode, tc.pha)
+		}
+	}
+}
+
+func writeKeyPair(t *testing.T, certFile, keyFile string, mt time.Time) []byte {
+	rawCert, rawKey, err := generateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{certFile: rawCert, keyFile: rawKey} {
+		if err := os.WriteFile(name, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, mt, mt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cert, err := tls.X509KeyPair(rawCert, rawKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Certificate[0]
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	now := time.Now()
+	first := writeKeyPair(t, certFile, keyFile, now.Add(-time.Hour))
+
+	certs, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go certs.Watch(10 * time.Millisecond)
+	defer certs.Stop()
+
+	cfg := &tls.Config{GetCertificate: certs.GetCertificate}
+	if cert := tlsCertificate(cfg); cert == nil || !bytes.Equal(cert.Certificate[0], first) {
+		t.Fatal("the certificate should be loaded")
+	}
+
+	// a half-written key is not loaded, the current certificate is kept.
+	if err := os.WriteFile(keyFile, []byte("-----BEGIN"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(keyFile, now, now)
+	time.Sleep(100 * time.Millisecond)
+	if cert := tlsCertificate(cfg); !bytes.Equal(cert.Certificate[0], first) {
+		t.Fatal("the certificate should be kept if the loading fails")
+	}
+
+	second := writeKeyPair(t, certFile, keyFile, now.Add(time.Minute))
+	for i := 0; i < 100; i++ {
+		if cert := tlsCertificate(cfg); bytes.Equal(cert.Certificate[0], second) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("the certificate should be reloaded")
+}
+
+func TestCertPin(t *testing.T) {
+	cert, err := genTestCert(nil, x509.ExtKeyUsageServerAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	spki := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	whole := sha256.Sum256(leaf.Raw)
+	other := sha256.Sum256([]byte("other"))
+	pin := func(b [sha256.Size]byte) string {
+		return "sha256/" + base64.StdEncoding.EncodeToString(b[:])
+	}
+
+	ln, err := TLSListener("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{Listener: ln}
+	go server.Serve(HTTPHandler())
+	defer server.Close()
+
+	for _, tc := range []struct {
+		pins     string
+		accepted bool
+	}{
+		{pin(spki), true},
+		{pin(whole), true},
+		{pin(other) + ", " + pin(spki), true},
+		{pin(other), false},
+	} {
+		pins, err := ParseCertPins(tc.pins)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+			InsecureSkipVerify: true,
+			VerifyConnection:   CertPinVerifier(pins, nil),
+		})
+		if conn != nil {
+			conn.Close()
+		}
+		if tc.accepted && err != nil {
+			t.Errorf("%s: cert should be accepted, got %v", tc.pins, err)
+		}
+		if !tc.accepted && (err == nil || !strings.Contains(err.Error(), ErrCertPinMismatch.Error())) {
+			t.Errorf("%s: cert should be rejected, got %v", tc.pins, err)
+		}
+	}
+
+	// the pin is checked after the verify callback.
+	errVerify := errors.New("verify failed")
+	verify := CertPinVerifier([][]byte{spki[:]}, func(tls.ConnectionState) error { return errVerify })
+	if err := verify(tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}}); err != errVerify {
+		t.Errorf("got %v, want %v", err, errVerify)
+	}
+
+	for _, s := range []string{"", "sha1/" + base64.StdEncoding.EncodeToString(spki[:]), "sha256/!!", "sha256/" + base64.StdEncoding.EncodeToString(spki[:16])} {
+		if _, err := ParseCertPins(s); err == nil {
+			t.Errorf("%q: want error", s)
+		}
+	}
+}
+
+func TestTLSClientAuth(t *testing.T) {
+	ca, err := genTestCert(nil, x509.ExtKeyUsageAny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, err := genTestCert(&ca, x509.ExtKeyUsageServerAuth, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, err := genTestCert(&ca, x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rogueCert, err := genTestCert(nil, x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	ln, err := TLSListener("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the probe resistance applies to the clients passing the certificate verification only.
+	server := &Server{Listener: ln}
+	go server.Serve(HTTPHandler(
+		UsersHandlerOption(url.UserPassword("admin", "123456")),
+		ProbeResistHandlerOption("code:400"),
+	))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		name   string
+		certs  []tls.Certificate
+		status int
+	}{
+		{"no cert", nil, 0},
+		{"untrusted cert", []tls.Certificate{rogueCert}, 0},
+		{"trusted cert", []tls.Certificate{clientCert}, 400},
+	} {
+		status, err := func() (int, error) {
+			conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+				ServerName:   "example.com",
+				RootCAs:      pool,
+				Certificates: tc.certs,
+			})
+			if err != nil {
+				return 0, err
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(3 * time.Second))
+
+			// with TLS 1.3 the client certificate is rejected after the client finishes the handshake.
+			if _, err := conn.Write([]byte("GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n")); err != nil {
+				return 0, err
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				return 0, err
+			}
+			resp.Body.Close()
+			return resp.StatusCode, nil
+		}()
+		if tc.status == 0 {
+			if err == nil {
+				t.Errorf("%s: should be rejected at handshake, got status %d", tc.name, status)
+			}
+			continue
+		}
+		if err != nil || status != tc.status {
+			t.Errorf("%s: status should be %d, got %d, %v", tc.name, tc.status, status, err)
+		}
+	}
+}
@@ -0,0 +1,508 @@
+package gost
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-log/log"
+)
+
+// DefaultTracer is the tracer for the connection lifecycle, nil means tracing is disabled.
+var DefaultTracer *Tracer
+
+// SpanContext identifies a span across process boundaries.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+}
+
+// IsValid reports whether the span context has non-zero IDs.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Traceparent formats the span context as a W3C traceparent value.
+func (sc SpanContext) Traceparent() string {
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-01"
+}
+
+// ParseTraceparent parses a W3C traceparent value.
+func ParseTraceparent(s string) (sc SpanContext, err error) {
+	ss := strings.Split(s, "-")
+	if len(ss) != 4 || len(ss[1]) != 32 || len(ss[2]) != 16 {
+		return sc, errors.New("invalid traceparent")
+	}
+	if _, err = hex.Decode(sc.TraceID[:], []byte(ss[1])); err != nil {
+		return
+	}
+	if _, err = hex.Decode(sc.SpanID[:], []byte(ss[2])); err != nil {
+		return
+	}
+	if !sc.IsValid() {
+		err = errors.New("invalid traceparent")
+	}
+	return
+}
+
+// SpanEvent is a timed event of a span.
+type SpanEvent struct {
+	Name  string
+	Time  time.Time
+	Attrs map[string]string
+}
+
+// Span represents the lifecycle of a connection.
+// All methods are safe to call on a nil span.
+type Span struct {
+	Name      string
+	Context   SpanContext
+	Parent    SpanContext
+	StartTime time.Time
+	EndTime   time.Time
+	Attrs     map[string]string
+	Events    []SpanEvent
+	Err       error
+	tracer    *Tracer
+	ended     bool
+	mux       sync.Mutex
+	// EMOD: the threshold of the slow log, zero means disabled.
+	slowLog time.Duration
+}
+
+// SpanContext returns the span context of the span.
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.Context
+}
+
+// SetAttr sets an attribute of the span.
+func (s *Span) SetAttr(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if !s.ended {
+		s.Attrs[key] = value
+	}
+}
+
+// AddEvent adds an event with optional key-value attribute pairs.
+func (s *Span) AddEvent(name string, kvs ...string) {
+	if s == nil {
+		return
+	}
+	ev := SpanEvent{
+		Name: name,
+		Time: time.Now(),
+	}
+	if len(kvs) > 1 {
+		ev.Attrs = make(map[string]string)
+		for i := 0; i+1 < len(kvs); i += 2 {
+			ev.Attrs[kvs[i]] = kvs[i+1]
+		}
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if !s.ended {
+		s.Events = append(s.Events, ev)
+	}
+}
+
+// SetError records err as the status of the span.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if !s.ended {
+		s.Err = err
+	}
+}
+
+// End ends the span and exports it.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mux.Lock()
+	if s.ended {
+		s.mux.Unlock()
+		return
+	}
+	s.ended = true
+	s.EndTime = time.Now()
+	s.mux.Unlock()
+
+	if s.slowLog > 0 {
+		s.logSlow()
+	}
+	if s.tracer.exporter == nil {
+		return
+	}
+	if err := s.tracer.exporter.ExportSpans([]*Span{s}); err != nil {
+		log.Log("[trace]", err)
+	}
+}
+
+// logSlow logs the span with the timing breakdown if the setup (till the last event before close)
+// or the total duration reaches the slow log threshold.
+func (s *Span) logSlow() {
+	var setup time.Duration
+	var b strings.Builder
+	last := s.StartTime
+	for _, ev := range s.Events {
+		if ev.Name == "close" {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%s %s", ev.Name, ev.Time.Sub(last))
+		if ev.Attrs["error"] != "" {
+			b.WriteString(" (error)")
+		}
+		last = ev.Time
+		setup = ev.Time.Sub(s.StartTime)
+	}
+
+	total := s.EndTime.Sub(s.StartTime)
+	if setup < s.slowLog && total < s.slowLog {
+		return
+	}
+	log.Logf("[slow] %s %s -> %s : setup %s [%s], total %s",
+		s.Name, s.Attrs["client.address"], s.Attrs["target.address"], setup, b.String(), total)
+}
+
+// spanErrAttrs appends the error attribute to the event attributes if err is not nil.
+func spanErrAttrs(err error, kvs ...string) []string {
+	if err != nil {
+		kvs = append(kvs, "error", err.Error())
+	}
+	return kvs
+}
+
+// SpanExporter exports the ended spans.
+type SpanExporter interface {
+	ExportSpans(spans []*Span) error
+}
+
+// Tracer creates spans and exports them when they end.
+// All methods are safe to call on a nil tracer, which creates nil spans.
+type Tracer struct {
+	exporter SpanExporter
+}
+
+// NewTracer creates a Tracer exporting spans to the exporter.
+func NewTracer(exporter SpanExporter) *Tracer {
+	return &Tracer{exporter: exporter}
+}
+
+// Start starts a span as the child of the span (or remote span context) in ctx,
+// and returns a copy of ctx holding the new span.
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	span := &Span{
+		Name:      name,
+		StartTime: time.Now(),
+		Attrs:     make(map[string]string),
+		tracer:    t,
+	}
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.Parent = parent.Context
+	} else if sc, ok := ctx.Value(remoteSpanContextKey{}).(SpanContext); ok {
+		span.Parent = sc
+	}
+
+	span.Context.TraceID = span.Parent.TraceID
+	if !span.Parent.IsValid() {
+		rand.Read(span.Context.TraceID[:])
+	}
+	rand.Read(span.Context.SpanID[:])
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// startSpan starts a span with DefaultTracer. If slowLog is positive,
+// the span is created even when tracing is disabled, and it is logged if the connection is slow.
+// Such a span is local, its context is not propagated to the upstream.
+func startSpan(ctx context.Context, name string, slowLog time.Duration) (context.Context, *Span) {
+	ctx, span := DefaultTracer.Start(ctx, name)
+	if slowLog <= 0 {
+		return ctx, span
+	}
+	if span == nil {
+		ctx, span = (&Tracer{}).Start(ctx, name)
+	}
+	span.slowLog = slowLog
+	return ctx, span
+}
+
+// traced reports whether the span is exported by a tracer, rather than created for the slow log only.
+// Only the context of a traced span is propagated to the peer.
+func (s *Span) traced() bool {
+	return s != nil && s.tracer != nil && s.tracer.exporter != nil
+}
+
+type spanKey struct{}
+
+type remoteSpanContextKey struct{}
+
+// SpanFromContext returns the span in ctx, or nil if there is none.
+func SpanFromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// ContextWithRemoteSpanContext returns a copy of ctx holding the span context received from the peer,
+// which becomes the parent of the next span started from ctx.
+func ContextWithRemoteSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteSpanContextKey{}, sc)
+}
+
+// OTLPExporter exports spans to an OTLP/HTTP collector in the JSON encoding.
+// Spans are sent in batches, and dropped if the queue is full.
+type OTLPExporter struct {
+	URL      string
+	Client   *http.Client
+	queue    chan *Span
+	flush    chan chan struct{}
+	closed   chan struct{}
+	stopOnce sync.Once
+}
+
+const (
+	otlpQueueSize     = 2048
+	otlpBatchSize     = 512
+	otlpFlushInterval = 5 * time.Second
+)
+
+// NewOTLPExporter creates an OTLPExporter for the collector endpoint, e.g. http://127.0.0.1:4318.
+// The path /v1/traces is used if the endpoint has no path.
+func NewOTLPExporter(endpoint string) *OTLPExporter {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+	if i := strings.Index(endpoint, "://"); !strings.Contains(endpoint[i+3:], "/") {
+		endpoint += "/v1/traces"
+	}
+
+	e := &OTLPExporter{
+		URL:    endpoint,
+		Client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan *Span, otlpQueueSize),
+		flush:  make(chan chan struct{}),
+		closed: make(chan struct{}),
+	}
+	go e.loop()
+	return e
+}
+
+// ExportSpans queues the spans for export.
+func (e *OTLPExporter) ExportSpans(spans []*Span) error {
+	for _, span := range spans {
+		select {
+		case e.queue <- span:
+		default:
+			return errors.New("otlp: queue is full, span dropped")
+		}
+	}
+	return nil
+}
+
+// Flush sends the queued spans.
+func (e *OTLPExporter) Flush() {
+	done := make(chan struct{})
+	select {
+	case e.flush <- done:
+		<-done
+	case <-e.closed:
+	}
+}
+
+// Close flushes the queued spans and stops the exporter.
+func (e *OTLPExporter) Close() error {
+	e.Flush()
+	e.stopOnce.Do(func() {
+		close(e.closed)
+	})
+	return nil
+}
+
+func (e *OTLPExporter) loop() {
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.send(batch); err != nil {
+			log.Log("[trace]", err)
+		}
+		batch = nil
+	}
+	drain := func() {
+		for {
+			select {
+			case span := <-e.queue:
+				batch = append(batch, span)
+			default:
+				return
+			}
+		}
+	}
+
+	for {
+		select {
+		case span := <-e.queue:
+			batch = append(batch, span)
+			if len(batch) >= otlpBatchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case done := <-e.flush:
+			drain()
+			send()
+			close(done)
+		case <-e.closed:
+			return
+		}
+	}
+}
+
+func (e *OTLPExporter) send(spans []*Span) error {
+	data, err := json.Marshal(otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+	resp, err := e.Client.Post(e.URL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("otlp: %s", resp.Status)
+	}
+	return nil
+}
+
+type otlpKeyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string         `json:"timeUnixNano"`
+	Name         string         `json:"name"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Events            []otlpEvent    `json:"events,omitempty"`
+	Status            struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+func otlpAttrs(m map[string]string) (kvs []otlpKeyValue) {
+	for k, v := range m {
+		kv := otlpKeyValue{Key: k}
+		kv.Value.StringValue = v
+		kvs = append(kvs, kv)
+	}
+	return
+}
+
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// otlpRequest builds the ExportTraceServiceRequest in the OTLP JSON encoding.
+func otlpRequest(spans []*Span) interface{} {
+	var ss []otlpSpan
+	for _, span := range spans {
+		s := otlpSpan{
+			TraceID:           hex.EncodeToString(span.Context.TraceID[:]),
+			SpanID:            hex.EncodeToString(span.Context.SpanID[:]),
+			Name:              span.Name,
+			Kind:              2, // SPAN_KIND_SERVER
+			StartTimeUnixNano: otlpTime(span.StartTime),
+			EndTimeUnixNano:   otlpTime(span.EndTime),
+			Attributes:        otlpAttrs(span.Attrs),
+		}
+		if span.Parent.IsValid() {
+			s.ParentSpanID = hex.EncodeToString(span.Parent.SpanID[:])
+		}
+		for _, ev := range span.Events {
+			s.Events = append(s.Events, otlpEvent{
+				TimeUnixNano: otlpTime(ev.Time),
+				Name:         ev.Name,
+				Attributes:   otlpAttrs(ev.Attrs),
+			})
+		}
+		if span.Err != nil {
+			s.Status.Code = 2 // STATUS_CODE_ERROR
+			s.Status.Message = span.Err.Error()
+		}
+		ss = append(ss, s)
+	}
+
+	service := otlpKeyValue{Key: "service.name"}
+	service.Value.StringValue = "gost"
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpKeyValue{service},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{
+							"name":    "gost",
+							"version": Version,
+						},
+						"spans": ss,
+					},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,237 @@
+package gost
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-gost/relay"
+)
+
+type memSpanExporter struct {
+	spans []*Span
+	mux   sync.Mutex
+}
+
+func (e *memSpanExporter) ExportSpans(spans []*Span) error {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func (e *memSpanExporter) find(name string, traceID [16]byte) *Span {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	for _, span := range e.spans {
+		if span.Name == name && span.Context.TraceID == traceID {
+			return span
+		}
+	}
+	return nil
+}
+
+func TestTraceparent(t *testing.T) {
+	_, span := NewTracer(&memSpanExporter{}).Start(context.Background(), "test")
+	sc, err := ParseTraceparent(span.SpanContext().Traceparent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc != span.SpanContext() {
+		t.Errorf("span context mismatch: %v, %v", sc, span.SpanContext())
+	}
+
+	for _, s := range []string{"", "00-abc-def-01", "00-" + hex.EncodeToString(make([]byte, 16)) + "-" + hex.EncodeToString(make([]byte, 8)) + "-01"} {
+		if _, err := ParseTraceparent(s); err == nil {
+			t.Errorf("%q should be invalid", s)
+		}
+	}
+}
+
+func TestRelayTracing(t *testing.T) {
+	exporter := &memSpanExporter{}
+	DefaultTracer = NewTracer(exporter)
+	defer func() { DefaultTracer = nil }()
+
+	target, err := idServer('x')
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := RelayHandler(target.Addr().String())
+	h.Init()
+	server := &Server{Listener: ln, Handler: h}
+	go server.Run()
+	defer server.Close()
+
+	ctx, clientSpan := DefaultTracer.Start(context.Background(), "client")
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc, err := RelayConnector(nil).ConnectContext(ctx, conn, "tcp", "", RelayExtConnectOption(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.Write([]byte{0})
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := cc.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	cc.Close()
+	clientSpan.End()
+
+	var span *Span
+	for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if span = exporter.find("relay", clientSpan.Context.TraceID); span != nil {
+			break
+		}
+	}
+	if span == nil {
+		t.Fatal("relay span is not exported")
+	}
+
+	if span.Parent != clientSpan.Context {
+		t.Errorf("trace context should be propagated, parent %v, want %v", span.Parent, clientSpan.Context)
+	}
+	var events []string
+	for _, ev := range span.Events {
+		events = append(events, ev.Name)
+	}
+	want := []string{"handshake", "resolve", "dial", "close"}
+	if len(events) != len(want) {
+		t.Fatalf("events should be %v, got %v", want, events)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Errorf("events should be %v, got %v", want, events)
+			break
+		}
+	}
+	if span.Attrs["target.address"] != target.Addr().String() {
+		t.Errorf("unexpected target address %q", span.Attrs["target.address"])
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var body []byte
+	var path string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	exporter := NewOTLPExporter(srv.URL)
+	defer exporter.Close()
+
+	_, span := NewTracer(exporter).Start(context.Background(), "tcp")
+	span.AddEvent("dial", "address", "127.0.0.1:80")
+	span.End()
+	exporter.Flush()
+
+	if path != "/v1/traces" {
+		t.Errorf("unexpected path %q", path)
+	}
+
+	var req struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatal(err)
+	}
+	if len(req.ResourceSpans) != 1 || len(req.ResourceSpans[0].ScopeSpans) != 1 ||
+		len(req.ResourceSpans[0].ScopeSpans[0].Spans) != 1 {
+		t.Fatalf("unexpected request: %s", body)
+	}
+	s := req.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if s.TraceID != hex.EncodeToString(span.Context.TraceID[:]) || s.Name != "tcp" ||
+		len(s.Events) != 1 || s.Events[0].Name != "dial" {
+		t.Errorf("unexpected span: %s", body)
+	}
+}
+
+func TestSlowLog(t *testing.T) {
+	target, err := idServer('x')
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	_, port, _ := net.SplitHostPort(target.Addr().String())
+
+	logger := &captureLogger{}
+	SetLogger(logger)
+	defer SetLogger(&NopLogger{})
+
+	forward := func(addr string, resolver Resolver) {
+		ln, err := TCPListener("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := TCPDirectForwardHandler(addr)
+		h.Init(
+			ResolverHandlerOption(resolver),
+			SlowLogHandlerOption(200*time.Millisecond),
+		)
+		server := &Server{Listener: ln, Handler: h}
+		go server.Run()
+		defer server.Close()
+
+		if id, err := readID(ln.Addr().String()); err != nil || id != 'x' {
+			t.Fatalf("unexpected response %q: %v", id, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	forward(target.Addr().String(), nil)
+	if lines := logger.grep("[slow]"); len(lines) > 0 {
+		t.Errorf("fast connection should not be logged, got %v", lines)
+	}
+
+	r := newResolver(0, NameServer{exchanger: &stubExchanger{delay: 300 * time.Millisecond, ip: net.IPv4(127, 0, 0, 1)}})
+	r.dnsTimeout = time.Second
+	forward(net.JoinHostPort("slow.example.com", port), r)
+	lines := logger.grep("[slow]")
+	if len(lines) != 1 {
+		t.Fatalf("slow connection should be logged once, got %v", lines)
+	}
+	for _, field := range []string{"resolve", "dial", "setup", "total"} {
+		if !strings.Contains(lines[0], field) {
+			t.Errorf("slow log should contain %q: %s", field, lines[0])
+		}
+	}
+}
+
+func TestSlowLogNotPropagated(t *testing.T) {
+	// the span of the slow log is local when tracing is disabled.
+	ctx, span := startSpan(context.Background(), "relay", time.Second)
+	defer span.End()
+	if span == nil {
+		t.Fatal("slow log should create a span")
+	}
+	b, err := relayConnectHeader(ctx, RelayExtConnectOption(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) == 0 || b[0] != relay.Version1 {
+		t.Errorf("traceparent should not be sent for the slow log, got %x", b)
+	}
+}
@@ -53,6 +53,9 @@ type TunConfig struct {
 	MTU     int
 	Routes  []IPRoute
 	Gateway string
+	// RouteTable is the routing table (name or number) the routes are installed into on Linux,
+	// the main table is used if it is empty.
+	RouteTable string
 }
 
 type tunRouteKey [16]byte
@@ -256,6 +259,22 @@ func (h *tunHandler) findRouteFor(dst net.IP) net.Addr {
 
 func (h *tunHandler) transportTun(tun net.Conn, conn net.PacketConn, raddr net.Addr) error {
 	errc := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+
+	// EMOD: client side, coalesce the packets into batch frames.
+	var batchc chan []byte
+	if raddr != nil && h.options.TunBatch > 1 {
+		batchc = make(chan []byte, h.options.TunBatch)
+		go func() {
+			if err := writeTunBatch(conn, raddr, batchc, h.options.TunBatch, done); err != nil {
+				select {
+				case errc <- err:
+				default:
+				}
+			}
+		}()
+	}
 
 	go func() {
 		for {
@@ -305,6 +324,13 @@ func (h *tunHandler) transportTun(tun net.Conn, conn net.PacketConn, raddr net.A
 
 				// client side, deliver packet directly.
 				if raddr != nil {
+					if batchc != nil {
+						select {
+						case batchc <- append([]byte(nil), b[:n]...):
+						case <-done:
+						}
+						return nil
+					}
 					_, err := conn.WriteTo(b[:n], raddr)
 					return err
 				}
@@ -334,8 +360,9 @@ func (h *tunHandler) transportTun(tun net.Conn, conn net.PacketConn, raddr net.A
 	go func() {
 		for {
 			err := func() error {
-				b := sPool.Get().([]byte)
-				defer sPool.Put(b)
+				// EMOD: large enough for a batch frame.
+				b := lPool.Get().([]byte)
+				defer lPool.Put(b)
 
 				n, addr, err := conn.ReadFrom(b)
 				if err != nil &&
@@ -343,70 +370,20 @@ func (h *tunHandler) transportTun(tun net.Conn, conn net.PacketConn, raddr net.A
 					return err
 				}
 
-				var src, dst net.IP
-				if waterutil.IsIPv4(b[:n]) {
-					header, err := ipv4.ParseHeader(b[:n])
+				if n > 0 && b[0] == tunBatchMagic {
+					packets, err := splitTunBatch(b[:n])
 					if err != nil {
 						log.Logf("[tun] %s: %v", tun.LocalAddr(), err)
 						return nil
 					}
-					if Debug {
-						log.Logf("[tun] %s -> %s %-4s %d/%-4d %-4x %d",
-							header.Src, header.Dst, ipProtocol(waterutil.IPv4Protocol(b[:n])),
-							header.Len, header.TotalLen, header.ID, header.Flags)
-					}
-					src, dst = header.Src, header.Dst
-				} else if waterutil.IsIPv6(b[:n]) {
-					header, err := ipv6.ParseHeader(b[:n])
-					if err != nil {
-						log.Logf("[tun] %s: %v", tun.LocalAddr(), err)
-						return nil
-					}
-					if Debug {
-						log.Logf("[tun] %s -> %s %s %d %d",
-							header.Src, header.Dst,
-							ipProtocol(waterutil.IPProtocol(header.NextHeader)),
-							header.PayloadLen, header.TrafficClass)
+					for _, pkt := range packets {
+						if err := h.handleTunnelPacket(tun, conn, pkt, addr, raddr); err != nil {
+							return err
+						}
 					}
-					src, dst = header.Src, header.Dst
-				} else {
-					log.Logf("[tun] unknown packet")
 					return nil
 				}
-
-				// client side, deliver packet to tun device.
-				if raddr != nil {
-					_, err := tun.Write(b[:n])
-					return err
-				}
-
-				rkey := ipToTunRouteKey(src)
-				if actual, loaded := h.routes.LoadOrStore(rkey, addr); loaded {
-					if actual.(net.Addr).String() != addr.String() {
-						log.Logf("[tun] update route: %s -> %s (old %s)",
-							src, addr, actual.(net.Addr))
-						h.routes.Store(rkey, addr)
-					}
-				} else {
-					log.Logf("[tun] new route: %s -> %s", src, addr)
-				}
-
-				if addr := h.findRouteFor(dst); addr != nil {
-					if Debug {
-						log.Logf("[tun] find route: %s -> %s", dst, addr)
-					}
-					_, err := conn.WriteTo(b[:n], addr)
-					return err
-				}
-
-				if _, err := tun.Write(b[:n]); err != nil {
-					select {
-					case h.chExit <- struct{}{}:
-					default:
-					}
-					return err
-				}
-				return nil
+				return h.handleTunnelPacket(tun, conn, b[:n], addr, raddr)
 			}()
 
 			if err != nil {
@@ -423,6 +400,166 @@ func (h *tunHandler) transportTun(tun net.Conn, conn net.PacketConn, raddr net.A
 	return err
 }
 
+// EMOD: tun packet batching.
+// A batch frame coalesces multiple IP packets in one write to the tunnel:
+//
+//	0x00 | count(1) | length(2) | packet | length(2) | packet ...
+//
+// The leading zero byte can never start an IPv4 or IPv6 packet,
+// so the receiver accepts both batch frames and single packets.
+const (
+	tunBatchMagic   = 0x00
+	tunBatchMaxSize = 32 * 1024 // fits in the large buffer of the receiver
+)
+
+// appendTunBatch encodes the packets as a batch frame appended to b.
+func appendTunBatch(b []byte, packets [][]byte) []byte {
+	b = append(b, tunBatchMagic, byte(len(packets)))
+	for _, pkt := range packets {
+		b = append(b, byte(len(pkt)>>8), byte(len(pkt)))
+		b = append(b, pkt...)
+	}
+	return b
+}
+
+// splitTunBatch decodes the packets from the batch frame b, the packets share the memory of b.
+func splitTunBatch(b []byte) ([][]byte, error) {
+	if len(b) < 2 || b[0] != tunBatchMagic {
+		return nil, errors.New("bad batch frame")
+	}
+	count := int(b[1])
+	packets := make([][]byte, 0, count)
+	b = b[2:]
+	for i := 0; i < count; i++ {
+		if len(b) < 2 {
+			return nil, errors.New("short batch frame")
+		}
+		n := int(b[0])<<8 | int(b[1])
+		if len(b) < 2+n {
+			return nil, errors.New("short batch frame")
+		}
+		packets = append(packets, b[2:2+n])
+		b = b[2+n:]
+	}
+	return packets, nil
+}
+
+// writeTunBatch writes the queued packets to the tunnel,
+// up to max packets that are available at the time are written in one batch frame.
+func writeTunBatch(conn net.PacketConn, raddr net.Addr, packets <-chan []byte, max int, done <-chan struct{}) error {
+	if max > 0xFF {
+		max = 0xFF
+	}
+	frame := make([]byte, 0, tunBatchMaxSize)
+
+	var pending []byte
+	for {
+		if pending == nil {
+			select {
+			case pending = <-packets:
+			case <-done:
+				return nil
+			}
+		}
+		batch := [][]byte{pending}
+		size := 2 + 2 + len(pending)
+		pending = nil
+
+	collect:
+		for len(batch) < max {
+			select {
+			case pkt := <-packets:
+				if size+2+len(pkt) > tunBatchMaxSize {
+					pending = pkt
+					break collect
+				}
+				batch = append(batch, pkt)
+				size += 2 + len(pkt)
+			default:
+				break collect
+			}
+		}
+
+		b := batch[0]
+		if len(batch) > 1 {
+			frame = appendTunBatch(frame[:0], batch)
+			b = frame
+		}
+		if _, err := conn.WriteTo(b, raddr); err != nil {
+			return err
+		}
+	}
+}
+
+// handleTunnelPacket delivers an IP packet received from the tunnel.
+func (h *tunHandler) handleTunnelPacket(tun net.Conn, conn net.PacketConn, b []byte, addr, raddr net.Addr) error {
+	n := len(b)
+	var src, dst net.IP
+	if waterutil.IsIPv4(b[:n]) {
+		header, err := ipv4.ParseHeader(b[:n])
+		if err != nil {
+			log.Logf("[tun] %s: %v", tun.LocalAddr(), err)
+			return nil
+		}
+		if Debug {
+			log.Logf("[tun] %s -> %s %-4s %d/%-4d %-4x %d",
+				header.Src, header.Dst, ipProtocol(waterutil.IPv4Protocol(b[:n])),
+				header.Len, header.TotalLen, header.ID, header.Flags)
+		}
+		src, dst = header.Src, header.Dst
+	} else if waterutil.IsIPv6(b[:n]) {
+		header, err := ipv6.ParseHeader(b[:n])
+		if err != nil {
+			log.Logf("[tun] %s: %v", tun.LocalAddr(), err)
+			return nil
+		}
+		if Debug {
+			log.Logf("[tun] %s -> %s %s %d %d",
+				header.Src, header.Dst,
+				ipProtocol(waterutil.IPProtocol(header.NextHeader)),
+				header.PayloadLen, header.TrafficClass)
+		}
+		src, dst = header.Src, header.Dst
+	} else {
+		log.Logf("[tun] unknown packet")
+		return nil
+	}
+
+	// client side, deliver packet to tun device.
+	if raddr != nil {
+		_, err := tun.Write(b[:n])
+		return err
+	}
+
+	rkey := ipToTunRouteKey(src)
+	if actual, loaded := h.routes.LoadOrStore(rkey, addr); loaded {
+		if actual.(net.Addr).String() != addr.String() {
+			log.Logf("[tun] update route: %s -> %s (old %s)",
+				src, addr, actual.(net.Addr))
+			h.routes.Store(rkey, addr)
+		}
+	} else {
+		log.Logf("[tun] new route: %s -> %s", src, addr)
+	}
+
+	if addr := h.findRouteFor(dst); addr != nil {
+		if Debug {
+			log.Logf("[tun] find route: %s -> %s", dst, addr)
+		}
+		_, err := conn.WriteTo(b[:n], addr)
+		return err
+	}
+
+	if _, err := tun.Write(b[:n]); err != nil {
+		select {
+		case h.chExit <- struct{}{}:
+		default:
+		}
+		return err
+	}
+	return nil
+}
+
 var mEtherTypes = map[waterutil.Ethertype]string{
 	waterutil.IPv4: "ip",
 	waterutil.ARP:  "arp",
@@ -444,6 +581,9 @@ type TapConfig struct {
 	MTU     int
 	Routes  []string
 	Gateway string
+	// RouteTable is the routing table (name or number) the routes are installed into on Linux,
+	// the main table is used if it is empty.
+	RouteTable string
 }
 
 type tapRouteKey [6]byte
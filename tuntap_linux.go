@@ -1,10 +1,15 @@
 package gost
 
 import (
+	"encoding/binary"
 	"fmt"
 	"net"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/go-log/log"
 	"github.com/songgao/water"
@@ -43,7 +48,7 @@ func createTun(cfg TunConfig) (conn net.Conn, itf *net.Interface, err error) {
 		log.Log(err)
 	}
 
-	if err = addTunRoutes(ifce.Name(), cfg.Routes...); err != nil {
+	if err = addTunRoutes(ifce.Name(), cfg.RouteTable, cfg.Routes...); err != nil {
 		return
 	}
 
@@ -97,7 +102,7 @@ func createTap(cfg TapConfig) (conn net.Conn, itf *net.Interface, err error) {
 		log.Log(err)
 	}
 
-	if err = addTapRoutes(ifce.Name(), cfg.Gateway, cfg.Routes...); err != nil {
+	if err = addTapRoutes(ifce.Name(), cfg.RouteTable, cfg.Gateway, cfg.Routes...); err != nil {
 		return
 	}
 
@@ -113,38 +118,224 @@ func createTap(cfg TapConfig) (conn net.Conn, itf *net.Interface, err error) {
 	return
 }
 
-func addTunRoutes(ifName string, routes ...IPRoute) error {
+// tunRoute is a route to the tun/tap device in the routing table.
+type tunRoute struct {
+	Dest    *net.IPNet
+	Gateway net.IP
+	IfName  string
+	Table   uint32
+}
+
+func (r tunRoute) String() string {
+	s := r.Dest.String()
+	if r.Gateway != nil {
+		s += " via " + r.Gateway.String()
+	}
+	return fmt.Sprintf("%s dev %s table %d", s, r.IfName, r.Table)
+}
+
+// addRoute installs the route by netlink, it is replaced in tests.
+var addRoute = netlinkAddRoute
+
+// routeTableFiles are the iproute2 files mapping the names to the IDs of the routing tables.
+var routeTableFiles = []string{
+	"/etc/iproute2/rt_tables",
+	"/usr/share/iproute2/rt_tables",
+	"/usr/lib/iproute2/rt_tables",
+}
+
+// routeTableID returns the ID of the routing table by its number or name, the main table if table is empty.
+func routeTableID(table string) (uint32, error) {
+	switch table {
+	case "", "main":
+		return syscall.RT_TABLE_MAIN, nil
+	case "local":
+		return syscall.RT_TABLE_LOCAL, nil
+	case "default":
+		return syscall.RT_TABLE_DEFAULT, nil
+	}
+	if id, err := strconv.ParseUint(table, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+
+	files := routeTableFiles
+	if len(files) > 0 {
+		conf, _ := filepath.Glob(files[0] + ".d/*.conf")
+		files = append(append([]string(nil), files...), conf...)
+	}
+	for _, name := range files {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		// the lines are in the form of "id name", # starts a comment.
+		for _, line := range strings.Split(string(data), "\n") {
+			if i := strings.IndexByte(line, '#'); i >= 0 {
+				line = line[:i]
+			}
+			fields := strings.Fields(line)
+			if len(fields) < 2 || fields[1] != table {
+				continue
+			}
+			if id, err := strconv.ParseUint(fields[0], 0, 32); err == nil {
+				return uint32(id), nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("unknown routing table %s", table)
+}
+
+func addTunRoutes(ifName string, table string, routes ...IPRoute) error {
+	id, err := routeTableID(table)
+	if err != nil {
+		return err
+	}
 	for _, route := range routes {
 		if route.Dest == nil {
 			continue
 		}
-		cmd := fmt.Sprintf("ip route add %s dev %s", route.Dest.String(), ifName)
-		log.Logf("[tun] %s", cmd)
+		rt := tunRoute{Dest: route.Dest, IfName: ifName, Table: id}
+		log.Logf("[tun] route add %s", rt)
 
-		args := strings.Split(cmd, " ")
-		if er := exec.Command(args[0], args[1:]...).Run(); er != nil {
-			log.Logf("[tun] %s: %v", cmd, er)
+		if er := addRoute(rt); er != nil {
+			log.Logf("[tun] route add %s: %v", rt, er)
 		}
 	}
 	return nil
 }
 
-func addTapRoutes(ifName string, gw string, routes ...string) error {
+func addTapRoutes(ifName string, table string, gw string, routes ...string) error {
+	id, err := routeTableID(table)
+	if err != nil {
+		return err
+	}
 	for _, route := range routes {
 		if route == "" {
 			continue
 		}
-		cmd := fmt.Sprintf("ip route add %s via %s dev %s", route, gw, ifName)
-		log.Logf("[tap] %s", cmd)
+		_, dest, err := net.ParseCIDR(route)
+		if err != nil {
+			log.Logf("[tap] route add %s: %v", route, err)
+			continue
+		}
+		rt := tunRoute{Dest: dest, Gateway: net.ParseIP(gw), IfName: ifName, Table: id}
+		log.Logf("[tap] route add %s", rt)
 
-		args := strings.Split(cmd, " ")
-		if er := exec.Command(args[0], args[1:]...).Run(); er != nil {
-			log.Logf("[tap] %s: %v", cmd, er)
+		if er := addRoute(rt); er != nil {
+			log.Logf("[tap] route add %s: %v", rt, er)
 		}
 	}
 	return nil
 }
 
+// rtaTable is the RTA_TABLE route attribute, the 32-bit table ID.
+const rtaTable = 0xf
+
+// routeMessage returns the RTM_NEWROUTE netlink message adding the route to the interface ifIndex.
+func routeMessage(r tunRoute, ifIndex int, seq uint32) ([]byte, error) {
+	family, dst := syscall.AF_INET, r.Dest.IP.To4()
+	if dst == nil {
+		family, dst = syscall.AF_INET6, r.Dest.IP.To16()
+	}
+	var gw net.IP
+	if r.Gateway != nil {
+		if family == syscall.AF_INET {
+			gw = r.Gateway.To4()
+		} else if r.Gateway.To4() == nil {
+			gw = r.Gateway.To16()
+		}
+		if gw == nil {
+			return nil, fmt.Errorf("gateway %s does not match the family of %s", r.Gateway, r.Dest)
+		}
+	}
+	ones, _ := r.Dest.Mask.Size()
+
+	// the 8-bit table of the header is the compat table if the ID does not fit, RTA_TABLE has the ID.
+	table := uint8(syscall.RT_TABLE_COMPAT)
+	if r.Table < 256 {
+		table = uint8(r.Table)
+	}
+	scope := uint8(syscall.RT_SCOPE_LINK)
+	if gw != nil {
+		scope = syscall.RT_SCOPE_UNIVERSE
+	}
+
+	b := make([]byte, syscall.NLMSG_HDRLEN, 64)
+	b = append(b, byte(family), byte(ones), 0, 0, table, syscall.RTPROT_BOOT, scope, syscall.RTN_UNICAST, 0, 0, 0, 0)
+	attr := func(typ uint16, data []byte) {
+		n := syscall.SizeofRtAttr + len(data)
+		b = binary.NativeEndian.AppendUint16(b, uint16(n))
+		b = binary.NativeEndian.AppendUint16(b, typ)
+		b = append(b, data...)
+		for ; n%syscall.RTA_ALIGNTO != 0; n++ {
+			b = append(b, 0)
+		}
+	}
+	attr(syscall.RTA_DST, dst)
+	attr(syscall.RTA_OIF, binary.NativeEndian.AppendUint32(nil, uint32(ifIndex)))
+	if gw != nil {
+		attr(syscall.RTA_GATEWAY, gw)
+	}
+	attr(rtaTable, binary.NativeEndian.AppendUint32(nil, r.Table))
+
+	binary.NativeEndian.PutUint32(b[0:4], uint32(len(b)))
+	binary.NativeEndian.PutUint16(b[4:6], syscall.RTM_NEWROUTE)
+	binary.NativeEndian.PutUint16(b[6:8], syscall.NLM_F_REQUEST|syscall.NLM_F_ACK|syscall.NLM_F_CREATE|syscall.NLM_F_EXCL)
+	binary.NativeEndian.PutUint32(b[8:12], seq)
+	return b, nil
+}
+
+// netlinkAddRoute adds the route by the RTM_NEWROUTE message, and waits for the acknowledgment.
+func netlinkAddRoute(r tunRoute) error {
+	ifi, err := net.InterfaceByName(r.IfName)
+	if err != nil {
+		return err
+	}
+	const seq = 1
+	msg, err := routeMessage(r, ifi.Index, seq)
+	if err != nil {
+		return err
+	}
+
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	sa := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}
+	if err := syscall.Bind(fd, sa); err != nil {
+		return err
+	}
+	if err := syscall.Sendto(fd, msg, 0, sa); err != nil {
+		return err
+	}
+
+	buf := make([]byte, os.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != seq || m.Header.Type != syscall.NLMSG_ERROR {
+				continue
+			}
+			if len(m.Data) < 4 {
+				return syscall.EINVAL
+			}
+			// the error of the acknowledgment is the negative errno, 0 on success.
+			if errno := int32(binary.NativeEndian.Uint32(m.Data)); errno != 0 {
+				return syscall.Errno(-errno)
+			}
+			return nil
+		}
+	}
+}
+
 func exeCmd(cmd string) error {
 	log.Log(cmd)
 
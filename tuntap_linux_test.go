@@ -0,0 +1,143 @@
+package gost
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func stubAddRoute(t *testing.T) *[]tunRoute {
+	var routes []tunRoute
+	add := addRoute
+	addRoute = func(r tunRoute) error {
+		routes = append(routes, r)
+		return nil
+	}
+	t.Cleanup(func() { addRoute = add })
+	return &routes
+}
+
+func stubRouteTables(t *testing.T, data string) {
+	name := filepath.Join(t.TempDir(), "rt_tables")
+	if err := os.WriteFile(name, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	files := routeTableFiles
+	routeTableFiles = []string{name}
+	t.Cleanup(func() { routeTableFiles = files })
+}
+
+func TestTunRoutesTable(t *testing.T) {
+	stubRouteTables(t, "# reserved values\n255\tlocal\n254\tmain\n100 vpn # policy routing\n")
+
+	_, dst1, _ := net.ParseCIDR("10.1.0.0/16")
+	_, dst2, _ := net.ParseCIDR("fd00::/64")
+	routes := []IPRoute{{Dest: dst1}, {}, {Dest: dst2}}
+
+	tests := []struct {
+		table string
+		id    uint32
+	}{
+		{"", syscall.RT_TABLE_MAIN},
+		{"100", 100},
+		{"1000", 1000},
+		{"vpn", 100},
+	}
+	for _, tc := range tests {
+		added := stubAddRoute(t)
+		if err := addTunRoutes("tun0", tc.table, routes...); err != nil {
+			t.Fatal(err)
+		}
+		if len(*added) != 2 {
+			t.Fatalf("table %q: expected 2 routes, got %v", tc.table, *added)
+		}
+		for i, dst := range []*net.IPNet{dst1, dst2} {
+			r := (*added)[i]
+			if r.Dest.String() != dst.String() || r.IfName != "tun0" || r.Gateway != nil || r.Table != tc.id {
+				t.Errorf("table %q: expected %s dev tun0 table %d, got %s", tc.table, dst, tc.id, r)
+			}
+		}
+	}
+
+	if err := addTunRoutes("tun0", "unknown", routes...); err == nil {
+		t.Error("unknown table should fail")
+	}
+}
+
+func TestTapRoutesTable(t *testing.T) {
+	added := stubAddRoute(t)
+	if err := addTapRoutes("tap0", "200", "192.168.10.1", "10.2.0.0/16", ""); err != nil {
+		t.Fatal(err)
+	}
+	want := "10.2.0.0/16 via 192.168.10.1 dev tap0 table 200"
+	if len(*added) != 1 || (*added)[0].String() != want {
+		t.Errorf("expected [%s], got %v", want, *added)
+	}
+}
+
+// routeMessageAttrs returns the header table and the attributes of the RTM_NEWROUTE message.
+func routeMessageAttrs(t *testing.T, b []byte) (uint8, map[uint16][]byte) {
+	msgs, err := syscall.ParseNetlinkMessage(b)
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("invalid message: %v", err)
+	}
+	m := msgs[0]
+	if m.Header.Type != syscall.RTM_NEWROUTE || len(m.Data) < syscall.SizeofRtMsg {
+		t.Fatalf("invalid message type %d", m.Header.Type)
+	}
+	attrs := make(map[uint16][]byte)
+	data := m.Data[syscall.SizeofRtMsg:]
+	for len(data) >= syscall.SizeofRtAttr {
+		n := int(binary.NativeEndian.Uint16(data[0:2]))
+		if n < syscall.SizeofRtAttr || n > len(data) {
+			t.Fatalf("invalid attribute length %d", n)
+		}
+		attrs[binary.NativeEndian.Uint16(data[2:4])] = data[syscall.SizeofRtAttr:n]
+		n = (n + syscall.RTA_ALIGNTO - 1) &^ (syscall.RTA_ALIGNTO - 1)
+		if n > len(data) {
+			n = len(data)
+		}
+		data = data[n:]
+	}
+	return m.Data[4], attrs
+}
+
+func TestRouteMessage(t *testing.T) {
+	_, dst, _ := net.ParseCIDR("10.2.0.0/16")
+	for _, tc := range []struct {
+		table       uint32
+		headerTable uint8
+	}{
+		{100, 100},
+		{1000, syscall.RT_TABLE_COMPAT},
+	} {
+		b, err := routeMessage(tunRoute{Dest: dst, Gateway: net.ParseIP("192.168.10.1"), IfName: "tap0", Table: tc.table}, 7, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		headerTable, attrs := routeMessageAttrs(t, b)
+		if headerTable != tc.headerTable {
+			t.Errorf("table %d: header table should be %d, got %d", tc.table, tc.headerTable, headerTable)
+		}
+		if v := attrs[rtaTable]; len(v) != 4 || binary.NativeEndian.Uint32(v) != tc.table {
+			t.Errorf("table %d: RTA_TABLE should be %d, got %v", tc.table, tc.table, v)
+		}
+		if v := attrs[syscall.RTA_OIF]; len(v) != 4 || binary.NativeEndian.Uint32(v) != 7 {
+			t.Errorf("table %d: RTA_OIF should be 7, got %v", tc.table, v)
+		}
+		if v := attrs[syscall.RTA_DST]; !net.IP(v).Equal(dst.IP) {
+			t.Errorf("table %d: RTA_DST should be %s, got %v", tc.table, dst.IP, v)
+		}
+		if v := attrs[syscall.RTA_GATEWAY]; !net.IP(v).Equal(net.ParseIP("192.168.10.1")) {
+			t.Errorf("table %d: RTA_GATEWAY should be 192.168.10.1, got %v", tc.table, v)
+		}
+	}
+
+	_, dst6, _ := net.ParseCIDR("fd00::/64")
+	if _, err := routeMessage(tunRoute{Dest: dst6, Gateway: net.ParseIP("192.168.10.1"), IfName: "tap0"}, 7, 1); err == nil {
+		t.Error("IPv4 gateway of the IPv6 route should fail")
+	}
+}
@@ -0,0 +1,102 @@
+package gost
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+func tunTestPackets(n int) [][]byte {
+	var packets [][]byte
+	for i := 0; i < n; i++ {
+		pkt := make([]byte, 20+i*100)
+		rand.Read(pkt)
+		pkt[0] = 0x45 // IPv4
+		packets = append(packets, pkt)
+	}
+	return packets
+}
+
+func TestTunBatchFrame(t *testing.T) {
+	packets := tunTestPackets(5)
+	frame := appendTunBatch(nil, packets)
+	if frame[0] != tunBatchMagic {
+		t.Fatal("batch frame should start with the magic byte")
+	}
+
+	result, err := splitTunBatch(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != len(packets) {
+		t.Fatalf("expected %d packets, got %d", len(packets), len(result))
+	}
+	for i := range packets {
+		if !bytes.Equal(packets[i], result[i]) {
+			t.Errorf("packet #%d mismatch", i)
+		}
+	}
+
+	for _, b := range [][]byte{nil, {0x45, 0x00}, frame[:len(frame)-1], {tunBatchMagic, 1, 0}} {
+		if _, err := splitTunBatch(b); err == nil {
+			t.Errorf("bad frame %v should fail", b)
+		}
+	}
+}
+
+func TestWriteTunBatch(t *testing.T) {
+	rc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	packets := tunTestPackets(5)
+	ch := make(chan []byte, len(packets))
+	for _, pkt := range packets {
+		ch <- pkt
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go writeTunBatch(pc, rc.LocalAddr(), ch, 4, done)
+
+	var result [][]byte
+	var frames int
+	rc.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for len(result) < len(packets) {
+		b := make([]byte, tunBatchMaxSize)
+		n, _, err := rc.ReadFrom(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames++
+		if b[0] != tunBatchMagic {
+			result = append(result, b[:n])
+			continue
+		}
+		pkts, err := splitTunBatch(b[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		result = append(result, pkts...)
+	}
+
+	if frames != 2 {
+		t.Errorf("5 packets should be written in 2 frames, got %d", frames)
+	}
+	if len(result) != len(packets) {
+		t.Fatalf("expected %d packets, got %d", len(packets), len(result))
+	}
+	for i := range packets {
+		if !bytes.Equal(packets[i], result[i]) {
+			t.Errorf("packet #%d mismatch", i)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package gost
 
 import (
+	"context"
 	"errors"
 	"net"
 	"sync"
@@ -46,6 +47,18 @@ type UDPListenConfig struct {
 	TTL       time.Duration // timeout per connection
 	Backlog   int           // connection backlog
 	QueueSize int           // recv queue size per connection
+	Mark      int           // mark (SO_MARK) of the listening socket
+	DSCP      int           // DSCP of the IP packets sent by the listening socket, 0 for the system default
+	// EMOD: MaxSessions limits the number of the UDP sessions (client tuples), 0 for unlimited,
+	// the datagrams of the new sessions are dropped when the table is full.
+	MaxSessions int
+	// Metrics counts the active UDP sessions, may be nil.
+	Metrics *RouterMetrics
+}
+
+// sessionsFull reports whether no more session can be added to the table of n sessions.
+func (cfg *UDPListenConfig) sessionsFull(n int64) bool {
+	return cfg.MaxSessions > 0 && n >= int64(cfg.MaxSessions)
 }
 
 type udpListener struct {
@@ -58,17 +71,23 @@ type udpListener struct {
 
 // UDPListener creates a Listener for UDP server.
 func UDPListener(addr string, cfg *UDPListenConfig) (Listener, error) {
-	laddr, err := net.ResolveUDPAddr("udp", addr)
-	if err != nil {
-		return nil, err
+	if cfg == nil {
+		cfg = &UDPListenConfig{}
 	}
-	ln, err := net.ListenUDP("udp", laddr)
+
+	laddr, err := net.ResolveUDPAddr("udp", addr)
 	if err != nil {
 		return nil, err
 	}
-
-	if cfg == nil {
-		cfg = &UDPListenConfig{}
+	// EMOD: adopt the socket handed over by the old process on upgrade.
+	var ln net.PacketConn
+	if pc := takeInheritedPacketConn(laddr); pc != nil {
+		ln = pc
+	} else {
+		lc := net.ListenConfig{Control: joinControl(markControl(cfg.Mark), dscpControl(cfg.DSCP))}
+		if ln, err = lc.ListenPacket(context.Background(), "udp", laddr.String()); err != nil {
+			return nil, err
+		}
 	}
 
 	backlog := cfg.Backlog
@@ -103,11 +122,18 @@ func (l *udpListener) listenLoop() {
 
 		conn, ok := l.connMap.Get(raddr.String())
 		if !ok {
+			if l.config.sessionsFull(l.connMap.Size()) {
+				mPool.Put(b)
+				log.Logf("[udp] %s - %s: session table is full (%d)", raddr, l.Addr(), l.connMap.Size())
+				continue
+			}
 			conn = newUDPServerConn(l.ln, raddr, &udpServerConnConfig{
 				ttl:   l.config.TTL,
 				qsize: l.config.QueueSize,
 				onClose: func() {
-					l.connMap.Delete(raddr.String())
+					if l.connMap.Delete(raddr.String()) {
+						l.config.Metrics.addUDPSessions(-1)
+					}
 					log.Logf("[udp] %s closed (%d)", raddr, l.connMap.Size())
 				},
 			})
@@ -115,6 +141,7 @@ func (l *udpListener) listenLoop() {
 			select {
 			case l.connChan <- conn:
 				l.connMap.Set(raddr.String(), conn)
+				l.config.Metrics.addUDPSessions(1)
 				log.Logf("[udp] %s -> %s (%d)", raddr, l.Addr(), l.connMap.Size())
 			default:
 				conn.Close()
@@ -149,6 +176,11 @@ func (l *udpListener) Addr() net.Addr {
 	return l.ln.LocalAddr()
 }
 
+func (l *udpListener) udpConn() *net.UDPConn {
+	c, _ := l.ln.(*net.UDPConn)
+	return c
+}
+
 func (l *udpListener) Close() error {
 	err := l.ln.Close()
 	l.connMap.Range(func(k interface{}, v *udpServerConn) bool {
@@ -177,9 +209,13 @@ func (m *udpConnMap) Set(key interface{}, conn *udpServerConn) {
 	atomic.AddInt64(&m.size, 1)
 }
 
-func (m *udpConnMap) Delete(key interface{}) {
-	m.m.Delete(key)
+// Delete deletes the connection of the key, it reports whether the key was present.
+func (m *udpConnMap) Delete(key interface{}) bool {
+	if _, ok := m.m.LoadAndDelete(key); !ok {
+		return false
+	}
 	atomic.AddInt64(&m.size, -1)
+	return true
 }
 
 func (m *udpConnMap) Range(f func(key interface{}, value *udpServerConn) bool) {
@@ -354,3 +390,57 @@ func (c *udpClientConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
 	addr = c.RemoteAddr()
 	return
 }
+
+// The handling modes of the datagrams larger than the max size.
+const (
+	// UDPOversizeDrop drops the oversized datagrams.
+	UDPOversizeDrop = "drop"
+	// UDPOversizeTruncate truncates the oversized datagrams to the max size.
+	UDPOversizeTruncate = "truncate"
+	// UDPOversizeFrag splits the oversized datagrams into the datagrams of the max size,
+	// the receiver gets the fragments as the separate datagrams.
+	UDPOversizeFrag = "frag"
+)
+
+// splitDatagram returns the datagrams to send for the datagram b under the max size and the oversize mode,
+// it returns nil if b is dropped. The max size is unlimited if it is not positive.
+func splitDatagram(b []byte, max int, mode string) [][]byte {
+	if max <= 0 || len(b) <= max {
+		return [][]byte{b}
+	}
+
+	switch mode {
+	case UDPOversizeTruncate:
+		return [][]byte{b[:max]}
+	case UDPOversizeFrag:
+		var frags [][]byte
+		for len(b) > max {
+			frags = append(frags, b[:max])
+			b = b[max:]
+		}
+		return append(frags, b)
+	default:
+		return nil
+	}
+}
+
+// udpSizeConn enforces the max datagram size on the datagrams written to the connection.
+type udpSizeConn struct {
+	net.Conn
+	max  int
+	mode string
+}
+
+func (c *udpSizeConn) Write(b []byte) (n int, err error) {
+	dgrams := splitDatagram(b, c.max, c.mode)
+	if dgrams == nil {
+		log.Logf("[udp] %s -> %s : datagram of %d bytes exceeds %d, dropped",
+			c.LocalAddr(), c.RemoteAddr(), len(b), c.max)
+	}
+	for _, dgram := range dgrams {
+		if _, err = c.Conn.Write(dgram); err != nil {
+			return
+		}
+	}
+	return len(b), nil
+}
@@ -0,0 +1,170 @@
+package gost
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSplitDatagram(t *testing.T) {
+	const max = 4
+	tests := []struct {
+		data string
+		mode string
+		want []string
+	}{
+		{"abc", UDPOversizeDrop, []string{"abc"}},
+		{"abcd", UDPOversizeDrop, []string{"abcd"}},
+		{"abcdefghij", UDPOversizeDrop, nil},
+		{"abcdefghij", "", nil},
+		{"abc", UDPOversizeTruncate, []string{"abc"}},
+		{"abcd", UDPOversizeTruncate, []string{"abcd"}},
+		{"abcdefghij", UDPOversizeTruncate, []string{"abcd"}},
+		{"abc", UDPOversizeFrag, []string{"abc"}},
+		{"abcd", UDPOversizeFrag, []string{"abcd"}},
+		{"abcdefgh", UDPOversizeFrag, []string{"abcd", "efgh"}},
+		{"abcdefghij", UDPOversizeFrag, []string{"abcd", "efgh", "ij"}},
+	}
+	for _, test := range tests {
+		var got []string
+		for _, b := range splitDatagram([]byte(test.data), max, test.mode) {
+			got = append(got, string(b))
+		}
+		if strings.Join(got, ",") != strings.Join(test.want, ",") || (got == nil) != (test.want == nil) {
+			t.Errorf("%s (%s): got %q, want %q", test.data, test.mode, got, test.want)
+		}
+	}
+
+	if got := splitDatagram([]byte("abcdefghij"), 0, UDPOversizeDrop); len(got) != 1 || len(got[0]) != 10 {
+		t.Errorf("datagram should be unlimited, got %q", got)
+	}
+}
+
+func TestUDPDirectForwardMaxSize(t *testing.T) {
+	for _, mode := range []string{UDPOversizeDrop, UDPOversizeTruncate, UDPOversizeFrag} {
+		t.Run(mode, func(t *testing.T) {
+			// the target records the datagrams.
+			target, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer target.Close()
+
+			ln, err := UDPListener("127.0.0.1:0", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := UDPDirectForwardHandler(target.LocalAddr().String())
+			h.Init(UDPMaxSizeHandlerOption(8, mode))
+			server := &Server{Listener: ln, Handler: h}
+			go server.Run()
+			defer server.Close()
+
+			conn, err := net.Dial("udp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			for _, s := range []string{"1234567", "12345678", "123456789abc", "end"} {
+				conn.Write([]byte(s))
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			var got []string
+			b := make([]byte, 64)
+			for {
+				target.SetReadDeadline(time.Now().Add(time.Second))
+				n, _, err := target.ReadFrom(b)
+				if err != nil {
+					t.Fatalf("got %q: %v", got, err)
+				}
+				if string(b[:n]) == "end" {
+					break
+				}
+				got = append(got, string(b[:n]))
+			}
+
+			want := map[string]string{
+				UDPOversizeDrop:     "1234567,12345678",
+				UDPOversizeTruncate: "1234567,12345678,12345678",
+				UDPOversizeFrag:     "1234567,12345678,12345678,9abc",
+			}[mode]
+			if strings.Join(got, ",") != want {
+				t.Errorf("target got %q, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestUDPListenerMaxSessions(t *testing.T) {
+	m := NewMetrics()
+	rm := m.Router("udp://:0", "udp", ":0")
+	ln, err := UDPListener("127.0.0.1:0", &UDPListenConfig{
+		TTL:         200 * time.Millisecond,
+		MaxSessions: 1,
+		Metrics:     rm,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conns := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+		}
+	}()
+	dial := func(s string) net.Conn {
+		conn, err := net.Dial("udp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte(s))
+		return conn
+	}
+
+	c1 := dial("1")
+	defer c1.Close()
+	select {
+	case <-conns:
+	case <-time.After(time.Second):
+		t.Fatal("the first session should be accepted")
+	}
+	if n := testutil.ToFloat64(rm.udpSessions); n != 1 {
+		t.Errorf("got %d sessions, want 1", n)
+	}
+
+	c2 := dial("2")
+	defer c2.Close()
+	select {
+	case <-conns:
+		t.Fatal("the session table is full, the second session should be rejected")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// the first session expires, then the second one is accepted.
+	time.Sleep(300 * time.Millisecond)
+	c2.Write([]byte("2"))
+	select {
+	case conn := <-conns:
+		b := make([]byte, 8)
+		if n, _ := conn.Read(b); string(b[:n]) != "2" {
+			t.Errorf("got %q, want 2", b[:n])
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the second session should be accepted after the first one expires")
+	}
+
+	metrics := scrapeMetrics(m)
+	if want := `gost_router_udp_sessions{addr=":0",node="udp://:0",protocol="udp"} 1`; !strings.Contains(metrics, want) {
+		t.Errorf("%q not found in\n%s", want, metrics)
+	}
+}
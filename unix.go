@@ -0,0 +1,79 @@
+package gost
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// unixTransporter is a raw UNIX domain socket transporter.
+type unixTransporter struct{}
+
+// UnixTransporter creates a raw UNIX domain socket client, the address is the path of the socket file.
+func UnixTransporter() Transporter {
+	return &unixTransporter{}
+}
+
+func (tr *unixTransporter) Dial(addr string, options ...DialOption) (net.Conn, error) {
+	opts := &DialOptions{}
+	for _, option := range options {
+		option(opts)
+	}
+
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = DialTimeout
+	}
+	if opts.Chain == nil {
+		return net.DialTimeout("unix", addr, timeout)
+	}
+	return opts.Chain.Dial(addr)
+}
+
+func (tr *unixTransporter) Handshake(conn net.Conn, options ...HandshakeOption) (net.Conn, error) {
+	return conn, nil
+}
+
+func (tr *unixTransporter) Multiplex() bool {
+	return false
+}
+
+// UnixListener creates a Listener on the UNIX domain socket of the path.
+// A stale socket file left by a dead process is removed before binding,
+// and the permissions of the socket file are set to mode if it is not zero.
+func UnixListener(path string, mode os.FileMode) (Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// removeStaleSocket removes the socket file of the path if no one is listening on it.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("unix: %s exists and is not a socket", path)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("unix: %s is in use", path)
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,69 @@
+package gost
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnixListener(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gost.sock")
+
+	// a stale socket file left by a dead listener
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := UnixListener(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Errorf("socket permissions: got %o, want 600", perm)
+	}
+
+	if _, err := UnixListener(path, 0); err == nil {
+		t.Error("listening on the socket in use should fail")
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("ok"))
+			conn.Close()
+		}
+	}()
+
+	conn, err := UnixTransporter().Dial(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	b := make([]byte, 2)
+	if _, err := conn.Read(b); err != nil || string(b) != "ok" {
+		t.Errorf("read: %q, %v", b, err)
+	}
+}
+
+func TestUnixListenerNotSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UnixListener(path, 0); err == nil {
+		t.Error("listening on a regular file should fail")
+	}
+}
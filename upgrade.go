@@ -0,0 +1,196 @@
+package gost
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+)
+
+// UpgradeFDEnv is the environment variable passing the descriptor of the upgrade socket to the new process.
+const UpgradeFDEnv = "GOST_UPGRADE_FD"
+
+// ErrUpgradeNotSupported is an error that implies the fd passing upgrade is not supported on the platform.
+var ErrUpgradeNotSupported = errors.New("upgrade is not supported on this platform")
+
+// errNotTransferable is an error that implies the listening socket of the listener can not be handed over.
+var errNotTransferable = errors.New("the listener can not be handed over")
+
+// the kinds of the sockets handed over, sent as the data byte of the message carrying the socket.
+const (
+	upgradeTCPListener byte = iota
+	upgradeUDPConn
+)
+
+// inheritedListeners are the listening sockets handed over by the old process,
+// they are adopted by TCPListener and UDPListener instead of binding the address again.
+var inheritedListeners struct {
+	lns []*net.TCPListener
+	pcs []*net.UDPConn
+	mux sync.Mutex
+}
+
+func addInheritedListener(ln *net.TCPListener) {
+	inheritedListeners.mux.Lock()
+	defer inheritedListeners.mux.Unlock()
+	inheritedListeners.lns = append(inheritedListeners.lns, ln)
+}
+
+func addInheritedPacketConn(pc *net.UDPConn) {
+	inheritedListeners.mux.Lock()
+	defer inheritedListeners.mux.Unlock()
+	inheritedListeners.pcs = append(inheritedListeners.pcs, pc)
+}
+
+// takeInheritedListener returns the inherited listener bound to laddr and removes it, nil if not found.
+func takeInheritedListener(laddr *net.TCPAddr) *net.TCPListener {
+	inheritedListeners.mux.Lock()
+	defer inheritedListeners.mux.Unlock()
+
+	for i, ln := range inheritedListeners.lns {
+		addr, ok := ln.Addr().(*net.TCPAddr)
+		if ok && inheritedAddrMatch(addr.IP, addr.Port, addr.Zone, laddr.IP, laddr.Port, laddr.Zone) {
+			inheritedListeners.lns = append(inheritedListeners.lns[:i], inheritedListeners.lns[i+1:]...)
+			return ln
+		}
+	}
+	return nil
+}
+
+// takeInheritedPacketConn returns the inherited UDP socket bound to laddr and removes it, nil if not found.
+func takeInheritedPacketConn(laddr *net.UDPAddr) *net.UDPConn {
+	inheritedListeners.mux.Lock()
+	defer inheritedListeners.mux.Unlock()
+
+	for i, pc := range inheritedListeners.pcs {
+		addr, ok := pc.LocalAddr().(*net.UDPAddr)
+		if ok && inheritedAddrMatch(addr.IP, addr.Port, addr.Zone, laddr.IP, laddr.Port, laddr.Zone) {
+			inheritedListeners.pcs = append(inheritedListeners.pcs[:i], inheritedListeners.pcs[i+1:]...)
+			return pc
+		}
+	}
+	return nil
+}
+
+// inheritedAddrMatch reports whether the bound address of the inherited socket is the address to listen on.
+func inheritedAddrMatch(ip net.IP, port int, zone string, lip net.IP, lport int, lzone string) bool {
+	if port != lport || zone != lzone {
+		return false
+	}
+	return (len(lip) == 0 || lip.IsUnspecified()) && ip.IsUnspecified() || ip.Equal(lip)
+}
+
+// udpSocketListener is the Listener serving on a UDP socket, which can be handed over.
+type udpSocketListener interface {
+	udpConn() *net.UDPConn
+}
+
+// listenerSocket returns the socket of the listener and its kind,
+// errNotTransferable is returned if the listener is not served on a TCP listening or UDP socket.
+func listenerSocket(ln Listener) (syscall.Conn, byte, error) {
+	if l, ok := ln.(udpSocketListener); ok {
+		if c := l.udpConn(); c != nil {
+			return c, upgradeUDPConn, nil
+		}
+		return nil, 0, errNotTransferable
+	}
+
+	if l, ok := ln.(*proxyProtoListener); ok {
+		ln = l.Listener
+	}
+	if l, ok := ln.(*keepAliveListener); ok {
+		ln = l.Listener
+	}
+	if l, ok := ln.(*RebindListener); ok {
+		ln = l.current()
+	}
+	switch l := ln.(type) {
+	case *tlsListener:
+		ln = l.tcp
+	case *mtlsListener:
+		ln = l.tcp
+	}
+	if l, ok := ln.(*tcpListener); ok {
+		ln = l.Listener
+	}
+	if l, ok := ln.(tcpKeepAliveListener); ok {
+		return l.TCPListener, upgradeTCPListener, nil
+	}
+	return nil, 0, errNotTransferable
+}
+
+// ShareListeners makes duplicates of the sockets of the listeners adoptable by TCPListener and UDPListener,
+// as the ones handed over by the upgrade, so that the listeners can be re-created on the same addresses
+// while the original ones are still serving. The duplicates not adopted are closed by the returned function.
+func ShareListeners(lns ...Listener) (release func()) {
+	var tlns []*net.TCPListener
+	var pcs []*net.UDPConn
+	for _, ln := range lns {
+		sc, kind, err := listenerSocket(ln)
+		if err != nil {
+			continue
+		}
+		switch kind {
+		case upgradeTCPListener:
+			if l, err := dupTCPListener(sc.(*net.TCPListener)); err == nil {
+				addInheritedListener(l)
+				tlns = append(tlns, l)
+			}
+		case upgradeUDPConn:
+			if c, err := dupUDPConn(sc.(*net.UDPConn)); err == nil {
+				addInheritedPacketConn(c)
+				pcs = append(pcs, c)
+			}
+		}
+	}
+
+	return func() {
+		inheritedListeners.mux.Lock()
+		defer inheritedListeners.mux.Unlock()
+
+		for _, l := range tlns {
+			for i, v := range inheritedListeners.lns {
+				if v == l {
+					inheritedListeners.lns = append(inheritedListeners.lns[:i], inheritedListeners.lns[i+1:]...)
+					l.Close()
+					break
+				}
+			}
+		}
+		for _, c := range pcs {
+			for i, v := range inheritedListeners.pcs {
+				if v == c {
+					inheritedListeners.pcs = append(inheritedListeners.pcs[:i], inheritedListeners.pcs[i+1:]...)
+					c.Close()
+					break
+				}
+			}
+		}
+	}
+}
+
+func dupTCPListener(ln *net.TCPListener) (*net.TCPListener, error) {
+	f, err := ln.File()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+	return l.(*net.TCPListener), nil
+}
+
+func dupUDPConn(c *net.UDPConn) (*net.UDPConn, error) {
+	f, err := c.File()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
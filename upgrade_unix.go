@@ -0,0 +1,306 @@
+//go:build !windows
+// +build !windows
+
+package gost
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-log/log"
+)
+
+// upgradeAckTimeout is the time to wait for the new process to acknowledge that its servers are running.
+var upgradeAckTimeout = 30 * time.Second
+
+// upgradeConn is the upgrade socket of the new process, the acknowledgement is sent on it by UpgradeReady.
+var upgradeConn struct {
+	conn *net.UnixConn
+	mux  sync.Mutex
+}
+
+// SendListeners sends the sockets of the listeners over the unix connection with SCM_RIGHTS,
+// one socket per message. Nothing is sent if any listener can not be handed over,
+// as the new process would fail to bind its address, which is still held by this process.
+// It returns the number of the sockets sent.
+func SendListeners(conn *net.UnixConn, lns ...Listener) (n int, err error) {
+	type socket struct {
+		rc   syscall.RawConn
+		kind byte
+	}
+	var sockets []socket
+	for _, ln := range lns {
+		sc, kind, err := listenerSocket(ln)
+		if err == nil {
+			var rc syscall.RawConn
+			if rc, err = sc.SyscallConn(); err == nil {
+				sockets = append(sockets, socket{rc: rc, kind: kind})
+			}
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", ln.Addr(), err)
+		}
+	}
+
+	for _, s := range sockets {
+		// the descriptor is sent in place, os.File.Fd of a duplicate would make the socket blocking.
+		e := s.rc.Control(func(fd uintptr) {
+			_, _, err = conn.WriteMsgUnix([]byte{s.kind}, syscall.UnixRights(int(fd)), nil)
+		})
+		if e != nil {
+			err = e
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, conn.CloseWrite()
+}
+
+// InheritListeners receives the sockets sent by SendListeners until EOF,
+// so that TCPListener and UDPListener adopt them. It returns the number of the sockets received.
+// The sender waits for the acknowledgement, see UpgradeReady.
+func InheritListeners(conn *net.UnixConn) (n int, err error) {
+	b := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	for {
+		nr, oobn, _, _, err := conn.ReadMsgUnix(b, oob)
+		if err == io.EOF || err == nil && nr == 0 && oobn == 0 {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+
+		msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			return n, err
+		}
+		for _, msg := range msgs {
+			fds, err := syscall.ParseUnixRights(&msg)
+			if err != nil {
+				return n, err
+			}
+			for _, fd := range fds {
+				ok, err := inheritSocket(os.NewFile(uintptr(fd), "listener"), b[0])
+				if err != nil {
+					return n, err
+				}
+				if ok {
+					n++
+				}
+			}
+		}
+	}
+	return n, nil
+}
+
+// inheritSocket adopts the socket of the kind in f, and closes f. It returns false if the socket is unknown.
+func inheritSocket(f *os.File, kind byte) (bool, error) {
+	defer f.Close()
+
+	switch kind {
+	case upgradeTCPListener:
+		ln, err := net.FileListener(f)
+		if err != nil {
+			return false, err
+		}
+		tln, ok := ln.(*net.TCPListener)
+		if !ok {
+			ln.Close()
+			return false, nil
+		}
+		log.Logf("[upgrade] inherit listener %s", tln.Addr())
+		addInheritedListener(tln)
+	case upgradeUDPConn:
+		pc, err := net.FilePacketConn(f)
+		if err != nil {
+			return false, err
+		}
+		uc, ok := pc.(*net.UDPConn)
+		if !ok {
+			pc.Close()
+			return false, nil
+		}
+		log.Logf("[upgrade] inherit udp socket %s", uc.LocalAddr())
+		addInheritedPacketConn(uc)
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// InheritFromParent receives the listeners from the old process if this process is started by Upgrade.
+// The old process keeps serving until UpgradeReady is called.
+func InheritFromParent() (int, error) {
+	s := os.Getenv(UpgradeFDEnv)
+	if s == "" {
+		return 0, nil
+	}
+	os.Unsetenv(UpgradeFDEnv)
+
+	fd, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	f := os.NewFile(uintptr(fd), "upgrade")
+	defer f.Close()
+	c, err := net.FileConn(f)
+	if err != nil {
+		return 0, err
+	}
+	conn, ok := c.(*net.UnixConn)
+	if !ok {
+		c.Close()
+		return 0, errors.New("upgrade: not a unix socket")
+	}
+	n, err := InheritListeners(conn)
+	if err != nil {
+		conn.Close()
+		return n, err
+	}
+
+	upgradeConn.mux.Lock()
+	upgradeConn.conn = conn
+	upgradeConn.mux.Unlock()
+	return n, nil
+}
+
+// UpgradeReady acknowledges to the old process that the servers of this process are running,
+// so that the old process stops serving. It does nothing if this process is not started by Upgrade.
+// If this process exits without the acknowledgement, the old process keeps serving.
+func UpgradeReady() error {
+	upgradeConn.mux.Lock()
+	defer upgradeConn.mux.Unlock()
+
+	conn := upgradeConn.conn
+	if conn == nil {
+		return nil
+	}
+	upgradeConn.conn = nil
+	defer conn.Close()
+
+	_, err := conn.Write([]byte{0})
+	return err
+}
+
+// handOver sends the listeners to the new process and waits for its acknowledgement,
+// an error is returned if the new process exits or does not acknowledge in upgradeAckTimeout.
+func handOver(conn *net.UnixConn, lns ...Listener) (int, error) {
+	n, err := SendListeners(conn, lns...)
+	if err != nil {
+		return n, err
+	}
+	conn.SetReadDeadline(time.Now().Add(upgradeAckTimeout))
+	if _, err = conn.Read(make([]byte, 1)); err != nil {
+		return n, fmt.Errorf("the new process is not ready: %w", err)
+	}
+	return n, nil
+}
+
+// Upgrade starts a new process of the same executable and arguments,
+// and hands the sockets of the listeners over to it. It returns after the new process is serving,
+// if it fails, the new process is killed and the listeners are kept serving by this process.
+func Upgrade(lns ...Listener) (*os.Process, error) {
+	// check the listeners first, so that no process is started if any can not be handed over.
+	for _, ln := range lns {
+		if _, _, err := listenerSocket(ln); err != nil {
+			return nil, fmt.Errorf("%s: %w", ln.Addr(), err)
+		}
+	}
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, err
+	}
+	parent := os.NewFile(uintptr(fds[0]), "upgrade")
+	child := os.NewFile(uintptr(fds[1]), "upgrade")
+	defer parent.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		child.Close()
+		return nil, err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = []*os.File{child}
+	// the first extra file is the descriptor 3 in the new process.
+	cmd.Env = append(os.Environ(), UpgradeFDEnv+"=3")
+	err = cmd.Start()
+	child.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := net.FileConn(parent)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+	defer c.Close()
+
+	n, err := handOver(c.(*net.UnixConn), lns...)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+	log.Logf("[upgrade] %d listeners handed over to process %d", n, cmd.Process.Pid)
+	return cmd.Process, nil
+}
+
+// HandleUpgrade upgrades the process on SIGUSR2: the listeners of the running servers returned by servers,
+// and the auxiliary listeners aux, e.g. of the management server, are handed over to a new process by Upgrade,
+// then they stop accepting, and the process exits after the active connections finish or the drain timeout elapses.
+func HandleUpgrade(drain time.Duration, servers func() []*Server, aux ...Listener) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR2)
+
+	var upgraded []*Server
+	for range ch {
+		upgraded = servers()
+		lns := make([]Listener, 0, len(upgraded)+len(aux))
+		for _, s := range upgraded {
+			lns = append(lns, s.Listener)
+		}
+		lns = append(lns, aux...)
+		if _, err := Upgrade(lns...); err != nil {
+			log.Logf("[upgrade] %s, keep serving", err)
+			continue
+		}
+		break
+	}
+	signal.Stop(ch)
+
+	for _, s := range upgraded {
+		s.Close()
+	}
+	for _, ln := range aux {
+		ln.Close()
+	}
+	deadline := time.Now().Add(drain)
+	for time.Now().Before(deadline) {
+		var conns int64
+		for _, s := range upgraded {
+			conns += s.Conns()
+		}
+		if conns == 0 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	log.Log("[upgrade] drained, exit")
+	os.Exit(0)
+}
@@ -0,0 +1,285 @@
+//go:build !windows
+// +build !windows
+
+package gost
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func unixSocketPair() (*net.UnixConn, *net.UnixConn, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var conns [2]*net.UnixConn
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socketpair")
+		c, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		conns[i] = c.(*net.UnixConn)
+	}
+	return conns[0], conns[1], nil
+}
+
+func setUpgradeConn(conn *net.UnixConn) {
+	upgradeConn.mux.Lock()
+	upgradeConn.conn = conn
+	upgradeConn.mux.Unlock()
+}
+
+func TestInheritListeners(t *testing.T) {
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	addr := ln.Addr().String()
+
+	c1, c2, err := unixSocketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		n, err := handOver(c1, ln)
+		if err == nil && n != 1 {
+			t.Errorf("sent %d listeners, want 1", n)
+		}
+		errc <- err
+	}()
+
+	n, err := InheritListeners(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("inherited %d listeners, want 1", n)
+	}
+	setUpgradeConn(c2)
+	if err := UpgradeReady(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	// the address is still bound by the old listener, so it must be adopted instead of bound.
+	adopted, err := TCPListener(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer adopted.Close()
+	ln.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("a"))
+		conn.Close()
+	}()
+	conn, err := adopted.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	b := make([]byte, 1)
+	if _, err := conn.Read(b); err != nil || b[0] != 'a' {
+		t.Errorf("read %q, %v from the adopted listener", b, err)
+	}
+
+	if takeInheritedListener(adopted.Addr().(*net.TCPAddr)) != nil {
+		t.Error("adopted listener should be taken only once")
+	}
+}
+
+func TestInheritUDPListener(t *testing.T) {
+	ln, err := UDPListener("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	addr := ln.Addr().String()
+
+	c1, c2, err := unixSocketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := SendListeners(c1, ln)
+		errc <- err
+	}()
+	n, err := InheritListeners(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("inherited %d sockets, want 1", n)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	// the address is still bound by the old listener, so it must be adopted instead of bound.
+	adopted, err := UDPListener(addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer adopted.Close()
+	ln.Close()
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	sc, err := adopted.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	b := make([]byte, 1)
+	if _, err := sc.Read(b); err != nil || b[0] != 'a' {
+		t.Errorf("read %q, %v from the adopted listener", b, err)
+	}
+}
+
+func TestSendListenersNotTransferable(t *testing.T) {
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	uln, err := UnixListener(filepath.Join(t.TempDir(), "gost.sock"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uln.Close()
+
+	c1, c2, err := unixSocketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	if _, err := SendListeners(c1, ln, uln); !errors.Is(err, errNotTransferable) {
+		t.Errorf("sending the unix listener: %v, want %v", err, errNotTransferable)
+	}
+	if _, err := Upgrade(ln, uln); !errors.Is(err, errNotTransferable) {
+		t.Errorf("upgrade with the unix listener: %v, want %v", err, errNotTransferable)
+	}
+	c1.Close()
+
+	// no listener is sent, not even the transferable one.
+	if n, err := InheritListeners(c2); err != nil || n != 0 {
+		t.Errorf("inherited %d listeners, %v, want none", n, err)
+	}
+}
+
+func TestHandOverNotReady(t *testing.T) {
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	c1, c2, err := unixSocketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+
+	go func() {
+		// the new process fails to start its servers and exits without the acknowledgement.
+		InheritListeners(c2)
+		c2.Close()
+	}()
+	if _, err := handOver(c1, ln); err == nil {
+		t.Error("hand over should fail without the acknowledgement")
+	}
+	if l := takeInheritedListener(ln.Addr().(*net.TCPAddr)); l != nil {
+		l.Close()
+	}
+}
+
+func TestShareListeners(t *testing.T) {
+	ln, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	uln, err := UDPListener("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uln.Close()
+	unused, err := TCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unused.Close()
+
+	release := ShareListeners(ln, uln, unused)
+	// re-created on the same addresses while the original ones are still open.
+	nln, err := TCPListener(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nln.Close()
+	nuln, err := UDPListener(uln.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nuln.Close()
+	release()
+
+	if takeInheritedListener(unused.Addr().(*net.TCPAddr)) != nil {
+		t.Error("the duplicate not adopted should be released")
+	}
+
+	// the original listener is still non-blocking, Close interrupts Accept.
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := ln.Accept()
+		accepted <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	ln.Close()
+	select {
+	case <-accepted:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Accept is not interrupted by Close")
+	}
+
+	go func() {
+		if conn, err := net.Dial("tcp", nln.Addr().String()); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := nln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
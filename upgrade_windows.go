@@ -0,0 +1,39 @@
+package gost
+
+import (
+	"net"
+	"os"
+	"time"
+
+	"github.com/go-log/log"
+)
+
+// SendListeners is not supported on windows.
+func SendListeners(conn *net.UnixConn, lns ...Listener) (int, error) {
+	return 0, ErrUpgradeNotSupported
+}
+
+// InheritListeners is not supported on windows.
+func InheritListeners(conn *net.UnixConn) (int, error) {
+	return 0, ErrUpgradeNotSupported
+}
+
+// InheritFromParent does nothing on windows.
+func InheritFromParent() (int, error) {
+	return 0, nil
+}
+
+// UpgradeReady does nothing on windows.
+func UpgradeReady() error {
+	return nil
+}
+
+// Upgrade is not supported on windows.
+func Upgrade(lns ...Listener) (*os.Process, error) {
+	return nil, ErrUpgradeNotSupported
+}
+
+// HandleUpgrade is not supported on windows.
+func HandleUpgrade(drain time.Duration, servers func() []*Server, aux ...Listener) {
+	log.Log("[upgrade]", ErrUpgradeNotSupported)
+}
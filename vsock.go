@@ -1,18 +1,54 @@
 package gost
 
 import (
+	"fmt"
 	"net"
 	"strconv"
+	"strings"
+	"syscall"
 
+	"github.com/go-log/log"
 	"github.com/mdlayher/vsock"
 )
 
+// The special VSOCK context IDs and port.
+const (
+	// VSOCKCIDHypervisor is VMADDR_CID_HYPERVISOR.
+	VSOCKCIDHypervisor uint32 = 0
+	// VSOCKCIDLocal is VMADDR_CID_LOCAL, the local loopback.
+	VSOCKCIDLocal uint32 = 1
+	// VSOCKCIDHost is VMADDR_CID_HOST, the host seen from a guest.
+	VSOCKCIDHost uint32 = 2
+	// VSOCKCIDAny is VMADDR_CID_ANY.
+	VSOCKCIDAny uint32 = 0xffffffff
+	// VSOCKPortAny is VMADDR_PORT_ANY.
+	VSOCKPortAny uint32 = 0xffffffff
+)
+
+var vsockCIDNames = map[string]uint32{
+	"hypervisor": VSOCKCIDHypervisor,
+	"local":      VSOCKCIDLocal,
+	"host":       VSOCKCIDHost,
+	"any":        VSOCKCIDAny,
+}
+
+// VSOCKConfig is the config for VSOCK client and server.
+type VSOCKConfig struct {
+	// BufferSize is the socket buffer size (SO_VM_SOCKETS_BUFFER_SIZE), zero means the system default.
+	BufferSize int
+}
+
 // vsockTransporter is a raw VSOCK transporter.
-type vsockTransporter struct{}
+type vsockTransporter struct {
+	config *VSOCKConfig
+}
 
 // VSOCKTransporter creates a raw VSOCK client.
-func VSOCKTransporter() Transporter {
-	return &vsockTransporter{}
+func VSOCKTransporter(config *VSOCKConfig) Transporter {
+	if config == nil {
+		config = &VSOCKConfig{}
+	}
+	return &vsockTransporter{config: config}
 }
 
 func (tr *vsockTransporter) Dial(addr string, options ...DialOption) (net.Conn, error) {
@@ -25,12 +61,20 @@ func (tr *vsockTransporter) Dial(addr string, options ...DialOption) (net.Conn,
 		if err != nil {
 			return nil, err
 		}
-		return vsock.Dial(vAddr.ContextID, vAddr.Port, nil)
+		conn, err := vsock.Dial(vAddr.ContextID, vAddr.Port, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := setVSOCKBuffer(conn, tr.config.BufferSize); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
 	}
 	return opts.Chain.Dial(addr)
 }
 
-func parseUint32(s string) (uint32, error ) {
+func parseUint32(s string) (uint32, error) {
 	n, err := strconv.ParseUint(s, 10, 32)
 	if err != nil {
 		return 0, err
@@ -38,6 +82,9 @@ func parseUint32(s string) (uint32, error ) {
 	return uint32(n), nil
 }
 
+// parseAddr parses the VSOCK address in the form of CID:port,
+// the CID can be numeric or one of the symbolic names hypervisor, local, host and any,
+// the port can be numeric or any. The empty CID is 0 (hypervisor).
 func parseAddr(addr string) (*vsock.Addr, error) {
 	hostStr, portStr, err := net.SplitHostPort(addr)
 	if err != nil {
@@ -45,15 +92,18 @@ func parseAddr(addr string) (*vsock.Addr, error) {
 	}
 	host := uint32(0)
 	if hostStr != "" {
-		host, err = parseUint32(hostStr)
-		if err != nil {
-			return nil, err
+		if cid, ok := vsockCIDNames[strings.ToLower(hostStr)]; ok {
+			host = cid
+		} else if host, err = parseUint32(hostStr); err != nil {
+			return nil, fmt.Errorf("invalid vsock CID %q", hostStr)
 		}
 	}
 
-	port, err := parseUint32(portStr)
-	if err != nil {
-		return nil, err
+	port := VSOCKPortAny
+	if !strings.EqualFold(portStr, "any") {
+		if port, err = parseUint32(portStr); err != nil {
+			return nil, fmt.Errorf("invalid vsock port %q", portStr)
+		}
 	}
 	return &vsock.Addr{ContextID: host, Port: port}, nil
 }
@@ -67,10 +117,63 @@ func (tr *vsockTransporter) Multiplex() bool {
 }
 
 // VSOCKListener creates a Listener for VSOCK proxy server.
-func VSOCKListener(addr string) (Listener, error) {
+// It listens on the local context ID if the CID of addr is empty.
+func VSOCKListener(addr string, config *VSOCKConfig) (Listener, error) {
+	if config == nil {
+		config = &VSOCKConfig{}
+	}
+	host, _, _ := net.SplitHostPort(addr)
 	vAddr, err := parseAddr(addr)
 	if err != nil {
 		return nil, err
 	}
-	return vsock.Listen(vAddr.Port, nil)
+
+	var ln *vsock.Listener
+	if host == "" {
+		ln, err = vsock.Listen(vAddr.Port, nil)
+	} else {
+		ln, err = vsock.ListenContextID(vAddr.ContextID, vAddr.Port, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &vsockListener{Listener: ln, config: config}, nil
+}
+
+type vsockListener struct {
+	net.Listener
+	config *VSOCKConfig
+}
+
+func (l *vsockListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if err := setVSOCKBuffer(conn, l.config.BufferSize); err != nil {
+		log.Logf("[vsock] %s: set buffer size: %s", conn.RemoteAddr(), err)
+	}
+	return conn, nil
+}
+
+// setVSOCKBuffer sets the buffer size of the VSOCK connection.
+func setVSOCKBuffer(conn net.Conn, size int) error {
+	if size <= 0 {
+		return nil
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = setSocketVSOCKBuffer(int(fd), uint64(size))
+	}); err != nil {
+		return err
+	}
+	return serr
 }
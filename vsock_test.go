@@ -0,0 +1,74 @@
+package gost
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/mdlayher/vsock"
+)
+
+func TestVSOCKParseAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		cid  uint32
+		port uint32
+		err  bool
+	}{
+		{":1080", 0, 1080, false},
+		{"3:1080", 3, 1080, false},
+		{"hypervisor:1080", VSOCKCIDHypervisor, 1080, false},
+		{"local:1080", VSOCKCIDLocal, 1080, false},
+		{"host:1080", VSOCKCIDHost, 1080, false},
+		{"HOST:1080", VSOCKCIDHost, 1080, false},
+		{"any:1080", VSOCKCIDAny, 1080, false},
+		{"4294967295:any", VSOCKCIDAny, VSOCKPortAny, false},
+		{"guest:1080", 0, 0, true},
+		{"-1:1080", 0, 0, true},
+		{"3:port", 0, 0, true},
+		{"3:4294967296", 0, 0, true},
+		{"3", 0, 0, true},
+	}
+	for _, test := range tests {
+		addr, err := parseAddr(test.addr)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: should fail, got %v", test.addr, addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.addr, err)
+			continue
+		}
+		if addr.ContextID != test.cid || addr.Port != test.port {
+			t.Errorf("%s: got CID %d port %d, want CID %d port %d",
+				test.addr, addr.ContextID, addr.Port, test.cid, test.port)
+		}
+	}
+}
+
+func TestVSOCKListenerBuffer(t *testing.T) {
+	ln, err := VSOCKListener("local:any", &VSOCKConfig{BufferSize: 1 << 20})
+	if err != nil {
+		t.Skipf("vsock is not available: %v", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	addr, ok := ln.Addr().(*vsock.Addr)
+	if !ok {
+		t.Fatalf("unexpected listener address %v", ln.Addr())
+	}
+	port := strconv.FormatUint(uint64(addr.Port), 10)
+	conn, err := VSOCKTransporter(&VSOCKConfig{BufferSize: 1 << 20}).Dial("local:" + port)
+	if err != nil {
+		t.Skipf("vsock loopback is not available: %v", err)
+	}
+	conn.Close()
+}
@@ -102,7 +102,7 @@ func (tr *mwsTransporter) Dial(addr string, options ...DialOption) (conn net.Con
 		}
 
 		if opts.Chain == nil {
-			conn, err = net.DialTimeout("tcp", addr, timeout)
+			conn, err = opts.dialTCP(addr, timeout)
 		} else {
 			conn, err = opts.Chain.Dial(addr)
 		}
@@ -259,7 +259,7 @@ func (tr *mwssTransporter) Dial(addr string, options ...DialOption) (conn net.Co
 		}
 
 		if opts.Chain == nil {
-			conn, err = net.DialTimeout("tcp", addr, timeout)
+			conn, err = opts.dialTCP(addr, timeout)
 		} else {
 			conn, err = opts.Chain.Dial(addr)
 		}